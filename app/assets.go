@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"github.com/go-logr/logr"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	assetsTemplatesDirectory = "templates"
+	assetsStaticDirectory    = "templates/static"
+
+	// layoutTemplateName is the file containing the layout every page
+	// shares. Pages fill in its "content" (and, optionally, "head") blocks.
+	layoutTemplateName = "layout.html"
+)
+
+// embeddedAssets are the templates and static files built into the binary, so
+// we don't depend on the working directory from which we're run.
+//
+//go:embed templates
+var embeddedAssets embed.FS
+
+// Assets are the templates and static files we serve.
+type Assets struct {
+	files fs.FS
+	// reload, if set, means we parse the templates from `files` on every
+	// render, so changes show up without restarting.
+	reload bool
+	pages  map[string]*template.Template
+
+	logger logr.Logger
+}
+
+// NewEmbeddedAssets returns the assets built into the binary, with each page
+// parsed once.
+func NewEmbeddedAssets(logger logr.Logger) (*Assets, error) {
+	return newAssets(embeddedAssets, false, logger)
+}
+
+// NewDiskAssets returns the assets in `directory` (i.e. the `app` directory of
+// a checkout), reloading them on every request. Only useful when developing
+// the templates.
+func NewDiskAssets(directory string, logger logr.Logger) (*Assets, error) {
+	return newAssets(os.DirFS(directory), true, logger)
+}
+
+func newAssets(files fs.FS, reload bool, logger logr.Logger) (*Assets, error) {
+	a := &Assets{
+		files:  files,
+		reload: reload,
+		logger: logger,
+	}
+
+	// We parse even when reloading, so we fail fast if the templates are
+	// missing or invalid.
+	pages, err := a.parsePages()
+	if err != nil {
+		return nil, err
+	}
+	a.pages = pages
+
+	return a, nil
+}
+
+// parsePages parses every page in the templates directory, each along with
+// the shared layout.
+func (a *Assets) parsePages() (map[string]*template.Template, error) {
+	// We only know the user's locale (and CSRF token) when rendering, so we
+	// add the real funcs then.
+	funcs := pageFuncs(&Localizer{catalog: messages, Locale: defaultLocale}, "")
+
+	layout, err := template.New(layoutTemplateName).Funcs(funcs).ParseFS(a.files, path.Join(assetsTemplatesDirectory, layoutTemplateName))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing layout template: %s", err)
+	}
+
+	pageFiles, err := fs.Glob(a.files, path.Join(assetsTemplatesDirectory, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make(map[string]*template.Template)
+	for _, pageFile := range pageFiles {
+		name := path.Base(pageFile)
+		if name == layoutTemplateName {
+			continue
+		}
+
+		page, err := template.Must(layout.Clone()).ParseFS(a.files, pageFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing template %s: %s", name, err)
+		}
+
+		pages[strings.TrimSuffix(name, ".html")] = page
+	}
+
+	return pages, nil
+}
+
+// pageFuncs are the functions our templates use to translate messages and to
+// include the user's CSRF token in forms.
+func pageFuncs(localizer *Localizer, csrfToken string) template.FuncMap {
+	funcs := localizer.templateFuncs()
+	funcs["csrfToken"] = func() string { return csrfToken }
+	return funcs
+}
+
+// Render renders the page (i.e. "index" for templates/index.html) with the
+// given status code, in the user's locale. We render into a buffer first, so
+// a template error results in an error page rather than a half rendered one.
+func (a *Assets) Render(w http.ResponseWriter, r *http.Request, statusCode int, name string, data interface{}) {
+	localizer := localizerFromRequest(messages, r)
+
+	pages := a.pages
+	if a.reload {
+		var err error
+		if pages, err = a.parsePages(); err != nil {
+			a.renderError(w, localizer, name, err)
+			return
+		}
+	}
+
+	page, found := pages[name]
+	if !found {
+		a.renderError(w, localizer, name, fmt.Errorf("No such template"))
+		return
+	}
+
+	// We clone the page so we can use this request's funcs without
+	// affecting concurrent renders.
+	page, err := page.Clone()
+	if err != nil {
+		a.renderError(w, localizer, name, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := page.Funcs(pageFuncs(localizer, csrfTokenFromRequest(r))).ExecuteTemplate(&buf, "layout", data); err != nil {
+		a.renderError(w, localizer, name, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if _, err := buf.WriteTo(w); err != nil {
+		a.logger.V(3).Info("Error writing page", "template", name, "error", err)
+	}
+}
+
+func (a *Assets) renderError(w http.ResponseWriter, localizer *Localizer, name string, err error) {
+	a.logger.V(0).Info("Error rendering template", "template", name, "error", err)
+	http.Error(w, localizer.T("errors.render"), http.StatusInternalServerError)
+}
+
+// StaticHandler serves our static files.
+func (a *Assets) StaticHandler() http.Handler {
+	static, err := fs.Sub(a.files, assetsStaticDirectory)
+	if err != nil {
+		// Only possible if `assetsStaticDirectory` is an invalid path.
+		panic(err)
+	}
+
+	return http.FileServer(http.FS(static))
+}
+
+// ServeStaticFile serves one of our static files with the given content type,
+// for those we serve outside of /static.
+func (a *Assets) ServeStaticFile(w http.ResponseWriter, r *http.Request, name, contentType string) {
+	contents, err := fs.ReadFile(a.files, path.Join(assetsStaticDirectory, name))
+	if err != nil {
+		a.logger.V(0).Info("Error reading static file", "name", name, "error", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(contents))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestAssets writes a minimal templates directory, with the given index
+// page, returning the assets directory.
+func writeTestAssets(t *testing.T, indexTemplate string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "assets")
+	if err != nil {
+		t.Fatalf("Error creating tmp dir: %s", err)
+	}
+
+	os.MkdirAll(filepath.Join(dir, assetsStaticDirectory), 0755)
+	writeTestAssetFile(t, dir, "layout.html", `{{ define "layout" }}<title>test</title>{{ template "content" . }}{{ end }}`)
+	writeTestAssetFile(t, dir, "index.html", indexTemplate)
+
+	return dir
+}
+
+func writeTestAssetFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, assetsTemplatesDirectory, name), []byte(contents), 0644); err != nil {
+		t.Fatalf("Error writing template: %s", err)
+	}
+}
+
+func TestEmbeddedAssetsRenderFromAnyDirectory(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(os.TempDir())
+
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `id="downloadForm"`) {
+		t.Fatalf("Expected index page, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	if !strings.Contains(w.Body.String(), `href="/static/bulma.min.css"`) {
+		t.Fatal("Expected the index page to use the shared layout")
+	}
+
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, httptest.NewRequest("GET", "/static/bulma.min.css", nil))
+
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("Expected static file, but got %d", w.Code)
+	}
+}
+
+func TestDiskAssetsReloadOnEveryRender(t *testing.T) {
+	dir := writeTestAssets(t, `{{ define "content" }}original{{ end }}`)
+	defer os.RemoveAll(dir)
+
+	assets, err := NewDiskAssets(dir, testLogger)
+	if err != nil {
+		t.Fatalf("Should not have error parsing assets: %s", err)
+	}
+
+	writeTestAssetFile(t, dir, "index.html", `{{ define "content" }}changed{{ end }}`)
+
+	w := httptest.NewRecorder()
+	assets.Render(w, httptest.NewRequest("GET", "/", nil), http.StatusOK, "index", nil)
+
+	if !strings.Contains(w.Body.String(), "changed") {
+		t.Fatalf("Expected reloaded template, but got %s", w.Body.String())
+	}
+}
+
+func TestEmbeddedAssetsParseOnce(t *testing.T) {
+	dir := writeTestAssets(t, `{{ define "content" }}original{{ end }}`)
+	defer os.RemoveAll(dir)
+
+	assets, err := newAssets(os.DirFS(dir), false, testLogger)
+	if err != nil {
+		t.Fatalf("Should not have error parsing assets: %s", err)
+	}
+
+	writeTestAssetFile(t, dir, "index.html", `{{ define "content" }}changed{{ end }}`)
+
+	w := httptest.NewRecorder()
+	assets.Render(w, httptest.NewRequest("GET", "/", nil), http.StatusOK, "index", nil)
+
+	if !strings.Contains(w.Body.String(), "original") {
+		t.Fatalf("Expected template parsed at startup, but got %s", w.Body.String())
+	}
+}
+
+func TestNewAssetsFailsWithInvalidTemplates(t *testing.T) {
+	dir := writeTestAssets(t, `{{ define "content" }}{{ .Unclosed {{ end }}`)
+	defer os.RemoveAll(dir)
+
+	if _, err := NewDiskAssets(dir, testLogger); err == nil {
+		t.Fatal("Should have error parsing invalid template")
+	}
+}
+
+func TestRenderHandlesTemplateErrors(t *testing.T) {
+	dir := writeTestAssets(t, `{{ define "content" }}partial {{ .DoesNotExist }}{{ end }}`)
+	defer os.RemoveAll(dir)
+
+	assets, err := NewDiskAssets(dir, testLogger)
+	if err != nil {
+		t.Fatalf("Should not have error parsing assets: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	assets.Render(w, httptest.NewRequest("GET", "/", nil), http.StatusOK, "index", &indexPage{})
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status %d, but got %d", http.StatusInternalServerError, w.Code)
+	}
+
+	if strings.Contains(w.Body.String(), "partial") {
+		t.Fatal("Should not send a partially rendered page")
+	}
+
+	w = httptest.NewRecorder()
+	assets.Render(w, httptest.NewRequest("GET", "/", nil), http.StatusOK, "missing", nil)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status %d for missing template, but got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+// Ensure editing a template while the dev server runs can't take it down.
+func TestDiskAssetsSurviveInvalidEdits(t *testing.T) {
+	dir := writeTestAssets(t, `{{ define "content" }}original{{ end }}`)
+	defer os.RemoveAll(dir)
+
+	assets, err := NewDiskAssets(dir, testLogger)
+	if err != nil {
+		t.Fatalf("Should not have error parsing assets: %s", err)
+	}
+
+	writeTestAssetFile(t, dir, "index.html", `{{ define "content" }}{{ if }}{{ end }}`)
+
+	w := httptest.NewRecorder()
+	assets.Render(w, httptest.NewRequest("GET", "/", nil), http.StatusOK, "index", nil)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status %d, but got %d", http.StatusInternalServerError, w.Code)
+	}
+}
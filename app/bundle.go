@@ -0,0 +1,62 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path"
+	"regexp"
+)
+
+// uniqueOutputFilePrefixRegexp matches the unique prefix the downloader adds
+// to every file name. We strip it before showing file names to users.
+var uniqueOutputFilePrefixRegexp = regexp.MustCompile(`^[a-z]{8}-`)
+
+// displayFileName returns the name we show the user for a downloaded file.
+func displayFileName(filePath string) string {
+	return uniqueOutputFilePrefixRegexp.ReplaceAllString(path.Base(filePath), "")
+}
+
+// bundleFiles writes a zip archive containing all of `filePaths` to
+// `bundlePath`.
+func bundleFiles(bundlePath string, filePaths []string) error {
+	bundleFile, err := os.Create(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer bundleFile.Close()
+
+	zipWriter := zip.NewWriter(bundleFile)
+	for _, filePath := range filePaths {
+		if err := addFileToZip(zipWriter, filePath); err != nil {
+			return err
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+
+	return bundleFile.Close()
+}
+
+func addFileToZip(zipWriter *zip.Writer, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Audio and video files are already compressed, so there's no point
+	// spending cpu trying to compress them further.
+	entryWriter, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:   displayFileName(filePath),
+		Method: zip.Store,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entryWriter, file)
+	return err
+}
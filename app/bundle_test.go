@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDisplayFileName(t *testing.T) {
+	filePathToDisplayFileName := map[string]string{
+		"/tmp/downloads/abcdefgh-My Video.mp3":    "My Video.mp3",
+		"abcdefgh-01-First Track.mp3":             "01-First Track.mp3",
+		"/tmp/downloads/abcdefghijklmnopqrstuvxy": "abcdefghijklmnopqrstuvxy",
+	}
+
+	for filePath, expectedDisplayFileName := range filePathToDisplayFileName {
+		if displayFileName := displayFileName(filePath); displayFileName != expectedDisplayFileName {
+			t.Fatalf("Expected display file name %q for %q, but got %q", expectedDisplayFileName, filePath, displayFileName)
+		}
+	}
+}
+
+func TestBundleFiles(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	fileNameToContents := map[string]string{
+		"abcdefgh-first.mp3":  "first",
+		"abcdefgh-second.mp3": "second",
+	}
+
+	var filePaths []string
+	for fileName, contents := range fileNameToContents {
+		filePath := tmpFsClient.GeneratePathForFile(fileName)
+		if err := ioutil.WriteFile(filePath, []byte(contents), 0644); err != nil {
+			t.Fatalf("Error writing file: %s", err)
+		}
+		filePaths = append(filePaths, filePath)
+	}
+
+	bundlePath := filepath.Join(tmpFsClient.GetMountDirectory(), "bundle.zip")
+	if err := bundleFiles(bundlePath, filePaths); err != nil {
+		t.Fatalf("Error bundling files: %s", err)
+	}
+
+	zipReader, err := zip.OpenReader(bundlePath)
+	if err != nil {
+		t.Fatalf("Error opening bundle: %s", err)
+	}
+	defer zipReader.Close()
+
+	if len(zipReader.File) != len(fileNameToContents) {
+		t.Fatalf("Expected %d files in bundle, but found %d", len(fileNameToContents), len(zipReader.File))
+	}
+
+	for _, zipFile := range zipReader.File {
+		if _, found := fileNameToContents["abcdefgh-"+zipFile.Name]; !found {
+			t.Fatalf("Unexpected file in bundle: %s", zipFile.Name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var secondsRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+var minutesOrHoursRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+// parseTimestamp parses the timestamps users enter when clipping a video. We
+// accept seconds ("90"), minutes and seconds ("1:30") and hours, minutes and
+// seconds ("1:01:30"). Seconds may be fractional.
+func parseTimestamp(timestamp string) (time.Duration, error) {
+	invalidTimestampErr := newUserError("errors.clip.invalid_timestamp", timestamp)
+
+	parts := strings.Split(strings.TrimSpace(timestamp), ":")
+	if len(parts) > 3 {
+		return 0, invalidTimestampErr
+	}
+
+	var seconds float64
+	for i, part := range parts {
+		isSeconds := i == len(parts)-1
+
+		partRegexp := minutesOrHoursRegexp
+		if isSeconds {
+			partRegexp = secondsRegexp
+		}
+		if !partRegexp.MatchString(part) {
+			return 0, invalidTimestampErr
+		}
+
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, invalidTimestampErr
+		}
+
+		// Only the leading part may exceed 59 (i.e. "90" or "90:00").
+		if i > 0 && value >= 60 {
+			return 0, invalidTimestampErr
+		}
+
+		seconds = seconds*60 + value
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// formatTimestamp formats the duration like the timestamps users enter (see
+// `parseTimestamp`), i.e. "1:30" or "1:02:30.5", so we can show it to them in
+// any language.
+func formatTimestamp(duration time.Duration) string {
+	hours := int(duration / time.Hour)
+	minutes := int(duration % time.Hour / time.Minute)
+	seconds := strconv.FormatFloat((duration % time.Minute).Seconds(), 'f', -1, 64)
+	if (duration % time.Minute) < 10*time.Second {
+		seconds = "0" + seconds
+	}
+
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%s", hours, minutes, seconds)
+	}
+
+	return fmt.Sprintf("%d:%s", minutes, seconds)
+}
+
+// validateClip validates the clip the user requested, before we know anything
+// about the video. The max duration limits the clip, rather than the video we
+// clip it from. We validate against the video's duration before downloading it
+// (see `validateClipForVideo`).
+func validateClip(clipStart, clipEnd, maxDuration time.Duration) error {
+	if clipEnd != 0 && clipEnd <= clipStart {
+		return newUserError("errors.clip.end_before_start")
+	}
+
+	if maxDuration != 0 && clipEnd != 0 && clipEnd-clipStart > maxDuration {
+		return newUserError("errors.clip.too_long", formatTimestamp(maxDuration))
+	}
+
+	return nil
+}
+
+// validateClipForVideo validates the clip against the duration of the video
+// we'd clip it from. A zero duration means the duration is unknown.
+func validateClipForVideo(clipStart, clipEnd, maxDuration, videoDuration time.Duration) error {
+	if videoDuration == 0 {
+		return nil
+	}
+
+	if clipStart >= videoDuration {
+		return newUserError("errors.clip.longer_than_video", formatTimestamp(clipStart), formatTimestamp(videoDuration))
+	}
+
+	if maxDuration != 0 && clipEnd == 0 && videoDuration-clipStart > maxDuration {
+		return newUserError("errors.clip.too_long", formatTimestamp(maxDuration))
+	}
+
+	return nil
+}
+
+// clipFfmpegArgs returns the ffmpeg options for cutting a clip out of a video
+// with the given duration. An end of zero means the clip runs until the end of
+// the video.
+func clipFfmpegArgs(clipStart, clipEnd, videoDuration time.Duration) ([]string, error) {
+	if err := validateClipForVideo(clipStart, clipEnd, 0, videoDuration); err != nil {
+		return nil, err
+	}
+
+	// Specifying `-ss` before the input makes ffmpeg seek the input, which
+	// is much faster than decoding everything before the clip.
+	args := []string{"-ss", formatFfmpegSeconds(clipStart)}
+
+	if clipEnd != 0 && (videoDuration == 0 || clipEnd < videoDuration) {
+		// When seeking the input, `-to` would be relative to the seek
+		// position, so we use the clip's duration instead.
+		args = append(args, "-t", formatFfmpegSeconds(clipEnd-clipStart))
+	}
+
+	return args, nil
+}
+
+func formatFfmpegSeconds(duration time.Duration) string {
+	return strconv.FormatFloat(duration.Seconds(), 'f', 3, 64)
+}
+
+// youtubeDlInfo contains the subset of the metadata youtube-dl writes via
+// `--write-info-json` which we care about.
+type youtubeDlInfo struct {
+	// Duration is in seconds, and may be missing (i.e. for live streams).
+	Duration float64 `json:"duration"`
+}
+
+func readYoutubeDlInfo(infoFilePath string) (*youtubeDlInfo, error) {
+	contents, err := ioutil.ReadFile(infoFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &youtubeDlInfo{}
+	if err := json.Unmarshal(contents, info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (y *youtubeDlInfo) duration() time.Duration {
+	return time.Duration(y.Duration * float64(time.Second))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	timestampToDuration := map[string]time.Duration{
+		"0":        0,
+		"90":       90 * time.Second,
+		"1:30":     90 * time.Second,
+		"01:02:03": time.Hour + 2*time.Minute + 3*time.Second,
+		"90:00":    90 * time.Minute,
+		" 2:05.5 ": 2*time.Minute + 5500*time.Millisecond,
+	}
+
+	for timestamp, expectedDuration := range timestampToDuration {
+		duration, err := parseTimestamp(timestamp)
+		if err != nil {
+			t.Fatalf("Expected %q to be valid, but got: %s", timestamp, err)
+		}
+		if duration != expectedDuration {
+			t.Fatalf("Expected %q to parse to %s, but got %s", timestamp, expectedDuration, duration)
+		}
+	}
+
+	invalidTimestamps := []string{"", "abc", "1:60", "1:2:3:4", "-5", "1.5:00", "NaN", "1e3"}
+	for _, timestamp := range invalidTimestamps {
+		if _, err := parseTimestamp(timestamp); err == nil {
+			t.Fatalf("Expected %q to be invalid", timestamp)
+		}
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	durationToTimestamp := map[time.Duration]string{
+		0:                                     "0:00",
+		90 * time.Second:                      "1:30",
+		5 * time.Minute:                       "5:00",
+		2*time.Minute + 5500*time.Millisecond: "2:05.5",
+		time.Hour + 2*time.Minute + 3*time.Second: "1:02:03",
+	}
+
+	for duration, expectedTimestamp := range durationToTimestamp {
+		if timestamp := formatTimestamp(duration); timestamp != expectedTimestamp {
+			t.Fatalf("Expected %s to format as %q, but got %q", duration, expectedTimestamp, timestamp)
+		}
+
+		if parsedDuration, err := parseTimestamp(formatTimestamp(duration)); err != nil || parsedDuration != duration {
+			t.Fatalf("Expected %q to parse back to %s, but got %s: %v", formatTimestamp(duration), duration, parsedDuration, err)
+		}
+	}
+}
+
+func TestValidateClip(t *testing.T) {
+	if err := validateClip(time.Minute, 3*time.Minute, 0); err != nil {
+		t.Fatalf("Expected valid clip, but got: %s", err)
+	}
+
+	if err := validateClip(time.Minute, 0, 0); err != nil {
+		t.Fatalf("Clips without an end should be valid: %s", err)
+	}
+
+	if err := validateClip(3*time.Minute, time.Minute, 0); err == nil {
+		t.Fatal("Clips ending before they start should be invalid")
+	}
+
+	// The max duration limits the clip, not the video it's from.
+	if err := validateClip(time.Hour, time.Hour+5*time.Minute, 5*time.Minute); err != nil {
+		t.Fatalf("Short clips of long videos should be valid: %s", err)
+	}
+
+	err := validateClip(time.Minute, 10*time.Minute, 5*time.Minute)
+	if err == nil {
+		t.Fatal("Clips longer than the max duration should be invalid")
+	}
+	if message := (&Localizer{catalog: messages, Locale: defaultLocale}).Error(err); !strings.Contains(message, "at most 5:00 long") {
+		t.Fatalf("Expected the max duration formatted as a timestamp, but got %q", message)
+	}
+}
+
+func TestValidateClipForVideo(t *testing.T) {
+	if err := validateClipForVideo(time.Minute, 3*time.Minute, 0, 10*time.Minute); err != nil {
+		t.Fatalf("Expected valid clip, but got: %s", err)
+	}
+
+	if err := validateClipForVideo(time.Hour, 0, 0, 0); err != nil {
+		t.Fatalf("Clips of videos with unknown durations should be valid: %s", err)
+	}
+
+	if err := validateClipForVideo(10*time.Minute, 0, 0, 10*time.Minute); err == nil {
+		t.Fatal("Clips starting after the video ends should be invalid")
+	}
+
+	if err := validateClipForVideo(time.Minute, 0, 5*time.Minute, 10*time.Minute); err == nil {
+		t.Fatal("Clips running to the end of the video should be limited by the max duration")
+	}
+
+	if err := validateClipForVideo(6*time.Minute, 0, 5*time.Minute, 10*time.Minute); err != nil {
+		t.Fatalf("Short clips running to the end of the video should be valid: %s", err)
+	}
+}
+
+func TestClipFfmpegArgs(t *testing.T) {
+	args, err := clipFfmpegArgs(time.Minute, 3*time.Minute, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error generating clip args: %s", err)
+	}
+	expectedArgs := []string{"-ss", "60.000", "-t", "120.000"}
+	if len(args) != len(expectedArgs) {
+		t.Fatalf("Expected args %v, but got %v", expectedArgs, args)
+	}
+	for i := range args {
+		if args[i] != expectedArgs[i] {
+			t.Fatalf("Expected args %v, but got %v", expectedArgs, args)
+		}
+	}
+
+	// Ends past the end of the video are equivalent to no end.
+	args, _ = clipFfmpegArgs(time.Minute, 20*time.Minute, 10*time.Minute)
+	if len(args) != 2 {
+		t.Fatalf("Expected no duration arg when clip ends after the video, but got %v", args)
+	}
+
+	if _, err := clipFfmpegArgs(20*time.Minute, 0, 10*time.Minute); err == nil {
+		t.Fatal("Clips starting after the video ends should be invalid")
+	}
+
+	// We can't validate against an unknown duration.
+	if _, err := clipFfmpegArgs(20*time.Minute, 0, 0); err != nil {
+		t.Fatalf("Clips for videos of unknown duration should be valid: %s", err)
+	}
+}
+
+func TestReadYoutubeDlInfo(t *testing.T) {
+	useDefaultTempDirectory := ""
+	tmpFile, err := ioutil.TempFile(useDefaultTempDirectory, "video.*.info.json")
+	if err != nil {
+		t.Fatalf("Error creating tmp file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	tmpFile.WriteString(`{"title": "My Video", "duration": 212.5}`)
+	tmpFile.Close()
+
+	info, err := readYoutubeDlInfo(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Error reading info file: %s", err)
+	}
+
+	if info.duration() != 212500*time.Millisecond {
+		t.Fatalf("Expected duration of 212.5s, but got %s", info.duration())
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config mirrors the yaml config file an operator can pass via
+// `-config_file_path`. Every field is optional, and the zero value of each
+// field should be a sensible default.
+type config struct {
+	S3Bucket   string           `yaml:"s3_bucket"`
+	Limits     limitsConfig     `yaml:"limits"`
+	URLs       urlsConfig       `yaml:"urls"`
+	Downloads  downloadsConfig  `yaml:"downloads"`
+	Sandbox    ContainerSandbox `yaml:"sandbox"`
+	Containers containersConfig `yaml:"containers"`
+	// ImageUpdates controls whether we keep the youtube-dl image up to
+	// date.
+	ImageUpdates imageUpdatesConfig `yaml:"image_updates"`
+	Health       healthConfig       `yaml:"health"`
+	Tracing      tracingConfig      `yaml:"tracing"`
+	Server       serverConfig       `yaml:"server"`
+	// Webhooks are notified whenever a job starts running or finishes.
+	Webhooks webhooksConfig `yaml:"webhooks"`
+	// Email lets us email users once their downloads finish.
+	Email emailConfig `yaml:"email"`
+}
+
+// containersConfig controls which container runtime runs youtube-dl.
+type containersConfig struct {
+	// Runtime is one of docker (the default), podman or containerd.
+	Runtime string `yaml:"runtime"`
+	// Address is the runtime's socket. If empty, we use the runtime's
+	// default (for docker, the DOCKER_HOST environment variable).
+	Address string `yaml:"address"`
+	// Namespace is the containerd namespace we use. Only applies to
+	// containerd.
+	Namespace string `yaml:"namespace"`
+
+	// YoutubeDlImage, if set, overrides the youtube-dl image we run. Pin
+	// it to a digest (i.e. "repo:tag@sha256:...") to ensure we only ever
+	// run that exact image.
+	YoutubeDlImage string `yaml:"youtube_dl_image"`
+	// PullPolicy is one of IfNotPresent (the default), Always or Never.
+	PullPolicy ImagePullPolicy `yaml:"pull_policy"`
+	// Registry, if set, are the credentials for pulling from a private
+	// registry.
+	Registry *RegistryCredentials `yaml:"registry"`
+}
+
+// limitsConfig controls how much any one family member can ask of vidzou.
+type limitsConfig struct {
+	// UserHeader is the request header from which we read the user's
+	// identity. vidzou does not authenticate users itself, so this should
+	// only be set when running behind an authenticating reverse proxy which
+	// sets (and strips any client provided value of) the header.
+	UserHeader string `yaml:"user_header"`
+
+	PerUser quotaLimits `yaml:"per_user"`
+	PerIP   quotaLimits `yaml:"per_ip"`
+}
+
+// urlsConfig controls which urls we're willing to download.
+type urlsConfig struct {
+	// AllowedHosts, if non-empty, is the exhaustive list of hosts (and
+	// their subdomains) from which we'll download.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	DeniedHosts  []string `yaml:"denied_hosts"`
+
+	// AllowPrivateNetworks disables our check that a url's host resolves to
+	// a public ip. Only useful when downloading from a server on your own
+	// network.
+	AllowPrivateNetworks bool `yaml:"allow_private_networks"`
+
+	// AllowedExtractors, if non-empty, is the exhaustive list of youtube-dl
+	// extractors (i.e. "Youtube", "Vimeo") with which we'll download.
+	// Unlike hosts, we only learn a url's extractor by asking youtube-dl,
+	// so we check these just before downloading.
+	AllowedExtractors []string `yaml:"allowed_extractors"`
+	DeniedExtractors  []string `yaml:"denied_extractors"`
+}
+
+// downloadsConfig controls how much a single job may download.
+type downloadsConfig struct {
+	// MaxBatchURLs is the most urls a user may submit in a single job.
+	MaxBatchURLs int `yaml:"max_batch_urls"`
+	// MaxPlaylistItems is the most items we'll download from a single
+	// playlist.
+	MaxPlaylistItems int `yaml:"max_playlist_items"`
+
+	// Profiles are the output formats users may choose from. The first
+	// profile is the default.
+	Profiles []*TranscodingProfile `yaml:"profiles"`
+
+	// Retries controls how we retry downloads which fail for transient
+	// reasons.
+	Retries RetryPolicy `yaml:"retries"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Downloads: downloadsConfig{
+			MaxBatchURLs:     10,
+			MaxPlaylistItems: 25,
+			Profiles:         defaultTranscodingProfiles(),
+			Retries:          defaultRetryPolicy(),
+		},
+		Sandbox:      defaultContainerSandbox(),
+		ImageUpdates: defaultImageUpdatesConfig(),
+		Health:       defaultHealthConfig(),
+		Tracing:      defaultTracingConfig(),
+		Server:       defaultServerConfig(),
+		Webhooks:     defaultWebhooksConfig(),
+		Email:        defaultEmailConfig(),
+	}
+}
+
+func parseConfigFile(configFilePath string) (*config, error) {
+	yamlFile, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := defaultConfig()
+	if err = yaml.Unmarshal(yamlFile, conf); err != nil {
+		return nil, err
+	}
+
+	if err = conf.validate(); err != nil {
+		return nil, err
+	}
+
+	if conf.Containers.Registry != nil {
+		if err = conf.Containers.Registry.loadPassword(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = conf.Webhooks.loadSecrets(); err != nil {
+		return nil, err
+	}
+
+	if conf.Email.enabled() && conf.Email.PasswordFile != "" {
+		if err = conf.Email.loadPassword(); err != nil {
+			return nil, err
+		}
+	}
+
+	return conf, nil
+}
+
+// validate catches configuration mistakes we'd otherwise only discover once
+// a user tries to download something.
+func (c *config) validate() error {
+	if c.Downloads.Retries.MaxAttempts < 1 {
+		return fmt.Errorf("The downloads.retries.max_attempts setting must be at least 1")
+	}
+
+	switch c.Containers.Runtime {
+	case "", containerRuntimeDocker, containerRuntimePodman, containerRuntimeContainerd:
+	default:
+		return fmt.Errorf("Unknown container runtime %s", c.Containers.Runtime)
+	}
+
+	if err := validateImagePullPolicy(c.Containers.PullPolicy); err != nil {
+		return err
+	}
+
+	if c.Containers.Registry != nil && (c.Containers.Registry.ServerAddress == "" || c.Containers.Registry.PasswordFile == "") {
+		return fmt.Errorf("Registry credentials require a server_address and password_file")
+	}
+
+	if c.ImageUpdates.Enabled && (c.ImageUpdates.Image == "" || c.ImageUpdates.CheckIntervalMinutes < 1) {
+		return fmt.Errorf("Image updates require an image and a check_interval_minutes of at least 1")
+	}
+
+	if c.Server.ShutdownTimeoutSeconds < 0 {
+		return fmt.Errorf("The server.shutdown_timeout_seconds setting must not be negative")
+	}
+
+	if err := c.Server.TLS.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Sandbox.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Webhooks.validate(); err != nil {
+		return err
+	}
+
+	// Without the user header, every job is anonymous, so per user webhooks
+	// would never be notified.
+	if len(c.Webhooks.PerUser) > 0 && c.Limits.UserHeader == "" {
+		return fmt.Errorf("The webhooks.per_user setting requires the limits.user_header setting")
+	}
+
+	if err := c.Email.validate(); err != nil {
+		return err
+	}
+
+	// We charge quotas for every video a playlist could download up front,
+	// so we can only limit jobs if we know how many that is.
+	if c.Downloads.MaxPlaylistItems <= 0 && (c.Limits.PerUser.limitsJobs() || c.Limits.PerIP.limitsJobs()) {
+		return fmt.Errorf("The downloads.max_playlist_items setting is required when limiting jobs_per_hour or concurrent_jobs")
+	}
+
+	return validateTranscodingProfiles(c.Downloads.Profiles)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	useDefaultTempDirectory := ""
+	tmpFile, err := ioutil.TempFile(useDefaultTempDirectory, "config.*.yaml")
+	if err != nil {
+		t.Fatalf("Error creating tmp file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	configContents := `
+s3_bucket: my-bucket
+limits:
+  user_header: X-Forwarded-User
+  per_ip:
+    jobs_per_hour: 10
+    max_video_duration_seconds: 600
+`
+	if _, err := tmpFile.WriteString(configContents); err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+	tmpFile.Close()
+
+	conf, err := parseConfigFile(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Error parsing config file: %s", err)
+	}
+
+	if conf.S3Bucket != "my-bucket" {
+		t.Fatalf("Expected s3 bucket my-bucket, but got %s", conf.S3Bucket)
+	}
+
+	if conf.Limits.UserHeader != "X-Forwarded-User" {
+		t.Fatalf("Expected user header X-Forwarded-User, but got %s", conf.Limits.UserHeader)
+	}
+
+	if conf.Limits.PerIP.JobsPerHour != 10 || conf.Limits.PerIP.MaxVideoDurationSeconds != 600 {
+		t.Fatalf("Per ip limits not parsed correctly: %+v", conf.Limits.PerIP)
+	}
+
+	if conf.Limits.PerUser != (quotaLimits{}) {
+		t.Fatalf("Expected per user limits to be unset, but got %+v", conf.Limits.PerUser)
+	}
+}
+
+func TestParseConfigFileFailsWhenFileDoesNotExist(t *testing.T) {
+	_, err := parseConfigFile("/this/path/does/not/exist.yaml")
+	if err == nil {
+		t.Fatal("Should not be able to parse non-existent config file")
+	}
+}
+
+func TestParseConfigFileFailsWhenContainerRuntimeUnknown(t *testing.T) {
+	useDefaultTempDirectory := ""
+	tmpFile, err := ioutil.TempFile(useDefaultTempDirectory, "config.*.yaml")
+	if err != nil {
+		t.Fatalf("Error creating tmp file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString("containers:\n  runtime: lxc\n"); err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+	tmpFile.Close()
+
+	if _, err := parseConfigFile(tmpFile.Name()); err == nil {
+		t.Fatal("Should not be able to parse config with unknown container runtime")
+	}
+}
@@ -2,22 +2,50 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
-	"os"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	dockerclient "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/go-logr/logr"
 )
 
+// The container runtimes we support.
+const (
+	containerRuntimeDocker     = "docker"
+	containerRuntimePodman     = "podman"
+	containerRuntimeContainerd = "containerd"
+)
+
+// maxCapturedOutputBytes bounds how much of a container's stdout and stderr we
+// keep in memory. We keep the end of the output, as that's where processes
+// report why they failed.
+const maxCapturedOutputBytes = 64 * 1024
+
 // ContainerClient defines an interface, implementable by a number of different
-// container runtimes (i.e. docker, containerd, etc...),
-// for the containerized options we need in this application.
+// container runtimes (i.e. docker, podman, containerd, etc...),
+// for the containerized options we need in this application. Every
+// implementation must pass `testContainerClientConformance`.
 type ContainerClient interface {
-	EnsureImageAvailableOnHost(imageName string) error
-	RunContainer(imageName string, cmd []string, runContainerOpts *runContainerOptions) error
+	// Ping checks we can reach the container runtime.
+	Ping() error
+	EnsureImageAvailableOnHost(imageName string, pullOpts *pullImageOptions) error
+	// ImageRepoDigests returns the digests (i.e. "repo@sha256:...") of an
+	// image on the host, which identify exactly which image a mutable tag
+	// currently refers to.
+	ImageRepoDigests(imageName string) ([]string, error)
+	// RunContainer runs the container to completion. The result is non-nil
+	// whenever the container actually ran, even if it exited non-zero (in
+	// which case the error is a `*ContainerExitError`). Cancelling `ctx`
+	// stops and removes the container.
+	RunContainer(ctx context.Context, imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error)
 }
 
 // runContainerOptions aggregates common options for running containers. We
@@ -25,6 +53,51 @@ type ContainerClient interface {
 type runContainerOptions struct {
 	binds []string
 	uid   string
+	env   []string
+
+	// entrypoint, if set, overrides the image's entrypoint (i.e. so we can
+	// run ffmpeg in the youtube-dl image).
+	entrypoint []string
+
+	// Resource limits. Zero means unlimited.
+	memoryBytes int64
+	nanoCPUs    int64
+	pidsLimit   int64
+
+	readOnlyRootFilesystem bool
+	// dropCapabilities drops all linux capabilities.
+	dropCapabilities bool
+	noNewPrivileges  bool
+	// tmpfs maps paths in the container to the options of the tmpfs we
+	// mount there (i.e. "size=64m").
+	tmpfs map[string]string
+}
+
+// runContainerResult describes how a container's process finished.
+type runContainerResult struct {
+	exitCode int
+	// stdout and stderr contain (at most) the last
+	// `maxCapturedOutputBytes` of the process's output.
+	stdout   string
+	stderr   string
+	duration time.Duration
+}
+
+// ContainerExitError indicates the containerized process exited non-zero.
+type ContainerExitError struct {
+	ContainerID string
+	ExitCode    int
+	// Stderr is the (bounded) stderr of the process.
+	Stderr string
+}
+
+func (c *ContainerExitError) Error() string {
+	message := fmt.Sprintf("Container %s finished with non-zero exit code %d.", c.ContainerID, c.ExitCode)
+	if lastLine := lastNonEmptyLine(c.Stderr); lastLine != "" {
+		message += " " + lastLine
+	}
+
+	return message
 }
 
 // DockerClient defines a wrapper around the Docker Golang SDK.
@@ -35,15 +108,36 @@ type DockerClient struct {
 	logger logr.Logger
 }
 
+// FakeContainerClient doesn't run any containers. Instead, it records the
+// containers it was asked to run, and simulates their side effects by calling
+// `RunContainerFunc` (if set).
+type FakeContainerClient struct {
+	RunContainerFunc func(imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error)
+	RanCmds          [][]string
+
+	// RepoDigests are the digests `ImageRepoDigests` returns for each
+	// image.
+	RepoDigests map[string][]string
+
+	// PingErr, if set, is returned by `Ping`.
+	PingErr error
+}
+
 // Ensure all client implementations fulfill the ContainerClient interface.
 var _ ContainerClient = (*DockerClient)(nil)
+var _ ContainerClient = (*FakeContainerClient)(nil)
 
 // NewDockerClient creates a new Docker client and returns it.
 func NewDockerClient(logger logr.Logger) (*DockerClient, error) {
+	return newDockerClient(logger, dockerclient.FromEnv)
+}
+
+func newDockerClient(logger logr.Logger, opts ...dockerclient.Opt) (*DockerClient, error) {
 	ctx := context.Background()
 
 	logger.V(3).Info("Creating new raw docker client")
-	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	opts = append(opts, dockerclient.WithAPIVersionNegotiation())
+	cli, err := dockerclient.NewClientWithOpts(opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -57,44 +151,155 @@ func NewDockerClient(logger logr.Logger) (*DockerClient, error) {
 	return dockerClient, nil
 }
 
+// NewContainerClient creates a client for the container runtime chosen in the
+// config.
+func NewContainerClient(conf containersConfig, logger logr.Logger) (ContainerClient, error) {
+	logger.V(2).Info("Creating container client", "runtime", conf.Runtime, "address", conf.Address)
+
+	switch conf.Runtime {
+	case "", containerRuntimeDocker:
+		if conf.Address != "" {
+			return newDockerClient(logger, dockerclient.FromEnv, dockerclient.WithHost(socketHost(conf.Address)))
+		}
+		return NewDockerClient(logger)
+	case containerRuntimePodman:
+		return NewPodmanClient(conf.Address, logger)
+	case containerRuntimeContainerd:
+		return NewContainerdClient(conf.Address, conf.Namespace, logger)
+	}
+
+	return nil, fmt.Errorf("Unknown container runtime %s", conf.Runtime)
+}
+
+// socketHost converts a socket path (i.e. "/run/podman/podman.sock") into the
+// host url the docker sdk expects. Addresses which are already urls are
+// returned as is.
+func socketHost(address string) string {
+	if strings.Contains(address, "://") {
+		return address
+	}
+
+	return "unix://" + address
+}
+
 // EnsureImageAvailableOnHost ensures that a container image exists on the host
-// (i.e. could be used to run a container). We return an error only if we were
-// unable to ensure the image exists on the host.
-func (dc *DockerClient) EnsureImageAvailableOnHost(imageName string) error {
-	dc.logger.V(3).Info("Ensuring image exists on host", "imageName", imageName)
+// (i.e. could be used to run a container), pulling it according to the pull
+// policy. We return an error if we were unable to ensure the image exists on
+// the host, or if it doesn't match the digest the image name is pinned to.
+func (dc *DockerClient) EnsureImageAvailableOnHost(imageName string, pullOpts *pullImageOptions) error {
+	dc.logger.V(3).Info("Ensuring image exists on host", "imageName", imageName, "pullPolicy", pullOpts.policy)
 
-	_, _, err := dc.cli.ImageInspectWithRaw(dc.ctx, imageName)
+	inspect := func() ([]string, bool, error) {
+		imageInspect, _, err := dc.cli.ImageInspectWithRaw(dc.ctx, imageName)
+		if dockerclient.IsErrNotFound(err) {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
 
-	imageExistsOnHost := err == nil
-	if imageExistsOnHost {
-		return nil
+		return imageInspect.RepoDigests, true, nil
 	}
 
-	dc.logger.V(3).Info("Pulling image onto host", "imageName", imageName)
-	reader, err := dc.cli.ImagePull(dc.ctx, imageName, types.ImagePullOptions{})
+	pull := func() error {
+		return dc.pullImage(imageName, pullOpts.credentialsFor(imageName))
+	}
+
+	return ensureImage(imageName, pullOpts, inspect, pull)
+}
+
+func (dc *DockerClient) Ping() error {
+	_, err := dc.cli.Ping(dc.ctx)
+	return err
+}
+
+func (dc *DockerClient) ImageRepoDigests(imageName string) ([]string, error) {
+	imageInspect, _, err := dc.cli.ImageInspectWithRaw(dc.ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	return imageInspect.RepoDigests, nil
+}
+
+func (dc *DockerClient) pullImage(imageName string, credentials *RegistryCredentials) error {
+	dc.logger.V(2).Info("Pulling image onto host", "imageName", imageName, "authenticated", credentials != nil)
+
+	imagePullOptions := types.ImagePullOptions{}
+	if credentials != nil {
+		registryAuth, err := encodeRegistryAuth(credentials)
+		if err != nil {
+			return err
+		}
+		imagePullOptions.RegistryAuth = registryAuth
+	}
+
+	reader, err := dc.cli.ImagePull(dc.ctx, imageName, imagePullOptions)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
-	// We need the `io.Copy`, or else will not actually download the
-	// image...
-	io.Copy(os.Stdout, reader)
-	return nil
+	// The pull only completes once we've read the whole progress stream,
+	// and any errors mid pull are only reported in the stream.
+	return logPullProgress(reader, imageName, dc.logger)
+}
+
+// encodeRegistryAuth encodes the credentials the way the docker api expects.
+func encodeRegistryAuth(credentials *RegistryCredentials) (string, error) {
+	authConfig, err := json.Marshal(&types.AuthConfig{
+		Username:      credentials.Username,
+		Password:      credentials.password,
+		ServerAddress: credentials.ServerAddress,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(authConfig), nil
+}
+
+// logPullProgress logs the progress stream of an image pull, returning any
+// error reported in the stream. We log each layer's status changes rather
+// than every progress update, as there are many updates per layer.
+func logPullProgress(progressStream io.Reader, imageName string, logger logr.Logger) error {
+	decoder := json.NewDecoder(progressStream)
+	layerStatuses := make(map[string]string)
+
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Error reading pull progress: %s", err)
+		}
+
+		if message.Error != nil {
+			return message.Error
+		}
+
+		if layerStatuses[message.ID] == message.Status {
+			continue
+		}
+		layerStatuses[message.ID] = message.Status
+
+		logger.V(3).Info("Image pull progress", "imageName", imageName, "layer", message.ID, "status", message.Status)
+	}
 }
 
 // RunContainer runs a container. We return a non-nil error either if there is
 // an error running the container or the exit code of the containerized process
-// is non-zero.
-func (dc *DockerClient) RunContainer(imageName string, cmd []string, runContainerOpts *runContainerOptions) error {
+// is non-zero. We capture the process's output before removing the container,
+// so we can tell why it failed.
+func (dc *DockerClient) RunContainer(ctx context.Context, imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
 	dc.logger.V(3).Info("Running container with following settings", "imageName", imageName, "cmd", cmd, "runContainerOptions", runContainerOpts)
 
 	containerConfig := &container.Config{
 		Image: imageName,
 		Cmd:   cmd,
 	}
-	hostConfig := &container.HostConfig{
-		AutoRemove: true,
-	}
+	// We don't use `AutoRemove`, as it can remove the container (and its
+	// logs) before we've read them.
+	hostConfig := &container.HostConfig{}
 
 	if runContainerOpts.uid != "" {
 		containerConfig.User = runContainerOpts.uid
@@ -102,41 +307,176 @@ func (dc *DockerClient) RunContainer(imageName string, cmd []string, runContaine
 	if runContainerOpts.binds != nil {
 		hostConfig.Binds = runContainerOpts.binds
 	}
+	if runContainerOpts.entrypoint != nil {
+		containerConfig.Entrypoint = runContainerOpts.entrypoint
+	}
+	containerConfig.Env = runContainerOpts.env
+
+	hostConfig.Memory = runContainerOpts.memoryBytes
+	if runContainerOpts.memoryBytes > 0 {
+		// Prevent the container from using swap to exceed its memory
+		// limit.
+		hostConfig.MemorySwap = runContainerOpts.memoryBytes
+	}
+	hostConfig.NanoCPUs = runContainerOpts.nanoCPUs
+	if runContainerOpts.pidsLimit > 0 {
+		hostConfig.PidsLimit = &runContainerOpts.pidsLimit
+	}
+
+	hostConfig.ReadonlyRootfs = runContainerOpts.readOnlyRootFilesystem
+	if runContainerOpts.dropCapabilities {
+		hostConfig.CapDrop = []string{"ALL"}
+	}
+	if runContainerOpts.noNewPrivileges {
+		hostConfig.SecurityOpt = []string{"no-new-privileges"}
+	}
+	hostConfig.Tmpfs = runContainerOpts.tmpfs
 
-	createContainerResp, err := dc.cli.ContainerCreate(dc.ctx, containerConfig, hostConfig, nil, "")
+	createContainerResp, err := dc.cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	containerID := createContainerResp.ID
+	// We remove the container with our own context, so we still remove
+	// (and thus stop) it when `ctx` is cancelled.
+	defer dc.removeContainer(containerID)
+
+	startTime := time.Now()
 
 	dc.logger.V(3).Info("Starting container")
-	err = dc.cli.ContainerStart(dc.ctx, createContainerResp.ID, types.ContainerStartOptions{})
+	err = dc.cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	dc.logger.V(3).Info("Waiting for container to finish executing")
-	statusCh, errCh := dc.cli.ContainerWait(dc.ctx, createContainerResp.ID, container.WaitConditionNotRunning)
+	statusCh, errCh := dc.cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
 
-	statusCodesIndicatingSuccess := map[int]bool{0: true}
+	result := &runContainerResult{}
 
 	select {
 	case err := <-errCh:
-		dc.logger.V(3).Info("No longer waiting on container")
-
 		// errCh passes an error if there was an issue waiting for the
-		// container... NOT if the container had an error while
-		// executing.
+		// container (including `ctx` being cancelled)... NOT if the
+		// container had an error while executing.
 		if err != nil {
-			return err
+			return nil, err
 		}
 	case resp := <-statusCh:
-		dc.logger.V(3).Info("No longer waiting on container")
+		result.exitCode = int(resp.StatusCode)
+	}
+
+	result.duration = time.Since(startTime)
+	dc.logger.V(3).Info("No longer waiting on container", "exitCode", result.exitCode, "duration", result.duration)
+
+	if err := dc.captureOutput(containerID, result); err != nil {
+		// Not fatal... we just have less information about the run.
+		dc.logger.V(2).Info("Failed to capture container output", "containerId", containerID, "error", err)
+	}
 
-		if _, ok := statusCodesIndicatingSuccess[int(resp.StatusCode)]; !ok {
-			return fmt.Errorf("Container %s finished with non-zero exit code.", createContainerResp.ID)
+	if result.exitCode != 0 {
+		return result, &ContainerExitError{
+			ContainerID: containerID,
+			ExitCode:    result.exitCode,
+			Stderr:      result.stderr,
 		}
 	}
 
-	dc.logger.V(3).Info("No longer waiting on container")
+	return result, nil
+}
+
+// captureOutput reads the stdout and stderr of the finished container into the
+// result.
+func (dc *DockerClient) captureOutput(containerID string, result *runContainerResult) error {
+	logs, err := dc.cli.ContainerLogs(dc.ctx, containerID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	stdout := newTailBuffer(maxCapturedOutputBytes)
+	stderr := newTailBuffer(maxCapturedOutputBytes)
+
+	// Without a TTY, docker multiplexes stdout and stderr onto a single
+	// stream.
+	_, err = stdcopy.StdCopy(stdout, stderr, logs)
+
+	result.stdout = stdout.String()
+	result.stderr = stderr.String()
+	return err
+}
+
+func (dc *DockerClient) removeContainer(containerID string) {
+	err := dc.cli.ContainerRemove(dc.ctx, containerID, types.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		dc.logger.V(2).Info("Failed to remove container", "containerId", containerID, "error", err)
+	}
+}
+
+// tailBuffer is an `io.Writer` which keeps only the last `maxBytes` written
+// to it.
+type tailBuffer struct {
+	maxBytes int
+	buf      []byte
+}
+
+func newTailBuffer(maxBytes int) *tailBuffer {
+	return &tailBuffer{maxBytes: maxBytes}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if overflow := len(t.buf) - t.maxBytes; overflow > 0 {
+		t.buf = append(t.buf[:0], t.buf[overflow:]...)
+	}
+
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
+
+// lastNonEmptyLine returns the last line of output which isn't blank, which is
+// usually the most informative line of an error message.
+func lastNonEmptyLine(output string) string {
+	lines := strings.Split(output, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return line
+		}
+	}
+
+	return ""
+}
+
+func NewFakeContainerClient() *FakeContainerClient {
+	return &FakeContainerClient{}
+}
+
+func (f *FakeContainerClient) Ping() error {
+	return f.PingErr
+}
+
+func (f *FakeContainerClient) EnsureImageAvailableOnHost(imageName string, pullOpts *pullImageOptions) error {
 	return nil
 }
+
+func (f *FakeContainerClient) ImageRepoDigests(imageName string) ([]string, error) {
+	repoDigests, found := f.RepoDigests[imageName]
+	if !found {
+		return nil, fmt.Errorf("No such image: %s", imageName)
+	}
+
+	return repoDigests, nil
+}
+
+func (f *FakeContainerClient) RunContainer(ctx context.Context, imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
+	f.RanCmds = append(f.RanCmds, cmd)
+
+	if f.RunContainerFunc == nil {
+		return &runContainerResult{}, nil
+	}
+
+	return f.RunContainerFunc(imageName, cmd, runContainerOpts)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// conformanceTestImage is a small image containing a shell and coreutils.
+const conformanceTestImage = "alpine:edge"
+
+// testContainerClientConformance verifies `containerClient` behaves the way the
+// rest of vidzou expects of any ContainerClient. Every ContainerClient
+// implementation must pass it.
+func testContainerClientConformance(t *testing.T, containerClient ContainerClient) {
+	t.Helper()
+
+	if err := containerClient.Ping(); err != nil {
+		t.Fatalf("Error pinging container runtime: %s", err)
+	}
+
+	if err := containerClient.EnsureImageAvailableOnHost(conformanceTestImage, &pullImageOptions{}); err != nil {
+		t.Fatalf("Error ensuring image available: %s", err)
+	}
+
+	// Ensuring an image which is already available is a no-op.
+	if err := containerClient.EnsureImageAvailableOnHost(conformanceTestImage, &pullImageOptions{}); err != nil {
+		t.Fatalf("Error ensuring already available image available: %s", err)
+	}
+
+	t.Run("PullErrors", func(t *testing.T) {
+		missingImage := "vidzou/does-not-exist:" + generateRandomString(8)
+
+		if err := containerClient.EnsureImageAvailableOnHost(missingImage, &pullImageOptions{policy: ImagePullNever}); err == nil {
+			t.Fatal("Should not be able to ensure missing image is available without pulling")
+		}
+
+		if err := containerClient.EnsureImageAvailableOnHost(missingImage, &pullImageOptions{}); err == nil {
+			t.Fatal("Should not be able to pull non-existent image")
+		}
+	})
+
+	t.Run("Succeeds", func(t *testing.T) {
+		result, err := containerClient.RunContainer(context.Background(), conformanceTestImage, []string{"/bin/true"}, &runContainerOptions{})
+		if err != nil {
+			t.Fatalf("Error running container: %s", err)
+		}
+
+		if result.exitCode != 0 {
+			t.Fatalf("Expected exit code 0, but got %d", result.exitCode)
+		}
+	})
+
+	t.Run("StopsWhenCancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		startedAt := time.Now()
+		if _, err := containerClient.RunContainer(ctx, conformanceTestImage, []string{"sleep", "60"}, &runContainerOptions{}); err == nil {
+			t.Fatal("Should have error when cancelled before the container finishes")
+		}
+
+		if elapsed := time.Since(startedAt); elapsed > 30*time.Second {
+			t.Fatalf("Expected cancelling to stop the container, but waited %s", elapsed)
+		}
+	})
+
+	t.Run("FailsWithExitDetails", func(t *testing.T) {
+		failWithOutputCmd := []string{"sh", "-c", "echo some output; echo some error >&2; exit 3"}
+
+		result, err := containerClient.RunContainer(context.Background(), conformanceTestImage, failWithOutputCmd, &runContainerOptions{})
+		exitErr, ok := err.(*ContainerExitError)
+		if !ok {
+			t.Fatalf("Expected ContainerExitError, but got %v", err)
+		}
+
+		if exitErr.ExitCode != 3 || result.exitCode != 3 {
+			t.Fatalf("Expected exit code 3, but got %d", exitErr.ExitCode)
+		}
+
+		if result.stdout != "some output\n" || result.stderr != "some error\n" {
+			t.Fatalf("Unexpected captured output: stdout %q, stderr %q", result.stdout, result.stderr)
+		}
+
+		if result.duration <= 0 {
+			t.Fatalf("Expected a positive duration, but got %s", result.duration)
+		}
+	})
+
+	t.Run("Entrypoint", func(t *testing.T) {
+		runOpts := &runContainerOptions{entrypoint: []string{"echo", "from"}}
+
+		result, err := containerClient.RunContainer(context.Background(), conformanceTestImage, []string{"entrypoint"}, runOpts)
+		if err != nil {
+			t.Fatalf("Error running container: %s", err)
+		}
+
+		if result.stdout != "from entrypoint\n" {
+			t.Fatalf("Expected entrypoint to be overridden, but got %q", result.stdout)
+		}
+	})
+
+	t.Run("Env", func(t *testing.T) {
+		runOpts := &runContainerOptions{env: []string{"GREETING=hi"}}
+
+		result, err := containerClient.RunContainer(context.Background(), conformanceTestImage, []string{"sh", "-c", "echo $GREETING"}, runOpts)
+		if err != nil {
+			t.Fatalf("Error running container: %s", err)
+		}
+
+		if result.stdout != "hi\n" {
+			t.Fatalf("Expected env to be set, but got %q", result.stdout)
+		}
+	})
+
+	t.Run("BindsAndUid", func(t *testing.T) {
+		useDefaultTempDirectory := ""
+		tmpDirectoryPath, err := ioutil.TempDir(useDefaultTempDirectory, "conformance-test")
+		if err != nil {
+			t.Fatalf("Error creating temp dir: %s", err)
+		}
+		defer os.RemoveAll(tmpDirectoryPath)
+
+		runOpts := &runContainerOptions{
+			binds: []string{fmt.Sprintf("%s:%s", tmpDirectoryPath, "/data")},
+			uid:   fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+		}
+
+		_, err = containerClient.RunContainer(context.Background(), conformanceTestImage, []string{"touch", "/data/fake-file.txt"}, runOpts)
+		if err != nil {
+			t.Fatalf("Error running container: %s", err)
+		}
+
+		fileInfo, err := os.Stat(filepath.Join(tmpDirectoryPath, "fake-file.txt"))
+		if err != nil {
+			t.Fatalf("Should be able to stat file on host: %s", err)
+		}
+
+		if !fileOwnedBy(fileInfo, os.Getuid()) {
+			t.Fatalf("Expected file to be owned by uid %d", os.Getuid())
+		}
+	})
+
+	t.Run("Sandbox", func(t *testing.T) {
+		runOpts := &runContainerOptions{}
+		defaultContainerSandbox().apply(runOpts)
+
+		// The root file system is read only, but the tmpfs is writable.
+		if _, err := containerClient.RunContainer(context.Background(), conformanceTestImage, []string{"touch", "/fake-file.txt"}, runOpts); err == nil {
+			t.Fatalf("Should not be able to write to the read only root file system")
+		}
+
+		tmpFilePath := fmt.Sprintf("%s/fake-file.txt", containerTmpDirectory)
+		if _, err := containerClient.RunContainer(context.Background(), conformanceTestImage, []string{"touch", tmpFilePath}, runOpts); err != nil {
+			t.Fatalf("Should be able to write to the tmpfs: %s", err)
+		}
+
+		result, err := containerClient.RunContainer(context.Background(), conformanceTestImage, []string{"cat", "/sys/fs/cgroup/pids.max", "/sys/fs/cgroup/pids/pids.max"}, runOpts)
+		if result == nil || !strings.Contains(result.stdout, "256") {
+			t.Fatalf("Expected pids limit of 256, but got %v: %v", result, err)
+		}
+
+		result, err = containerClient.RunContainer(context.Background(), conformanceTestImage, []string{"id", "-u"}, runOpts)
+		if err != nil {
+			t.Fatalf("Error running container: %s", err)
+		}
+		if strings.TrimSpace(result.stdout) == "0" {
+			t.Fatalf("Should not run as root by default")
+		}
+	})
+}
+
+func TestDockerClientConformanceIntegration(t *testing.T) {
+	markIntegrationTest(t)
+
+	dockerClient, err := NewDockerClient(testLogger)
+	if err != nil {
+		t.Fatalf("Error creating docker client: %s", err)
+	}
+
+	testContainerClientConformance(t, dockerClient)
+}
+
+func TestPodmanClientConformanceIntegration(t *testing.T) {
+	markIntegrationTest(t)
+
+	if _, err := os.Stat(defaultPodmanSocketPath()); err != nil {
+		t.Skipf("Skipping as podman socket is unavailable: %s", err)
+	}
+
+	podmanClient, err := NewPodmanClient("", testLogger)
+	if err != nil {
+		t.Fatalf("Error creating podman client: %s", err)
+	}
+
+	testContainerClientConformance(t, podmanClient)
+}
+
+func TestContainerdClientConformanceIntegration(t *testing.T) {
+	markIntegrationTest(t)
+
+	containerdClient, err := NewContainerdClient("", "", testLogger)
+	if err != nil {
+		t.Skipf("Skipping as containerd is unavailable: %s", err)
+	}
+
+	testContainerClientConformance(t, containerdClient)
+}
+
+func TestNerdctlRunArgs(t *testing.T) {
+	runContainerOpts := &runContainerOptions{
+		binds:      []string{"/tmp/abc:/downloads"},
+		entrypoint: []string{"ffmpeg"},
+	}
+	defaultContainerSandbox().apply(runContainerOpts)
+	runContainerOpts.uid = "1000:1000"
+
+	args := nerdctlRunArgs("vidzou-abc", "youtube-dl:latest", []string{"-i", "in.mp3", "out.mp3"}, runContainerOpts)
+	expectedArgs := strings.Join([]string{
+		"run --rm --name vidzou-abc --pull never",
+		"--user 1000:1000 --volume /tmp/abc:/downloads --env HOME=/tmp",
+		"--memory 1073741824 --memory-swap 1073741824 --cpus 1 --pids-limit 256",
+		"--read-only --cap-drop ALL --security-opt no-new-privileges",
+		"--tmpfs /tmp:rw,noexec,nosuid,size=256m",
+		"--entrypoint ffmpeg youtube-dl:latest -i in.mp3 out.mp3",
+	}, " ")
+
+	if strings.Join(args, " ") != expectedArgs {
+		t.Fatalf("Expected args:\n%s\nbut got:\n%s", expectedArgs, strings.Join(args, " "))
+	}
+}
+
+func TestNewContainerClientRejectsUnknownRuntime(t *testing.T) {
+	if _, err := NewContainerClient(containersConfig{Runtime: "lxc"}, testLogger); err == nil {
+		t.Fatal("Should not be able to create a client for an unknown runtime")
+	}
+}
+
+// fileOwnedBy returns whether the file is owned by the given uid.
+func fileOwnedBy(fileInfo os.FileInfo, uid int) bool {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == uid
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// defaultContainerdNamespace is the containerd namespace in which we pull
+// images and run containers, keeping them separate from any other users of
+// containerd on the host.
+const defaultContainerdNamespace = "vidzou"
+
+// ContainerdClient runs containers using containerd, via nerdctl (containerd's
+// docker compatible cli). Driving nerdctl, rather than using the containerd
+// client library, means we don't need to reimplement image unpacking,
+// networking and mounts ourselves.
+type ContainerdClient struct {
+	// address is the containerd socket. If empty, nerdctl uses its default.
+	address   string
+	namespace string
+
+	// NerdctlPath is the nerdctl binary we run.
+	NerdctlPath string
+
+	logger logr.Logger
+}
+
+var _ ContainerClient = (*ContainerdClient)(nil)
+
+func NewContainerdClient(address string, namespace string, logger logr.Logger) (*ContainerdClient, error) {
+	if namespace == "" {
+		namespace = defaultContainerdNamespace
+	}
+
+	nerdctlPath, err := exec.LookPath("nerdctl")
+	if err != nil {
+		return nil, fmt.Errorf("Running containers with containerd requires nerdctl: %s", err)
+	}
+
+	return &ContainerdClient{
+		address:     address,
+		namespace:   namespace,
+		NerdctlPath: nerdctlPath,
+		logger:      logger,
+	}, nil
+}
+
+// EnsureImageAvailableOnHost ensures that a container image exists in our
+// containerd namespace, pulling it according to the pull policy.
+func (c *ContainerdClient) EnsureImageAvailableOnHost(imageName string, pullOpts *pullImageOptions) error {
+	c.logger.V(3).Info("Ensuring image exists on host", "imageName", imageName, "pullPolicy", pullOpts.policy)
+
+	inspect := func() ([]string, bool, error) {
+		return c.inspectImage(imageName)
+	}
+
+	pull := func() error {
+		return c.pullImage(imageName, pullOpts.credentialsFor(imageName))
+	}
+
+	return ensureImage(imageName, pullOpts, inspect, pull)
+}
+
+func (c *ContainerdClient) Ping() error {
+	// `nerdctl info` fails unless it can reach containerd.
+	infoCmd := c.nerdctl("info")
+
+	var stderr bytes.Buffer
+	infoCmd.Stderr = &stderr
+	if err := infoCmd.Run(); err != nil {
+		return fmt.Errorf("Error reaching containerd: %s %s", err, lastNonEmptyLine(stderr.String()))
+	}
+
+	return nil
+}
+
+func (c *ContainerdClient) ImageRepoDigests(imageName string) ([]string, error) {
+	repoDigests, imageExistsOnHost, err := c.inspectImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+	if !imageExistsOnHost {
+		return nil, fmt.Errorf("Image %s is not on the host", imageName)
+	}
+
+	return repoDigests, nil
+}
+
+// nerdctlImageNotFoundRegexp matches nerdctl's error when inspecting an image
+// which isn't in our namespace.
+var nerdctlImageNotFoundRegexp = regexp.MustCompile(`(?i)no such (image|object)`)
+
+// inspectImage returns the image's repo digests, and whether the image exists
+// on the host. Unlike docker's api, nerdctl only tells us an image is missing
+// via its error message, so any other failure (i.e. we can't reach
+// containerd) is returned as an error.
+func (c *ContainerdClient) inspectImage(imageName string) ([]string, bool, error) {
+	inspectCmd := c.nerdctl("image", "inspect", "--format", "{{json .RepoDigests}}", imageName)
+
+	var stderr bytes.Buffer
+	inspectCmd.Stderr = &stderr
+	output, err := inspectCmd.Output()
+	if err != nil {
+		if nerdctlImageNotFoundRegexp.MatchString(stderr.String()) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("Error inspecting image %s: %s %s", imageName, err, lastNonEmptyLine(stderr.String()))
+	}
+
+	repoDigests, err := parseRepoDigests(output)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return repoDigests, true, nil
+}
+
+func parseRepoDigests(inspectOutput []byte) ([]string, error) {
+	var repoDigests []string
+	if err := json.Unmarshal(bytes.TrimSpace(inspectOutput), &repoDigests); err != nil {
+		return nil, fmt.Errorf("Error parsing image inspect output: %s", err)
+	}
+
+	return repoDigests, nil
+}
+
+func (c *ContainerdClient) pullImage(imageName string, credentials *RegistryCredentials) error {
+	c.logger.V(2).Info("Pulling image onto host", "imageName", imageName, "authenticated", credentials != nil)
+
+	pullCmd := c.nerdctl("pull", imageName)
+
+	if credentials != nil {
+		// nerdctl reads credentials from a docker config file, so we
+		// write one just for this pull.
+		dockerConfigDir, err := writeDockerConfig(credentials)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dockerConfigDir)
+
+		pullCmd.Env = append(os.Environ(), "DOCKER_CONFIG="+dockerConfigDir)
+	}
+
+	stdout, err := pullCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := newTailBuffer(maxCapturedOutputBytes)
+	pullCmd.Stderr = stderr
+
+	if err := pullCmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		c.logger.V(3).Info("Image pull progress", "imageName", imageName, "status", strings.TrimSpace(scanner.Text()))
+	}
+	scanErr := scanner.Err()
+
+	if err := pullCmd.Wait(); err != nil {
+		return fmt.Errorf("%s %s", err, lastNonEmptyLine(stderr.String()))
+	}
+
+	return scanErr
+}
+
+// writeDockerConfig writes a docker config file containing the credentials to
+// a new temporary directory, returning the directory.
+func writeDockerConfig(credentials *RegistryCredentials) (string, error) {
+	useDefaultTempDirectory := ""
+	dockerConfigDir, err := ioutil.TempDir(useDefaultTempDirectory, "docker-config")
+	if err != nil {
+		return "", err
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte(credentials.Username + ":" + credentials.password))
+	dockerConfig, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			credentials.ServerAddress: map[string]string{"auth": auth},
+		},
+	})
+	if err != nil {
+		os.RemoveAll(dockerConfigDir)
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dockerConfigDir, "config.json"), dockerConfig, 0600); err != nil {
+		os.RemoveAll(dockerConfigDir)
+		return "", err
+	}
+
+	return dockerConfigDir, nil
+}
+
+// RunContainer runs a container. We return a non-nil error either if there is
+// an error running the container or the exit code of the containerized process
+// is non-zero.
+func (c *ContainerdClient) RunContainer(ctx context.Context, imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
+	c.logger.V(3).Info("Running container with following settings", "imageName", imageName, "cmd", cmd, "runContainerOptions", runContainerOpts)
+
+	containerName := "vidzou-" + generateRandomString(16)
+	runCmd := c.nerdctl(nerdctlRunArgs(containerName, imageName, cmd, runContainerOpts)...)
+	stopped := c.stopContainerWhenDone(ctx, containerName)
+	defer close(stopped)
+
+	stdout := newTailBuffer(maxCapturedOutputBytes)
+	stderr := newTailBuffer(maxCapturedOutputBytes)
+	runCmd.Stdout = stdout
+	runCmd.Stderr = stderr
+
+	startTime := time.Now()
+	err := runCmd.Run()
+
+	result := &runContainerResult{
+		stdout:   stdout.String(),
+		stderr:   stderr.String(),
+		duration: time.Since(startTime),
+	}
+
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, err
+		}
+
+		// nerdctl exits with the containerized process's exit code.
+		result.exitCode = exitErr.ExitCode()
+		c.logger.V(3).Info("No longer waiting on container", "exitCode", result.exitCode, "duration", result.duration)
+
+		return result, &ContainerExitError{
+			ContainerID: containerName,
+			ExitCode:    result.exitCode,
+			Stderr:      result.stderr,
+		}
+	}
+
+	c.logger.V(3).Info("No longer waiting on container", "exitCode", result.exitCode, "duration", result.duration)
+	return result, nil
+}
+
+// stopContainerWhenDone removes the container if `ctx` is cancelled before we
+// close the returned channel. Killing nerdctl wouldn't stop the container, so
+// we ask containerd to remove it instead, which also makes nerdctl exit.
+func (c *ContainerdClient) stopContainerWhenDone(ctx context.Context, containerName string) chan<- struct{} {
+	stopped := make(chan struct{})
+
+	go func() {
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			c.logger.V(2).Info("Removing cancelled container", "containerName", containerName)
+			if output, err := c.nerdctl("rm", "--force", containerName).CombinedOutput(); err != nil {
+				c.logger.V(2).Info("Failed to remove container", "containerName", containerName, "error", err, "output", string(output))
+			}
+		}
+	}()
+
+	return stopped
+}
+
+func (c *ContainerdClient) nerdctl(args ...string) *exec.Cmd {
+	globalArgs := []string{"--namespace", c.namespace}
+	if c.address != "" {
+		globalArgs = append(globalArgs, "--address", c.address)
+	}
+
+	return exec.Command(c.NerdctlPath, append(globalArgs, args...)...)
+}
+
+// nerdctlRunArgs translates our options for running a container into the
+// arguments for `nerdctl run`.
+func nerdctlRunArgs(containerName string, imageName string, cmd []string, runContainerOpts *runContainerOptions) []string {
+	args := []string{"run", "--rm", "--name", containerName, "--pull", "never"}
+
+	if runContainerOpts.uid != "" {
+		args = append(args, "--user", runContainerOpts.uid)
+	}
+	for _, bind := range runContainerOpts.binds {
+		args = append(args, "--volume", bind)
+	}
+	for _, env := range runContainerOpts.env {
+		args = append(args, "--env", env)
+	}
+
+	if runContainerOpts.memoryBytes > 0 {
+		memory := strconv.FormatInt(runContainerOpts.memoryBytes, 10)
+		args = append(args, "--memory", memory, "--memory-swap", memory)
+	}
+	if runContainerOpts.nanoCPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(float64(runContainerOpts.nanoCPUs)/1e9, 'f', -1, 64))
+	}
+	if runContainerOpts.pidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.FormatInt(runContainerOpts.pidsLimit, 10))
+	}
+
+	if runContainerOpts.readOnlyRootFilesystem {
+		args = append(args, "--read-only")
+	}
+	if runContainerOpts.dropCapabilities {
+		args = append(args, "--cap-drop", "ALL")
+	}
+	if runContainerOpts.noNewPrivileges {
+		args = append(args, "--security-opt", "no-new-privileges")
+	}
+
+	// Sort so the args are deterministic.
+	var tmpfsPaths []string
+	for tmpfsPath := range runContainerOpts.tmpfs {
+		tmpfsPaths = append(tmpfsPaths, tmpfsPath)
+	}
+	sort.Strings(tmpfsPaths)
+	for _, tmpfsPath := range tmpfsPaths {
+		args = append(args, "--tmpfs", fmt.Sprintf("%s:%s", tmpfsPath, runContainerOpts.tmpfs[tmpfsPath]))
+	}
+
+	// Like docker's cli, nerdctl only accepts the entrypoint's binary, so
+	// any remaining entrypoint args precede the command.
+	if len(runContainerOpts.entrypoint) > 0 {
+		args = append(args, "--entrypoint", runContainerOpts.entrypoint[0])
+		cmd = append(append([]string{}, runContainerOpts.entrypoint[1:]...), cmd...)
+	}
+
+	args = append(args, imageName)
+	return append(args, cmd...)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	dockerclient "github.com/docker/docker/client"
+	"github.com/go-logr/logr"
+)
+
+// PodmanClient runs containers using podman, via podman's docker compatible
+// api. Podman implements enough of the docker api for our needs, so we reuse
+// the docker sdk rather than the libpod api.
+type PodmanClient struct {
+	*DockerClient
+}
+
+var _ ContainerClient = (*PodmanClient)(nil)
+
+// NewPodmanClient creates a client for the podman socket at `socketPath` (a
+// path, or a url like "unix:///run/podman/podman.sock"). If
+// `socketPath` is empty, we use the default socket for rootless podman if
+// it exists, and otherwise the default socket for rootful podman.
+func NewPodmanClient(socketPath string, logger logr.Logger) (*PodmanClient, error) {
+	if socketPath == "" {
+		socketPath = defaultPodmanSocketPath()
+	}
+
+	logger.V(3).Info("Creating podman client", "socketPath", socketPath)
+	dockerClient, err := newDockerClient(logger, dockerclient.WithHost(socketHost(socketPath)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PodmanClient{DockerClient: dockerClient}, nil
+}
+
+func defaultPodmanSocketPath() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		rootlessSocketPath := filepath.Join(runtimeDir, "podman", "podman.sock")
+		if _, err := os.Stat(rootlessSocketPath); err == nil {
+			return rootlessSocketPath
+		}
+	}
+
+	if os.Getuid() != 0 {
+		return fmt.Sprintf("/run/user/%d/podman/podman.sock", os.Getuid())
+	}
+
+	return "/run/podman/podman.sock"
+}
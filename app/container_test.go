@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -24,7 +26,7 @@ func TestDockerClientEnsureImageAvailableOnHostIntegration(t *testing.T) {
 		t.Fatalf("Error ensuring image didn't originally exist on host: %s", err)
 	}
 
-	err = dockerClient.EnsureImageAvailableOnHost(demoImageToPull)
+	err = dockerClient.EnsureImageAvailableOnHost(demoImageToPull, &pullImageOptions{})
 	if err != nil {
 		t.Fatalf("Error ensuring image available: %s", err)
 	}
@@ -48,7 +50,7 @@ func TestDockerClientEnsureImageAvailableOnHostImageAlreadyExistsIntegration(t *
 	}
 
 	for i := 0; i < 2; i++ {
-		err = dockerClient.EnsureImageAvailableOnHost(demoImageToPull)
+		err = dockerClient.EnsureImageAvailableOnHost(demoImageToPull, &pullImageOptions{})
 		if err != nil {
 			t.Fatalf("Error ensuring image available: %s", err)
 		}
@@ -65,7 +67,7 @@ func TestDockerClientEnsureImageAvailableOnHostFailsOnNonExistentImageIntegratio
 	}
 
 	nonExistentImageToTryAndPull := "alpine:blahblah"
-	err = dockerClient.EnsureImageAvailableOnHost(nonExistentImageToTryAndPull)
+	err = dockerClient.EnsureImageAvailableOnHost(nonExistentImageToTryAndPull, &pullImageOptions{})
 	if err == nil {
 		t.Fatal("Pulling non-existent image should've raised an error")
 	}
@@ -80,7 +82,7 @@ func TestDockerClientRunContainerIntegration(t *testing.T) {
 	}
 
 	demoImage := "alpine:edge"
-	err = dockerClient.EnsureImageAvailableOnHost(demoImage)
+	err = dockerClient.EnsureImageAvailableOnHost(demoImage, &pullImageOptions{})
 	if err != nil {
 		t.Fatalf("Error ensuring image available: %s", err)
 	}
@@ -89,7 +91,7 @@ func TestDockerClientRunContainerIntegration(t *testing.T) {
 		"/bin/true",
 	}
 
-	err = dockerClient.RunContainer(demoImage, alwaysSucceedCmd, &runContainerOptions{})
+	_, err = dockerClient.RunContainer(context.Background(), demoImage, alwaysSucceedCmd, &runContainerOptions{})
 	if err != nil {
 		t.Fatalf("Error running container: %s", err)
 	}
@@ -104,7 +106,7 @@ func TestDockerClientRunContainerFailsWhenContainerFailsIntegration(t *testing.T
 	}
 
 	demoImage := "alpine:edge"
-	err = dockerClient.EnsureImageAvailableOnHost(demoImage)
+	err = dockerClient.EnsureImageAvailableOnHost(demoImage, &pullImageOptions{})
 	if err != nil {
 		t.Fatalf("Error ensuring image available: %s", err)
 	}
@@ -113,7 +115,7 @@ func TestDockerClientRunContainerFailsWhenContainerFailsIntegration(t *testing.T
 		"/bin/false",
 	}
 
-	err = dockerClient.RunContainer(demoImage, alwaysFailCmd, &runContainerOptions{})
+	_, err = dockerClient.RunContainer(context.Background(), demoImage, alwaysFailCmd, &runContainerOptions{})
 	if err == nil {
 		t.Fatalf("Expected error running container with always fail command.")
 	}
@@ -128,7 +130,7 @@ func TestDockerClientRunContainerWithBindsIntegration(t *testing.T) {
 	}
 
 	demoImage := "alpine:edge"
-	err = dockerClient.EnsureImageAvailableOnHost(demoImage)
+	err = dockerClient.EnsureImageAvailableOnHost(demoImage, &pullImageOptions{})
 	if err != nil {
 		t.Fatalf("Error ensuring image available: %s", err)
 	}
@@ -151,7 +153,7 @@ func TestDockerClientRunContainerWithBindsIntegration(t *testing.T) {
 		binds: []string{fmt.Sprintf("%s:%s", tmpDirectoryPath, containerDirectoryPath)},
 	}
 
-	err = dockerClient.RunContainer(demoImage, writeTmpFileCmd, runOpts)
+	_, err = dockerClient.RunContainer(context.Background(), demoImage, writeTmpFileCmd, runOpts)
 	if err != nil {
 		t.Fatalf("Error running container: %s", err)
 	}
@@ -171,7 +173,7 @@ func TestDockerClientRunContainerWithUidIntegration(t *testing.T) {
 	}
 
 	demoImage := "alpine:edge"
-	err = dockerClient.EnsureImageAvailableOnHost(demoImage)
+	err = dockerClient.EnsureImageAvailableOnHost(demoImage, &pullImageOptions{})
 	if err != nil {
 		t.Fatalf("Error ensuring image available: %s", err)
 	}
@@ -196,7 +198,7 @@ func TestDockerClientRunContainerWithUidIntegration(t *testing.T) {
 		uid:   uid,
 	}
 
-	err = dockerClient.RunContainer(demoImage, writeTmpFileCmd, runOpts)
+	_, err = dockerClient.RunContainer(context.Background(), demoImage, writeTmpFileCmd, runOpts)
 	if err != nil {
 		t.Fatalf("Error running container: %s", err)
 	}
@@ -216,3 +218,64 @@ func TestDockerClientRunContainerWithUidIntegration(t *testing.T) {
 		t.Fatalf("Because we created file in containerized process running as host user, should be able to write to the file: %s", err)
 	}
 }
+
+func TestTailBuffer(t *testing.T) {
+	tailBuffer := newTailBuffer(5)
+	tailBuffer.Write([]byte("abc"))
+	tailBuffer.Write([]byte("defg"))
+
+	if tailBuffer.String() != "cdefg" {
+		t.Fatalf("Expected only the last 5 bytes, but got %q", tailBuffer.String())
+	}
+}
+
+// fakeNerdctl writes a script standing in for nerdctl, which fails to inspect
+// images with `inspectStderr` until they're pulled.
+func fakeNerdctl(t *testing.T, inspectStderr string) (*ContainerdClient, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	pulledPath := filepath.Join(dir, "pulled")
+	script := fmt.Sprintf(`#!/bin/sh
+case "$*" in
+  *"image inspect"*)
+    if [ -f %[1]q ]; then echo '[]'; exit 0; fi
+    echo %[2]q >&2; exit 1 ;;
+  *pull*) touch %[1]q ;;
+esac
+`, pulledPath, inspectStderr)
+
+	nerdctlPath := filepath.Join(dir, "nerdctl")
+	if err := ioutil.WriteFile(nerdctlPath, []byte(script), 0755); err != nil {
+		t.Fatalf("Error writing fake nerdctl: %s", err)
+	}
+
+	return &ContainerdClient{namespace: defaultContainerdNamespace, NerdctlPath: nerdctlPath, logger: testLogger}, pulledPath
+}
+
+func TestContainerdClientEnsureImageAvailableOnHostPullsMissingImage(t *testing.T) {
+	containerdClient, pulledPath := fakeNerdctl(t, `time="2026-10-19T00:00:00Z" level=fatal msg="1 errors:\nno such image: alpine:latest"`)
+
+	if err := containerdClient.EnsureImageAvailableOnHost("alpine:latest", &pullImageOptions{policy: ImagePullIfNotPresent}); err != nil {
+		t.Fatalf("Should be able to pull missing image: %s", err)
+	}
+
+	if _, err := os.Stat(pulledPath); err != nil {
+		t.Fatalf("Expected the missing image to be pulled: %s", err)
+	}
+}
+
+func TestContainerdClientEnsureImageAvailableOnHostFailsWhenInspectFails(t *testing.T) {
+	containerdClient, pulledPath := fakeNerdctl(t, `time="2026-10-19T00:00:00Z" level=fatal msg="cannot access containerd socket \"/run/containerd/containerd.sock\": permission denied"`)
+
+	for _, policy := range []ImagePullPolicy{ImagePullIfNotPresent, ImagePullNever} {
+		err := containerdClient.EnsureImageAvailableOnHost("alpine:latest", &pullImageOptions{policy: policy})
+		if err == nil || !strings.Contains(err.Error(), "permission denied") {
+			t.Fatalf("Expected the inspect error with pull policy %s, but got %v", policy, err)
+		}
+	}
+
+	if _, err := os.Stat(pulledPath); err == nil {
+		t.Fatal("Should not pull when we can't tell whether the image exists")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentCache remembers which remote files we've already uploaded, so
+// repeated requests for the same video can reuse the existing remote file
+// instead of downloading and uploading it again.
+type ContentCache interface {
+	// Acquire returns the remote files cached under the key and takes a
+	// reference on them, which prevents the garbage collector from
+	// deleting them until the reference is released.
+	Acquire(key string) (remoteFileNames []string, release func(), found bool)
+	// Store records that the content for the key is available as
+	// `remoteFileNames`.
+	Store(key string, remoteFileNames []string)
+	// Evict removes the remote file (and any other files cached under the
+	// same key) from the cache, if it's safe to delete (i.e. it has no
+	// references and hasn't been accessed since the cutoff). It returns
+	// whether the remote file may be deleted.
+	Evict(remoteFileName string, cutoffTime time.Time) bool
+}
+
+type cachedContent struct {
+	key             string
+	remoteFileNames []string
+	lastAccess      time.Time
+	references      int
+}
+
+// InMemoryContentCache keeps the cache in memory. Remote files uploaded before
+// the process (re)started are never reused, but the garbage collector still
+// deletes them as normal.
+type InMemoryContentCache struct {
+	mu               sync.Mutex
+	byKey            map[string]*cachedContent
+	byRemoteFileName map[string]*cachedContent
+
+	// now exists so tests can control the passage of time.
+	now func() time.Time
+}
+
+var _ ContentCache = (*InMemoryContentCache)(nil)
+
+func NewInMemoryContentCache() *InMemoryContentCache {
+	return &InMemoryContentCache{
+		byKey:            make(map[string]*cachedContent),
+		byRemoteFileName: make(map[string]*cachedContent),
+		now:              time.Now,
+	}
+}
+
+func (i *InMemoryContentCache) Acquire(key string) ([]string, func(), bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	content, found := i.byKey[key]
+	if !found {
+		return nil, nil, false
+	}
+
+	content.references++
+	content.lastAccess = i.now()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			i.mu.Lock()
+			defer i.mu.Unlock()
+
+			content.references--
+			content.lastAccess = i.now()
+		})
+	}
+
+	remoteFileNames := make([]string, len(content.remoteFileNames))
+	copy(remoteFileNames, content.remoteFileNames)
+
+	return remoteFileNames, release, true
+}
+
+func (i *InMemoryContentCache) Store(key string, remoteFileNames []string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if existing, found := i.byKey[key]; found {
+		i.remove(existing)
+	}
+
+	content := &cachedContent{
+		key:             key,
+		remoteFileNames: make([]string, len(remoteFileNames)),
+		lastAccess:      i.now(),
+	}
+	copy(content.remoteFileNames, remoteFileNames)
+
+	i.byKey[key] = content
+	for _, remoteFileName := range remoteFileNames {
+		i.byRemoteFileName[remoteFileName] = content
+	}
+}
+
+func (i *InMemoryContentCache) Evict(remoteFileName string, cutoffTime time.Time) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	content, found := i.byRemoteFileName[remoteFileName]
+	if !found {
+		return true
+	}
+
+	if content.references > 0 || content.lastAccess.After(cutoffTime) {
+		return false
+	}
+
+	// Once we delete any one of the files, the cached content is
+	// incomplete, so we can't reuse any of it.
+	i.remove(content)
+	return true
+}
+
+// remove removes the content from all of our indices. Must be called with `mu`
+// held.
+func (i *InMemoryContentCache) remove(content *cachedContent) {
+	for _, remoteFileName := range content.remoteFileNames {
+		if i.byRemoteFileName[remoteFileName] == content {
+			delete(i.byRemoteFileName, remoteFileName)
+		}
+	}
+
+	if i.byKey[content.key] == content {
+		delete(i.byKey, content.key)
+	}
+}
+
+// trackingQueryParams are query params which never change the video a url
+// refers to, so we drop them when normalizing urls.
+var trackingQueryParams = map[string]bool{
+	"feature": true,
+	"fbclid":  true,
+	"gclid":   true,
+	"si":      true,
+}
+
+// contentCacheKey generates the cache key for downloading `remotePath` with
+// the given options and transcoding profile. Urls which refer to the same
+// video should generate the same key.
+func contentCacheKey(remotePath string, downloadOptions *DownloadOptions, profileName string) string {
+	return fmt.Sprintf("%s|%s|profile=%s", normalizeRemotePath(remotePath), downloadOptions.cacheKey(), profileName)
+}
+
+func normalizeRemotePath(remotePath string) string {
+	parsedURL, err := url.Parse(strings.TrimSpace(remotePath))
+	if err != nil {
+		return remotePath
+	}
+
+	host := strings.ToLower(parsedURL.Hostname())
+	for _, prefix := range []string{"www.", "m.", "music."} {
+		host = strings.TrimPrefix(host, prefix)
+	}
+
+	if videoID := youtubeVideoID(host, parsedURL); videoID != "" {
+		// The same video can appear in many playlists, and we must not
+		// confuse them when downloading the whole playlist.
+		if playlistID := parsedURL.Query().Get("list"); playlistID != "" {
+			return fmt.Sprintf("youtube:%s?list=%s", videoID, playlistID)
+		}
+		return "youtube:" + videoID
+	}
+
+	query := parsedURL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if trackingQueryParams[key] || strings.HasPrefix(key, "utm_") {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	normalizedQuery := url.Values{}
+	for _, key := range keys {
+		normalizedQuery[key] = query[key]
+	}
+
+	normalized := host + strings.TrimSuffix(parsedURL.EscapedPath(), "/")
+	if len(normalizedQuery) > 0 {
+		normalized += "?" + normalizedQuery.Encode()
+	}
+
+	return normalized
+}
+
+// youtubeVideoID extracts the video id from the many different forms of
+// youtube url, or returns the empty string if the url isn't a youtube video.
+func youtubeVideoID(host string, parsedURL *url.URL) string {
+	switch host {
+	case "youtu.be":
+		return strings.Trim(parsedURL.Path, "/")
+	case "youtube.com", "youtube-nocookie.com":
+		if videoID := parsedURL.Query().Get("v"); videoID != "" {
+			return videoID
+		}
+
+		for _, prefix := range []string{"/shorts/", "/embed/", "/v/", "/live/"} {
+			if strings.HasPrefix(parsedURL.Path, prefix) {
+				return strings.Trim(strings.TrimPrefix(parsedURL.Path, prefix), "/")
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContentCacheKeyNormalizesEquivalentURLs(t *testing.T) {
+	downloadOptions := &DownloadOptions{audioOnly: true}
+
+	equivalentURLGroups := [][]string{
+		{
+			"https://www.youtube.com/watch?v=hLswuIQ5Tjk",
+			"https://youtube.com/watch?v=hLswuIQ5Tjk&feature=share",
+			"https://m.youtube.com/watch?v=hLswuIQ5Tjk",
+			"https://youtu.be/hLswuIQ5Tjk",
+			"https://www.youtube.com/shorts/hLswuIQ5Tjk",
+		},
+		{
+			"https://vimeo.com/12345?utm_source=email&b=2&a=1",
+			"https://www.vimeo.com/12345/?a=1&b=2",
+		},
+	}
+
+	for _, equivalentURLs := range equivalentURLGroups {
+		expectedKey := contentCacheKey(equivalentURLs[0], downloadOptions, "")
+		for _, equivalentURL := range equivalentURLs[1:] {
+			if key := contentCacheKey(equivalentURL, downloadOptions, ""); key != expectedKey {
+				t.Fatalf("Expected %q to have key %q, but got %q", equivalentURL, expectedKey, key)
+			}
+		}
+	}
+
+	if contentCacheKey(youtubeURL, downloadOptions, "") == contentCacheKey(youtubeURL, &DownloadOptions{}, "") {
+		t.Fatal("Different download options should generate different keys")
+	}
+
+	if contentCacheKey(youtubeURL, downloadOptions, "") == contentCacheKey("https://youtu.be/differentVideo", downloadOptions, "") {
+		t.Fatal("Different videos should generate different keys")
+	}
+
+	if contentCacheKey(youtubeURL, downloadOptions, "car") == contentCacheKey(youtubeURL, downloadOptions, "phone") {
+		t.Fatal("Different transcoding profiles should generate different keys")
+	}
+}
+
+func TestInMemoryContentCacheAcquireAndStore(t *testing.T) {
+	contentCache := NewInMemoryContentCache()
+
+	if _, _, found := contentCache.Acquire("key"); found {
+		t.Fatal("Should not find content which was never stored")
+	}
+
+	contentCache.Store("key", []string{"remote-file.mp3"})
+
+	remoteFileNames, release, found := contentCache.Acquire("key")
+	if !found {
+		t.Fatal("Should find stored content")
+	}
+	defer release()
+
+	if len(remoteFileNames) != 1 || remoteFileNames[0] != "remote-file.mp3" {
+		t.Fatalf("Expected [remote-file.mp3], but got %v", remoteFileNames)
+	}
+}
+
+func TestInMemoryContentCacheEvict(t *testing.T) {
+	contentCache := NewInMemoryContentCache()
+
+	now := time.Now()
+	contentCache.now = func() time.Time { return now }
+
+	if !contentCache.Evict("never-cached.mp3", now) {
+		t.Fatal("Should be able to evict files which were never cached")
+	}
+
+	contentCache.Store("key", []string{"remote-file.mp3", "other-remote-file.mp3"})
+	_, release, _ := contentCache.Acquire("key")
+
+	now = now.Add(48 * time.Hour)
+	cutoffTime := now.Add(-24 * time.Hour)
+	if contentCache.Evict("remote-file.mp3", cutoffTime) {
+		t.Fatal("Should not be able to evict files with active references")
+	}
+
+	release()
+	if contentCache.Evict("remote-file.mp3", cutoffTime) {
+		t.Fatal("Should not be able to evict files accessed after the cutoff")
+	}
+
+	now = now.Add(48 * time.Hour)
+	cutoffTime = now.Add(-24 * time.Hour)
+	if !contentCache.Evict("remote-file.mp3", cutoffTime) {
+		t.Fatal("Should be able to evict unreferenced files last accessed before the cutoff")
+	}
+
+	if _, _, found := contentCache.Acquire("key"); found {
+		t.Fatal("Should not find evicted content")
+	}
+
+	if !contentCache.Evict("other-remote-file.mp3", cutoffTime) {
+		t.Fatal("Evicting one file should evict all files cached under the same key")
+	}
+}
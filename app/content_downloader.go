@@ -1,18 +1,36 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultAudioFormat = "mp3"
 
+// youtubeDlMountDirectory is the directory in the container to which youtube-dl
+// writes downloads. Must match the published container.
+const youtubeDlMountDirectory = "/downloads"
+
+// youtubeDlInfoFileSuffix is the suffix of the metadata files youtube-dl
+// writes when passed `--write-info-json`.
+const youtubeDlInfoFileSuffix = ".info.json"
+
 type ContentDownloader interface {
-	DownloadContent(remotePath string, downloadOptions *DownloadOptions) (string, error)
+	// DownloadContent downloads the content at `remotePath` and returns the
+	// paths of all files created on the local file system. Most remote
+	// paths result in a single file, but playlists can result in many.
+	DownloadContent(ctx context.Context, remotePath string, downloadOptions *DownloadOptions) ([]string, error)
 
 	// BestEffortInit contains non-critical operations which, if run before
 	// the first call of `DownloadContent`, improve performance.
@@ -21,13 +39,195 @@ type ContentDownloader interface {
 
 type DownloadOptions struct {
 	audioOnly bool
+
+	// maxDuration, if non-zero, causes the download to fail for any video
+	// (or clip, see `maxSourceDuration`) longer than maxDuration.
+	maxDuration time.Duration
+
+	// playlist indicates we should download every video in a playlist,
+	// rather than just the single video the url references.
+	playlist bool
+	// playlistItems optionally selects which items in the playlist we
+	// download, using youtube-dl's syntax (i.e. "1-3,7"). See
+	// `validatePlaylistItems`.
+	playlistItems string
+	// maxPlaylistItems caps the number of items we download from a
+	// playlist, when `playlistItems` isn't set.
+	maxPlaylistItems int
+
+	// clipStart and clipEnd, if non-zero, restrict the download to a
+	// segment of the video. A zero clipEnd means the end of the video.
+	clipStart time.Duration
+	clipEnd   time.Duration
+
+	// subtitleLanguages, if set, are the languages of the subtitles we
+	// download alongside the video (i.e. "en", "es").
+	subtitleLanguages []string
+	// autoSubtitles allows falling back to automatically generated
+	// subtitles for languages without subtitles written by a person.
+	autoSubtitles bool
+	// embedSubtitles embeds the subtitles in the video, rather than
+	// uploading them as separate .srt files.
+	embedSubtitles bool
+
+	// embedThumbnail embeds the video's thumbnail and metadata tags (i.e.
+	// title and artist) in audio files.
+	embedThumbnail bool
+}
+
+// clipping returns whether the user only wants a segment of the video.
+func (d *DownloadOptions) clipping() bool {
+	return d.clipStart != 0 || d.clipEnd != 0
+}
+
+// maxSourceDuration returns the longest video we may download, or zero if any
+// video is fine. When clipping, `maxDuration` limits the clip rather than the
+// video: clips with an end were already checked by `validateClip`, and clips
+// running to the end of the video are only short enough if the video is.
+func (d *DownloadOptions) maxSourceDuration() time.Duration {
+	if d.maxDuration == 0 || !d.clipping() {
+		return d.maxDuration
+	}
+
+	if d.clipEnd != 0 {
+		return 0
+	}
+
+	return d.clipStart + d.maxDuration
+}
+
+// tooLongError is the error we show users when youtube-dl skips a video for
+// being longer than `maxSourceDuration`.
+func (d *DownloadOptions) tooLongError() error {
+	if d.clipping() {
+		return newUserError("errors.clip.too_long", formatTimestamp(d.maxDuration))
+	}
+
+	return newUserError("errors.quota.video_too_long", formatTimestamp(d.maxDuration))
+}
+
+// maxDownloadsPerURL returns the most videos we may download for a single url,
+// so we can charge the client's quota for all of them up front. We can't know
+// the size of an unlimited playlist without asking youtube-dl, so we count it
+// as a single video. That's only safe without job limits, which
+// `config.validate` ensures.
+func (d *DownloadOptions) maxDownloadsPerURL() int {
+	if !d.playlist {
+		return 1
+	}
+
+	if d.playlistItems != "" {
+		if numItems, err := countPlaylistItems(d.playlistItems); err == nil {
+			return numItems
+		}
+	}
+
+	if d.maxPlaylistItems > 0 {
+		return d.maxPlaylistItems
+	}
+
+	return 1
+}
+
+// cacheKey identifies all of the options which change the downloaded content,
+// so we can tell when two downloads would produce the same file. maxDuration
+// doesn't change the content, but we include it so reusing cached content can
+// never bypass a client's duration limit.
+func (d *DownloadOptions) cacheKey() string {
+	key := fmt.Sprintf("audioOnly=%t,maxDuration=%s", d.audioOnly, d.maxDuration)
+	if d.playlist {
+		key += fmt.Sprintf(",playlistItems=%s,maxPlaylistItems=%d", d.playlistItems, d.maxPlaylistItems)
+	}
+	if d.clipping() {
+		key += fmt.Sprintf(",clipStart=%s,clipEnd=%s", d.clipStart, d.clipEnd)
+	}
+	if len(d.subtitleLanguages) > 0 {
+		key += fmt.Sprintf(",subtitles=%s,autoSubtitles=%t,embedSubtitles=%t", strings.Join(d.subtitleLanguages, "+"), d.autoSubtitles, d.embedSubtitles)
+	}
+	if d.embedThumbnail {
+		key += ",embedThumbnail=true"
+	}
+
+	return key
+}
+
+// playlistItemsRegexp matches youtube-dl's `--playlist-items` syntax: a comma
+// separated list of indices and ranges of indices.
+var playlistItemsRegexp = regexp.MustCompile(`^[1-9][0-9]*(-[1-9][0-9]*)?(,[1-9][0-9]*(-[1-9][0-9]*)?)*$`)
+
+// validatePlaylistItems ensures `playlistItems` is valid `--playlist-items`
+// syntax selecting at most `maxPlaylistItems` items.
+func validatePlaylistItems(playlistItems string, maxPlaylistItems int) error {
+	if !playlistItemsRegexp.MatchString(playlistItems) {
+		return newUserError("errors.playlist.invalid_items")
+	}
+
+	numItems, err := countPlaylistItems(playlistItems)
+	if err != nil {
+		return err
+	}
+
+	if maxPlaylistItems > 0 && numItems > maxPlaylistItems {
+		return newUserError("errors.playlist.too_many_items", maxPlaylistItems)
+	}
+
+	return nil
+}
+
+// countPlaylistItems returns the number of items `playlistItems` selects, which
+// must already match `playlistItemsRegexp`.
+func countPlaylistItems(playlistItems string) (int, error) {
+	numItems := 0
+	for _, itemRange := range strings.Split(playlistItems, ",") {
+		bounds := strings.Split(itemRange, "-")
+
+		start, _ := strconv.Atoi(bounds[0])
+		end := start
+		if len(bounds) == 2 {
+			end, _ = strconv.Atoi(bounds[1])
+		}
+
+		if end < start {
+			return 0, newUserError("errors.playlist.decreasing_range", itemRange)
+		}
+		numItems += end - start + 1
+	}
+
+	return numItems, nil
 }
 
 type ContainerYoutubeDlContentDownloader struct {
-	containerClient    ContainerClient
-	fsClient           FsClient
-	logger             logr.Logger
+	containerClient ContainerClient
+	fsClient        FsClient
+	logger          logr.Logger
+
+	// YoutubeDlImageName may only be set before the first download. Use
+	// `SetYoutubeDlImageName` afterwards.
 	YoutubeDlImageName string
+	imageNameMu        sync.RWMutex
+
+	// imageOutcomes tracks how well downloads go with each image, so we
+	// can roll back image updates which break downloads.
+	imageOutcomes *imageOutcomeTracker
+
+	// imageEnsured and imageEnsureErr record our most recent attempt at
+	// ensuring the youtube-dl image is available, for our readiness checks.
+	imageEnsured   bool
+	imageEnsureErr error
+	imageEnsureMu  sync.Mutex
+
+	// Sandbox restricts the containers in which we run youtube-dl and
+	// ffmpeg.
+	Sandbox ContainerSandbox
+
+	// ImagePullPolicy and RegistryCredentials control how we pull
+	// `YoutubeDlImageName`.
+	ImagePullPolicy     ImagePullPolicy
+	RegistryCredentials *RegistryCredentials
+
+	// Extractors, if set, restricts the youtube-dl extractors with which
+	// we download.
+	Extractors *ExtractorFilter
 }
 
 type FakeContentDownloader struct {
@@ -54,38 +254,242 @@ func NewContainerYoutubeDlContentDownloader(containerClient ContainerClient, fsC
 
 		// Can set via constructor/setting later, should we find the need.
 		YoutubeDlImageName: "mattjmcnaughton/youtube-dl:2020.05.29",
+		Sandbox:            defaultContainerSandbox(),
+		ImagePullPolicy:    ImagePullIfNotPresent,
+
+		imageOutcomes: newImageOutcomeTracker(),
 	}
 }
 
-func (c *ContainerYoutubeDlContentDownloader) DownloadContent(remotePath string, downloadOptions *DownloadOptions) (string, error) {
-	c.logger.V(3).Info("Downloading content using ContainerYoutubeDl", "remotePath", remotePath)
+// SetYoutubeDlImageName atomically switches the image used by all future
+// downloads. Downloads already in progress finish with the previous image.
+func (c *ContainerYoutubeDlContentDownloader) SetYoutubeDlImageName(imageName string) {
+	c.imageNameMu.Lock()
+	defer c.imageNameMu.Unlock()
+
+	c.YoutubeDlImageName = imageName
+}
+
+func (c *ContainerYoutubeDlContentDownloader) youtubeDlImageName() string {
+	c.imageNameMu.RLock()
+	defer c.imageNameMu.RUnlock()
+
+	return c.YoutubeDlImageName
+}
+
+func (c *ContainerYoutubeDlContentDownloader) DownloadContent(ctx context.Context, remotePath string, downloadOptions *DownloadOptions) ([]string, error) {
+	ctx, span := startSpan(ctx, "download", attribute.String("vidzou.url", remotePath))
+	startedAt := time.Now()
+	filePaths, err := c.downloadContent(ctx, remotePath, downloadOptions)
+	observeDuration(downloadDurationSeconds, startedAt, err)
+	endSpan(span, err)
+
+	return filePaths, err
+}
+
+func (c *ContainerYoutubeDlContentDownloader) downloadContent(ctx context.Context, remotePath string, downloadOptions *DownloadOptions) ([]string, error) {
+	// We use the same image for the whole download, even if the image is
+	// updated mid download.
+	imageName := c.youtubeDlImageName()
+	c.logger.V(3).Info("Downloading content using ContainerYoutubeDl", "remotePath", remotePath, "imageName", imageName)
 
 	// When we launch the server, we kick off a background go routine to
 	// ensure the image is available on the host. As a result, this call
 	// should be a no-op the majority of the time. Still, there's no harm to
 	// having it for additional protection.
-	if err := c.containerClient.EnsureImageAvailableOnHost(c.YoutubeDlImageName); err != nil {
-		return "", err
+	if err := c.ensureImageAvailable(ctx, imageName); err != nil {
+		return nil, err
 	}
 
-	// Mount directory should be specified as contant? Must match the
-	// published container.
-	youtubeDlMountDirectory := "/downloads"
+	if err := c.inspectVideos(ctx, imageName, remotePath, downloadOptions); err != nil {
+		return nil, err
+	}
 
 	// We will use this unique prefix for identifying the file on the file
 	// system (as we can't predict the title, extension, etc...)
 	uniqueOutputFilePrefix := generateRandomString(8)
 	fileNameTemplate := fmt.Sprintf("%s/%s-%%(title)s.%%(ext)s", youtubeDlMountDirectory, uniqueOutputFilePrefix)
+	if downloadOptions.playlist {
+		// Include the index so files sort in playlist order, and so
+		// videos with the same title don't overwrite each other.
+		fileNameTemplate = fmt.Sprintf("%s/%s-%%(playlist_index)s-%%(title)s.%%(ext)s", youtubeDlMountDirectory, uniqueOutputFilePrefix)
+	}
 	c.logger.V(3).Info("Generated fileNameTemplate", "fileNameTemplate", fileNameTemplate)
 
-	cmd := []string{"-o", fileNameTemplate, remotePath}
+	// The `--` ensures youtube-dl never interprets the remote path as an
+	// option, regardless of any validation done by our caller.
+	cmd := []string{"-o", fileNameTemplate, "--", remotePath}
 	if downloadOptions.audioOnly {
 		c.logger.V(2).Info("Restricting download to audio only")
 		audioOnlyYoutubeDlOptions := []string{"-x", "--audio-format", defaultAudioFormat}
 		cmd = append(audioOnlyYoutubeDlOptions, cmd...)
+
+		if downloadOptions.embedThumbnail {
+			c.logger.V(2).Info("Embedding thumbnail and metadata")
+			cmd = append([]string{"--embed-thumbnail", "--add-metadata"}, cmd...)
+		}
+	}
+	if subtitleOptions := subtitleYoutubeDlOptions(downloadOptions); subtitleOptions != nil {
+		c.logger.V(2).Info("Downloading subtitles", "languages", downloadOptions.subtitleLanguages, "embed", downloadOptions.embedSubtitles)
+		cmd = append(subtitleOptions, cmd...)
+	}
+	maxSourceDuration := downloadOptions.maxSourceDuration()
+	if maxSourceDuration > 0 {
+		// youtube-dl checks the filter against the video's metadata
+		// before downloading, so we don't waste time/bandwidth on
+		// videos which are too long. Videos which don't pass the filter
+		// are skipped (see `skippedByMatchFilter`), so we will fail to
+		// find the file afterwards.
+		c.logger.V(2).Info("Restricting download to max duration", "maxDuration", downloadOptions.maxDuration, "maxSourceDuration", maxSourceDuration)
+		maxDurationOptions := []string{"--match-filter", fmt.Sprintf("duration <= %d", int(maxSourceDuration.Seconds()))}
+		cmd = append(maxDurationOptions, cmd...)
+	}
+	if downloadOptions.clipping() {
+		// We need the video's duration to validate the clip.
+		cmd = append([]string{"--write-info-json"}, cmd...)
+	}
+	if c.Sandbox.MaxFileSizeMB > 0 {
+		cmd = append([]string{"--max-filesize", fmt.Sprintf("%dm", c.Sandbox.MaxFileSizeMB)}, cmd...)
 	}
+	cmd = append(playlistYoutubeDlOptions(downloadOptions), cmd...)
 	c.logger.V(3).Info("Issuing the following args to the containerized youtube dl process", "args", cmd)
 
+	result, runErr := c.runContainer(ctx, "youtube-dl", imageName, cmd, c.runContainerOptions())
+	if result != nil {
+		c.logger.V(3).Info("youtube-dl finished", "remotePath", remotePath, "exitCode", result.exitCode, "duration", result.duration)
+	}
+	if runErr != nil {
+		runErr = c.youtubeDlError(remotePath, result, runErr)
+	}
+	c.imageOutcomes.record(imageName, runErr)
+	if runErr != nil && !downloadOptions.playlist {
+		return nil, runErr
+	}
+
+	_, findSpan := startSpan(ctx, "files.discover")
+	filePaths, err := c.findFilesUsingUniqueIdentifier(uniqueOutputFilePrefix)
+	findSpan.SetAttributes(attribute.Int("vidzou.num_files", len(filePaths)))
+	endSpan(findSpan, err)
+	if err != nil {
+		// For playlists, youtube-dl exits non-zero if any item fails,
+		// so we only consider the download failed if no items
+		// succeeded.
+		if runErr != nil {
+			return nil, runErr
+		}
+		if maxSourceDuration > 0 && result != nil && skippedByMatchFilter(result.stdout) {
+			c.logger.V(2).Info("youtube-dl skipped videos longer than the max duration", "remotePath", remotePath, "maxSourceDuration", maxSourceDuration)
+			return nil, downloadOptions.tooLongError()
+		}
+		return nil, err
+	}
+
+	if runErr != nil {
+		c.logger.V(2).Info("Some playlist items failed to download", "remotePath", remotePath, "error", runErr)
+	}
+
+	filePaths, infoFilePaths := splitInfoFiles(filePaths)
+	defer removeFiles(infoFilePaths)
+
+	if downloadOptions.clipping() {
+		for _, filePath := range filePaths {
+			if err := c.clipFile(ctx, filePath, downloadOptions); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return filePaths, nil
+}
+
+// videoSummaryTemplate is the output template with which `inspectVideos` asks
+// youtube-dl about each video. We'd rather use `--dump-json`, but its output
+// for a single video can be larger than we capture.
+const videoSummaryTemplate = "%(extractor_key)s %(duration)s"
+
+// inspectVideos asks youtube-dl about every video it would download for
+// `remotePath` (without downloading anything), so we can refuse downloads we
+// know would fail before spending time/bandwidth on them. It returns an
+// `*InvalidURLError` if `Extractors` refuses any video's extractor, and a
+// `*UserError` if any video is too short (or too long) for the clip. We only ask
+// when we need to, as it costs an extra container run.
+func (c *ContainerYoutubeDlContentDownloader) inspectVideos(ctx context.Context, imageName string, remotePath string, downloadOptions *DownloadOptions) error {
+	if !c.Extractors.enabled() && !downloadOptions.clipping() {
+		return nil
+	}
+
+	cmd := append(playlistYoutubeDlOptions(downloadOptions), "--skip-download", "--get-filename", "-o", videoSummaryTemplate, "--", remotePath)
+	c.logger.V(3).Info("Issuing the following args to the containerized youtube dl process", "args", cmd)
+
+	// Playlists can mix extractors and durations, so we check every item
+	// we would download. With `--ignore-errors`, youtube-dl still
+	// summarizes the items it can.
+	result, err := c.runContainer(ctx, "youtube-dl", imageName, cmd, c.runContainerOptions())
+	if err != nil && (!downloadOptions.playlist || result == nil) {
+		return c.youtubeDlError(remotePath, result, err)
+	}
+
+	for _, line := range strings.Split(result.stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		extractor := fields[0]
+		if err := c.Extractors.Validate(extractor); err != nil {
+			c.logger.V(2).Info("Refusing to download with extractor", "remotePath", remotePath, "extractor", extractor)
+			return err
+		}
+
+		if downloadOptions.clipping() && len(fields) > 1 {
+			// youtube-dl prints "NA" for videos without a duration
+			// (i.e. live streams), which we can't validate.
+			seconds, parseErr := strconv.ParseFloat(fields[1], 64)
+			if parseErr != nil {
+				continue
+			}
+
+			videoDuration := time.Duration(seconds * float64(time.Second))
+			if err := validateClipForVideo(downloadOptions.clipStart, downloadOptions.clipEnd, downloadOptions.maxDuration, videoDuration); err != nil {
+				c.logger.V(2).Info("Refusing to clip video", "remotePath", remotePath, "videoDuration", videoDuration, "error", err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// youtubeDlError converts a failed youtube-dl run into a `*YoutubeDlError`,
+// when the failure was youtube-dl's (rather than the container runtime's).
+func (c *ContainerYoutubeDlContentDownloader) youtubeDlError(remotePath string, result *runContainerResult, runErr error) error {
+	if _, ok := runErr.(*ContainerExitError); !ok || result == nil {
+		return runErr
+	}
+
+	youtubeDlErr := classifyYoutubeDlError(result.stderr)
+	c.logger.V(2).Info("youtube-dl failed", "remotePath", remotePath, "exitCode", result.exitCode, "kind", youtubeDlErr.Kind, "detail", youtubeDlErr.Detail, "stderr", result.stderr)
+
+	return youtubeDlErr
+}
+
+// runContainer runs the container, tracking it in our active containers metric
+// under `command`.
+func (c *ContainerYoutubeDlContentDownloader) runContainer(ctx context.Context, command string, imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
+	_, span := startSpan(ctx, "container.run", attribute.String("vidzou.container_command", command), attribute.String("vidzou.image", imageName))
+	activeContainers.WithLabelValues(command).Inc()
+	defer activeContainers.WithLabelValues(command).Dec()
+
+	result, err := c.containerClient.RunContainer(ctx, imageName, cmd, runContainerOpts)
+	if result != nil {
+		span.SetAttributes(attribute.Int("vidzou.exit_code", result.exitCode))
+	}
+	endSpan(span, err)
+
+	return result, err
+}
+
+func (c *ContainerYoutubeDlContentDownloader) runContainerOptions() *runContainerOptions {
 	binds := []string{
 		fmt.Sprintf("%s:%s", c.fsClient.GetMountDirectory(), youtubeDlMountDirectory),
 	}
@@ -93,35 +497,224 @@ func (c *ContainerYoutubeDlContentDownloader) DownloadContent(remotePath string,
 	runContainerOpts := &runContainerOptions{
 		binds: binds,
 	}
+	c.Sandbox.apply(runContainerOpts)
+
+	return runContainerOpts
+}
+
+// clipFile replaces the downloaded file with the segment the user asked for.
+// We cut the clip using the ffmpeg shipped in the youtube-dl image, so the host
+// doesn't need ffmpeg installed.
+func (c *ContainerYoutubeDlContentDownloader) clipFile(ctx context.Context, filePath string, downloadOptions *DownloadOptions) error {
+	var videoDuration time.Duration
+	info, err := readYoutubeDlInfo(infoFilePathFor(filePath))
+	if err != nil {
+		// Not fatal... we just can't validate the clip as thoroughly.
+		c.logger.V(2).Info("Unable to read video metadata", "filePath", filePath, "error", err)
+	} else {
+		videoDuration = info.duration()
+	}
+
+	clipArgs, err := clipFfmpegArgs(downloadOptions.clipStart, downloadOptions.clipEnd, videoDuration)
+	if err != nil {
+		return err
+	}
+
+	clipFilePath := path.Join(path.Dir(filePath), "clip-"+path.Base(filePath))
+
+	c.logger.V(2).Info("Clipping downloaded file", "filePath", filePath)
+	if err := c.runFfmpeg(ctx, clipArgs, filePath, clipOutputArgs(filePath, downloadOptions.audioOnly), clipFilePath); err != nil {
+		return err
+	}
+
+	return os.Rename(clipFilePath, filePath)
+}
+
+// clipOutputArgs returns the ffmpeg options for writing the clip of the file.
+func clipOutputArgs(filePath string, audioOnly bool) []string {
+	if isSubtitleFile(filePath) {
+		// Subtitle sidecars only contain text, which is cheap to
+		// re-encode, so we don't rely on ffmpeg copying subtitle
+		// streams.
+		return []string{"-c:s", "srt"}
+	}
+
+	if audioOnly {
+		// We map every stream, so we keep any embedded thumbnail. Audio
+		// is cheap to re-encode, so we let ffmpeg do so for a precise
+		// cut.
+		return []string{"-map", "0", "-c:v", "copy"}
+	}
+
+	// We map every stream, so we keep all embedded subtitles, rather than
+	// just ffmpeg's favourite. Re-encoding video is slow, so we copy the
+	// streams, which means the clip can only start on a keyframe.
+	return []string{"-map", "0", "-c", "copy"}
+}
+
+// TranscodeContent converts a downloaded file according to the profile. Like
+// clipping, we use the ffmpeg shipped in the youtube-dl image.
+func (c *ContainerYoutubeDlContentDownloader) TranscodeContent(ctx context.Context, localFilePath string, profile *TranscodingProfile) (string, error) {
+	if !profile.transcodes() {
+		return localFilePath, nil
+	}
 
-	if err := c.containerClient.RunContainer(c.YoutubeDlImageName, cmd, runContainerOpts); err != nil {
+	// ffmpeg can't write to the file it's reading, and the input and
+	// output may have the same extension, so we write to a temporary file
+	// first.
+	transcodedFilePath := profile.outputFilePath(localFilePath)
+	tmpFilePath := path.Join(path.Dir(transcodedFilePath), "transcode-"+path.Base(transcodedFilePath))
+
+	c.logger.V(2).Info("Transcoding downloaded file", "localFilePath", localFilePath, "profile", profile.Name)
+	if err := c.runFfmpeg(ctx, nil, localFilePath, profile.FfmpegArgs, tmpFilePath); err != nil {
+		return "", err
+	}
+
+	os.Remove(localFilePath)
+	if err := os.Rename(tmpFilePath, transcodedFilePath); err != nil {
 		return "", err
 	}
 
-	return c.findFileUsingUniqueIdentifier(uniqueOutputFilePrefix)
+	return transcodedFilePath, nil
 }
 
-// We will use this unique prefix for identifying the file on the file
+// runFfmpeg runs ffmpeg in the youtube-dl image. The input and output files
+// must be in our mount directory. `inputArgs` apply to reading the input file,
+// and `outputArgs` to writing the output file.
+func (c *ContainerYoutubeDlContentDownloader) runFfmpeg(ctx context.Context, inputArgs []string, inputFilePath string, outputArgs []string, outputFilePath string) error {
+	args := []string{"-y", "-loglevel", "error"}
+	args = append(args, inputArgs...)
+	args = append(args, "-i", path.Join(youtubeDlMountDirectory, path.Base(inputFilePath)))
+	args = append(args, outputArgs...)
+	args = append(args, path.Join(youtubeDlMountDirectory, path.Base(outputFilePath)))
+
+	c.logger.V(3).Info("Issuing the following args to the containerized ffmpeg process", "args", args)
+	runContainerOpts := c.runContainerOptions()
+	runContainerOpts.entrypoint = []string{"ffmpeg"}
+
+	_, err := c.runContainer(ctx, "ffmpeg", c.youtubeDlImageName(), args, runContainerOpts)
+	if exitErr, ok := err.(*ContainerExitError); ok {
+		c.logger.V(2).Info("ffmpeg failed", "exitCode", exitErr.ExitCode, "stderr", exitErr.Stderr)
+		return fmt.Errorf("ffmpeg failed: %s", lastNonEmptyLine(exitErr.Stderr))
+	}
+
+	return err
+}
+
+// splitInfoFiles separates the metadata files youtube-dl writes from the
+// actual downloaded files.
+func splitInfoFiles(allFilePaths []string) (filePaths, infoFilePaths []string) {
+	for _, filePath := range allFilePaths {
+		if strings.HasSuffix(filePath, youtubeDlInfoFileSuffix) {
+			infoFilePaths = append(infoFilePaths, filePath)
+		} else {
+			filePaths = append(filePaths, filePath)
+		}
+	}
+
+	return filePaths, infoFilePaths
+}
+
+// infoFilePathFor returns the path of the metadata file youtube-dl writes for
+// the downloaded file, which shares the downloaded file's name (minus the
+// extension, and the language for subtitles).
+func infoFilePathFor(filePath string) string {
+	basePath := strings.TrimSuffix(filePath, path.Ext(filePath))
+	if isSubtitleFile(filePath) {
+		basePath = strings.TrimSuffix(basePath, path.Ext(basePath))
+	}
+
+	return basePath + youtubeDlInfoFileSuffix
+}
+
+func removeFiles(filePaths []string) {
+	for _, filePath := range filePaths {
+		os.Remove(filePath)
+	}
+}
+
+// playlistYoutubeDlOptions translates our playlist options into youtube-dl
+// options.
+func playlistYoutubeDlOptions(downloadOptions *DownloadOptions) []string {
+	if !downloadOptions.playlist {
+		// Without this option, a url referencing a video within a
+		// playlist (i.e. `watch?v=...&list=...`) downloads the entire
+		// playlist.
+		return []string{"--no-playlist"}
+	}
+
+	// `--ignore-errors` ensures one unavailable video doesn't prevent us
+	// from downloading the rest of the playlist.
+	options := []string{"--yes-playlist", "--ignore-errors"}
+	if downloadOptions.playlistItems != "" {
+		options = append(options, "--playlist-items", downloadOptions.playlistItems)
+	} else if downloadOptions.maxPlaylistItems > 0 {
+		options = append(options, "--playlist-end", strconv.Itoa(downloadOptions.maxPlaylistItems))
+	}
+
+	return options
+}
+
+// We will use this unique prefix for identifying the files on the file
 // system (as we can't predict the title, extension, etc...)
-func (c *ContainerYoutubeDlContentDownloader) findFileUsingUniqueIdentifier(uniqueOutputFilePrefix string) (string, error) {
-	c.logger.V(3).Info("Identifying file using unique id", "uniqueIdentifier", uniqueOutputFilePrefix)
+func (c *ContainerYoutubeDlContentDownloader) findFilesUsingUniqueIdentifier(uniqueOutputFilePrefix string) ([]string, error) {
+	c.logger.V(3).Info("Identifying files using unique id", "uniqueIdentifier", uniqueOutputFilePrefix)
 
 	filesInDir, err := ioutil.ReadDir(c.fsClient.GetMountDirectory())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
+	var filePaths []string
 	for _, f := range filesInDir {
 		if strings.HasPrefix(f.Name(), uniqueOutputFilePrefix) {
-			return path.Join(c.fsClient.GetMountDirectory(), f.Name()), nil
+			filePaths = append(filePaths, path.Join(c.fsClient.GetMountDirectory(), f.Name()))
 		}
 	}
 
-	return "", fmt.Errorf("Cannot identify file with unique prefix: %s", uniqueOutputFilePrefix)
+	if len(filePaths) == 0 {
+		return nil, fmt.Errorf("Cannot identify file with unique prefix: %s", uniqueOutputFilePrefix)
+	}
+
+	sort.Strings(filePaths)
+	return filePaths, nil
 }
 
 func (c *ContainerYoutubeDlContentDownloader) BestEffortInit() error {
-	return c.containerClient.EnsureImageAvailableOnHost(c.YoutubeDlImageName)
+	return c.ensureImageAvailable(context.Background(), c.youtubeDlImageName())
+}
+
+func (c *ContainerYoutubeDlContentDownloader) ensureImageAvailable(ctx context.Context, imageName string) error {
+	_, span := startSpan(ctx, "image.ensure", attribute.String("vidzou.image", imageName), attribute.String("vidzou.pull_policy", string(c.ImagePullPolicy)))
+	err := c.containerClient.EnsureImageAvailableOnHost(imageName, c.pullImageOptions())
+	endSpan(span, err)
+
+	c.imageEnsureMu.Lock()
+	defer c.imageEnsureMu.Unlock()
+	c.imageEnsured = true
+	c.imageEnsureErr = err
+
+	return err
+}
+
+// ImageAvailable returns an error unless our most recent attempt at ensuring
+// the youtube-dl image is available (i.e. `BestEffortInit`) succeeded.
+func (c *ContainerYoutubeDlContentDownloader) ImageAvailable() error {
+	c.imageEnsureMu.Lock()
+	defer c.imageEnsureMu.Unlock()
+
+	if !c.imageEnsured {
+		return fmt.Errorf("Still ensuring the youtube-dl image is available")
+	}
+
+	return c.imageEnsureErr
+}
+
+func (c *ContainerYoutubeDlContentDownloader) pullImageOptions() *pullImageOptions {
+	return &pullImageOptions{
+		policy:      c.ImagePullPolicy,
+		credentials: c.RegistryCredentials,
+	}
 }
 
 func NewFakeContentDownloader(fsClient FsClient) *FakeContentDownloader {
@@ -130,17 +723,28 @@ func NewFakeContentDownloader(fsClient FsClient) *FakeContentDownloader {
 	}
 }
 
-func (f *FakeContentDownloader) DownloadContent(remotePath string, downloadOptions *DownloadOptions) (string, error) {
+func (f *FakeContentDownloader) DownloadContent(ctx context.Context, remotePath string, downloadOptions *DownloadOptions) ([]string, error) {
 	fakeFileDownloadPath := path.Join(f.fsClient.GetMountDirectory(), generateRandomString(16))
 	fakeFileContents := []byte("hi everyone\n")
 	var defaultFilePerm os.FileMode = 0644
 
 	err := ioutil.WriteFile(fakeFileDownloadPath, fakeFileContents, defaultFilePerm)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	filePaths := []string{fakeFileDownloadPath}
+
+	if !downloadOptions.embedSubtitles {
+		for _, language := range downloadOptions.subtitleLanguages {
+			subtitleFilePath := fmt.Sprintf("%s.%s.%s", fakeFileDownloadPath, language, subtitleFileExtension)
+			if err := ioutil.WriteFile(subtitleFilePath, []byte("1\n00:00:00,000 --> 00:00:01,000\nhi everyone\n"), defaultFilePerm); err != nil {
+				return nil, err
+			}
+			filePaths = append(filePaths, subtitleFilePath)
+		}
 	}
 
-	return fakeFileDownloadPath, nil
+	return filePaths, nil
 }
 
 func (f *FakeContentDownloader) BestEffortInit() error {
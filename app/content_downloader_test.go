@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 const invalidURL = "https://mattjmcnaughton.com/this-url/is-invalid"
@@ -33,11 +41,16 @@ func TestDockerContainerYoutubeDlContentDownloaderDownloadContentIntegration(t *
 
 		remotePath := youtubeURL
 
-		filePath, err := contentDownloader.DownloadContent(remotePath, downloadOptions)
+		filePaths, err := contentDownloader.DownloadContent(context.Background(), remotePath, downloadOptions)
 		if err != nil {
 			t.Fatalf("Should not have error downloading content: %s", err)
 		}
 
+		if len(filePaths) != 1 {
+			t.Fatalf("Expected downloading a single video to create 1 file, but got %d", len(filePaths))
+		}
+		filePath := filePaths[0]
+
 		// We may also want to wrap these calls in the `fsClient`.
 		if _, err := os.Stat(filePath); os.IsNotExist(err) || os.IsPermission(err) {
 			t.Fatalf("After download, file should exist and be accessible: %s", err)
@@ -75,7 +88,7 @@ func TestDockerContainerYoutubeDlContentDownloaderDownloadContentFailsWhenInvali
 
 	remotePath := invalidURL
 
-	_, err = contentDownloader.DownloadContent(remotePath, downloadOptions)
+	_, err = contentDownloader.DownloadContent(context.Background(), remotePath, downloadOptions)
 	if err == nil {
 		t.Fatalf("Should not be able to download content from invalid url")
 	}
@@ -106,3 +119,359 @@ func TestDockerContainerYoutubeDlContentDownloaderBestEffortInit(t *testing.T) {
 
 	testImageAvailableOnHost(t, contentDownloader.YoutubeDlImageName)
 }
+
+func TestValidatePlaylistItems(t *testing.T) {
+	maxPlaylistItems := 5
+
+	validPlaylistItems := []string{"1", "1-3", "1-3,7", "2,4,6"}
+	for _, playlistItems := range validPlaylistItems {
+		if err := validatePlaylistItems(playlistItems, maxPlaylistItems); err != nil {
+			t.Fatalf("Expected %q to be valid, but got: %s", playlistItems, err)
+		}
+	}
+
+	invalidPlaylistItems := []string{"", "0", "a-b", "1,,2", "3-1", "1-10", "--exec", "1;rm"}
+	for _, playlistItems := range invalidPlaylistItems {
+		err := validatePlaylistItems(playlistItems, maxPlaylistItems)
+		if _, ok := err.(*UserError); !ok {
+			t.Fatalf("Expected %q to be invalid with a translated error, but got %v", playlistItems, err)
+		}
+	}
+}
+
+func TestDownloadOptionsMaxSourceDuration(t *testing.T) {
+	optionsToMaxSourceDuration := map[*DownloadOptions]time.Duration{
+		{}:                         0,
+		{maxDuration: time.Minute}: time.Minute,
+		// Clips with an end are limited by `validateClip` instead.
+		{maxDuration: time.Minute, clipStart: time.Hour, clipEnd: time.Hour + time.Minute}: 0,
+		// Clips running to the end of the video.
+		{maxDuration: time.Minute, clipStart: time.Hour}: time.Hour + time.Minute,
+	}
+
+	for downloadOptions, expected := range optionsToMaxSourceDuration {
+		if maxSourceDuration := downloadOptions.maxSourceDuration(); maxSourceDuration != expected {
+			t.Fatalf("Expected max source duration %s for %+v, but got %s", expected, downloadOptions, maxSourceDuration)
+		}
+	}
+}
+
+func TestPlaylistYoutubeDlOptions(t *testing.T) {
+	options := playlistYoutubeDlOptions(&DownloadOptions{})
+	if len(options) != 1 || options[0] != "--no-playlist" {
+		t.Fatalf("Expected non-playlist downloads to use --no-playlist, but got %v", options)
+	}
+
+	options = playlistYoutubeDlOptions(&DownloadOptions{playlist: true, maxPlaylistItems: 10})
+	if options[len(options)-2] != "--playlist-end" || options[len(options)-1] != "10" {
+		t.Fatalf("Expected playlist downloads to be limited to max items, but got %v", options)
+	}
+
+	options = playlistYoutubeDlOptions(&DownloadOptions{playlist: true, playlistItems: "1-3", maxPlaylistItems: 10})
+	if options[len(options)-2] != "--playlist-items" || options[len(options)-1] != "1-3" {
+		t.Fatalf("Expected playlist downloads to select items, but got %v", options)
+	}
+}
+
+// fakeYoutubeDlRunContainerFunc simulates running youtube-dl and ffmpeg
+// containers by creating the files they would create in `mountDirectory`.
+func fakeYoutubeDlRunContainerFunc(mountDirectory string, videoInfo string) func(string, []string, *runContainerOptions) (*runContainerResult, error) {
+	return func(imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
+		hostPath := func(containerPath string) string {
+			return filepath.Join(mountDirectory, strings.TrimPrefix(containerPath, youtubeDlMountDirectory))
+		}
+
+		if runContainerOpts.entrypoint != nil {
+			// ffmpeg... the output path is always the last arg.
+			return &runContainerResult{}, ioutil.WriteFile(hostPath(cmd[len(cmd)-1]), []byte("clipped"), 0644)
+		}
+
+		if containsString(cmd, "--get-filename") {
+			info := &youtubeDlInfo{}
+			if err := json.Unmarshal([]byte(videoInfo), info); err != nil {
+				return nil, err
+			}
+
+			duration := "NA"
+			if info.Duration != 0 {
+				duration = strconv.FormatFloat(info.Duration, 'f', -1, 64)
+			}
+			return &runContainerResult{stdout: fmt.Sprintf("Youtube %s\n", duration)}, nil
+		}
+
+		for i, arg := range cmd {
+			if arg == "-o" {
+				fileNameTemplate := hostPath(cmd[i+1])
+				filePath := strings.Replace(fileNameTemplate, "%(title)s.%(ext)s", "My Video.mp3", 1)
+				if err := ioutil.WriteFile(filePath, []byte("full video"), 0644); err != nil {
+					return nil, err
+				}
+
+				if containsString(cmd, "--write-sub") {
+					subtitleFilePath := strings.Replace(fileNameTemplate, "%(title)s.%(ext)s", "My Video.en.srt", 1)
+					if err := ioutil.WriteFile(subtitleFilePath, []byte("full subtitles"), 0644); err != nil {
+						return nil, err
+					}
+				}
+
+				infoFilePath := strings.Replace(fileNameTemplate, "%(title)s.%(ext)s", "My Video.info.json", 1)
+				return &runContainerResult{}, ioutil.WriteFile(infoFilePath, []byte(videoInfo), 0644)
+			}
+		}
+
+		return &runContainerResult{}, nil
+	}
+}
+
+func TestContainerYoutubeDlContentDownloaderDownloadContentClip(t *testing.T) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+	defer fsClient.CleanUp()
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RunContainerFunc = fakeYoutubeDlRunContainerFunc(fsClient.GetMountDirectory(), `{"duration": 600}`)
+	contentDownloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+
+	downloadOptions := &DownloadOptions{
+		audioOnly: true,
+		clipStart: time.Minute,
+		clipEnd:   3 * time.Minute,
+	}
+
+	filePaths, err := contentDownloader.DownloadContent(context.Background(), youtubeURL, downloadOptions)
+	if err != nil {
+		t.Fatalf("Should not have error downloading content: %s", err)
+	}
+
+	if len(filePaths) != 1 {
+		t.Fatalf("Expected 1 file (and no info files), but got %v", filePaths)
+	}
+
+	contents, err := ioutil.ReadFile(filePaths[0])
+	if err != nil || string(contents) != "clipped" {
+		t.Fatalf("Expected downloaded file to be replaced by the clip, but got %q: %v", contents, err)
+	}
+
+	if len(fakeContainerClient.RanCmds) != 3 {
+		t.Fatalf("Expected to inspect the video, then run youtube-dl and ffmpeg, but ran %d containers", len(fakeContainerClient.RanCmds))
+	}
+
+	filesInDir, _ := ioutil.ReadDir(fsClient.GetMountDirectory())
+	if len(filesInDir) != 1 {
+		t.Fatalf("Expected info files to be removed, but found %d files", len(filesInDir))
+	}
+}
+
+func TestContainerYoutubeDlContentDownloaderDownloadContentClipFailsWhenStartAfterEnd(t *testing.T) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+	defer fsClient.CleanUp()
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RunContainerFunc = fakeYoutubeDlRunContainerFunc(fsClient.GetMountDirectory(), `{"duration": 30}`)
+	contentDownloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+
+	downloadOptions := &DownloadOptions{
+		clipStart: time.Minute,
+	}
+
+	_, err = contentDownloader.DownloadContent(context.Background(), youtubeURL, downloadOptions)
+	userErr, ok := err.(*UserError)
+	if !ok || userErr.Key != "errors.clip.longer_than_video" {
+		t.Fatalf("Should not be able to clip a video starting after it ends, but got %v", err)
+	}
+
+	if len(fakeContainerClient.RanCmds) != 1 {
+		t.Fatalf("Expected to refuse the clip without downloading, but ran %d containers", len(fakeContainerClient.RanCmds))
+	}
+}
+
+func TestContainerYoutubeDlContentDownloaderDownloadContentClipFailsWhenRestOfVideoTooLong(t *testing.T) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+	defer fsClient.CleanUp()
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RunContainerFunc = fakeYoutubeDlRunContainerFunc(fsClient.GetMountDirectory(), `{"duration": 600}`)
+	contentDownloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+
+	downloadOptions := &DownloadOptions{
+		maxDuration: time.Minute,
+		clipStart:   time.Minute,
+	}
+
+	_, err = contentDownloader.DownloadContent(context.Background(), youtubeURL, downloadOptions)
+	userErr, ok := err.(*UserError)
+	if !ok || userErr.Key != "errors.clip.too_long" {
+		t.Fatalf("Should not be able to clip the rest of a video longer than the max duration, but got %v", err)
+	}
+
+	if len(fakeContainerClient.RanCmds) != 1 {
+		t.Fatalf("Expected to refuse the clip without downloading, but ran %d containers", len(fakeContainerClient.RanCmds))
+	}
+}
+
+func TestContainerYoutubeDlContentDownloaderDownloadContentClipsSubtitles(t *testing.T) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+	defer fsClient.CleanUp()
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RunContainerFunc = fakeYoutubeDlRunContainerFunc(fsClient.GetMountDirectory(), `{"duration": 600}`)
+	contentDownloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+
+	downloadOptions := &DownloadOptions{
+		clipStart:         time.Minute,
+		clipEnd:           3 * time.Minute,
+		subtitleLanguages: []string{"en"},
+	}
+
+	filePaths, err := contentDownloader.DownloadContent(context.Background(), youtubeURL, downloadOptions)
+	if err != nil {
+		t.Fatalf("Should not have error downloading content: %s", err)
+	}
+
+	if len(filePaths) != 2 {
+		t.Fatalf("Expected the video and its subtitles, but got %v", filePaths)
+	}
+
+	var clippedSubtitles bool
+	for _, cmd := range fakeContainerClient.RanCmds {
+		if !strings.HasSuffix(cmd[len(cmd)-1], ".en.srt") {
+			continue
+		}
+
+		clippedSubtitles = true
+		if !reflect.DeepEqual(cmd[len(cmd)-3:len(cmd)-1], []string{"-c:s", "srt"}) || containsString(cmd, "copy") {
+			t.Fatalf("Expected subtitles to be re-encoded as srt, but got %v", cmd)
+		}
+	}
+
+	if !clippedSubtitles {
+		t.Fatalf("Expected the subtitles to be clipped, but ran %v", fakeContainerClient.RanCmds)
+	}
+}
+
+func TestContainerYoutubeDlContentDownloaderDownloadContentClassifiesErrors(t *testing.T) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+	defer fsClient.CleanUp()
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RunContainerFunc = func(imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
+		stderr := "ERROR: This video is not available in your country.\n"
+		result := &runContainerResult{exitCode: 1, stderr: stderr}
+		return result, &ContainerExitError{ContainerID: "abc", ExitCode: 1, Stderr: stderr}
+	}
+	contentDownloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+
+	_, err = contentDownloader.DownloadContent(context.Background(), youtubeURL, &DownloadOptions{})
+	youtubeDlErr, ok := err.(*YoutubeDlError)
+	if !ok {
+		t.Fatalf("Expected a YoutubeDlError, but got %v", err)
+	}
+
+	if youtubeDlErr.Kind != YoutubeDlErrorGeoBlocked {
+		t.Fatalf("Expected error to be classified as %s, but got %s", YoutubeDlErrorGeoBlocked, youtubeDlErr.Kind)
+	}
+}
+
+func TestContainerYoutubeDlContentDownloaderDownloadContentIsSandboxed(t *testing.T) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+	defer fsClient.CleanUp()
+
+	var ranRunContainerOpts *runContainerOptions
+	fakeYoutubeDl := fakeYoutubeDlRunContainerFunc(fsClient.GetMountDirectory(), `{}`)
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RunContainerFunc = func(imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
+		ranRunContainerOpts = runContainerOpts
+		return fakeYoutubeDl(imageName, cmd, runContainerOpts)
+	}
+	contentDownloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+	contentDownloader.Sandbox.User = "1234:1234"
+	contentDownloader.Sandbox.MaxFileSizeMB = 500
+
+	if _, err := contentDownloader.DownloadContent(context.Background(), youtubeURL, &DownloadOptions{audioOnly: true}); err != nil {
+		t.Fatalf("Should not have error downloading content: %s", err)
+	}
+
+	if ranRunContainerOpts.uid != "1234:1234" || !ranRunContainerOpts.readOnlyRootFilesystem || ranRunContainerOpts.memoryBytes == 0 {
+		t.Fatalf("Expected youtube-dl to run in the sandbox, but got %+v", ranRunContainerOpts)
+	}
+
+	cmd := fakeContainerClient.RanCmds[0]
+	if !containsString(cmd, "--max-filesize") || !containsString(cmd, "500m") {
+		t.Fatalf("Expected youtube-dl to enforce the max file size, but got %v", cmd)
+	}
+}
+
+func TestContainerYoutubeDlContentDownloaderDownloadContentChecksExtractors(t *testing.T) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+	defer fsClient.CleanUp()
+
+	fakeYoutubeDl := fakeYoutubeDlRunContainerFunc(fsClient.GetMountDirectory(), `{}`)
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RunContainerFunc = func(imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
+		if containsString(cmd, "--get-filename") {
+			return &runContainerResult{stdout: "Youtube 212\nGeneric NA\n"}, nil
+		}
+		return fakeYoutubeDl(imageName, cmd, runContainerOpts)
+	}
+	contentDownloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+
+	contentDownloader.Extractors = NewExtractorFilter(urlsConfig{DeniedExtractors: []string{"generic"}})
+	_, err = contentDownloader.DownloadContent(context.Background(), youtubeURL, &DownloadOptions{playlist: true})
+	if _, ok := err.(*InvalidURLError); !ok {
+		t.Fatalf("Expected an InvalidURLError when any item uses a denied extractor, but got %v", err)
+	}
+	if len(fakeContainerClient.RanCmds) != 1 {
+		t.Fatalf("Expected to refuse without downloading, but ran %d containers", len(fakeContainerClient.RanCmds))
+	}
+
+	contentDownloader.Extractors = NewExtractorFilter(urlsConfig{AllowedExtractors: []string{"youtube", "generic"}})
+	if _, err := contentDownloader.DownloadContent(context.Background(), youtubeURL, &DownloadOptions{playlist: true}); err != nil {
+		t.Fatalf("Should not have error downloading with allowed extractors: %s", err)
+	}
+}
+
+func TestContainerYoutubeDlContentDownloaderDownloadContentFailsWhenVideoTooLong(t *testing.T) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+	defer fsClient.CleanUp()
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RunContainerFunc = func(imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
+		return &runContainerResult{stdout: "[download] My Video does not pass filter duration <= 300, skipping ..\n"}, nil
+	}
+	contentDownloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+
+	_, err = contentDownloader.DownloadContent(context.Background(), youtubeURL, &DownloadOptions{maxDuration: 5 * time.Minute})
+	userErr, ok := err.(*UserError)
+	if !ok || userErr.Key != "errors.quota.video_too_long" {
+		t.Fatalf("Expected a video too long error, but got %v", err)
+	}
+
+	if err.Error() != "Videos may be at most 5:00 long." {
+		t.Fatalf("Expected the max duration in the error, but got %q", err.Error())
+	}
+}
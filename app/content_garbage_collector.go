@@ -11,14 +11,16 @@ type ContentGarbageCollector interface {
 
 type RemoteStoreContentGarbageCollector struct {
 	remoteStoreClient RemoteStoreClient
+	contentCache      ContentCache
 	logger            logr.Logger
 }
 
 var _ ContentGarbageCollector = (*RemoteStoreContentGarbageCollector)(nil)
 
-func NewRemoteStoreContentGarbageCollector(remoteStoreClient RemoteStoreClient, logger logr.Logger) *RemoteStoreContentGarbageCollector {
+func NewRemoteStoreContentGarbageCollector(remoteStoreClient RemoteStoreClient, contentCache ContentCache, logger logr.Logger) *RemoteStoreContentGarbageCollector {
 	return &RemoteStoreContentGarbageCollector{
 		remoteStoreClient: remoteStoreClient,
+		contentCache:      contentCache,
 		logger:            logger,
 	}
 }
@@ -38,8 +40,20 @@ func (r *RemoteStoreContentGarbageCollector) DeleteStaleFiles(cutoffTime time.Ti
 	// responding to web requests, I'm not super worried about it for now...
 	for _, remoteFile := range remoteFiles {
 		if remoteFile.LastModified.Before(cutoffTime) {
+			// Jobs may be reusing files we uploaded a while ago, in
+			// which case the file isn't stale yet.
+			if !r.contentCache.Evict(remoteFile.FilePath, cutoffTime) {
+				r.logger.V(3).Info("Skipping stale file which is still in use", "filePath", remoteFile.FilePath)
+				continue
+			}
+
 			r.logger.V(2).Info("Deleting stale file", "filePath", remoteFile.FilePath)
-			r.remoteStoreClient.DeleteFile(remoteFile.FilePath)
+			if err := r.remoteStoreClient.DeleteFile(remoteFile.FilePath); err != nil {
+				r.logger.V(1).Info("Error deleting stale file", "filePath", remoteFile.FilePath, "error", err)
+				gcFailuresTotal.Inc()
+				continue
+			}
+			gcDeletedFilesTotal.Inc()
 		}
 	}
 
@@ -54,6 +68,7 @@ func RunGarbageCollectionForever(gc ContentGarbageCollector, sleepDuration time.
 		err := gc.DeleteStaleFiles(cutoff)
 		if err != nil {
 			logger.V(1).Info("Error garbage collecting stale files", "error", err)
+			gcFailuresTotal.Inc()
 		}
 
 		logger.V(3).Info("Sleeping before next garbage collection", "sleepDuration", sleepDuration)
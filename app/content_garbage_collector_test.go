@@ -22,7 +22,7 @@ func TestRemoteStoreContentGarbageCollectDeleteStaleFiles(t *testing.T) {
 
 	fakeRemoteStoreClient.UploadRandomFilesWithMockedAge(lastModifiedToNumFilesToCreate)
 
-	garbageCollector := NewRemoteStoreContentGarbageCollector(fakeRemoteStoreClient, testLogger)
+	garbageCollector := NewRemoteStoreContentGarbageCollector(fakeRemoteStoreClient, NewInMemoryContentCache(), testLogger)
 	garbageCollector.DeleteStaleFiles(cutoffTime)
 
 	stillExistingFiles, _ := fakeRemoteStoreClient.ListAllUploadedFiles()
@@ -30,3 +30,26 @@ func TestRemoteStoreContentGarbageCollectDeleteStaleFiles(t *testing.T) {
 		t.Fatalf("Expected %d files to remain after garbage collection, but found: %d", numFilesToKeep, len(stillExistingFiles))
 	}
 }
+
+func TestRemoteStoreContentGarbageCollectDeleteStaleFilesSkipsFilesInUse(t *testing.T) {
+	fakeRemoteStoreClient := NewFakeRemoteStoreClient()
+	contentCache := NewInMemoryContentCache()
+
+	staleTime := time.Now().Add(-2 * time.Hour)
+	cutoffTime := time.Now().Add(-1 * time.Hour)
+
+	fakeRemoteStoreClient.UploadRandomFilesWithMockedAge(map[time.Time]int{staleTime: 2})
+	remoteFiles, _ := fakeRemoteStoreClient.ListAllUploadedFiles()
+
+	contentCache.Store("in-use-key", []string{remoteFiles[0].FilePath})
+	_, release, _ := contentCache.Acquire("in-use-key")
+	defer release()
+
+	garbageCollector := NewRemoteStoreContentGarbageCollector(fakeRemoteStoreClient, contentCache, testLogger)
+	garbageCollector.DeleteStaleFiles(cutoffTime)
+
+	stillExistingFiles, _ := fakeRemoteStoreClient.ListAllUploadedFiles()
+	if len(stillExistingFiles) != 1 || stillExistingFiles[0].FilePath != remoteFiles[0].FilePath {
+		t.Fatalf("Expected only the in use file to remain after garbage collection, but found: %d files", len(stillExistingFiles))
+	}
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
 	"os"
 	"path"
+	"time"
 )
 
 type ContentUploader interface {
 	// For now, we do not give the user any control over what we name the
 	// file remotely.
-	UploadContentPublicly(hostLocation string) (string, error)
+	UploadContentPublicly(ctx context.Context, hostLocation string) (*UploadedContent, error)
+	// PublicURLForUploadedContent generates a new public url for content
+	// we've previously uploaded.
+	PublicURLForUploadedContent(ctx context.Context, remoteFileName string) (string, error)
+}
+
+// UploadedContent describes content which we've uploaded publicly.
+type UploadedContent struct {
+	RemoteFileName string
+	PublicURL      string
 }
 
 type RemoteStoreContentUploader struct {
@@ -27,13 +39,42 @@ func NewRemoteStoreContentUploader(remoteStoreClient RemoteStoreClient, logger l
 	}
 }
 
-func (r *RemoteStoreContentUploader) UploadContentPublicly(hostLocation string) (string, error) {
+func (r *RemoteStoreContentUploader) UploadContentPublicly(ctx context.Context, hostLocation string) (uploadedContent *UploadedContent, err error) {
+	_, span := startSpan(ctx, "upload", attribute.String("vidzou.file", path.Base(hostLocation)))
+	defer func() { endSpan(span, err) }()
+
 	r.logger.V(3).Info("Publicly uploading content from local file system", "hostLocation", hostLocation)
 
 	if _, err := os.Stat(hostLocation); os.IsNotExist(err) || os.IsPermission(err) {
-		return "", fmt.Errorf("Error accessing file prior to upload: %s", err)
+		return nil, fmt.Errorf("Error accessing file prior to upload: %s", err)
 	}
 
 	remoteFileName := path.Base(hostLocation)
-	return r.remoteStoreClient.UploadFilePublicly(hostLocation, remoteFileName)
+	startedAt := time.Now()
+	publicURL, err := r.remoteStoreClient.UploadFilePublicly(hostLocation, remoteFileName)
+	observeDuration(uploadDurationSeconds, startedAt, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if fileInfo, err := os.Stat(hostLocation); err == nil {
+		uploadedBytesTotal.Add(float64(fileInfo.Size()))
+		span.SetAttributes(attribute.Int64("vidzou.file_size_bytes", fileInfo.Size()))
+	}
+
+	uploadedContent = &UploadedContent{
+		RemoteFileName: remoteFileName,
+		PublicURL:      publicURL,
+	}
+	return uploadedContent, nil
+}
+
+func (r *RemoteStoreContentUploader) PublicURLForUploadedContent(ctx context.Context, remoteFileName string) (string, error) {
+	_, span := startSpan(ctx, "presign", attribute.String("vidzou.file", remoteFileName))
+
+	r.logger.V(3).Info("Generating public url for previously uploaded content", "remoteFileName", remoteFileName)
+	publicURL, err := r.remoteStoreClient.GeneratePublicURL(remoteFileName)
+	endSpan(span, err)
+
+	return publicURL, err
 }
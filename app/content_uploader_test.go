@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 )
 
@@ -19,7 +20,7 @@ func TestRemoteStoreContentUploaderUploadContentPublicly(t *testing.T) {
 	downloadOptions := &DownloadOptions{}
 
 	// Should we give back the full file path or just the file name?
-	downloadedFilePath, err := fakeContentDownloader.DownloadContent(remotePath, downloadOptions)
+	downloadedFilePaths, err := fakeContentDownloader.DownloadContent(context.Background(), remotePath, downloadOptions)
 	if err != nil {
 		t.Fatalf("Error downloading content using fake content downloader: %s", err)
 	}
@@ -29,7 +30,7 @@ func TestRemoteStoreContentUploaderUploadContentPublicly(t *testing.T) {
 		t.Fatalf("Expected 0 uploaded files, but found %d", len(allUploadedFiles))
 	}
 
-	_, err = uploader.UploadContentPublicly(downloadedFilePath)
+	_, err = uploader.UploadContentPublicly(context.Background(), downloadedFilePaths[0])
 	if err != nil {
 		t.Fatalf("Error uploading file publicly: %s", err)
 	}
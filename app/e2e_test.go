@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
@@ -39,23 +40,23 @@ func TestAppE2ENoHTTPIntegration(t *testing.T) {
 	}
 	go downloader.BestEffortInit()
 	uploader := NewRemoteStoreContentUploader(s3Client, testLogger)
-	garbageCollector := NewRemoteStoreContentGarbageCollector(s3Client, testLogger)
+	garbageCollector := NewRemoteStoreContentGarbageCollector(s3Client, NewInMemoryContentCache(), testLogger)
 
 	downloadOptions := &DownloadOptions{
 		audioOnly: true,
 	}
 	remotePath := youtubeURL
-	downloadedFilePath, err := downloader.DownloadContent(remotePath, downloadOptions)
+	downloadedFilePaths, err := downloader.DownloadContent(context.Background(), remotePath, downloadOptions)
 	if err != nil {
 		t.Fatalf("Should not have error downloading content: %s", err)
 	}
 
-	publicFileURL, err := uploader.UploadContentPublicly(downloadedFilePath)
+	uploadedContent, err := uploader.UploadContentPublicly(context.Background(), downloadedFilePaths[0])
 	if err != nil {
 		t.Fatalf("Error uploading file publicly: %s", err)
 	}
 
-	getFileResp, err := http.Get(publicFileURL)
+	getFileResp, err := http.Get(uploadedContent.PublicURL)
 	if err != nil {
 		t.Fatalf("Error calling GET on public file url: %s", err)
 	}
@@ -40,7 +40,7 @@ func TestAppE2EWebIntegration(t *testing.T) {
 		t.Fatalf("Failed to navigate: %s", err)
 	}
 
-	formTextInput := page.Find("form#downloadForm input[name='url']")
+	formTextInput := page.Find("form#downloadForm textarea[name='url']")
 	formSubmitInput := page.Find("form#downloadForm input[value='submit']")
 
 	if err := formTextInput.Fill(youtubeURL); err != nil {
@@ -123,7 +123,11 @@ func runWebServer() (cleanUpFunc, error) {
 	go downloader.BestEffortInit()
 
 	uploader := NewRemoteStoreContentUploader(s3Client, testLogger)
-	server := NewServer(testServerPort, downloader, uploader, testLogger)
+	quotaEnforcer := NewInMemoryQuotaEnforcer(defaultConfig().Limits)
+	urlValidator := NewHostURLValidator(defaultConfig().URLs)
+	jobStore := NewInMemoryJobStore()
+	jobProcessor := NewJobProcessor(downloader, downloader, uploader, NewInMemoryContentCache(), jobStore, testLogger)
+	server := NewServer(testServerPort, jobProcessor, jobStore, quotaEnforcer, urlValidator, defaultConfig().Downloads, testLogger)
 
 	go func() {
 		server.ListenAndServe(func() error {
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Relatives often close the tab while a long download runs, so we can email
+// them once it finishes: either the download link or why it failed. Emails are
+// text templates (in templates/email) which translate their messages like our
+// pages do, into the language the user had chosen when starting the download.
+
+const emailTemplatesDirectory = "templates/email"
+
+// emailConfig configures the SMTP server through which we email users. Email
+// notifications are disabled unless `SMTPHost` is set.
+type emailConfig struct {
+	SMTPHost string `yaml:"smtp_host"`
+	SMTPPort int    `yaml:"smtp_port"`
+	// Username and PasswordFile, if set, are our credentials for the SMTP
+	// server. We only send them over TLS (or to a server on localhost).
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+
+	// From is the address from which we send (i.e. "vidzou
+	// <vidzou@example.com>").
+	From string `yaml:"from"`
+
+	// AccountEmailHeader, if set, is the request header from which we read
+	// the user's email address (i.e. as set by an authenticating reverse
+	// proxy), with which we fill in the download form.
+	AccountEmailHeader string `yaml:"account_email_header"`
+	// PublicURL, if set, is the url at which users reach vidzou (i.e.
+	// "https://vidzou.example.com"), so we can link to the download's page.
+	PublicURL string `yaml:"public_url"`
+
+	// Retries controls how we retry emails which fail for transient
+	// reasons (i.e. network errors or 4xx SMTP replies).
+	Retries        RetryPolicy `yaml:"retries"`
+	TimeoutSeconds int         `yaml:"timeout_seconds"`
+
+	password string
+}
+
+func defaultEmailConfig() emailConfig {
+	return emailConfig{
+		SMTPPort:       587,
+		Retries:        defaultRetryPolicy(),
+		TimeoutSeconds: 30,
+	}
+}
+
+// enabled returns whether we should email users.
+func (c *emailConfig) enabled() bool {
+	return c.SMTPHost != ""
+}
+
+func (c *emailConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+
+	if c.SMTPPort < 1 || c.SMTPPort > 65535 {
+		return fmt.Errorf("The email.smtp_port setting must be a valid port")
+	}
+
+	if (c.Username == "") != (c.PasswordFile == "") {
+		return fmt.Errorf("Email credentials require both a username and password_file")
+	}
+
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("The email.from setting must be an email address: %s", err)
+	}
+
+	if c.PublicURL != "" {
+		publicURL, err := url.Parse(c.PublicURL)
+		if err != nil || (publicURL.Scheme != "http" && publicURL.Scheme != "https") || publicURL.Host == "" {
+			return fmt.Errorf("The email.public_url setting must be an http or https url")
+		}
+	}
+
+	if c.Retries.MaxAttempts < 1 {
+		return fmt.Errorf("The email.retries.max_attempts setting must be at least 1")
+	}
+
+	if c.TimeoutSeconds < 1 {
+		return fmt.Errorf("The email.timeout_seconds setting must be at least 1")
+	}
+
+	return nil
+}
+
+// loadPassword reads the SMTP password from the password file.
+func (c *emailConfig) loadPassword() error {
+	password, err := ioutil.ReadFile(c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("Error reading email password file: %s", err)
+	}
+
+	c.password = strings.TrimSpace(string(password))
+	return nil
+}
+
+// parseEmailAddress parses the address the user gave us for notifications,
+// returning just the address (i.e. without any name).
+func parseEmailAddress(rawAddress string) (string, error) {
+	address, err := mail.ParseAddress(rawAddress)
+	if err != nil {
+		return "", newUserError("errors.invalid_email", rawAddress)
+	}
+
+	return address.Address, nil
+}
+
+// EmailNotifier emails users when their downloads finish, if they gave us
+// their email address.
+type EmailNotifier struct {
+	conf        emailConfig
+	fromAddress string
+	templates   *template.Template
+	logger      logr.Logger
+
+	// sleep exists so tests can skip waiting between retries.
+	sleep func(time.Duration)
+}
+
+var _ JobNotifier = (*EmailNotifier)(nil)
+
+func NewEmailNotifier(conf emailConfig, logger logr.Logger) (*EmailNotifier, error) {
+	from, err := mail.ParseAddress(conf.From)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing from address: %s", err)
+	}
+
+	// We only know the user's locale when sending, so we add the real
+	// funcs then.
+	funcs := template.FuncMap((&Localizer{catalog: messages, Locale: defaultLocale}).templateFuncs())
+	templates, err := template.New("email").Funcs(funcs).ParseFS(embeddedAssets, path.Join(emailTemplatesDirectory, "*.txt"))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing email templates: %s", err)
+	}
+
+	return &EmailNotifier{
+		conf:        conf,
+		fromAddress: from.Address,
+		templates:   templates,
+		logger:      logger,
+		sleep:       time.Sleep,
+	}, nil
+}
+
+// AccountEmail returns the email address of the user making the request, if
+// our reverse proxy tells us it.
+func (n *EmailNotifier) AccountEmail(r *http.Request) string {
+	if n.conf.AccountEmailHeader == "" {
+		return ""
+	}
+
+	address, err := parseEmailAddress(r.Header.Get(n.conf.AccountEmailHeader))
+	if err != nil {
+		return ""
+	}
+
+	return address
+}
+
+// NotifyJobStateChanged emails the user, in the background, once their job
+// finishes.
+func (n *EmailNotifier) NotifyJobStateChanged(job *Job) {
+	if job.Email == "" || !job.Complete() {
+		return
+	}
+
+	go n.sendWithRetries(job)
+}
+
+// emailData is everything our email templates show.
+type emailData struct {
+	Job   *Job
+	Files []*JobFile
+	// JobURL is the job's page, if we know our public url.
+	JobURL string
+	// Error explains, in the user's language, why the job failed.
+	Error string
+}
+
+// message returns the email telling the user how their job went.
+func (n *EmailNotifier) message(job *Job) ([]byte, error) {
+	localizer := &Localizer{catalog: messages, Locale: messages.MatchLocale(job.Locale, "")}
+
+	data := &emailData{Job: job, Files: job.Files(), Error: localizer.Error(job.Err)}
+	if n.conf.PublicURL != "" {
+		data.JobURL = fmt.Sprintf("%s/downloads/%s", strings.TrimSuffix(n.conf.PublicURL, "/"), job.ID)
+	}
+
+	templateName, subject := "job_succeeded.txt", localizer.T("email.succeeded_subject")
+	if job.State == JobStateFailed {
+		templateName, subject = "job_failed.txt", localizer.T("email.failed_subject")
+	}
+
+	emailTemplate := template.Must(n.templates.Clone()).Funcs(template.FuncMap(localizer.templateFuncs())).Lookup(templateName)
+	if emailTemplate == nil {
+		return nil, fmt.Errorf("No email template %s", templateName)
+	}
+
+	var body bytes.Buffer
+	bodyWriter := quotedprintable.NewWriter(&body)
+	if err := emailTemplate.Execute(bodyWriter, data); err != nil {
+		return nil, fmt.Errorf("Error rendering email template %s: %s", templateName, err)
+	}
+	bodyWriter.Close()
+
+	var msg bytes.Buffer
+	for _, header := range [][2]string{
+		{"From", n.conf.From},
+		{"To", job.Email},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s.%s@%s>", job.ID, generateRandomString(defaultRandomStringLength), n.fromDomain())},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	} {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+func (n *EmailNotifier) fromDomain() string {
+	return n.fromAddress[strings.LastIndex(n.fromAddress, "@")+1:]
+}
+
+// sendWithRetries emails the user about the job, retrying transient failures
+// according to our retry policy.
+func (n *EmailNotifier) sendWithRetries(job *Job) {
+	msg, err := n.message(job)
+	if err != nil {
+		// Only possible if we've broken our templates, which our tests
+		// catch.
+		n.logger.V(0).Info("Error creating email", "jobId", job.ID, "error", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := n.send(job.Email, msg)
+		if err == nil || attempt >= n.conf.Retries.MaxAttempts || !isRetryableEmailError(err) {
+			n.logger.V(3).Info("Finished emailing user", "jobId", job.ID, "jobState", job.State, "attempts", attempt, "error", err)
+			emailsSentTotal.WithLabelValues(metricsOutcome(err)).Inc()
+			return
+		}
+
+		backoff := n.conf.Retries.backoff(attempt)
+		n.logger.V(2).Info("Retrying email after transient failure", "jobId", job.ID, "attempt", attempt, "backoff", backoff, "error", err)
+		n.sleep(backoff)
+	}
+}
+
+// send delivers the message via our SMTP server. Unlike `smtp.SendMail`, we
+// give up if the server doesn't respond within our timeout.
+func (n *EmailNotifier) send(to string, msg []byte) error {
+	timeout := time.Duration(n.conf.TimeoutSeconds) * time.Second
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(n.conf.SMTPHost, strconv.Itoa(n.conf.SMTPPort)), timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, n.conf.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: n.conf.SMTPHost}); err != nil {
+			return err
+		}
+	}
+
+	if n.conf.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.conf.Username, n.conf.password, n.conf.SMTPHost)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(n.fromAddress); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(msg); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// isRetryableEmailError returns whether the email may send if we try again.
+// SMTP servers reply with 4xx codes for transient failures (i.e. greylisting)
+// and 5xx codes for permanent ones (i.e. unknown recipients).
+func isRetryableEmailError(err error) bool {
+	if smtpErr, ok := err.(*textproto.Error); ok {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+
+	return true
+}
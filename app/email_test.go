@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer is just enough of an SMTP server to receive our emails. It
+// rejects the first `rejections` emails with each of the given replies.
+type fakeSMTPServer struct {
+	listener net.Listener
+
+	rejections []string
+	emails     []*fakeSMTPEmail
+	mu         sync.Mutex
+}
+
+type fakeSMTPEmail struct {
+	// auth is the decoded AUTH PLAIN response, if the client authenticated.
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSMTPServer(t *testing.T, rejections ...string) *fakeSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+
+	server := &fakeSMTPServer{listener: listener, rejections: rejections}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *fakeSMTPServer) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) receivedEmails() []*fakeSMTPEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*fakeSMTPEmail{}, s.emails...)
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		fmt.Fprintf(conn, "%s\r\n", line)
+	}
+
+	email := &fakeSMTPEmail{}
+	reply("220 localhost fake SMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch {
+		case command == "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case command == "AUTH":
+			auth, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+			email.auth = string(auth)
+			reply("235 Authenticated")
+		case command == "MAIL":
+			s.mu.Lock()
+			var rejection string
+			if len(s.rejections) > 0 {
+				rejection, s.rejections = s.rejections[0], s.rejections[1:]
+			}
+			s.mu.Unlock()
+
+			if rejection != "" {
+				reply(rejection)
+				continue
+			}
+
+			email.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			reply("250 OK")
+		case command == "RCPT":
+			email.to = append(email.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 Go ahead")
+
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			email.data = data.String()
+
+			s.mu.Lock()
+			s.emails = append(s.emails, email)
+			s.mu.Unlock()
+			reply("250 Queued")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// newTestEmailNotifier returns a notifier which sends via the fake server.
+func newTestEmailNotifier(t *testing.T, smtpServer *fakeSMTPServer) *EmailNotifier {
+	t.Helper()
+
+	conf := defaultEmailConfig()
+	conf.SMTPHost = "localhost"
+	conf.SMTPPort = smtpServer.port()
+	conf.From = "vidzou <vidzou@example.com>"
+	conf.PublicURL = "https://vidzou.example.com/"
+
+	notifier, err := NewEmailNotifier(conf, testLogger)
+	if err != nil {
+		t.Fatalf("Error creating email notifier: %s", err)
+	}
+	notifier.sleep = func(time.Duration) {}
+
+	return notifier
+}
+
+// waitForEmails waits for the fake server to receive the expected number of
+// emails.
+func waitForEmails(t *testing.T, smtpServer *fakeSMTPServer, expected int) []*fakeSMTPEmail {
+	t.Helper()
+
+	var emails []*fakeSMTPEmail
+	err := retryWithTimeout(50, 10*time.Millisecond, func() error {
+		if emails = smtpServer.receivedEmails(); len(emails) != expected {
+			return fmt.Errorf("Expected %d emails, but received %d", expected, len(emails))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Did not receive emails: %s", err)
+	}
+
+	return emails
+}
+
+// readTestEmail parses the email, returning its decoded subject and body.
+func readTestEmail(t *testing.T, email *fakeSMTPEmail) (*mail.Message, string, string) {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(strings.NewReader(email.data))
+	if err != nil {
+		t.Fatalf("Error parsing email: %s", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("Error decoding subject: %s", err)
+	}
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatalf("Error decoding body: %s", err)
+	}
+
+	return msg, subject, string(body)
+}
+
+func TestEmailNotifierSendsDownloadLink(t *testing.T) {
+	smtpServer := newFakeSMTPServer(t)
+	defer smtpServer.Close()
+
+	job := newTestFinishedJob("")
+	job.Email = "alice@example.com"
+	newTestEmailNotifier(t, smtpServer).NotifyJobStateChanged(job)
+
+	email := waitForEmails(t, smtpServer, 1)[0]
+	if email.from != "vidzou@example.com" || len(email.to) != 1 || email.to[0] != job.Email {
+		t.Fatalf("Expected email from vidzou to %s, but got %s to %v", job.Email, email.from, email.to)
+	}
+
+	msg, subject, body := readTestEmail(t, email)
+	if msg.Header.Get("To") != job.Email || subject != "Your download is ready" {
+		t.Fatalf("Expected email to %s about the download, but got %q to %s", job.Email, subject, msg.Header.Get("To"))
+	}
+
+	for _, expected := range []string{youtubeURL, job.PublicDownloadURL, "https://vidzou.example.com/downloads/" + job.ID} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected email to contain %s, but got %s", expected, body)
+		}
+	}
+}
+
+func TestEmailNotifierExplainsFailureInUsersLanguage(t *testing.T) {
+	smtpServer := newFakeSMTPServer(t)
+	defer smtpServer.Close()
+
+	job := NewJob([]string{youtubeURL}, &DownloadOptions{})
+	job.Email = "alice@example.com"
+	job.Locale = "fr"
+	job.State = JobStateFailed
+	job.Err = &YoutubeDlError{Kind: YoutubeDlErrorPrivate}
+	newTestEmailNotifier(t, smtpServer).NotifyJobStateChanged(job)
+
+	_, subject, body := readTestEmail(t, waitForEmails(t, smtpServer, 1)[0])
+	if subject != "Nous n'avons pas pu terminer votre téléchargement" {
+		t.Fatalf("Expected French subject, but got %q", subject)
+	}
+
+	if !strings.Contains(body, "Cette vidéo est privée.") || !strings.Contains(body, "Bonjour,") {
+		t.Fatalf("Expected French explanation of the failure, but got %s", body)
+	}
+}
+
+func TestEmailNotifierOnlyEmailsFinishedJobs(t *testing.T) {
+	smtpServer := newFakeSMTPServer(t)
+	defer smtpServer.Close()
+
+	notifier := newTestEmailNotifier(t, smtpServer)
+
+	runningJob := newTestFinishedJob("")
+	runningJob.Email = "alice@example.com"
+	runningJob.State = JobStateRunning
+	notifier.NotifyJobStateChanged(runningJob)
+
+	// Users who didn't give us their email address don't get emails.
+	notifier.NotifyJobStateChanged(newTestFinishedJob(""))
+
+	finishedJob := newTestFinishedJob("")
+	finishedJob.Email = "alice@example.com"
+	notifier.NotifyJobStateChanged(finishedJob)
+
+	waitForEmails(t, smtpServer, 1)
+	time.Sleep(50 * time.Millisecond)
+	if emails := smtpServer.receivedEmails(); len(emails) != 1 {
+		t.Fatalf("Expected only the finished job's email, but got %d emails", len(emails))
+	}
+}
+
+func TestEmailNotifierRetriesTransientFailures(t *testing.T) {
+	smtpServer := newFakeSMTPServer(t, "451 Greylisted, try again later")
+	defer smtpServer.Close()
+
+	job := newTestFinishedJob("")
+	job.Email = "alice@example.com"
+	newTestEmailNotifier(t, smtpServer).NotifyJobStateChanged(job)
+
+	waitForEmails(t, smtpServer, 1)
+
+	// Permanent failures aren't retried.
+	permanentSMTPServer := newFakeSMTPServer(t, "550 No such user", "550 No such user")
+	defer permanentSMTPServer.Close()
+
+	notifier := newTestEmailNotifier(t, permanentSMTPServer)
+	if err := notifier.send(job.Email, []byte("Subject: test\r\n\r\ntest\r\n")); err == nil || isRetryableEmailError(err) {
+		t.Fatalf("Expected permanent error, but got %v", err)
+	}
+
+	notifier.NotifyJobStateChanged(job)
+	time.Sleep(50 * time.Millisecond)
+	if emails := permanentSMTPServer.receivedEmails(); len(emails) != 0 {
+		t.Fatalf("Should not retry permanent failures, but received %d emails", len(emails))
+	}
+}
+
+func TestEmailNotifierAuthenticates(t *testing.T) {
+	smtpServer := newFakeSMTPServer(t)
+	defer smtpServer.Close()
+
+	notifier := newTestEmailNotifier(t, smtpServer)
+	notifier.conf.Username = "vidzou"
+	notifier.conf.password = "hunter2"
+
+	if err := notifier.send("alice@example.com", []byte("Subject: test\r\n\r\ntest\r\n")); err != nil {
+		t.Fatalf("Should not have error sending email: %s", err)
+	}
+
+	if email := waitForEmails(t, smtpServer, 1)[0]; email.auth != "\x00vidzou\x00hunter2" {
+		t.Fatalf("Expected to authenticate as vidzou, but got %q", email.auth)
+	}
+}
+
+func TestServerEmailsWhenDownloadFinishes(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	smtpServer := newFakeSMTPServer(t)
+	defer smtpServer.Close()
+
+	server.Emails = newTestEmailNotifier(t, smtpServer)
+	server.Emails.conf.AccountEmailHeader = "X-Forwarded-Email"
+	server.jobProcessor.Notifiers = []JobNotifier{server.Emails}
+
+	// We fill in the user's account email, if we know it.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-Email", "Alice <alice@example.com>")
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+
+	if !strings.Contains(rec.Body.String(), `name="email" type="email" value="alice@example.com"`) {
+		t.Fatalf("Expected form to ask for email, filled in with the account's, but got %s", rec.Body.String())
+	}
+
+	rec = postDownloadForm(server, url.Values{"url": {youtubeURL}, "email": {"bob@example.com"}})
+	job := waitForJobComplete(t, jobStore, rec)
+	if job.Email != "bob@example.com" {
+		t.Fatalf("Expected job to have email bob@example.com, but got %s", job.Email)
+	}
+
+	if email := waitForEmails(t, smtpServer, 1)[0]; email.to[0] != "bob@example.com" {
+		t.Fatalf("Expected email to bob@example.com, but got %v", email.to)
+	}
+
+	rec = postDownloadForm(server, url.Values{"url": {youtubeURL}, "email": {"not an email"}})
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "look like an email address") {
+		t.Fatalf("Expected invalid email to be refused, but got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerIndexWithoutEmails(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if strings.Contains(rec.Body.String(), `name="email"`) {
+		t.Fatal("Should not ask for email when we can't send emails")
+	}
+}
+
+func TestEmailConfigValidate(t *testing.T) {
+	validConf := func() emailConfig {
+		conf := defaultEmailConfig()
+		conf.SMTPHost = "smtp.example.com"
+		conf.From = "vidzou@example.com"
+		return conf
+	}
+
+	if conf := validConf(); conf.validate() != nil {
+		t.Fatalf("Expected valid config, but got %s", conf.validate())
+	}
+
+	// Without an SMTP server, email notifications are disabled.
+	if conf := defaultEmailConfig(); conf.enabled() || conf.validate() != nil {
+		t.Fatal("Expected email to be disabled by default")
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(*emailConfig)
+	}{
+		{"no from", func(c *emailConfig) { c.From = "" }},
+		{"invalid from", func(c *emailConfig) { c.From = "vidzou" }},
+		{"invalid port", func(c *emailConfig) { c.SMTPPort = 0 }},
+		{"username without password", func(c *emailConfig) { c.Username = "vidzou" }},
+		{"invalid public url", func(c *emailConfig) { c.PublicURL = "vidzou.example.com" }},
+		{"no attempts", func(c *emailConfig) { c.Retries.MaxAttempts = 0 }},
+	}
+
+	for _, testCase := range testCases {
+		conf := validConf()
+		testCase.modify(&conf)
+
+		if err := conf.validate(); err == nil {
+			t.Errorf("Expected error validating config with %s", testCase.name)
+		}
+	}
+}
+
+func TestParseEmailAddress(t *testing.T) {
+	for rawAddress, expected := range map[string]string{
+		"alice@example.com":         "alice@example.com",
+		"Alice <alice@example.com>": "alice@example.com",
+	} {
+		if address, err := parseEmailAddress(rawAddress); err != nil || address != expected {
+			t.Errorf("Expected %s for %s, but got %s (%v)", expected, rawAddress, address, err)
+		}
+	}
+
+	for _, rawAddress := range []string{"alice", "alice@example.com\r\nBcc: eve@example.com", strconv.Itoa(42)} {
+		if _, err := parseEmailAddress(rawAddress); err == nil {
+			t.Errorf("Expected error parsing %q", rawAddress)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// healthConfig controls our readiness checks.
+type healthConfig struct {
+	// MinFreeDiskMB is the free space we require in the directory to which
+	// we download, as downloads fail once the disk fills up.
+	MinFreeDiskMB int `yaml:"min_free_disk_mb"`
+}
+
+func defaultHealthConfig() healthConfig {
+	return healthConfig{
+		MinFreeDiskMB: 1024,
+	}
+}
+
+// HealthChecker determines whether vidzou is ready to serve traffic by running
+// a set of named checks (i.e. whether docker is reachable).
+type HealthChecker struct {
+	checks []*healthCheck
+	logger logr.Logger
+
+	// CacheDuration is how long we reuse the results of our checks, so
+	// frequent probes don't hammer our dependencies (i.e. by writing to s3
+	// every few seconds). Can set via constructor/setting later, should we
+	// find the need.
+	CacheDuration time.Duration
+
+	mu           sync.Mutex
+	lastReport   *ReadinessReport
+	lastReportAt time.Time
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// ReadinessReport is the outcome of all of our readiness checks. We're only
+// ready if every check passed.
+type ReadinessReport struct {
+	Ready  bool                    `json:"ready"`
+	Checks []*ReadinessCheckResult `json:"checks"`
+}
+
+type ReadinessCheckResult struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	// Error explains why the check failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+func NewHealthChecker(logger logr.Logger) *HealthChecker {
+	return &HealthChecker{
+		logger: logger,
+
+		// Can set via constructor/setting later, should we find the need.
+		CacheDuration: 10 * time.Second,
+	}
+}
+
+// AddCheck adds a readiness check, which passes if `check` returns nil. Checks
+// must be added before the first call of `Check`.
+func (h *HealthChecker) AddCheck(name string, check func() error) {
+	h.checks = append(h.checks, &healthCheck{name: name, check: check})
+}
+
+// Check runs all of our checks in parallel, unless we've run them within
+// `CacheDuration`.
+func (h *HealthChecker) Check() *ReadinessReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.lastReport != nil && time.Since(h.lastReportAt) < h.CacheDuration {
+		return h.lastReport
+	}
+
+	report := &ReadinessReport{
+		Ready:  true,
+		Checks: make([]*ReadinessCheckResult, len(h.checks)),
+	}
+
+	var wg sync.WaitGroup
+	for i, check := range h.checks {
+		wg.Add(1)
+		go func(i int, check *healthCheck) {
+			defer wg.Done()
+
+			result := &ReadinessCheckResult{Name: check.name, Ready: true}
+			if err := check.check(); err != nil {
+				result.Ready = false
+				result.Error = err.Error()
+			}
+			report.Checks[i] = result
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if !result.Ready {
+			h.logger.V(2).Info("Readiness check failed", "check", result.Name, "error", result.Error)
+			report.Ready = false
+		}
+	}
+
+	h.lastReport = report
+	h.lastReportAt = time.Now()
+	return report
+}
+
+// freeDiskSpaceCheck returns a check which fails unless `directory` has at
+// least `minFreeMB` of free space.
+func freeDiskSpaceCheck(directory string, minFreeMB int) func() error {
+	return func() error {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(directory, &stat); err != nil {
+			return err
+		}
+
+		freeMB := uint64(stat.Bavail) * uint64(stat.Bsize) / (1024 * 1024)
+		if freeMB < uint64(minFreeMB) {
+			return fmt.Errorf("Only %dMB free in %s, but need at least %dMB", freeMB, directory, minFreeMB)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestHealthCheckerCheck(t *testing.T) {
+	healthChecker := NewHealthChecker(testLogger)
+
+	var numChecks int
+	healthChecker.AddCheck("passing", func() error {
+		numChecks++
+		return nil
+	})
+	healthChecker.AddCheck("failing", func() error {
+		return fmt.Errorf("Docker is unreachable")
+	})
+
+	report := healthChecker.Check()
+	if report.Ready {
+		t.Fatal("Should not be ready when a check fails")
+	}
+
+	if len(report.Checks) != 2 || !report.Checks[0].Ready || report.Checks[1].Ready {
+		t.Fatalf("Unexpected check results %+v", report.Checks)
+	}
+
+	if report.Checks[1].Error != "Docker is unreachable" {
+		t.Fatalf("Expected failing check to explain why, but got %q", report.Checks[1].Error)
+	}
+
+	// We reuse recent results, rather than running the checks again.
+	healthChecker.Check()
+	if numChecks != 1 {
+		t.Fatalf("Expected checks to run once, but ran %d times", numChecks)
+	}
+}
+
+func TestFreeDiskSpaceCheck(t *testing.T) {
+	if err := freeDiskSpaceCheck(os.TempDir(), 0)(); err != nil {
+		t.Fatalf("Should not have error when requiring no free space: %s", err)
+	}
+
+	if err := freeDiskSpaceCheck(os.TempDir(), 1<<40)(); err == nil {
+		t.Fatal("Should have error when requiring more free space than any disk has")
+	}
+}
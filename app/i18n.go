@@ -0,0 +1,227 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v2"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// defaultLocale is the locale we use when we don't support any of the
+	// user's languages, and for any message missing from their locale. It's
+	// also the language of our logs.
+	defaultLocale = "en"
+
+	// languageCookieName is the cookie in which we store the language a
+	// user chose, which overrides their browser's languages.
+	languageCookieName = "vidzou_language"
+
+	localesDirectory = "locales"
+)
+
+// embeddedLocales are our message catalogs, one yaml file per locale (i.e.
+// locales/es.yaml). See locales/en.yaml for how to edit them.
+//
+//go:embed locales/*.yaml
+var embeddedLocales embed.FS
+
+// messages is the catalog of every message we show users.
+var messages = mustParseCatalog(embeddedLocales)
+
+// Catalog holds the translations of each message, keyed by locale and then by
+// message key.
+type Catalog struct {
+	translations map[string]map[string]string
+	// locales are our supported locales, with `defaultLocale` first, as
+	// `matcher` falls back to the first locale.
+	locales []string
+	matcher language.Matcher
+}
+
+func mustParseCatalog(files fs.FS) *Catalog {
+	catalog, err := parseCatalog(files)
+	if err != nil {
+		// Only possible if we built invalid locales into the binary,
+		// which our tests catch.
+		panic(err)
+	}
+
+	return catalog
+}
+
+func parseCatalog(files fs.FS) (*Catalog, error) {
+	localeFiles, err := fs.Glob(files, path.Join(localesDirectory, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Catalog{translations: make(map[string]map[string]string)}
+	for _, localeFile := range localeFiles {
+		contents, err := fs.ReadFile(files, localeFile)
+		if err != nil {
+			return nil, err
+		}
+
+		translations := make(map[string]string)
+		if err := yaml.Unmarshal(contents, &translations); err != nil {
+			return nil, fmt.Errorf("Error parsing locale %s: %s", localeFile, err)
+		}
+
+		locale := strings.TrimSuffix(path.Base(localeFile), ".yaml")
+		if _, err := language.Parse(locale); err != nil {
+			return nil, fmt.Errorf("Locale file %s is not named after a language: %s", localeFile, err)
+		}
+
+		c.translations[locale] = translations
+		c.locales = append(c.locales, locale)
+	}
+
+	if _, found := c.translations[defaultLocale]; !found {
+		return nil, fmt.Errorf("Missing the default locale %s", defaultLocale)
+	}
+
+	sort.Slice(c.locales, func(i, j int) bool {
+		return c.locales[i] == defaultLocale || (c.locales[j] != defaultLocale && c.locales[i] < c.locales[j])
+	})
+
+	tags := make([]language.Tag, len(c.locales))
+	for i, locale := range c.locales {
+		tags[i] = language.Make(locale)
+	}
+	c.matcher = language.NewMatcher(tags)
+
+	return c, nil
+}
+
+// Locales returns our supported locales, starting with the default.
+func (c *Catalog) Locales() []string {
+	return c.locales
+}
+
+// Translate returns the message in the given locale, formatting any `args`
+// like `fmt.Sprintf`. We fall back to the default locale for messages which
+// haven't been translated yet, and then to the key itself.
+func (c *Catalog) Translate(locale, key string, args ...interface{}) string {
+	format, found := c.translations[locale][key]
+	if !found {
+		if format, found = c.translations[defaultLocale][key]; !found {
+			return key
+		}
+	}
+
+	if len(args) == 0 {
+		return format
+	}
+
+	return fmt.Sprintf(format, args...)
+}
+
+// MatchLocale returns the locale in which we should show messages. The user's
+// chosen locale (from our cookie), if we support it, takes precedence over the
+// languages they've configured their browser with (from the Accept-Language
+// header).
+func (c *Catalog) MatchLocale(chosenLocale, acceptLanguage string) string {
+	if _, found := c.translations[chosenLocale]; found {
+		return chosenLocale
+	}
+
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return defaultLocale
+	}
+
+	_, index, confidence := c.matcher.Match(tags...)
+	if confidence == language.No {
+		return defaultLocale
+	}
+
+	return c.locales[index]
+}
+
+// Localizer translates messages into a single locale.
+type Localizer struct {
+	catalog *Catalog
+	Locale  string
+}
+
+// localizerFromRequest returns a localizer for the locale the user chose or,
+// if they haven't chosen one, for their browser's languages.
+func localizerFromRequest(catalog *Catalog, r *http.Request) *Localizer {
+	var chosenLocale string
+	if cookie, err := r.Cookie(languageCookieName); err == nil {
+		chosenLocale = cookie.Value
+	}
+
+	return &Localizer{
+		catalog: catalog,
+		Locale:  catalog.MatchLocale(chosenLocale, r.Header.Get("Accept-Language")),
+	}
+}
+
+// templateFuncs are the functions with which our templates translate
+// messages.
+func (l *Localizer) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"t":          l.T,
+		"tError":     l.Error,
+		"locale":     func() string { return l.Locale },
+		"locales":    l.catalog.Locales,
+		"localeName": func(locale string) string { return l.catalog.Translate(locale, "language.name") },
+	}
+}
+
+// T translates the message with the given key.
+func (l *Localizer) T(key string, args ...interface{}) string {
+	return l.catalog.Translate(l.Locale, key, args...)
+}
+
+// Error translates the error, if it's one we show users. Otherwise, we have no
+// translation, so we return its message as is.
+func (l *Localizer) Error(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var userErr userFacingError
+	if errors.As(err, &userErr) {
+		u := userErr.userError()
+		return l.T(u.Key, u.Args...)
+	}
+
+	return err.Error()
+}
+
+// UserError is an error whose message we show users, in their language.
+type UserError struct {
+	// Key is the error's message key in our catalog.
+	Key  string
+	Args []interface{}
+}
+
+// userFacingError is implemented by `UserError` and by the errors embedding
+// it.
+type userFacingError interface {
+	error
+	userError() *UserError
+}
+
+func newUserError(key string, args ...interface{}) *UserError {
+	return &UserError{Key: key, Args: args}
+}
+
+// Error returns the message in our default locale, i.e. for our logs.
+func (u *UserError) Error() string {
+	return messages.Translate(defaultLocale, u.Key, u.Args...)
+}
+
+func (u *UserError) userError() *UserError {
+	return u
+}
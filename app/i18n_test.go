@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var formatVerbRegexp = regexp.MustCompile(`%[-+# 0]*[0-9]*[a-zA-Z]`)
+
+func TestEveryLocaleHasEveryMessage(t *testing.T) {
+	expected := messages.translations[defaultLocale]
+
+	for _, locale := range messages.Locales() {
+		translations := messages.translations[locale]
+
+		for key, format := range expected {
+			translation, found := translations[key]
+			if !found {
+				t.Errorf("Locale %s is missing message %s", locale, key)
+				continue
+			}
+
+			// Translations must fill in the same details, in the same
+			// order.
+			expectedVerbs := formatVerbRegexp.FindAllString(format, -1)
+			verbs := formatVerbRegexp.FindAllString(translation, -1)
+			if !reflect.DeepEqual(expectedVerbs, verbs) {
+				t.Errorf("Locale %s message %s has placeholders %v, but expected %v", locale, key, verbs, expectedVerbs)
+			}
+		}
+
+		for key := range translations {
+			if _, found := expected[key]; !found {
+				t.Errorf("Locale %s has message %s, which doesn't exist in %s", locale, key, defaultLocale)
+			}
+		}
+	}
+}
+
+// messageKeyRegexps find the message keys we use in our templates and code.
+var messageKeyRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`{{ t "([a-z_.]+)"`),
+	regexp.MustCompile(`newUserError\("([a-z_.]+)"[,)]`),
+	regexp.MustCompile(`\.T\("([a-z_.]+)"[,)]`),
+}
+
+func TestEveryMessageKeyExists(t *testing.T) {
+	var usedKeys []string
+
+	templateFiles, _ := fs.Glob(embeddedAssets, "templates/*.html")
+	emailTemplateFiles, _ := fs.Glob(embeddedAssets, "templates/email/*.txt")
+	goFiles, _ := filepath.Glob("*.go")
+
+	for _, file := range append(append(templateFiles, emailTemplateFiles...), goFiles...) {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", file, err)
+		}
+
+		for _, keyRegexp := range messageKeyRegexps {
+			for _, match := range keyRegexp.FindAllStringSubmatch(string(contents), -1) {
+				usedKeys = append(usedKeys, match[1])
+			}
+		}
+	}
+
+	for _, kind := range []YoutubeDlErrorKind{
+		YoutubeDlErrorUnsupportedURL, YoutubeDlErrorGeoBlocked, YoutubeDlErrorPrivate, YoutubeDlErrorAgeRestricted,
+		YoutubeDlErrorCopyright, YoutubeDlErrorThrottled, YoutubeDlErrorNetwork, YoutubeDlErrorUnknown,
+	} {
+		usedKeys = append(usedKeys, (&YoutubeDlError{Kind: kind}).userError().Key)
+	}
+
+	if len(usedKeys) < 10 {
+		t.Fatalf("Expected to find the message keys we use, but only found %v", usedKeys)
+	}
+
+	for _, key := range usedKeys {
+		if _, found := messages.translations[defaultLocale][key]; !found {
+			t.Errorf("Message %s is used, but doesn't exist", key)
+		}
+	}
+}
+
+func TestCatalogLocales(t *testing.T) {
+	locales := messages.Locales()
+	if locales[0] != defaultLocale {
+		t.Fatalf("Expected default locale first, but got %v", locales)
+	}
+
+	if !sort.StringsAreSorted(locales[1:]) || len(locales) < 3 {
+		t.Fatalf("Expected sorted locales, but got %v", locales)
+	}
+}
+
+func TestMatchLocale(t *testing.T) {
+	testCases := []struct {
+		chosenLocale   string
+		acceptLanguage string
+		expected       string
+	}{
+		{"", "", "en"},
+		{"", "es", "es"},
+		{"", "es-MX,es;q=0.9", "es"},
+		{"", "de-DE,fr;q=0.8,en;q=0.5", "fr"},
+		{"", "de-DE", "en"},
+		{"", "not a language", "en"},
+		{"fr", "es", "fr"},
+		{"xx", "es", "es"},
+	}
+
+	for _, testCase := range testCases {
+		if locale := messages.MatchLocale(testCase.chosenLocale, testCase.acceptLanguage); locale != testCase.expected {
+			t.Errorf("Expected %s for %q and %q, but got %s", testCase.expected, testCase.chosenLocale, testCase.acceptLanguage, locale)
+		}
+	}
+}
+
+func TestLocalizerError(t *testing.T) {
+	localizer := &Localizer{catalog: messages, Locale: "es"}
+
+	quotaErr := &QuotaExceededError{newUserError("errors.quota.jobs_per_hour", 5)}
+	if message := localizer.Error(quotaErr); message != "Has alcanzado el límite de 5 descargas por hora. Vuelve a intentarlo más tarde." {
+		t.Fatalf("Expected translated error, but got %q", message)
+	}
+
+	if quotaErr.Error() != "You have reached the limit of 5 downloads per hour. Please try again later." {
+		t.Fatalf("Expected error in the default locale, but got %q", quotaErr.Error())
+	}
+
+	wrappedErr := fmt.Errorf("Error downloading: %w", &YoutubeDlError{Kind: YoutubeDlErrorPrivate})
+	if message := localizer.Error(wrappedErr); message != "Este video es privado." {
+		t.Fatalf("Expected translated wrapped error, but got %q", message)
+	}
+
+	if message := localizer.Error(fmt.Errorf("connection reset")); message != "connection reset" {
+		t.Fatalf("Expected untranslatable error as is, but got %q", message)
+	}
+}
+
+func TestTranslateFallsBackToDefaultLocale(t *testing.T) {
+	catalog := &Catalog{translations: map[string]map[string]string{
+		"en": {"greeting": "Hello %s"},
+		"es": {},
+	}}
+
+	if message := catalog.Translate("es", "greeting", "vidzou"); message != "Hello vidzou" {
+		t.Fatalf("Expected fallback to default locale, but got %q", message)
+	}
+
+	if message := catalog.Translate("es", "missing"); message != "missing" {
+		t.Fatalf("Expected fallback to key, but got %q", message)
+	}
+}
+
+func TestServerRendersInUsersLanguage(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Language", "es-ES,es;q=0.9")
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), "Bienvenido a vidzou") || !strings.Contains(w.Body.String(), `lang="es"`) {
+		t.Fatalf("Expected the index page in Spanish, but got %s", w.Body.String())
+	}
+
+	form := url.Values{"language": []string{"fr"}}
+	req = withTestCSRFToken(httptest.NewRequest("POST", "/language", strings.NewReader(form.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", "http://vidzou.test/downloads/abc")
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/downloads/abc" {
+		t.Fatalf("Expected redirect back to the page, but got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != languageCookieName || cookies[0].Value != "fr" {
+		t.Fatalf("Expected language cookie, but got %v", cookies)
+	}
+
+	// The user's choice takes precedence over their browser's languages.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Language", "es")
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), "Bienvenue sur vidzou") {
+		t.Fatalf("Expected the index page in French, but got %s", w.Body.String())
+	}
+}
+
+func TestServerRendersErrorsInUsersLanguage(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	form := url.Values{"url": []string{"ftp://example.com/video"}}
+	req := withTestCSRFToken(httptest.NewRequest("POST", "/downloads", strings.NewReader(form.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept-Language", "fr")
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Seules les urls http et https sont prises en charge.") {
+		t.Fatalf("Expected error in French, but got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLanguageUpdateOnlyRedirectsToOurPages(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	for _, referer := range []string{"", "http://evil.test//evil.test/path", "not a url\x7f"} {
+		req := withTestCSRFToken(httptest.NewRequest("POST", "/language", strings.NewReader("language=es")))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Referer", referer)
+		w := httptest.NewRecorder()
+		server.router().ServeHTTP(w, req)
+
+		if w.Header().Get("Location") != "/" {
+			t.Errorf("Expected redirect to / for referer %q, but got %s", referer, w.Header().Get("Location"))
+		}
+	}
+}
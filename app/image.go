@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// ImagePullPolicy controls when we pull container images, mirroring
+// kubernetes' image pull policies.
+type ImagePullPolicy string
+
+const (
+	// ImagePullIfNotPresent only pulls images which aren't on the host.
+	// It's the default.
+	ImagePullIfNotPresent ImagePullPolicy = "IfNotPresent"
+	// ImagePullAlways pulls the image every time we ensure it's available
+	// (i.e. before every download), so mutable tags (i.e. "latest") stay
+	// up to date.
+	ImagePullAlways ImagePullPolicy = "Always"
+	// ImagePullNever never pulls images, so they must be loaded onto the
+	// host by other means.
+	ImagePullNever ImagePullPolicy = "Never"
+)
+
+// pullImageOptions aggregates options for pulling images, like
+// `runContainerOptions` does for running containers.
+type pullImageOptions struct {
+	// policy defaults to ImagePullIfNotPresent.
+	policy ImagePullPolicy
+	// credentials, if set, are used when pulling images from their
+	// registry.
+	credentials *RegistryCredentials
+}
+
+// RegistryCredentials authenticate us with a private registry.
+type RegistryCredentials struct {
+	// ServerAddress is the registry's host (i.e. "registry.example.com"). We
+	// only send the credentials when pulling images from this registry.
+	ServerAddress string `yaml:"server_address"`
+	Username      string `yaml:"username"`
+	// PasswordFile contains the password, so the password needn't be in
+	// the config file.
+	PasswordFile string `yaml:"password_file"`
+
+	password string
+}
+
+func validateImagePullPolicy(policy ImagePullPolicy) error {
+	switch policy {
+	case "", ImagePullIfNotPresent, ImagePullAlways, ImagePullNever:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown image pull policy %s", policy)
+}
+
+// loadPassword reads the password from the password file.
+func (r *RegistryCredentials) loadPassword() error {
+	password, err := ioutil.ReadFile(r.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("Error reading registry password file: %s", err)
+	}
+
+	r.password = strings.TrimSpace(string(password))
+	return nil
+}
+
+// credentialsFor returns the credentials to use when pulling the image, or nil
+// if the image isn't from the registry for which we have credentials.
+func (p *pullImageOptions) credentialsFor(imageName string) *RegistryCredentials {
+	if p.credentials == nil || imageRegistry(imageName) != p.credentials.ServerAddress {
+		return nil
+	}
+
+	return p.credentials
+}
+
+// ensureImage implements EnsureImageAvailableOnHost for any container runtime,
+// given functions for inspecting and pulling images with that runtime.
+// `inspect` returns the image's repo digests, and whether the image is on the
+// host at all.
+func ensureImage(imageName string, pullOpts *pullImageOptions, inspect func() ([]string, bool, error), pull func() error) error {
+	repoDigests, imageExistsOnHost, err := inspect()
+	if err != nil {
+		return err
+	}
+
+	var shouldPull bool
+	switch pullOpts.policy {
+	case ImagePullAlways:
+		shouldPull = true
+	case ImagePullNever:
+		if !imageExistsOnHost {
+			return fmt.Errorf("Image %s is not on the host, and the pull policy is %s", imageName, ImagePullNever)
+		}
+	default:
+		shouldPull = !imageExistsOnHost
+	}
+
+	if shouldPull {
+		startedAt := time.Now()
+		err := pull()
+		observeDuration(imagePullDurationSeconds, startedAt, err)
+		if err != nil {
+			return fmt.Errorf("Error pulling image %s: %s", imageName, err)
+		}
+
+		if repoDigests, imageExistsOnHost, err = inspect(); err != nil {
+			return err
+		}
+		if !imageExistsOnHost {
+			return fmt.Errorf("Image %s is not on the host after pulling it", imageName)
+		}
+	}
+
+	return verifyImageDigest(imageName, repoDigests)
+}
+
+// verifyImageDigest ensures that, if the image reference is pinned to a digest
+// (i.e. "repo@sha256:..."), the image on the host has that digest.
+func verifyImageDigest(imageName string, repoDigests []string) error {
+	repository, _, digest := parseImageReference(imageName)
+	if digest == "" {
+		return nil
+	}
+
+	for _, repoDigest := range repoDigests {
+		localRepository, _, localDigest := parseImageReference(repoDigest)
+		if localDigest == digest && normalizeRepository(localRepository) == normalizeRepository(repository) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Image %s on the host does not match digest %s (found %v)", imageName, digest, repoDigests)
+}
+
+// parseImageReference splits an image reference like
+// "registry.example.com:5000/repo:tag@sha256:abc" into its repository, tag and
+// digest.
+func parseImageReference(imageName string) (repository, tag, digest string) {
+	repository = imageName
+	if i := strings.Index(repository, "@"); i != -1 {
+		repository, digest = repository[:i], repository[i+1:]
+	}
+
+	// A colon after the last slash separates the tag, whereas earlier
+	// colons separate the registry's port.
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository, tag = repository[:i], repository[i+1:]
+	}
+
+	return repository, tag, digest
+}
+
+// imageRegistry returns the registry from which the image is pulled.
+func imageRegistry(imageName string) string {
+	repository, _, _ := parseImageReference(imageName)
+
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+
+	return "docker.io"
+}
+
+// normalizeRepository expands docker hub shorthand, so "alpine" and
+// "docker.io/library/alpine" compare equal.
+func normalizeRepository(repository string) string {
+	if imageRegistry(repository) != "docker.io" || strings.HasPrefix(repository, "docker.io/") {
+		return repository
+	}
+
+	if !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+
+	return "docker.io/" + repository
+}
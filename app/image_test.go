@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:4bcff63911fcb4448bd4fdacec207030997caf25e9bea4045fa6c8c44de311d1"
+
+func TestParseImageReference(t *testing.T) {
+	references := map[string][3]string{
+		"alpine":                               {"alpine", "", ""},
+		"alpine:edge":                          {"alpine", "edge", ""},
+		"alpine@" + testDigest:                 {"alpine", "", testDigest},
+		"localhost:5000/youtube-dl:2020.05.29": {"localhost:5000/youtube-dl", "2020.05.29", ""},
+		"registry.example.com:5000/a/b:1@" + testDigest: {"registry.example.com:5000/a/b", "1", testDigest},
+	}
+
+	for reference, expected := range references {
+		repository, tag, digest := parseImageReference(reference)
+		if repository != expected[0] || tag != expected[1] || digest != expected[2] {
+			t.Fatalf("Unexpected parse of %s: %s, %s, %s", reference, repository, tag, digest)
+		}
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	registries := map[string]string{
+		"alpine:edge":                           "docker.io",
+		"mattjmcnaughton/youtube-dl:2020.05.29": "docker.io",
+		"localhost/youtube-dl":                  "localhost",
+		"registry.example.com:5000/a/b:1":       "registry.example.com:5000",
+	}
+
+	for imageName, expectedRegistry := range registries {
+		if registry := imageRegistry(imageName); registry != expectedRegistry {
+			t.Fatalf("Expected registry %s for %s, but got %s", expectedRegistry, imageName, registry)
+		}
+	}
+}
+
+func TestVerifyImageDigest(t *testing.T) {
+	if err := verifyImageDigest("alpine:edge", nil); err != nil {
+		t.Fatalf("Images which aren't pinned should always verify: %s", err)
+	}
+
+	if err := verifyImageDigest("alpine:edge@"+testDigest, []string{"alpine@" + testDigest}); err != nil {
+		t.Fatalf("Image with matching digest should verify: %s", err)
+	}
+
+	if err := verifyImageDigest("docker.io/library/alpine@"+testDigest, []string{"alpine@" + testDigest}); err != nil {
+		t.Fatalf("Image with matching digest should verify regardless of docker hub shorthand: %s", err)
+	}
+
+	otherDigest := "sha256:" + strings.Repeat("0", 64)
+	if err := verifyImageDigest("alpine@"+testDigest, []string{"alpine@" + otherDigest}); err == nil {
+		t.Fatal("Image with different digest should not verify")
+	}
+
+	if err := verifyImageDigest("alpine@"+testDigest, []string{"evil/alpine@" + testDigest}); err == nil {
+		t.Fatal("Image from a different repository should not verify")
+	}
+}
+
+func TestEnsureImage(t *testing.T) {
+	testCases := []struct {
+		policy            ImagePullPolicy
+		imageExistsOnHost bool
+		expectPull        bool
+		expectErr         bool
+	}{
+		{ImagePullIfNotPresent, true, false, false},
+		{ImagePullIfNotPresent, false, true, false},
+		{"", false, true, false},
+		{ImagePullAlways, true, true, false},
+		{ImagePullNever, true, false, false},
+		{ImagePullNever, false, false, true},
+	}
+
+	for _, testCase := range testCases {
+		imageExistsOnHost := testCase.imageExistsOnHost
+		pulled := false
+
+		inspect := func() ([]string, bool, error) {
+			return nil, imageExistsOnHost, nil
+		}
+		pull := func() error {
+			pulled = true
+			imageExistsOnHost = true
+			return nil
+		}
+
+		err := ensureImage("alpine:edge", &pullImageOptions{policy: testCase.policy}, inspect, pull)
+		if (err != nil) != testCase.expectErr || pulled != testCase.expectPull {
+			t.Fatalf("Unexpected result for %+v: pulled %t, error %v", testCase, pulled, err)
+		}
+	}
+}
+
+func TestEnsureImageSurfacesPullErrors(t *testing.T) {
+	inspect := func() ([]string, bool, error) {
+		return nil, false, nil
+	}
+	pull := func() error {
+		return fmt.Errorf("unauthorized")
+	}
+
+	if err := ensureImage("alpine:edge", &pullImageOptions{}, inspect, pull); err == nil {
+		t.Fatal("Expected pull error to be returned")
+	}
+}
+
+func TestPullImageOptionsCredentialsFor(t *testing.T) {
+	credentials := &RegistryCredentials{ServerAddress: "registry.example.com", Username: "vidzou"}
+	pullOpts := &pullImageOptions{credentials: credentials}
+
+	if pullOpts.credentialsFor("registry.example.com/youtube-dl:latest") != credentials {
+		t.Fatal("Expected credentials for images from the registry")
+	}
+
+	if pullOpts.credentialsFor("alpine:edge") != nil {
+		t.Fatal("Should not send credentials to other registries")
+	}
+}
+
+func TestLogPullProgress(t *testing.T) {
+	progressStream := strings.NewReader(`{"status":"Pulling from library/alpine","id":"edge"}
+{"status":"Downloading","progressDetail":{"current":1,"total":2},"id":"abc"}
+{"status":"Downloading","progressDetail":{"current":2,"total":2},"id":"abc"}
+{"errorDetail":{"message":"unexpected EOF"},"error":"unexpected EOF"}
+`)
+
+	if err := logPullProgress(progressStream, "alpine:edge", testLogger); err == nil || err.Error() != "unexpected EOF" {
+		t.Fatalf("Expected error from the progress stream, but got %v", err)
+	}
+
+	if err := logPullProgress(strings.NewReader(`{"status":"Downloading"`), "alpine:edge", testLogger); err == nil {
+		t.Fatal("Expected error from truncated progress stream")
+	}
+
+	if err := logPullProgress(strings.NewReader(`{"status":"Pull complete","id":"abc"}`), "alpine:edge", testLogger); err != nil {
+		t.Fatalf("Should not have error for successful pull: %s", err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// smokeTestMountDirectory is where we mount the smoke test's fixture in the
+// container.
+const smokeTestMountDirectory = "/smoke-test"
+
+// smokeTestFixtureName is the file youtube-dl downloads during the smoke test.
+const smokeTestFixtureName = "smoke-test.mp4"
+
+// rollbackCheckInterval is how often we check whether an update broke
+// downloads.
+const rollbackCheckInterval = time.Minute
+
+// imageUpdatesConfig controls whether vidzou keeps its youtube-dl image up to
+// date. youtube-dl breaks whenever sites change, so old images eventually fail
+// to download anything.
+type imageUpdatesConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Image is the mutable tag we follow for new versions (i.e.
+	// "mattjmcnaughton/youtube-dl:latest").
+	Image                string `yaml:"image"`
+	CheckIntervalMinutes int    `yaml:"check_interval_minutes"`
+
+	// Once an updated image has been used for RollbackMinDownloads
+	// downloads, we roll back to the previous image if the updated
+	// image's failure rate exceeds the previous image's by more than
+	// RollbackFailureRateIncrease (i.e. 0.25 for 25 percentage points).
+	RollbackMinDownloads        int     `yaml:"rollback_min_downloads"`
+	RollbackFailureRateIncrease float64 `yaml:"rollback_failure_rate_increase"`
+}
+
+func defaultImageUpdatesConfig() imageUpdatesConfig {
+	return imageUpdatesConfig{
+		Image:                       "mattjmcnaughton/youtube-dl:latest",
+		CheckIntervalMinutes:        6 * 60,
+		RollbackMinDownloads:        10,
+		RollbackFailureRateIncrease: 0.25,
+	}
+}
+
+// YoutubeDlImageUpdater periodically checks for a new youtube-dl image and,
+// once the new image passes a smoke test, switches the downloader to it. If
+// downloads start failing after an update, we roll back.
+type YoutubeDlImageUpdater struct {
+	containerClient ContainerClient
+	downloader      *ContainerYoutubeDlContentDownloader
+	conf            imageUpdatesConfig
+	logger          logr.Logger
+
+	// previousImageName is the image we used before our most recent
+	// update, to which we'll roll back if the update breaks downloads.
+	// Empty once we're confident the update is healthy.
+	previousImageName   string
+	previousFailureRate float64
+
+	// rejectedImageNames failed their smoke test or were rolled back, so
+	// we won't adopt them again.
+	rejectedImageNames map[string]bool
+}
+
+func NewYoutubeDlImageUpdater(containerClient ContainerClient, downloader *ContainerYoutubeDlContentDownloader, conf imageUpdatesConfig, logger logr.Logger) *YoutubeDlImageUpdater {
+	return &YoutubeDlImageUpdater{
+		containerClient:    containerClient,
+		downloader:         downloader,
+		conf:               conf,
+		logger:             logger,
+		rejectedImageNames: make(map[string]bool),
+	}
+}
+
+// RunImageUpdatesForever checks for image updates (and whether we need to roll
+// them back) until the process exits.
+func RunImageUpdatesForever(updater *YoutubeDlImageUpdater, logger logr.Logger) {
+	checkInterval := time.Duration(updater.conf.CheckIntervalMinutes) * time.Minute
+	var lastUpdateCheck time.Time
+
+	for {
+		if time.Since(lastUpdateCheck) >= checkInterval {
+			lastUpdateCheck = time.Now()
+			if err := updater.CheckForUpdate(); err != nil {
+				logger.V(1).Info("Error updating youtube-dl image", "error", err)
+			}
+		}
+
+		updater.CheckForRollback()
+		time.Sleep(rollbackCheckInterval)
+	}
+}
+
+// CheckForUpdate pulls the image tag we follow and, if it refers to a new
+// image which passes our smoke test, switches the downloader to the new image.
+// We pin the new image by digest, so the tag moving again can't change the
+// image out from under us.
+func (u *YoutubeDlImageUpdater) CheckForUpdate() error {
+	u.logger.V(3).Info("Checking for youtube-dl image update", "image", u.conf.Image)
+
+	pullOpts := &pullImageOptions{policy: ImagePullAlways, credentials: u.downloader.RegistryCredentials}
+	if err := u.containerClient.EnsureImageAvailableOnHost(u.conf.Image, pullOpts); err != nil {
+		return err
+	}
+
+	repoDigests, err := u.containerClient.ImageRepoDigests(u.conf.Image)
+	if err != nil {
+		return err
+	}
+
+	candidateImageName, err := pinnedImageName(u.conf.Image, repoDigests)
+	if err != nil {
+		return err
+	}
+
+	currentImageName := u.downloader.youtubeDlImageName()
+	if candidateImageName == currentImageName || u.rejectedImageNames[candidateImageName] {
+		u.logger.V(3).Info("No youtube-dl image update available", "currentImage", currentImageName)
+		return nil
+	}
+
+	u.logger.V(2).Info("Smoke testing youtube-dl image update", "candidateImage", candidateImageName)
+	if err := u.smokeTest(candidateImageName); err != nil {
+		u.rejectedImageNames[candidateImageName] = true
+		return fmt.Errorf("Image %s failed smoke test: %s", candidateImageName, err)
+	}
+
+	u.previousImageName = currentImageName
+	u.previousFailureRate, _ = u.downloader.imageOutcomes.failureRate(currentImageName)
+	u.downloader.SetYoutubeDlImageName(candidateImageName)
+
+	u.logger.V(1).Info("Updated youtube-dl image", "previousImage", currentImageName, "image", candidateImageName)
+	return nil
+}
+
+// CheckForRollback rolls back our most recent update if downloads using the
+// updated image fail much more often than with the previous image. It returns
+// whether we rolled back.
+func (u *YoutubeDlImageUpdater) CheckForRollback() bool {
+	if u.previousImageName == "" {
+		return false
+	}
+
+	currentImageName := u.downloader.youtubeDlImageName()
+	failureRate, numDownloads := u.downloader.imageOutcomes.failureRate(currentImageName)
+	if numDownloads < u.conf.RollbackMinDownloads {
+		return false
+	}
+
+	if failureRate <= u.previousFailureRate+u.conf.RollbackFailureRateIncrease {
+		u.logger.V(2).Info("youtube-dl image update is healthy", "image", currentImageName, "failureRate", failureRate)
+		u.previousImageName = ""
+		return false
+	}
+
+	u.logger.V(0).Info("Rolling back youtube-dl image update", "image", currentImageName, "failureRate", failureRate, "previousImage", u.previousImageName, "previousFailureRate", u.previousFailureRate)
+	u.downloader.SetYoutubeDlImageName(u.previousImageName)
+	u.rejectedImageNames[currentImageName] = true
+	u.previousImageName = ""
+
+	return true
+}
+
+// smokeTest verifies the image's youtube-dl can download a fixture served
+// from within the container, so the test doesn't depend on any external site.
+func (u *YoutubeDlImageUpdater) smokeTest(imageName string) error {
+	useDefaultTempDirectory := ""
+	fixtureDirectory, err := ioutil.TempDir(useDefaultTempDirectory, "smoke-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(fixtureDirectory)
+
+	if err := u.downloader.Sandbox.prepareMountDirectory(fixtureDirectory); err != nil {
+		return err
+	}
+
+	fixtureContents := []byte(generateRandomString(64 * 1024))
+	if err := ioutil.WriteFile(filepath.Join(fixtureDirectory, smokeTestFixtureName), fixtureContents, 0644); err != nil {
+		return err
+	}
+
+	// The image has python3 (as youtube-dl needs it), so we use it to
+	// serve the fixture.
+	script := fmt.Sprintf(
+		"cd %s && (python3 -m http.server 8000 --bind 127.0.0.1 >/dev/null 2>&1 &) && sleep 2 && /youtube-dl --no-cache-dir -o %s/downloaded.%%(ext)s http://127.0.0.1:8000/%s",
+		smokeTestMountDirectory, smokeTestMountDirectory, smokeTestFixtureName,
+	)
+
+	runContainerOpts := &runContainerOptions{
+		binds:      []string{fmt.Sprintf("%s:%s", fixtureDirectory, smokeTestMountDirectory)},
+		entrypoint: []string{"sh", "-c"},
+	}
+	u.downloader.Sandbox.apply(runContainerOpts)
+
+	if _, err := u.containerClient.RunContainer(context.Background(), imageName, []string{script}, runContainerOpts); err != nil {
+		return err
+	}
+
+	downloadedContents, err := ioutil.ReadFile(filepath.Join(fixtureDirectory, "downloaded.mp4"))
+	if err != nil {
+		return fmt.Errorf("youtube-dl did not download the fixture: %s", err)
+	}
+
+	if !bytes.Equal(downloadedContents, fixtureContents) {
+		return fmt.Errorf("youtube-dl downloaded the fixture incorrectly")
+	}
+
+	return nil
+}
+
+// pinnedImageName returns a reference to the exact image (i.e.
+// "repo@sha256:...") the image name currently refers to.
+func pinnedImageName(imageName string, repoDigests []string) (string, error) {
+	repository, _, _ := parseImageReference(imageName)
+
+	for _, repoDigest := range repoDigests {
+		digestRepository, _, digest := parseImageReference(repoDigest)
+		if digest != "" && normalizeRepository(digestRepository) == normalizeRepository(repository) {
+			return repository + "@" + digest, nil
+		}
+	}
+
+	return "", fmt.Errorf("Image %s has no digest for repository %s", imageName, repository)
+}
+
+// imageOutcomeTracker counts, for each image, the downloads which succeeded and
+// the downloads which failed in a way which may be the image's fault.
+type imageOutcomeTracker struct {
+	mu       sync.Mutex
+	outcomes map[string]*imageOutcomes
+}
+
+type imageOutcomes struct {
+	succeeded int
+	failed    int
+}
+
+func newImageOutcomeTracker() *imageOutcomeTracker {
+	return &imageOutcomeTracker{
+		outcomes: make(map[string]*imageOutcomes),
+	}
+}
+
+func (i *imageOutcomeTracker) record(imageName string, err error) {
+	// Errors we can classify (i.e. private or geo-blocked videos) aren't
+	// the image's fault, whereas a broken extractor shows up as an unknown
+	// error.
+	if youtubeDlErr, ok := err.(*YoutubeDlError); err != nil && (!ok || youtubeDlErr.Kind != YoutubeDlErrorUnknown) {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	outcomes, found := i.outcomes[imageName]
+	if !found {
+		outcomes = &imageOutcomes{}
+		i.outcomes[imageName] = outcomes
+	}
+
+	if err != nil {
+		outcomes.failed++
+	} else {
+		outcomes.succeeded++
+	}
+}
+
+// failureRate returns the fraction of downloads with the image which failed,
+// and the number of downloads on which the fraction is based.
+func (i *imageOutcomeTracker) failureRate(imageName string) (float64, int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	outcomes, found := i.outcomes[imageName]
+	if !found {
+		return 0, 0
+	}
+
+	numDownloads := outcomes.succeeded + outcomes.failed
+	if numDownloads == 0 {
+		return 0, 0
+	}
+
+	return float64(outcomes.failed) / float64(numDownloads), numDownloads
+}
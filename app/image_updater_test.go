@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testUpdatedImageName = "mattjmcnaughton/youtube-dl@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+// fakeSmokeTestRunContainerFunc mimics youtube-dl downloading the smoke test's
+// fixture, unless `broken`.
+func fakeSmokeTestRunContainerFunc(broken bool) func(string, []string, *runContainerOptions) (*runContainerResult, error) {
+	return func(imageName string, cmd []string, runContainerOpts *runContainerOptions) (*runContainerResult, error) {
+		if broken {
+			stderr := "ERROR: Unable to extract video data\n"
+			return &runContainerResult{exitCode: 1, stderr: stderr}, &ContainerExitError{ContainerID: "abc", ExitCode: 1, Stderr: stderr}
+		}
+
+		fixtureDirectory := strings.Split(runContainerOpts.binds[0], ":")[0]
+		contents, err := ioutil.ReadFile(filepath.Join(fixtureDirectory, smokeTestFixtureName))
+		if err != nil {
+			return nil, err
+		}
+
+		return &runContainerResult{}, ioutil.WriteFile(filepath.Join(fixtureDirectory, "downloaded.mp4"), contents, 0644)
+	}
+}
+
+func newTestYoutubeDlImageUpdater(t *testing.T, brokenImage bool) (*YoutubeDlImageUpdater, *ContainerYoutubeDlContentDownloader) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+
+	conf := defaultImageUpdatesConfig()
+	conf.Enabled = true
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RepoDigests = map[string][]string{
+		conf.Image: {testUpdatedImageName},
+	}
+	fakeContainerClient.RunContainerFunc = fakeSmokeTestRunContainerFunc(brokenImage)
+
+	downloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+	// Our tests may not run as root, so we can't chown the fixture.
+	downloader.Sandbox.User = ""
+
+	return NewYoutubeDlImageUpdater(fakeContainerClient, downloader, conf, testLogger), downloader
+}
+
+func TestYoutubeDlImageUpdaterCheckForUpdate(t *testing.T) {
+	updater, downloader := newTestYoutubeDlImageUpdater(t, false)
+	originalImageName := downloader.youtubeDlImageName()
+
+	if err := updater.CheckForUpdate(); err != nil {
+		t.Fatalf("Should not have error checking for update: %s", err)
+	}
+
+	if downloader.youtubeDlImageName() != testUpdatedImageName {
+		t.Fatalf("Expected downloader to use %s, but got %s", testUpdatedImageName, downloader.youtubeDlImageName())
+	}
+
+	if updater.previousImageName != originalImageName {
+		t.Fatalf("Expected to be able to roll back to %s, but got %s", originalImageName, updater.previousImageName)
+	}
+}
+
+func TestYoutubeDlImageUpdaterCheckForUpdateRejectsImageFailingSmokeTest(t *testing.T) {
+	updater, downloader := newTestYoutubeDlImageUpdater(t, true)
+	originalImageName := downloader.youtubeDlImageName()
+
+	if err := updater.CheckForUpdate(); err == nil {
+		t.Fatal("Should have error when the update fails its smoke test")
+	}
+
+	if downloader.youtubeDlImageName() != originalImageName {
+		t.Fatalf("Expected downloader to keep using %s, but got %s", originalImageName, downloader.youtubeDlImageName())
+	}
+
+	if !updater.rejectedImageNames[testUpdatedImageName] {
+		t.Fatal("Expected image failing its smoke test to be rejected")
+	}
+}
+
+func TestYoutubeDlImageUpdaterCheckForRollback(t *testing.T) {
+	testCases := []struct {
+		name               string
+		numFailedDownloads int
+		expectedRollback   bool
+	}{
+		{name: "healthy", numFailedDownloads: 1, expectedRollback: false},
+		{name: "broken", numFailedDownloads: 8, expectedRollback: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			updater, downloader := newTestYoutubeDlImageUpdater(t, false)
+			originalImageName := downloader.youtubeDlImageName()
+
+			if err := updater.CheckForUpdate(); err != nil {
+				t.Fatalf("Should not have error checking for update: %s", err)
+			}
+
+			if updater.CheckForRollback() {
+				t.Fatal("Should not roll back before the update has been used")
+			}
+
+			for i := 0; i < updater.conf.RollbackMinDownloads; i++ {
+				var err error
+				if i < testCase.numFailedDownloads {
+					err = &YoutubeDlError{Kind: YoutubeDlErrorUnknown}
+				}
+				downloader.imageOutcomes.record(testUpdatedImageName, err)
+			}
+
+			if rolledBack := updater.CheckForRollback(); rolledBack != testCase.expectedRollback {
+				t.Fatalf("Expected rolled back to be %t, but got %t", testCase.expectedRollback, rolledBack)
+			}
+
+			expectedImageName := testUpdatedImageName
+			if testCase.expectedRollback {
+				expectedImageName = originalImageName
+			}
+
+			if downloader.youtubeDlImageName() != expectedImageName {
+				t.Fatalf("Expected downloader to use %s, but got %s", expectedImageName, downloader.youtubeDlImageName())
+			}
+
+			// Once rejected, we never adopt the image again.
+			if err := updater.CheckForUpdate(); err != nil {
+				t.Fatalf("Should not have error checking for update: %s", err)
+			}
+
+			if downloader.youtubeDlImageName() != expectedImageName {
+				t.Fatalf("Expected downloader to still use %s, but got %s", expectedImageName, downloader.youtubeDlImageName())
+			}
+		})
+	}
+}
+
+func TestImageOutcomeTrackerIgnoresErrorsNotCausedByImage(t *testing.T) {
+	tracker := newImageOutcomeTracker()
+
+	tracker.record("image", nil)
+	tracker.record("image", &YoutubeDlError{Kind: YoutubeDlErrorPrivate})
+	tracker.record("image", fmt.Errorf("Error creating container"))
+	tracker.record("image", &YoutubeDlError{Kind: YoutubeDlErrorUnknown})
+
+	failureRate, numDownloads := tracker.failureRate("image")
+	if numDownloads != 2 || failureRate != 0.5 {
+		t.Fatalf("Expected a failure rate of 0.5 over 2 downloads, but got %f over %d", failureRate, numDownloads)
+	}
+}
+
+func TestPinnedImageName(t *testing.T) {
+	digest := "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	repoDigests := []string{
+		"other/image@" + digest,
+		"docker.io/mattjmcnaughton/youtube-dl@" + digest,
+	}
+
+	pinnedName, err := pinnedImageName("mattjmcnaughton/youtube-dl:latest", repoDigests)
+	if err != nil {
+		t.Fatalf("Should not have error pinning image: %s", err)
+	}
+
+	if pinnedName != "mattjmcnaughton/youtube-dl@"+digest {
+		t.Fatalf("Unexpected pinned image name %s", pinnedName)
+	}
+
+	if _, err := pinnedImageName("mattjmcnaughton/youtube-dl:latest", repoDigests[:1]); err == nil {
+		t.Fatal("Should have error when no digest matches the repository")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobStatePending   JobState = "pending"
+	JobStateRunning   JobState = "running"
+	JobStateSucceeded JobState = "succeeded"
+	JobStateFailed    JobState = "failed"
+)
+
+// Job tracks a single request to download one or more urls and make the
+// resulting files available to the user.
+type Job struct {
+	ID              string
+	Items           []*JobItem
+	DownloadOptions *DownloadOptions
+
+	// User is the identity of the user who created the job, if we know it
+	// (see `Server.UserHeader`).
+	User string
+	// Email, if set, is the address we email once the job finishes, in the
+	// user's Locale.
+	Email  string
+	Locale string
+
+	// Bundle indicates the user wants all of the job's files in a single
+	// zip archive.
+	Bundle bool
+	// Profile is the output format the user chose. If nil, we upload the
+	// downloaded files as is.
+	Profile *TranscodingProfile
+
+	State JobState
+
+	// PublicDownloadURL is the primary link we show the user once the job
+	// has succeeded: the bundle if one was requested, or the only file if
+	// the job produced just one file.
+	PublicDownloadURL string
+	// Err is only set once the job has failed.
+	Err error
+
+	BytesDownloaded int64
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// JobItem tracks the download of a single url within a job.
+type JobItem struct {
+	RemotePath string
+	State      JobState
+	Files      []*JobFile
+	Err        error
+
+	// ReusedCachedContent indicates we didn't need to download the url,
+	// because an identical download was already available.
+	ReusedCachedContent bool
+
+	// Attempts records every attempt at downloading the url, including
+	// automatic and manual retries.
+	Attempts []*JobAttempt
+}
+
+// JobAttempt records a single attempt at processing a job item.
+type JobAttempt struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Err is nil if the attempt succeeded.
+	Err error
+}
+
+// JobFile is a single file we've made publicly available.
+type JobFile struct {
+	Name              string
+	PublicDownloadURL string
+}
+
+// Complete returns whether the job has finished, successfully or not.
+func (j *Job) Complete() bool {
+	return j.State == JobStateSucceeded || j.State == JobStateFailed
+}
+
+// Files returns all the files created by all of the job's items.
+func (j *Job) Files() []*JobFile {
+	var files []*JobFile
+	for _, item := range j.Items {
+		files = append(files, item.Files...)
+	}
+
+	return files
+}
+
+// Retryable returns whether the user may manually retry the job, which is
+// possible once the job has finished with at least one failed item.
+func (j *Job) Retryable() bool {
+	if !j.Complete() {
+		return false
+	}
+
+	for _, item := range j.Items {
+		if item.State == JobStateFailed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resetForRetry prepares a finished job to be processed again. We only
+// process the failed items again, unless the job is bundled, as the bundle
+// needs every item's files on the local file system.
+func (j *Job) resetForRetry() {
+	for _, item := range j.Items {
+		if j.retriesItem(item) {
+			item.State = JobStatePending
+			item.Files = nil
+			item.Err = nil
+			item.ReusedCachedContent = false
+		}
+	}
+
+	j.State = JobStatePending
+	j.PublicDownloadURL = ""
+	j.Err = nil
+}
+
+// numDownloadsToRetry returns the most videos retrying the job could
+// download, so we can check the client's quota before retrying.
+func (j *Job) numDownloadsToRetry() int {
+	var numItems int
+	for _, item := range j.Items {
+		if j.retriesItem(item) {
+			numItems++
+		}
+	}
+
+	return numItems * j.DownloadOptions.maxDownloadsPerURL()
+}
+
+func (j *Job) retriesItem(item *JobItem) bool {
+	return item.State == JobStateFailed || j.Bundle
+}
+
+// copy returns a deep copy of the job, so callers can read it while the job
+// is updated concurrently.
+func (j *Job) copy() *Job {
+	jobCopy := *j
+
+	jobCopy.Items = make([]*JobItem, len(j.Items))
+	for i, item := range j.Items {
+		itemCopy := *item
+
+		itemCopy.Files = make([]*JobFile, len(item.Files))
+		for k, file := range item.Files {
+			fileCopy := *file
+			itemCopy.Files[k] = &fileCopy
+		}
+
+		itemCopy.Attempts = make([]*JobAttempt, len(item.Attempts))
+		for k, attempt := range item.Attempts {
+			attemptCopy := *attempt
+			itemCopy.Attempts[k] = &attemptCopy
+		}
+
+		jobCopy.Items[i] = &itemCopy
+	}
+
+	return &jobCopy
+}
+
+func NewJob(remotePaths []string, downloadOptions *DownloadOptions) *Job {
+	now := time.Now()
+
+	items := make([]*JobItem, len(remotePaths))
+	for i, remotePath := range remotePaths {
+		items[i] = &JobItem{
+			RemotePath: remotePath,
+			State:      JobStatePending,
+		}
+	}
+
+	return &Job{
+		ID:              generateRandomString(defaultRandomStringLength),
+		Items:           items,
+		DownloadOptions: downloadOptions,
+		State:           JobStatePending,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+}
+
+// JobStore stores jobs. Implementations must be safe for concurrent use, as
+// jobs are processed in background go routines while the web server reads
+// them.
+type JobStore interface {
+	Create(job *Job) error
+	// Get returns a copy of the job, so callers may read it without
+	// worrying about concurrent updates.
+	Get(id string) (*Job, bool)
+	// Update applies `updateFunc` to the stored job while holding any
+	// necessary locks.
+	Update(id string, updateFunc func(job *Job)) error
+	// Stats summarizes the stored jobs, for our metrics.
+	Stats() *JobStoreStats
+}
+
+// JobStoreStats summarizes the jobs in a JobStore.
+type JobStoreStats struct {
+	JobsByState map[JobState]int
+	// PendingItems counts the job items we haven't started processing.
+	PendingItems int
+}
+
+// InMemoryJobStore stores jobs in memory, so all jobs are lost when the
+// process restarts.
+type InMemoryJobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+var _ JobStore = (*InMemoryJobStore)(nil)
+
+func NewInMemoryJobStore() *InMemoryJobStore {
+	return &InMemoryJobStore{
+		jobs: make(map[string]*Job),
+	}
+}
+
+func (i *InMemoryJobStore) Create(job *Job) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, found := i.jobs[job.ID]; found {
+		return fmt.Errorf("Job with id %s already exists", job.ID)
+	}
+
+	i.jobs[job.ID] = job.copy()
+	return nil
+}
+
+func (i *InMemoryJobStore) Get(id string) (*Job, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	job, found := i.jobs[id]
+	if !found {
+		return nil, false
+	}
+
+	return job.copy(), true
+}
+
+func (i *InMemoryJobStore) Update(id string, updateFunc func(job *Job)) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	job, found := i.jobs[id]
+	if !found {
+		return fmt.Errorf("Cannot update non-existent job with id %s", id)
+	}
+
+	updateFunc(job)
+	job.UpdatedAt = time.Now()
+	return nil
+}
+
+func (i *InMemoryJobStore) Stats() *JobStoreStats {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	stats := &JobStoreStats{
+		JobsByState: make(map[JobState]int),
+	}
+
+	for _, job := range i.jobs {
+		stats.JobsByState[job.State]++
+
+		for _, item := range job.Items {
+			if item.State == JobStatePending {
+				stats.PendingItems++
+			}
+		}
+	}
+
+	return stats
+}
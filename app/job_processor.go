@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// JobNotifier is told whenever a job starts running or finishes (i.e. so we
+// can let users know their download is ready). We notify from the job
+// pipeline, so implementations must not block.
+type JobNotifier interface {
+	NotifyJobStateChanged(job *Job)
+}
+
+// JobProcessor runs jobs to completion: downloading each of the job's urls
+// (unless an identical download is already cached) and making the resulting
+// files publicly available.
+type JobProcessor struct {
+	contentDownloader ContentDownloader
+	contentTranscoder ContentTranscoder
+	contentUploader   ContentUploader
+	contentCache      ContentCache
+	jobStore          JobStore
+	logger            logr.Logger
+
+	// RetryPolicy controls how we retry job items which fail for
+	// transient reasons.
+	RetryPolicy RetryPolicy
+
+	// Notifiers are told about every change to a job's state. Can set
+	// after construction, should we find the need.
+	Notifiers []JobNotifier
+
+	// sleep exists so tests can skip waiting between retries.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// itemResult aggregates everything we learn from successfully running a
+// single job item.
+type itemResult struct {
+	files               []*JobFile
+	localFilePaths      []string
+	reusedCachedContent bool
+	bytesDownloaded     int64
+}
+
+func NewJobProcessor(contentDownloader ContentDownloader, contentTranscoder ContentTranscoder, contentUploader ContentUploader, contentCache ContentCache, jobStore JobStore, logger logr.Logger) *JobProcessor {
+	return &JobProcessor{
+		contentDownloader: contentDownloader,
+		contentTranscoder: contentTranscoder,
+		contentUploader:   contentUploader,
+		contentCache:      contentCache,
+		jobStore:          jobStore,
+		logger:            logger,
+
+		// Can set via constructor/setting later, should we find the need.
+		RetryPolicy: defaultRetryPolicy(),
+		sleep:       sleepContext,
+	}
+}
+
+// Process runs the job with the given id. It's intended to be run in a
+// background go routine, so it records the outcome on the job instead of
+// returning it. Items which have already succeeded (i.e. when the user
+// retries a job) are skipped. We only cancel `ctx` when shutting down, which
+// stops the job, failing its unfinished items with `errShuttingDown`.
+func (p *JobProcessor) Process(ctx context.Context, jobID string) {
+	ctx, span := startSpan(contextWithJobID(ctx, jobID), "job.process")
+	defer span.End()
+
+	job, found := p.jobStore.Get(jobID)
+	if !found {
+		p.logger.V(1).Info("Cannot process non-existent job", "jobId", jobID)
+		return
+	}
+
+	p.jobStore.Update(jobID, func(job *Job) {
+		job.State = JobStateRunning
+	})
+	p.notify(jobID)
+
+	var localFilePaths []string
+	for i, item := range job.Items {
+		if item.State == JobStateSucceeded {
+			continue
+		}
+
+		p.jobStore.Update(jobID, func(job *Job) {
+			job.Items[i].State = JobStateRunning
+		})
+
+		result, err := p.processItemWithRetries(ctx, job, i)
+
+		p.jobStore.Update(jobID, func(job *Job) {
+			p.recordItemResult(job, job.Items[i], result, err)
+		})
+
+		if err == nil {
+			localFilePaths = append(localFilePaths, result.localFilePaths...)
+		}
+	}
+
+	var bundleURL string
+	var bundleErr error
+	if job.Bundle && len(localFilePaths) > 0 {
+		bundleURL, bundleErr = p.bundleAndUpload(ctx, job, localFilePaths)
+	}
+
+	p.jobStore.Update(jobID, func(job *Job) {
+		p.recordJobResult(job, bundleURL, bundleErr)
+	})
+
+	if job, found := p.jobStore.Get(jobID); found {
+		span.SetAttributes(attribute.String("vidzou.job_state", string(job.State)))
+	}
+	p.notify(jobID)
+}
+
+// notify tells our notifiers about the job's current state. Each notifier
+// gets its own copy of the job, so may hold onto it.
+func (p *JobProcessor) notify(jobID string) {
+	for _, notifier := range p.Notifiers {
+		if job, found := p.jobStore.Get(jobID); found {
+			notifier.NotifyJobStateChanged(job)
+		}
+	}
+}
+
+func (p *JobProcessor) recordItemResult(job *Job, item *JobItem, result *itemResult, err error) {
+	if err != nil {
+		p.logger.V(2).Info("Job item failed", "jobId", job.ID, "remotePath", item.RemotePath, "error", err)
+		item.State = JobStateFailed
+		item.Err = err
+		return
+	}
+
+	p.logger.V(3).Info("Job item succeeded", "jobId", job.ID, "remotePath", item.RemotePath, "reusedCachedContent", result.reusedCachedContent)
+	item.State = JobStateSucceeded
+	item.Files = result.files
+	item.ReusedCachedContent = result.reusedCachedContent
+	job.BytesDownloaded += result.bytesDownloaded
+}
+
+// recordJobResult determines the overall outcome of the job, once every item
+// has finished. The job succeeds if any of its items succeeded, as we'd rather
+// give the user some of their files than none.
+func (p *JobProcessor) recordJobResult(job *Job, bundleURL string, bundleErr error) {
+	var firstErr error
+	for _, item := range job.Items {
+		if item.State == JobStateSucceeded {
+			firstErr = nil
+			break
+		}
+		if firstErr == nil {
+			firstErr = item.Err
+		}
+	}
+
+	if firstErr == nil && bundleErr != nil {
+		firstErr = newUserError("errors.bundle", bundleErr)
+	}
+
+	if firstErr != nil {
+		p.logger.V(2).Info("Job failed", "jobId", job.ID, "error", firstErr)
+		job.State = JobStateFailed
+		job.Err = firstErr
+		return
+	}
+
+	p.logger.V(3).Info("Job succeeded", "jobId", job.ID)
+	job.State = JobStateSucceeded
+
+	if bundleURL != "" {
+		job.PublicDownloadURL = bundleURL
+	} else if files := job.Files(); len(files) == 1 {
+		job.PublicDownloadURL = files[0].PublicDownloadURL
+	}
+}
+
+// processItemWithRetries processes the job's i-th item, retrying transient
+// failures according to our retry policy. Every attempt is recorded on the
+// item.
+func (p *JobProcessor) processItemWithRetries(ctx context.Context, job *Job, i int) (*itemResult, error) {
+	item := job.Items[i]
+
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return nil, errShuttingDown
+		}
+
+		attemptCtx, span := startSpan(ctx, "job.item", attribute.String("vidzou.url", item.RemotePath), attribute.Int("vidzou.attempt", attempt))
+		startedAt := time.Now()
+		result, err := p.processItem(attemptCtx, job, item)
+		if err != nil && ctx.Err() != nil {
+			// Whatever error the cancellation caused isn't useful
+			// to the user.
+			err = errShuttingDown
+		}
+		endSpan(span, err)
+
+		p.jobStore.Update(job.ID, func(job *Job) {
+			job.Items[i].Attempts = append(job.Items[i].Attempts, &JobAttempt{
+				StartedAt:  startedAt,
+				FinishedAt: time.Now(),
+				Err:        err,
+			})
+		})
+
+		if err == nil || attempt >= p.RetryPolicy.MaxAttempts || !isRetryableError(err) {
+			return result, err
+		}
+
+		backoff := p.RetryPolicy.backoff(attempt)
+		p.logger.V(2).Info("Retrying job item after transient failure", "jobId", job.ID, "remotePath", item.RemotePath, "attempt", attempt, "backoff", backoff, "error", err)
+		if err := p.sleep(ctx, backoff); err != nil {
+			return nil, errShuttingDown
+		}
+	}
+}
+
+func (p *JobProcessor) processItem(ctx context.Context, job *Job, item *JobItem) (*itemResult, error) {
+	var profileName string
+	if job.Profile != nil {
+		profileName = job.Profile.Name
+	}
+	cacheKey := contentCacheKey(item.RemotePath, job.DownloadOptions, profileName)
+
+	// Bundling requires the files on the local file system, which we won't
+	// have if we reuse cached content.
+	if !job.Bundle {
+		if result, ok := p.reuseCachedContent(ctx, job, cacheKey); ok {
+			return result, nil
+		}
+	}
+
+	p.logger.V(3).Info("Starting download", "jobId", job.ID, "remotePath", item.RemotePath)
+	localFilePaths, err := p.contentDownloader.DownloadContent(ctx, item.RemotePath, job.DownloadOptions)
+	if err != nil {
+		return nil, err
+	}
+	p.logger.V(3).Info("Content download completed", "jobId", job.ID, "numFiles", len(localFilePaths))
+
+	if job.Profile != nil {
+		if localFilePaths, err = p.transcode(ctx, job, localFilePaths); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &itemResult{localFilePaths: localFilePaths}
+	var remoteFileNames []string
+
+	for _, localFilePath := range localFilePaths {
+		if fileInfo, err := os.Stat(localFilePath); err == nil {
+			result.bytesDownloaded += fileInfo.Size()
+		}
+
+		p.logger.V(3).Info("Starting upload", "jobId", job.ID, "localFilePath", localFilePath)
+		uploadedContent, err := p.contentUploader.UploadContentPublicly(ctx, localFilePath)
+		if err != nil {
+			return nil, err
+		}
+		p.logger.V(3).Info("Content upload completed", "jobId", job.ID, "localFilePath", localFilePath)
+
+		remoteFileNames = append(remoteFileNames, uploadedContent.RemoteFileName)
+		result.files = append(result.files, &JobFile{
+			Name:              displayFileName(uploadedContent.RemoteFileName),
+			PublicDownloadURL: uploadedContent.PublicURL,
+		})
+	}
+
+	p.contentCache.Store(cacheKey, remoteFileNames)
+
+	return result, nil
+}
+
+// transcode converts all of the downloaded files according to the job's
+// profile.
+func (p *JobProcessor) transcode(ctx context.Context, job *Job, localFilePaths []string) ([]string, error) {
+	transcodedFilePaths := make([]string, len(localFilePaths))
+
+	for i, localFilePath := range localFilePaths {
+		if isSubtitleFile(localFilePath) {
+			// Subtitle sidecars aren't media, so there's nothing to
+			// transcode.
+			transcodedFilePaths[i] = localFilePath
+			continue
+		}
+
+		p.logger.V(3).Info("Starting transcode", "jobId", job.ID, "localFilePath", localFilePath, "profile", job.Profile.Name)
+		transcodedFilePath, err := p.contentTranscoder.TranscodeContent(ctx, localFilePath, job.Profile)
+		if err != nil {
+			return nil, newUserError("errors.transcode", job.Profile.Description, err)
+		}
+		p.logger.V(3).Info("Transcode completed", "jobId", job.ID, "transcodedFilePath", transcodedFilePath)
+
+		transcodedFilePaths[i] = transcodedFilePath
+	}
+
+	return transcodedFilePaths, nil
+}
+
+// reuseCachedContent attempts to reuse previously uploaded content, returning
+// false if there is no usable cached content.
+func (p *JobProcessor) reuseCachedContent(ctx context.Context, job *Job, cacheKey string) (*itemResult, bool) {
+	remoteFileNames, release, found := p.contentCache.Acquire(cacheKey)
+	if !found {
+		return nil, false
+	}
+	defer release()
+
+	result := &itemResult{reusedCachedContent: true}
+	for _, remoteFileName := range remoteFileNames {
+		p.logger.V(3).Info("Reusing cached content", "jobId", job.ID, "remoteFileName", remoteFileName)
+		publicURL, err := p.contentUploader.PublicURLForUploadedContent(ctx, remoteFileName)
+		if err != nil {
+			// Not the end of the world... we can still download the
+			// content again.
+			p.logger.V(2).Info("Failed to reuse cached content", "jobId", job.ID, "remoteFileName", remoteFileName, "error", err)
+			return nil, false
+		}
+
+		result.files = append(result.files, &JobFile{
+			Name:              displayFileName(remoteFileName),
+			PublicDownloadURL: publicURL,
+		})
+	}
+
+	return result, true
+}
+
+// bundleAndUpload zips all of the job's files into a single archive and
+// uploads it, returning the archive's public url.
+func (p *JobProcessor) bundleAndUpload(ctx context.Context, job *Job, localFilePaths []string) (string, error) {
+	bundlePath := filepath.Join(filepath.Dir(localFilePaths[0]), fmt.Sprintf("%s.zip", job.ID))
+
+	p.logger.V(3).Info("Bundling files", "jobId", job.ID, "bundlePath", bundlePath, "numFiles", len(localFilePaths))
+	if err := bundleFiles(bundlePath, localFilePaths); err != nil {
+		return "", err
+	}
+
+	uploadedContent, err := p.contentUploader.UploadContentPublicly(ctx, bundlePath)
+	if err != nil {
+		return "", err
+	}
+
+	return uploadedContent.PublicURL, nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type failingContentDownloader struct{}
+
+func (f *failingContentDownloader) DownloadContent(ctx context.Context, remotePath string, downloadOptions *DownloadOptions) ([]string, error) {
+	return nil, fmt.Errorf("failed to download %s", remotePath)
+}
+
+func (f *failingContentDownloader) BestEffortInit() error {
+	return nil
+}
+
+func newTestJobProcessor(t *testing.T, contentDownloader ContentDownloader) (*JobProcessor, JobStore, *FakeRemoteStoreClient) {
+	t.Helper()
+
+	fakeRemoteStoreClient := NewFakeRemoteStoreClient()
+	uploader := NewRemoteStoreContentUploader(fakeRemoteStoreClient, testLogger)
+	jobStore := NewInMemoryJobStore()
+
+	return NewJobProcessor(contentDownloader, NewFakeContentTranscoder(), uploader, NewInMemoryContentCache(), jobStore, testLogger), jobStore, fakeRemoteStoreClient
+}
+
+func processTestJob(t *testing.T, jobProcessor *JobProcessor, jobStore JobStore, job *Job) *Job {
+	t.Helper()
+
+	if err := jobStore.Create(job); err != nil {
+		t.Fatalf("Error creating job: %s", err)
+	}
+
+	jobProcessor.Process(context.Background(), job.ID)
+
+	processedJob, found := jobStore.Get(job.ID)
+	if !found {
+		t.Fatalf("Job %s should exist after processing", job.ID)
+	}
+
+	return processedJob
+}
+
+func TestJobProcessorProcess(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	jobProcessor, jobStore, fakeRemoteStoreClient := newTestJobProcessor(t, NewFakeContentDownloader(tmpFsClient))
+
+	job := processTestJob(t, jobProcessor, jobStore, NewJob([]string{youtubeURL}, &DownloadOptions{audioOnly: true}))
+	if job.State != JobStateSucceeded {
+		t.Fatalf("Expected job to succeed, but got state %s: %v", job.State, job.Err)
+	}
+	if job.PublicDownloadURL == "" {
+		t.Fatal("Successful job should have a public download url")
+	}
+	if job.Items[0].ReusedCachedContent {
+		t.Fatal("First job for a video should not reuse cached content")
+	}
+
+	// A second job for the same video should reuse the uploaded file.
+	job = processTestJob(t, jobProcessor, jobStore, NewJob([]string{"https://youtu.be/hLswuIQ5Tjk"}, &DownloadOptions{audioOnly: true}))
+	if job.State != JobStateSucceeded {
+		t.Fatalf("Expected job to succeed, but got state %s: %v", job.State, job.Err)
+	}
+	if !job.Items[0].ReusedCachedContent {
+		t.Fatal("Second job for the same video should reuse cached content")
+	}
+
+	allUploadedFiles, _ := fakeRemoteStoreClient.ListAllUploadedFiles()
+	if len(allUploadedFiles) != 1 {
+		t.Fatalf("Expected 1 uploaded file, but found %d", len(allUploadedFiles))
+	}
+}
+
+func TestJobProcessorProcessFailsWhenDownloadFails(t *testing.T) {
+	jobProcessor, jobStore, _ := newTestJobProcessor(t, &failingContentDownloader{})
+
+	job := processTestJob(t, jobProcessor, jobStore, NewJob([]string{invalidURL}, &DownloadOptions{audioOnly: true}))
+	if job.State != JobStateFailed {
+		t.Fatalf("Expected job to fail, but got state %s", job.State)
+	}
+	if job.Err == nil {
+		t.Fatal("Failed job should record its error")
+	}
+	if !job.Complete() {
+		t.Fatal("Failed job should be complete")
+	}
+}
+
+func TestJobProcessorProcessBatch(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	jobProcessor, jobStore, fakeRemoteStoreClient := newTestJobProcessor(t, NewFakeContentDownloader(tmpFsClient))
+
+	remotePaths := []string{youtubeURL, "https://vimeo.com/12345"}
+	job := NewJob(remotePaths, &DownloadOptions{audioOnly: true})
+	job.Bundle = true
+
+	job = processTestJob(t, jobProcessor, jobStore, job)
+	if job.State != JobStateSucceeded {
+		t.Fatalf("Expected job to succeed, but got state %s: %v", job.State, job.Err)
+	}
+
+	for _, item := range job.Items {
+		if item.State != JobStateSucceeded || len(item.Files) != 1 {
+			t.Fatalf("Expected item %s to succeed with 1 file, but got state %s with %d files", item.RemotePath, item.State, len(item.Files))
+		}
+	}
+
+	if job.PublicDownloadURL == "" {
+		t.Fatal("Bundled job should have a public download url for the bundle")
+	}
+
+	// We upload each file, plus the bundle.
+	allUploadedFiles, _ := fakeRemoteStoreClient.ListAllUploadedFiles()
+	if len(allUploadedFiles) != len(remotePaths)+1 {
+		t.Fatalf("Expected %d uploaded files, but found %d", len(remotePaths)+1, len(allUploadedFiles))
+	}
+}
+
+func TestJobProcessorProcessBatchPartialFailure(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	contentDownloader := &remotePathFailingContentDownloader{
+		ContentDownloader: NewFakeContentDownloader(tmpFsClient),
+		failingRemotePath: invalidURL,
+	}
+	jobProcessor, jobStore, _ := newTestJobProcessor(t, contentDownloader)
+
+	job := processTestJob(t, jobProcessor, jobStore, NewJob([]string{youtubeURL, invalidURL}, &DownloadOptions{audioOnly: true}))
+	if job.State != JobStateSucceeded {
+		t.Fatalf("Expected job with some successful items to succeed, but got state %s", job.State)
+	}
+
+	if job.Items[0].State != JobStateSucceeded {
+		t.Fatalf("Expected first item to succeed, but got state %s", job.Items[0].State)
+	}
+	if job.Items[1].State != JobStateFailed || job.Items[1].Err == nil {
+		t.Fatalf("Expected second item to fail with an error, but got state %s", job.Items[1].State)
+	}
+}
+
+// remotePathFailingContentDownloader fails to download one specific remote
+// path, and otherwise delegates to the wrapped ContentDownloader.
+type remotePathFailingContentDownloader struct {
+	ContentDownloader
+	failingRemotePath string
+}
+
+func (r *remotePathFailingContentDownloader) DownloadContent(ctx context.Context, remotePath string, downloadOptions *DownloadOptions) ([]string, error) {
+	if remotePath == r.failingRemotePath {
+		return nil, fmt.Errorf("failed to download %s", remotePath)
+	}
+
+	return r.ContentDownloader.DownloadContent(ctx, remotePath, downloadOptions)
+}
+
+func TestJobProcessorProcessTranscodes(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	jobProcessor, jobStore, _ := newTestJobProcessor(t, NewFakeContentDownloader(tmpFsClient))
+
+	job := NewJob([]string{youtubeURL}, &DownloadOptions{})
+	job.Profile, _ = findTranscodingProfile(defaultTranscodingProfiles(), "phone")
+
+	job = processTestJob(t, jobProcessor, jobStore, job)
+	if job.State != JobStateSucceeded {
+		t.Fatalf("Expected job to succeed, but got state %s: %v", job.State, job.Err)
+	}
+
+	if fileName := job.Items[0].Files[0].Name; filepath.Ext(fileName) != ".mp4" {
+		t.Fatalf("Expected uploaded file to be transcoded to mp4, but got %s", fileName)
+	}
+
+	// The same video with a different profile is different content.
+	job = NewJob([]string{youtubeURL}, &DownloadOptions{})
+	job.Profile, _ = findTranscodingProfile(defaultTranscodingProfiles(), "original")
+
+	job = processTestJob(t, jobProcessor, jobStore, job)
+	if job.Items[0].ReusedCachedContent {
+		t.Fatal("Jobs with different profiles should not reuse each other's content")
+	}
+}
+
+func TestJobProcessorProcessUploadsSubtitles(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	jobProcessor, jobStore, _ := newTestJobProcessor(t, NewFakeContentDownloader(tmpFsClient))
+
+	job := NewJob([]string{youtubeURL}, &DownloadOptions{subtitleLanguages: []string{"en", "es"}})
+	job.Profile, _ = findTranscodingProfile(defaultTranscodingProfiles(), "phone")
+
+	job = processTestJob(t, jobProcessor, jobStore, job)
+	if job.State != JobStateSucceeded {
+		t.Fatalf("Expected job to succeed, but got state %s: %v", job.State, job.Err)
+	}
+
+	files := job.Files()
+	if len(files) != 3 {
+		t.Fatalf("Expected the video and 2 subtitle files, but got %d files", len(files))
+	}
+
+	// Only the video is transcoded.
+	if filepath.Ext(files[0].Name) != ".mp4" || filepath.Ext(files[1].Name) != ".srt" || filepath.Ext(files[2].Name) != ".srt" {
+		t.Fatalf("Unexpected file names: %s, %s, %s", files[0].Name, files[1].Name, files[2].Name)
+	}
+}
+
+// flakyContentDownloader fails with `err` the first `numFailures` times it's
+// called, and otherwise delegates to the wrapped ContentDownloader.
+type flakyContentDownloader struct {
+	ContentDownloader
+	numFailures int
+	err         error
+	numCalls    int
+}
+
+func (f *flakyContentDownloader) DownloadContent(ctx context.Context, remotePath string, downloadOptions *DownloadOptions) ([]string, error) {
+	f.numCalls++
+	if f.numCalls <= f.numFailures {
+		return nil, f.err
+	}
+
+	return f.ContentDownloader.DownloadContent(ctx, remotePath, downloadOptions)
+}
+
+func TestJobProcessorProcessRetriesTransientFailures(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	contentDownloader := &flakyContentDownloader{
+		ContentDownloader: NewFakeContentDownloader(tmpFsClient),
+		numFailures:       2,
+		err:               &YoutubeDlError{Kind: YoutubeDlErrorThrottled},
+	}
+	jobProcessor, jobStore, _ := newTestJobProcessor(t, contentDownloader)
+
+	var backoffs []time.Duration
+	jobProcessor.sleep = func(ctx context.Context, backoff time.Duration) error {
+		backoffs = append(backoffs, backoff)
+		return nil
+	}
+
+	job := processTestJob(t, jobProcessor, jobStore, NewJob([]string{youtubeURL}, &DownloadOptions{audioOnly: true}))
+	if job.State != JobStateSucceeded {
+		t.Fatalf("Expected job to succeed after retrying, but got state %s: %v", job.State, job.Err)
+	}
+
+	attempts := job.Items[0].Attempts
+	if len(attempts) != 3 || attempts[0].Err == nil || attempts[1].Err == nil || attempts[2].Err != nil {
+		t.Fatalf("Expected 2 failed attempts and then a successful attempt, but got %d attempts", len(attempts))
+	}
+
+	if len(backoffs) != 2 || backoffs[1] <= backoffs[0] {
+		t.Fatalf("Expected increasing backoffs between attempts, but got %v", backoffs)
+	}
+}
+
+func TestJobProcessorProcessGivesUpAfterMaxAttempts(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	contentDownloader := &flakyContentDownloader{
+		ContentDownloader: NewFakeContentDownloader(tmpFsClient),
+		numFailures:       10,
+		err:               &YoutubeDlError{Kind: YoutubeDlErrorNetwork},
+	}
+	jobProcessor, jobStore, _ := newTestJobProcessor(t, contentDownloader)
+	jobProcessor.sleep = func(context.Context, time.Duration) error { return nil }
+
+	job := processTestJob(t, jobProcessor, jobStore, NewJob([]string{youtubeURL}, &DownloadOptions{audioOnly: true}))
+	if job.State != JobStateFailed {
+		t.Fatalf("Expected job to fail, but got state %s", job.State)
+	}
+
+	if numAttempts := len(job.Items[0].Attempts); numAttempts != jobProcessor.RetryPolicy.MaxAttempts {
+		t.Fatalf("Expected %d attempts, but got %d", jobProcessor.RetryPolicy.MaxAttempts, numAttempts)
+	}
+}
+
+func TestJobProcessorProcessStopsRetryingWhenCancelled(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	contentDownloader := &flakyContentDownloader{
+		ContentDownloader: NewFakeContentDownloader(tmpFsClient),
+		numFailures:       10,
+		err:               &YoutubeDlError{Kind: YoutubeDlErrorNetwork},
+	}
+	jobProcessor, jobStore, _ := newTestJobProcessor(t, contentDownloader)
+	jobProcessor.RetryPolicy.InitialBackoffSeconds = 60
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	job := NewJob([]string{youtubeURL}, &DownloadOptions{audioOnly: true})
+	if err := jobStore.Create(job); err != nil {
+		t.Fatalf("Error creating job: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		jobProcessor.Process(ctx, job.ID)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cancelling the job should stop us waiting to retry")
+	}
+
+	job, _ = jobStore.Get(job.ID)
+	if job.State != JobStateFailed || job.Items[0].Err != errShuttingDown || len(job.Items[0].Attempts) != 1 {
+		t.Fatalf("Expected job to fail due to the shutdown after 1 attempt, but got %s after %d attempts: %v", job.State, len(job.Items[0].Attempts), job.Err)
+	}
+}
+
+func TestJobProcessorProcessDoesNotRetryPermanentFailures(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	contentDownloader := &flakyContentDownloader{
+		ContentDownloader: NewFakeContentDownloader(tmpFsClient),
+		numFailures:       1,
+		err:               &YoutubeDlError{Kind: YoutubeDlErrorUnsupportedURL},
+	}
+	jobProcessor, jobStore, _ := newTestJobProcessor(t, contentDownloader)
+	jobProcessor.sleep = func(context.Context, time.Duration) error {
+		t.Fatal("Should not wait to retry permanent failures")
+		return nil
+	}
+
+	job := processTestJob(t, jobProcessor, jobStore, NewJob([]string{youtubeURL}, &DownloadOptions{audioOnly: true}))
+	if job.State != JobStateFailed || len(job.Items[0].Attempts) != 1 {
+		t.Fatalf("Expected job to fail after a single attempt, but got state %s after %d attempts", job.State, len(job.Items[0].Attempts))
+	}
+
+	// Manually retrying the job processes it again.
+	jobStore.Update(job.ID, func(job *Job) {
+		job.resetForRetry()
+	})
+	jobProcessor.Process(context.Background(), job.ID)
+
+	job, _ = jobStore.Get(job.ID)
+	if job.State != JobStateSucceeded || len(job.Items[0].Attempts) != 2 {
+		t.Fatalf("Expected manual retry to succeed, but got state %s after %d attempts", job.State, len(job.Items[0].Attempts))
+	}
+}
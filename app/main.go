@@ -2,8 +2,8 @@ package main
 
 import (
 	"flag"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/klogr"
 	"strconv"
@@ -19,12 +19,6 @@ var runningLocally = flag.Bool("local", false, "run app locally")
 var s3Bucket = flag.String("s3_bucket", "", "s3 bucket in which to store info")
 var configFilePath = flag.String("config_file_path", "", "path to yaml config file")
 
-// @TODO(mattjmcnaughton) Need to refactor how we handle config... it shouldn't
-// all be in the main file, it should have better unit tests, etc...
-type config struct {
-	S3Bucket string `yaml:"s3_bucket"`
-}
-
 func main() {
 	initAndParseFlags()
 	logger := klogr.New()
@@ -33,6 +27,15 @@ func main() {
 	var s3CleanUp func() error
 	var err error
 
+	conf := defaultConfig()
+	if len(*configFilePath) != 0 {
+		logger.V(2).Info("Parsing config file", "configFilePath", *configFilePath)
+		conf, err = parseConfigFile(*configFilePath)
+		if err != nil {
+			panic(fmt.Errorf("error parsing config file %s: %w", *configFilePath, err))
+		}
+	}
+
 	if *runningLocally {
 		logger.V(2).Info("Running locally... create tmp s3 bucket")
 
@@ -50,12 +53,9 @@ func main() {
 
 		// @TODO(mattjmcnaughton) this method of processing the configuration is far from
 		// optimal...
-		if len(*configFilePath) != 0 {
+		if len(conf.S3Bucket) != 0 {
 			logger.V(2).Info("Retrieving bucket name from config file")
-			s3BucketName, err = parseBucketNameFromConfigFile(*configFilePath)
-			if err != nil {
-				panic("Error parsing bucket name from config file")
-			}
+			s3BucketName = conf.S3Bucket
 		} else {
 			logger.V(2).Info("Retrieving bucket name from command line argument")
 			if len(*s3Bucket) == 0 {
@@ -77,7 +77,16 @@ func main() {
 		panic(err)
 	}
 
+	shutdownTracing, err := setupTracing(conf.Tracing, logger)
+	if err != nil {
+		panic(err)
+	}
+
 	cleanUpFunc := func() error {
+		if err := shutdownTracing(); err != nil {
+			logger.V(1).Info("Error flushing traces", "error", err)
+		}
+
 		if err := s3CleanUp(); err != nil {
 			return err
 		}
@@ -95,20 +104,87 @@ func main() {
 	}
 
 	logger.V(3).Info("Creating all content managers")
-	downloader, err := NewDockerYoutubeDlContentDownloader(fsClient, logger)
+	containerClient, err := NewContainerClient(conf.Containers, logger)
 	if err != nil {
 		panic(err)
 	}
 
-	go downloader.BestEffortInit()
+	downloader := NewContainerYoutubeDlContentDownloader(containerClient, fsClient, logger)
+	downloader.Sandbox = conf.Sandbox
+	downloader.ImagePullPolicy = conf.Containers.PullPolicy
+	downloader.RegistryCredentials = conf.Containers.Registry
+	downloader.Extractors = NewExtractorFilter(conf.URLs)
+	if conf.Containers.YoutubeDlImage != "" {
+		downloader.YoutubeDlImageName = conf.Containers.YoutubeDlImage
+	}
+	if err := conf.Sandbox.prepareMountDirectory(fsClient.GetMountDirectory()); err != nil {
+		panic(err)
+	}
+
+	if conf.ImageUpdates.Enabled {
+		imageUpdater := NewYoutubeDlImageUpdater(containerClient, downloader, conf.ImageUpdates, logger)
+		go RunImageUpdatesForever(imageUpdater, logger)
+	}
+
+	go func() {
+		if err := downloader.BestEffortInit(); err != nil {
+			// Not fatal, as we try again before each download, but
+			// likely means every download will fail.
+			logger.V(0).Info("Failed to initialize downloader", "error", err)
+		}
+	}()
+
+	// We aren't ready until `BestEffortInit` has ensured the youtube-dl
+	// image is available, as downloads would be slow (or fail) until then.
+	healthChecker := NewHealthChecker(logger)
+	healthChecker.AddCheck("container_runtime", containerClient.Ping)
+	healthChecker.AddCheck("youtube_dl_image", downloader.ImageAvailable)
+	healthChecker.AddCheck("remote_store", s3Client.CheckWritable)
+	healthChecker.AddCheck("disk_space", freeDiskSpaceCheck(fsClient.GetMountDirectory(), conf.Health.MinFreeDiskMB))
 
 	uploader := NewRemoteStoreContentUploader(s3Client, logger)
-	garbageCollector := NewRemoteStoreContentGarbageCollector(s3Client, logger)
+	contentCache := NewInMemoryContentCache()
+	garbageCollector := NewRemoteStoreContentGarbageCollector(s3Client, contentCache, logger)
 
 	garbageCollectorSleepDuration := 5 * time.Minute
 	go RunGarbageCollectionForever(garbageCollector, garbageCollectorSleepDuration, logger)
 
-	server := NewServer(8080, downloader, uploader, logger)
+	quotaEnforcer := NewInMemoryQuotaEnforcer(conf.Limits)
+	urlValidator := NewHostURLValidator(conf.URLs)
+
+	jobStore := NewInMemoryJobStore()
+	prometheus.MustRegister(newJobStoreCollector(jobStore))
+	jobProcessor := NewJobProcessor(downloader, downloader, uploader, contentCache, jobStore, logger)
+	jobProcessor.RetryPolicy = conf.Downloads.Retries
+
+	var webhookNotifier *WebhookNotifier
+	if len(conf.Webhooks.all()) > 0 {
+		webhookNotifier = NewWebhookNotifier(conf.Webhooks, logger)
+		jobProcessor.Notifiers = append(jobProcessor.Notifiers, webhookNotifier)
+	}
+
+	var emailNotifier *EmailNotifier
+	if conf.Email.enabled() {
+		emailNotifier, err = NewEmailNotifier(conf.Email, logger)
+		if err != nil {
+			panic(err)
+		}
+		jobProcessor.Notifiers = append(jobProcessor.Notifiers, emailNotifier)
+	}
+
+	server := NewServer(conf.Server.Port, jobProcessor, jobStore, quotaEnforcer, urlValidator, conf.Downloads, logger)
+	server.UserHeader = conf.Limits.UserHeader
+	server.HealthChecker = healthChecker
+	server.Conf = conf.Server
+	server.Webhooks = webhookNotifier
+	server.Emails = emailNotifier
+	if conf.Server.DevAssetsDirectory != "" {
+		logger.V(2).Info("Reloading assets from disk", "directory", conf.Server.DevAssetsDirectory)
+		server.Assets, err = NewDiskAssets(conf.Server.DevAssetsDirectory, logger)
+		if err != nil {
+			panic(err)
+		}
+	}
 	err = server.ListenAndServe(cleanUpFunc)
 
 	logger.V(2).Info("Terminating program")
@@ -122,19 +198,3 @@ func initAndParseFlags() {
 	flag.Set("v", strconv.Itoa(defaultLogLevel))
 	flag.Parse()
 }
-
-func parseBucketNameFromConfigFile(configFilePath string) (string, error) {
-	yamlFile, err := ioutil.ReadFile(configFilePath)
-
-	if err != nil {
-		return "", err
-	}
-
-	var conf config
-	err = yaml.Unmarshal(yamlFile, &conf)
-	if err != nil {
-		return "", err
-	}
-
-	return conf.S3Bucket, nil
-}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsNamespace prefixes all of our metrics' names.
+const metricsNamespace = "vidzou"
+
+// Outcome label values, for metrics which distinguish success from failure.
+const (
+	metricsOutcomeSuccess = "success"
+	metricsOutcomeFailure = "failure"
+)
+
+var (
+	downloadDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "download_duration_seconds",
+		Help:      "How long youtube-dl downloads take, including any clipping.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"outcome"})
+
+	uploadDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_duration_seconds",
+		Help:      "How long uploading a file to the remote store takes.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"outcome"})
+
+	uploadedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes successfully uploaded to the remote store.",
+	})
+
+	activeContainers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_containers",
+		Help:      "Containers currently running, by the command they run.",
+	}, []string{"command"})
+
+	imagePullDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_pull_duration_seconds",
+		Help:      "How long pulling a container image takes.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"outcome"})
+
+	gcDeletedFilesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_deleted_files_total",
+		Help:      "Stale files the garbage collector deleted from the remote store.",
+	})
+
+	gcFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_failures_total",
+		Help:      "Garbage collection runs, or individual deletions, which failed.",
+	})
+
+	webhookDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook deliveries, once we've given up retrying or succeeded, by outcome.",
+	}, []string{"outcome"})
+
+	emailsSentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "emails_sent_total",
+		Help:      "Emails telling users their download finished, once we've given up retrying or succeeded, by outcome.",
+	}, []string{"outcome"})
+
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "How long serving HTTP requests takes, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+// observeDuration records the time since `startedAt` in the histogram, labelled
+// with the outcome of `err`.
+func observeDuration(histogram *prometheus.HistogramVec, startedAt time.Time, err error) {
+	histogram.WithLabelValues(metricsOutcome(err)).Observe(time.Since(startedAt).Seconds())
+}
+
+func metricsOutcome(err error) string {
+	if err != nil {
+		return metricsOutcomeFailure
+	}
+
+	return metricsOutcomeSuccess
+}
+
+// jobStoreCollector exports the number of jobs in each state, and the number
+// of job items waiting their turn to be processed, whenever we're scraped.
+type jobStoreCollector struct {
+	jobStore JobStore
+
+	jobsDesc       *prometheus.Desc
+	queueDepthDesc *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*jobStoreCollector)(nil)
+
+func newJobStoreCollector(jobStore JobStore) *jobStoreCollector {
+	return &jobStoreCollector{
+		jobStore: jobStore,
+		jobsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "jobs"),
+			"Jobs, by state.",
+			[]string{"state"}, nil,
+		),
+		queueDepthDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "job_queue_depth"),
+			"Job items which are waiting to be processed.",
+			nil, nil,
+		),
+	}
+}
+
+func (j *jobStoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- j.jobsDesc
+	ch <- j.queueDepthDesc
+}
+
+func (j *jobStoreCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := j.jobStore.Stats()
+
+	// Always export every state, so a state's absence doesn't look like a
+	// scrape failure.
+	for _, state := range []JobState{JobStatePending, JobStateRunning, JobStateSucceeded, JobStateFailed} {
+		ch <- prometheus.MustNewConstMetric(j.jobsDesc, prometheus.GaugeValue, float64(stats.JobsByState[state]), string(state))
+	}
+
+	ch <- prometheus.MustNewConstMetric(j.queueDepthDesc, prometheus.GaugeValue, float64(stats.PendingItems))
+}
+
+// instrumentHTTP is middleware recording metrics for each request, labelled by
+// the mux route (i.e. "/downloads/{id}") rather than the path, so we don't
+// create a time series per job.
+func instrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		recorder := &statusRecordingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		startedAt := time.Now()
+		next.ServeHTTP(recorder, r)
+
+		httpRequestDurationSeconds.WithLabelValues(route, r.Method).Observe(time.Since(startedAt).Seconds())
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(recorder.statusCode)).Inc()
+	})
+}
+
+// routeTemplate returns the template of the mux route the request matched
+// (i.e. "/downloads/{id}").
+func routeTemplate(r *http.Request) string {
+	if currentRoute := mux.CurrentRoute(r); currentRoute != nil {
+		if pathTemplate, err := currentRoute.GetPathTemplate(); err == nil {
+			return pathTemplate
+		}
+	}
+
+	return "unknown"
+}
+
+// statusRecordingResponseWriter remembers the status code the handler wrote.
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (s *statusRecordingResponseWriter) WriteHeader(statusCode int) {
+	s.statusCode = statusCode
+	s.ResponseWriter.WriteHeader(statusCode)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestJobStoreCollector(t *testing.T) {
+	jobStore := NewInMemoryJobStore()
+
+	runningJob := NewJob([]string{youtubeURL, youtubeURL + "&2", youtubeURL + "&3"}, &DownloadOptions{})
+	runningJob.State = JobStateRunning
+	runningJob.Items[0].State = JobStateSucceeded
+	runningJob.Items[1].State = JobStateRunning
+
+	for _, job := range []*Job{NewJob([]string{youtubeURL}, &DownloadOptions{}), runningJob} {
+		if err := jobStore.Create(job); err != nil {
+			t.Fatalf("Error creating job: %s", err)
+		}
+	}
+
+	expected := `
+# HELP vidzou_job_queue_depth Job items which are waiting to be processed.
+# TYPE vidzou_job_queue_depth gauge
+vidzou_job_queue_depth 2
+# HELP vidzou_jobs Jobs, by state.
+# TYPE vidzou_jobs gauge
+vidzou_jobs{state="failed"} 0
+vidzou_jobs{state="pending"} 1
+vidzou_jobs{state="running"} 1
+vidzou_jobs{state="succeeded"} 0
+`
+	if err := testutil.CollectAndCompare(newJobStoreCollector(jobStore), strings.NewReader(expected)); err != nil {
+		t.Fatalf("Unexpected job metrics: %s", err)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	requestsBefore := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/downloads/{id}", "GET", "404"))
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/downloads/does-not-exist", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, but got %d", http.StatusNotFound, rec.Code)
+	}
+
+	// We label by route, rather than path, so each job doesn't get its
+	// own time series.
+	requestsAfter := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/downloads/{id}", "GET", "404"))
+	if requestsAfter != requestsBefore+1 {
+		t.Fatalf("Expected request to be counted under its route, but count went from %f to %f", requestsBefore, requestsAfter)
+	}
+
+	rec = httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rec.Code)
+	}
+
+	body, _ := ioutil.ReadAll(rec.Body)
+	if !strings.Contains(string(body), `vidzou_http_requests_total{code="404",method="GET",route="/downloads/{id}"}`) {
+		t.Fatalf("Expected /metrics to export http request metrics, but got %s", body)
+	}
+}
+
+func TestRemoteStoreContentUploaderRecordsMetrics(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "metrics")
+	if err != nil {
+		t.Fatalf("Error creating tmp file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	tmpFile.WriteString("some content")
+
+	uploader := NewRemoteStoreContentUploader(NewFakeRemoteStoreClient(), testLogger)
+
+	bytesBefore := testutil.ToFloat64(uploadedBytesTotal)
+	if _, err := uploader.UploadContentPublicly(context.Background(), tmpFile.Name()); err != nil {
+		t.Fatalf("Should not have error uploading: %s", err)
+	}
+
+	if bytesAfter := testutil.ToFloat64(uploadedBytesTotal); bytesAfter != bytesBefore+float64(len("some content")) {
+		t.Fatalf("Expected uploaded bytes to increase by %d, but went from %f to %f", len("some content"), bytesBefore, bytesAfter)
+	}
+}
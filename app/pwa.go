@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// vidzou is a Progressive Web App, so relatives can install it on their phones
+// and share videos to it (i.e. from the YouTube app) rather than copying and
+// pasting urls. Our web app manifest declares a share target which posts
+// shared urls straight to `downloadsCreate`, and our service worker caches
+// pages so the download history works offline.
+
+var sharedTextURLRegexp = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// urlsInSharedText finds the urls in text shared with us. Apps often share a
+// url as part of their text (i.e. "Check out this video! https://...") rather
+// than as the share's url, so we search the text for them.
+func urlsInSharedText(text string) []string {
+	urls := sharedTextURLRegexp.FindAllString(text, -1)
+	for i, url := range urls {
+		// Punctuation ending a sentence isn't part of the url.
+		urls[i] = strings.TrimRight(url, ".,;:!?)")
+	}
+
+	return urls
+}
+
+// webManifest serves our web app manifest. We serve it (and our service
+// worker) from the root, rather than under /static, so their scope includes
+// every page.
+func (s *Server) webManifest(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(3).Info("Serving request", "endpoint", "GET#manifest.webmanifest")
+	s.Assets.ServeStaticFile(w, r, "manifest.webmanifest", "application/manifest+json")
+}
+
+func (s *Server) serviceWorker(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(3).Info("Serving request", "endpoint", "GET#service-worker.js")
+
+	// Browsers check for a new service worker on every visit, so we
+	// shouldn't let caches hide updates.
+	w.Header().Set("Cache-Control", "no-cache")
+	s.Assets.ServeStaticFile(w, r, "service-worker.js", "text/javascript; charset=utf-8")
+}
+
+// history lists the downloads made on this device. We only know which
+// downloads those are on the device itself, so the page's script fills in the
+// list.
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(2).Info("Serving request", "endpoint", "GET#history")
+	s.Assets.Render(w, r, http.StatusOK, "history", nil)
+}
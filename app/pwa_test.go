@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestURLsInSharedText(t *testing.T) {
+	testCases := []struct {
+		text     string
+		expected []string
+	}{
+		{"", nil},
+		{"No urls here", nil},
+		{youtubeURL, []string{youtubeURL}},
+		{"Watch this! " + youtubeURL + ".", []string{youtubeURL}},
+		{"Funny cat video\nhttps://youtu.be/abc (via YouTube)", []string{"https://youtu.be/abc"}},
+		{"http://a.test/1 and https://b.test/2", []string{"http://a.test/1", "https://b.test/2"}},
+	}
+
+	for _, testCase := range testCases {
+		if urls := urlsInSharedText(testCase.text); !reflect.DeepEqual(urls, testCase.expected) {
+			t.Errorf("Expected %v for %q, but got %v", testCase.expected, testCase.text, urls)
+		}
+	}
+}
+
+func TestServerDownloadsSharedURLs(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	// The form fields our web app manifest's share target posts.
+	rec := postDownloadForm(server, url.Values{
+		"shared_title": []string{"A video"},
+		"shared_text":  []string{"Check out this video! " + youtubeURL},
+	})
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect to the job, but got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	job := waitForJobComplete(t, jobStore, rec)
+	if len(job.Items) != 1 || job.Items[0].RemotePath != youtubeURL {
+		t.Fatalf("Expected job for the shared url, but got %v", job.Items)
+	}
+}
+
+func TestServerServesWebManifest(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/manifest.webmanifest", nil))
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/manifest+json" {
+		t.Fatalf("Expected manifest, but got %d with %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var manifest struct {
+		StartURL string `json:"start_url"`
+		Icons    []struct {
+			Src string `json:"src"`
+		} `json:"icons"`
+		ShareTarget struct {
+			Action string            `json:"action"`
+			Method string            `json:"method"`
+			Params map[string]string `json:"params"`
+		} `json:"share_target"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &manifest); err != nil {
+		t.Fatalf("Should not have error parsing manifest: %s", err)
+	}
+
+	if manifest.ShareTarget.Action != "/downloads" || manifest.ShareTarget.Method != "POST" {
+		t.Fatalf("Expected share target posting to /downloads, but got %+v", manifest.ShareTarget)
+	}
+
+	expectedParams := map[string]string{"title": "shared_title", "text": "shared_text", "url": "url"}
+	if !reflect.DeepEqual(manifest.ShareTarget.Params, expectedParams) {
+		t.Fatalf("Expected share target params %v, but got %v", expectedParams, manifest.ShareTarget.Params)
+	}
+
+	for _, icon := range manifest.Icons {
+		iconRec := httptest.NewRecorder()
+		server.router().ServeHTTP(iconRec, httptest.NewRequest("GET", icon.Src, nil))
+
+		if iconRec.Code != http.StatusOK || iconRec.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("Expected icon %s, but got %d", icon.Src, iconRec.Code)
+		}
+	}
+}
+
+var appShellRegexp = regexp.MustCompile(`(?s)const APP_SHELL = \[(.*?)\];`)
+var quotedStringRegexp = regexp.MustCompile(`"([^"]*)"`)
+
+func TestServerServesServiceWorkerAndAppShell(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/service-worker.js", nil))
+
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/javascript") {
+		t.Fatalf("Expected service worker, but got %d with %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	if rec.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("Expected service worker to not be cached, but got %s", rec.Header().Get("Cache-Control"))
+	}
+
+	// The service worker fails to install if any of the app shell is
+	// missing.
+	appShell := appShellRegexp.FindStringSubmatch(rec.Body.String())
+	if appShell == nil {
+		t.Fatal("Expected service worker to define its app shell")
+	}
+
+	for _, match := range quotedStringRegexp.FindAllStringSubmatch(appShell[1], -1) {
+		shellRec := httptest.NewRecorder()
+		server.router().ServeHTTP(shellRec, httptest.NewRequest("GET", match[1], nil))
+
+		if shellRec.Code != http.StatusOK {
+			t.Errorf("Expected app shell %s, but got %d", match[1], shellRec.Code)
+		}
+	}
+}
+
+func TestServerHistory(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/history", nil))
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `id="history"`) {
+		t.Fatalf("Expected history page, but got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if !strings.Contains(rec.Body.String(), `data-state-succeeded="Done"`) {
+		t.Fatal("Expected history page to provide translated job states")
+	}
+}
+
+func TestDownloadsShowDescribesJobForHistory(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := postDownloadForm(server, url.Values{"url": []string{youtubeURL}})
+	job := waitForJobComplete(t, jobStore, rec)
+
+	showRec := httptest.NewRecorder()
+	server.router().ServeHTTP(showRec, httptest.NewRequest("GET", "/downloads/"+job.ID, nil))
+
+	body := html.UnescapeString(showRec.Body.String())
+	for _, expected := range []string{
+		`data-id="` + job.ID + `"`,
+		`data-state="succeeded"`,
+		`data-remote-paths="["` + youtubeURL + `"]"`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected job page to contain %s, but got %s", expected, body)
+		}
+	}
+}
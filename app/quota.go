@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quotaLimits are the limits we apply to a single client (i.e. a user or an
+// ip). A zero value for any limit means the limit is not enforced.
+type quotaLimits struct {
+	JobsPerHour             int   `yaml:"jobs_per_hour"`
+	ConcurrentJobs          int   `yaml:"concurrent_jobs"`
+	BytesPerDay             int64 `yaml:"bytes_per_day"`
+	MaxVideoDurationSeconds int   `yaml:"max_video_duration_seconds"`
+}
+
+// limitsJobs returns whether any limit counts the client's jobs, rather than
+// what they download.
+func (q quotaLimits) limitsJobs() bool {
+	return q.JobsPerHour > 0 || q.ConcurrentJobs > 0
+}
+
+// quotaClient identifies who is asking for a download. `user` is empty unless
+// we are configured to trust an authenticating proxy's user header.
+type quotaClient struct {
+	user string
+	ip   string
+}
+
+// QuotaEnforcer decides whether a client may start a new download job.
+type QuotaEnforcer interface {
+	// Reserve checks every limit applying to the client and, if none are
+	// exceeded, records the start of a new job downloading up to
+	// `numDownloads` videos. Each video counts against the client's job
+	// limits, so batches and playlists can't get around them. The returned
+	// release func must be called exactly once when the job finishes, with
+	// the number of bytes the job downloaded.
+	Reserve(client *quotaClient, numDownloads int) (release func(bytesDownloaded int64), err error)
+
+	// MaxVideoDuration returns the longest video the client may download,
+	// or zero if there is no limit.
+	MaxVideoDuration(client *quotaClient) time.Duration
+}
+
+// QuotaExceededError is returned by `Reserve` when a client has hit one of its
+// limits. Its message is intended to be shown directly to the user.
+type QuotaExceededError struct {
+	*UserError
+}
+
+// InMemoryQuotaEnforcer tracks usage in memory, so usage resets whenever the
+// process restarts. That's acceptable for a family sized deployment.
+type InMemoryQuotaEnforcer struct {
+	perUser quotaLimits
+	perIP   quotaLimits
+
+	mu    sync.Mutex
+	usage map[string]*clientUsage
+
+	// now exists so tests can control the passage of time.
+	now func() time.Time
+}
+
+type clientUsage struct {
+	jobStartTimes []time.Time
+	activeJobs    int
+	downloads     []downloadUsage
+}
+
+type downloadUsage struct {
+	completedAt time.Time
+	bytes       int64
+}
+
+var _ QuotaEnforcer = (*InMemoryQuotaEnforcer)(nil)
+
+func NewInMemoryQuotaEnforcer(limits limitsConfig) *InMemoryQuotaEnforcer {
+	return &InMemoryQuotaEnforcer{
+		perUser: limits.PerUser,
+		perIP:   limits.PerIP,
+		usage:   make(map[string]*clientUsage),
+		now:     time.Now,
+	}
+}
+
+// subjects returns the usage keys (and the limits which apply to them) for a
+// given client. We track users and ips in the same map, so we prefix the keys
+// to avoid collisions.
+func (q *InMemoryQuotaEnforcer) subjects(client *quotaClient) map[string]quotaLimits {
+	subjects := make(map[string]quotaLimits)
+
+	if client.user != "" {
+		subjects["user:"+client.user] = q.perUser
+	}
+	if client.ip != "" {
+		subjects["ip:"+client.ip] = q.perIP
+	}
+
+	return subjects
+}
+
+func (q *InMemoryQuotaEnforcer) Reserve(client *quotaClient, numDownloads int) (func(bytesDownloaded int64), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	q.forgetIdleUsage(now)
+	subjects := q.subjects(client)
+
+	// Check every limit before recording anything, so a rejected request
+	// doesn't count against the client.
+	for key, limits := range subjects {
+		if err := q.usageFor(key, now).check(limits, numDownloads); err != nil {
+			return nil, err
+		}
+	}
+
+	for key := range subjects {
+		usage := q.usageFor(key, now)
+		for i := 0; i < numDownloads; i++ {
+			usage.jobStartTimes = append(usage.jobStartTimes, now)
+		}
+		usage.activeJobs += numDownloads
+	}
+
+	var once sync.Once
+	release := func(bytesDownloaded int64) {
+		once.Do(func() {
+			q.release(subjects, numDownloads, bytesDownloaded)
+		})
+	}
+
+	return release, nil
+}
+
+func (q *InMemoryQuotaEnforcer) release(subjects map[string]quotaLimits, numDownloads int, bytesDownloaded int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	for key := range subjects {
+		usage := q.usageFor(key, now)
+		usage.activeJobs -= numDownloads
+		usage.downloads = append(usage.downloads, downloadUsage{completedAt: now, bytes: bytesDownloaded})
+	}
+}
+
+func (q *InMemoryQuotaEnforcer) MaxVideoDuration(client *quotaClient) time.Duration {
+	var maxDuration time.Duration
+
+	for _, limits := range q.subjects(client) {
+		limit := time.Duration(limits.MaxVideoDurationSeconds) * time.Second
+		if limit > 0 && (maxDuration == 0 || limit < maxDuration) {
+			maxDuration = limit
+		}
+	}
+
+	return maxDuration
+}
+
+// usageFor returns the usage for the key, first dropping any usage which has
+// aged out of every window we care about. Must be called with `mu` held.
+func (q *InMemoryQuotaEnforcer) usageFor(key string, now time.Time) *clientUsage {
+	usage, found := q.usage[key]
+	if !found {
+		usage = &clientUsage{}
+		q.usage[key] = usage
+	}
+
+	hourAgo := now.Add(-1 * time.Hour)
+	for len(usage.jobStartTimes) > 0 && !usage.jobStartTimes[0].After(hourAgo) {
+		usage.jobStartTimes = usage.jobStartTimes[1:]
+	}
+
+	dayAgo := now.Add(-24 * time.Hour)
+	for len(usage.downloads) > 0 && !usage.downloads[0].completedAt.After(dayAgo) {
+		usage.downloads = usage.downloads[1:]
+	}
+
+	return usage
+}
+
+// forgetIdleUsage drops the usage of every client which no longer counts
+// against any limit, so we don't remember every client we've ever seen. Must
+// be called with `mu` held.
+func (q *InMemoryQuotaEnforcer) forgetIdleUsage(now time.Time) {
+	for key := range q.usage {
+		if q.usageFor(key, now).idle() {
+			delete(q.usage, key)
+		}
+	}
+}
+
+// idle returns whether the client has no running jobs, and no recent jobs or
+// downloads which count against its limits.
+func (c *clientUsage) idle() bool {
+	return c.activeJobs == 0 && len(c.jobStartTimes) == 0 && len(c.downloads) == 0
+}
+
+// check returns a `*QuotaExceededError` if starting `numDownloads` more
+// downloads would exceed any of the limits.
+func (c *clientUsage) check(limits quotaLimits, numDownloads int) error {
+	if limits.ConcurrentJobs > 0 && c.activeJobs+numDownloads > limits.ConcurrentJobs {
+		if numDownloads > limits.ConcurrentJobs {
+			return &QuotaExceededError{newUserError("errors.quota.too_many_downloads", limits.ConcurrentJobs)}
+		}
+		return &QuotaExceededError{newUserError("errors.quota.concurrent_jobs", c.activeJobs)}
+	}
+
+	if limits.JobsPerHour > 0 && len(c.jobStartTimes)+numDownloads > limits.JobsPerHour {
+		if numDownloads > limits.JobsPerHour {
+			return &QuotaExceededError{newUserError("errors.quota.too_many_downloads", limits.JobsPerHour)}
+		}
+		return &QuotaExceededError{newUserError("errors.quota.jobs_per_hour", limits.JobsPerHour)}
+	}
+
+	if limits.BytesPerDay > 0 {
+		var bytesToday int64
+		for _, d := range c.downloads {
+			bytesToday += d.bytes
+		}
+
+		if bytesToday >= limits.BytesPerDay {
+			return &QuotaExceededError{newUserError("errors.quota.bytes_per_day", formatBytes(limits.BytesPerDay))}
+		}
+	}
+
+	return nil
+}
+
+// byteUnits are the units in which `formatBytes` shows sizes, each 1024 times
+// the previous.
+var byteUnits = []string{"B", "KB", "MB", "GB", "TB"}
+
+// formatBytes formats the size in the largest unit in which it's at least one,
+// with at most one decimal place, i.e. "512 KB" or "1.5 GB".
+func formatBytes(bytes int64) string {
+	size := float64(bytes)
+	unit := 0
+	for size >= 1024 && unit < len(byteUnits)-1 {
+		size /= 1024
+		unit++
+	}
+
+	formattedSize := strings.TrimSuffix(strconv.FormatFloat(size, 'f', 1, 64), ".0")
+	return fmt.Sprintf("%s %s", formattedSize, byteUnits[unit])
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInMemoryQuotaEnforcerJobsPerHour(t *testing.T) {
+	quotaEnforcer := NewInMemoryQuotaEnforcer(limitsConfig{
+		PerIP: quotaLimits{JobsPerHour: 2},
+	})
+
+	now := time.Now()
+	quotaEnforcer.now = func() time.Time { return now }
+
+	client := &quotaClient{ip: "10.0.0.1"}
+	for i := 0; i < 2; i++ {
+		release, err := quotaEnforcer.Reserve(client, 1)
+		if err != nil {
+			t.Fatalf("Should be able to reserve job %d: %s", i, err)
+		}
+		release(0)
+	}
+
+	if _, err := quotaEnforcer.Reserve(client, 1); err == nil {
+		t.Fatal("Should not be able to exceed jobs per hour")
+	}
+
+	otherClient := &quotaClient{ip: "10.0.0.2"}
+	if _, err := quotaEnforcer.Reserve(otherClient, 1); err != nil {
+		t.Fatalf("Limits of one ip should not impact another ip: %s", err)
+	}
+
+	now = now.Add(61 * time.Minute)
+	if _, err := quotaEnforcer.Reserve(client, 1); err != nil {
+		t.Fatalf("Should be able to reserve job after an hour passes: %s", err)
+	}
+}
+
+func TestInMemoryQuotaEnforcerConcurrentJobs(t *testing.T) {
+	quotaEnforcer := NewInMemoryQuotaEnforcer(limitsConfig{
+		PerUser: quotaLimits{ConcurrentJobs: 1},
+	})
+
+	client := &quotaClient{user: "grandma", ip: "10.0.0.1"}
+	release, err := quotaEnforcer.Reserve(client, 1)
+	if err != nil {
+		t.Fatalf("Should be able to reserve first job: %s", err)
+	}
+
+	_, err = quotaEnforcer.Reserve(client, 1)
+	if _, ok := err.(*QuotaExceededError); !ok {
+		t.Fatalf("Expected QuotaExceededError, but got: %v", err)
+	}
+
+	// Calling release more than once should not free up additional slots.
+	release(0)
+	release(0)
+
+	if _, err := quotaEnforcer.Reserve(client, 1); err != nil {
+		t.Fatalf("Should be able to reserve job after first job finishes: %s", err)
+	}
+	if _, err := quotaEnforcer.Reserve(client, 1); err == nil {
+		t.Fatal("Should not be able to exceed concurrent jobs")
+	}
+}
+
+func TestInMemoryQuotaEnforcerCountsEveryDownload(t *testing.T) {
+	quotaEnforcer := NewInMemoryQuotaEnforcer(limitsConfig{
+		PerIP: quotaLimits{ConcurrentJobs: 3, JobsPerHour: 4},
+	})
+
+	client := &quotaClient{ip: "10.0.0.1"}
+	if _, err := quotaEnforcer.Reserve(client, 4); err == nil {
+		t.Fatal("Should not be able to start more concurrent downloads than the limit in one job")
+	}
+
+	release, err := quotaEnforcer.Reserve(client, 3)
+	if err != nil {
+		t.Fatalf("Should be able to reserve downloads up to the limit: %s", err)
+	}
+
+	if _, err := quotaEnforcer.Reserve(client, 1); err == nil {
+		t.Fatal("Should not be able to exceed concurrent downloads")
+	}
+
+	release(0)
+	if _, err := quotaEnforcer.Reserve(client, 2); err == nil {
+		t.Fatal("Should not be able to exceed downloads per hour")
+	}
+	if _, err := quotaEnforcer.Reserve(client, 1); err != nil {
+		t.Fatalf("Should be able to reserve the last download this hour: %s", err)
+	}
+}
+
+func TestInMemoryQuotaEnforcerBytesPerDay(t *testing.T) {
+	quotaEnforcer := NewInMemoryQuotaEnforcer(limitsConfig{
+		PerIP: quotaLimits{BytesPerDay: 100},
+	})
+
+	now := time.Now()
+	quotaEnforcer.now = func() time.Time { return now }
+
+	client := &quotaClient{ip: "10.0.0.1"}
+	release, err := quotaEnforcer.Reserve(client, 1)
+	if err != nil {
+		t.Fatalf("Should be able to reserve first job: %s", err)
+	}
+	release(150)
+
+	_, err = quotaEnforcer.Reserve(client, 1)
+	if err == nil {
+		t.Fatal("Should not be able to exceed bytes per day")
+	}
+
+	if err.Error() != "You have reached the limit of 100 B of downloads per day. Please try again tomorrow." {
+		t.Fatalf("Expected the limit in the error, but got %q", err.Error())
+	}
+
+	now = now.Add(25 * time.Hour)
+	if _, err := quotaEnforcer.Reserve(client, 1); err != nil {
+		t.Fatalf("Should be able to reserve job after a day passes: %s", err)
+	}
+}
+
+func TestInMemoryQuotaEnforcerMaxVideoDuration(t *testing.T) {
+	quotaEnforcer := NewInMemoryQuotaEnforcer(limitsConfig{
+		PerUser: quotaLimits{MaxVideoDurationSeconds: 300},
+		PerIP:   quotaLimits{MaxVideoDurationSeconds: 600},
+	})
+
+	ipOnlyClient := &quotaClient{ip: "10.0.0.1"}
+	if maxDuration := quotaEnforcer.MaxVideoDuration(ipOnlyClient); maxDuration != 10*time.Minute {
+		t.Fatalf("Expected max duration of 10m, but got %s", maxDuration)
+	}
+
+	userClient := &quotaClient{user: "grandpa", ip: "10.0.0.1"}
+	if maxDuration := quotaEnforcer.MaxVideoDuration(userClient); maxDuration != 5*time.Minute {
+		t.Fatalf("Expected strictest max duration of 5m, but got %s", maxDuration)
+	}
+
+	unlimitedQuotaEnforcer := NewInMemoryQuotaEnforcer(limitsConfig{})
+	if maxDuration := unlimitedQuotaEnforcer.MaxVideoDuration(userClient); maxDuration != 0 {
+		t.Fatalf("Expected no max duration, but got %s", maxDuration)
+	}
+}
+
+func TestInMemoryQuotaEnforcerForgetsIdleClients(t *testing.T) {
+	quotaEnforcer := NewInMemoryQuotaEnforcer(limitsConfig{
+		PerUser: quotaLimits{JobsPerHour: 2},
+		PerIP:   quotaLimits{JobsPerHour: 2},
+	})
+
+	now := time.Now()
+	quotaEnforcer.now = func() time.Time { return now }
+
+	release, err := quotaEnforcer.Reserve(&quotaClient{user: "alice", ip: "10.0.0.1"}, 1)
+	if err != nil {
+		t.Fatalf("Should be able to reserve job: %s", err)
+	}
+
+	// Clients with running jobs aren't idle, however long the job runs.
+	now = now.Add(25 * time.Hour)
+	if _, err := quotaEnforcer.Reserve(&quotaClient{ip: "10.0.0.2"}, 1); err != nil {
+		t.Fatalf("Should be able to reserve job: %s", err)
+	}
+	if len(quotaEnforcer.usage) != 3 {
+		t.Fatalf("Expected to remember 3 clients, but remembered %d", len(quotaEnforcer.usage))
+	}
+
+	release(0)
+	now = now.Add(25 * time.Hour)
+	if _, err := quotaEnforcer.Reserve(&quotaClient{ip: "10.0.0.3"}, 1); err != nil {
+		t.Fatalf("Should be able to reserve job: %s", err)
+	}
+
+	// 10.0.0.2's job is still running, but alice's finished over a day
+	// ago.
+	for _, key := range []string{"user:alice", "ip:10.0.0.1"} {
+		if _, found := quotaEnforcer.usage[key]; found {
+			t.Errorf("Expected to forget idle client %s", key)
+		}
+	}
+	if len(quotaEnforcer.usage) != 2 {
+		t.Fatalf("Expected to remember 2 clients, but remembered %d", len(quotaEnforcer.usage))
+	}
+}
+
+func TestConfigValidateRequiresMaxPlaylistItemsWhenLimitingJobs(t *testing.T) {
+	conf := defaultConfig()
+	conf.Downloads.MaxPlaylistItems = 0
+	conf.Limits.PerIP.MaxVideoDurationSeconds = 600
+	conf.Limits.PerUser.BytesPerDay = 1024
+	if err := conf.validate(); err != nil {
+		t.Fatalf("Unlimited playlists should be valid without job limits: %s", err)
+	}
+
+	conf.Limits.PerUser.JobsPerHour = 10
+	if err := conf.validate(); err == nil {
+		t.Fatal("Unlimited playlists should be invalid when limiting jobs per hour")
+	}
+
+	conf.Limits.PerUser.JobsPerHour = 0
+	conf.Limits.PerIP.ConcurrentJobs = 2
+	if err := conf.validate(); err == nil {
+		t.Fatal("Unlimited playlists should be invalid when limiting concurrent jobs")
+	}
+
+	conf.Downloads.MaxPlaylistItems = 25
+	if err := conf.validate(); err != nil {
+		t.Fatalf("Capped playlists should be valid when limiting jobs: %s", err)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	bytesToFormatted := map[int64]string{
+		0:                                "0 B",
+		100:                              "100 B",
+		512 * 1024:                       "512 KB",
+		1536 * 1024:                      "1.5 MB",
+		5 * 1024 * 1024 * 1024:           "5 GB",
+		1024 * 1024 * 1024 * 1024 * 1024: "1024 TB",
+	}
+
+	for bytes, expected := range bytesToFormatted {
+		if formatted := formatBytes(bytes); formatted != expected {
+			t.Fatalf("Expected %d bytes to be formatted as %q, but got %q", bytes, expected, formatted)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -19,10 +21,20 @@ type RemoteStoreClient interface {
 	// privately and then another for sharing the public link... but I'm not
 	// sure that actually buys us anything.
 	UploadFilePublicly(hostFilePath, remoteFileName string) (string, error)
+	// GeneratePublicURL returns a new publicly accessible link for a file
+	// we've already uploaded.
+	GeneratePublicURL(remoteFileName string) (string, error)
 	ListAllUploadedFiles() ([]*RemoteFile, error)
 	DeleteFile(remoteFileName string) error
+	// CheckWritable verifies we can write to (and delete from) the remote
+	// store.
+	CheckWritable() error
 }
 
+// writableCheckFileName is the file we write (and immediately delete) to check
+// the remote store is writable.
+const writableCheckFileName = ".vidzou-writable-check"
+
 type RemoteFile struct {
 	FilePath     string
 	LastModified time.Time
@@ -48,6 +60,9 @@ type s3ConfigurationOptions struct {
 
 type FakeRemoteStoreClient struct {
 	remoteFiles []*RemoteFile
+
+	// WritableErr, if set, is returned by `CheckWritable`.
+	WritableErr error
 }
 
 var _ RemoteStoreClient = (*S3Client)(nil)
@@ -89,7 +104,7 @@ func (s *S3Client) UploadFilePublicly(hostFilePath, remoteFileName string) (stri
 		return "", err
 	}
 
-	return s.generatePublicURLForUploadedFile(remoteFileName)
+	return s.GeneratePublicURL(remoteFileName)
 }
 
 func (s *S3Client) uploadFile(hostFilePath, remoteFileName string) error {
@@ -107,7 +122,9 @@ func (s *S3Client) uploadFile(hostFilePath, remoteFileName string) error {
 	return err
 }
 
-func (s *S3Client) generatePublicURLForUploadedFile(remoteFileName string) (string, error) {
+// GeneratePublicURL generates a presigned url for a file we've already
+// uploaded.
+func (s *S3Client) GeneratePublicURL(remoteFileName string) (string, error) {
 	s.logger.V(3).Info("Generating public URL for remote file", "remoteFileName", remoteFileName)
 
 	objectRequest, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
@@ -168,6 +185,28 @@ func (s *S3Client) DeleteFile(remoteFileName string) error {
 	})
 }
 
+func (s *S3Client) CheckWritable() error {
+	s.logger.V(3).Info("Checking bucket is writable", "bucket", s.configOptions.awsBucket)
+
+	_, err := s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.configOptions.awsBucket),
+		Key:    aws.String(writableCheckFileName),
+		Body:   strings.NewReader("ok"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// We don't wait for the file to disappear, as we'd rather not slow
+	// down our readiness checks. Should the delete fail, garbage collection
+	// will clean up the file.
+	_, err = s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.configOptions.awsBucket),
+		Key:    aws.String(writableCheckFileName),
+	})
+	return err
+}
+
 func NewFakeRemoteStoreClient() *FakeRemoteStoreClient {
 	return &FakeRemoteStoreClient{
 		remoteFiles: []*RemoteFile{},
@@ -185,6 +224,16 @@ func (f *FakeRemoteStoreClient) UploadFilePublicly(hostFilePath, remoteFileName
 	return "fake-presigned-url", nil
 }
 
+func (f *FakeRemoteStoreClient) GeneratePublicURL(remoteFileName string) (string, error) {
+	for _, remoteFile := range f.remoteFiles {
+		if remoteFile.FilePath == remoteFileName {
+			return "fake-presigned-url", nil
+		}
+	}
+
+	return "", fmt.Errorf("Cannot generate public url for non-existent file: %s", remoteFileName)
+}
+
 func (f *FakeRemoteStoreClient) ListAllUploadedFiles() ([]*RemoteFile, error) {
 	// We need to copy `remoteFiles` into a stable slice so that anyone
 	// interacting with the returned slice sees a consistent list of
@@ -214,6 +263,10 @@ func (f *FakeRemoteStoreClient) DeleteFile(remoteFileName string) error {
 	return nil
 }
 
+func (f *FakeRemoteStoreClient) CheckWritable() error {
+	return f.WritableErr
+}
+
 func (f *FakeRemoteStoreClient) UploadRandomFilesWithMockedAge(lastModifiedToNumFilesToCreate map[time.Time]int) {
 	for lastModifiedTime, numFilesToCreate := range lastModifiedToNumFilesToCreate {
 		for i := 0; i < numFilesToCreate; i++ {
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// RetryPolicy controls how we retry job items which fail for (what we believe
+// to be) transient reasons.
+type RetryPolicy struct {
+	// MaxAttempts is the most times we'll attempt each job item, including
+	// the first attempt. A value of one disables retries.
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// We wait InitialBackoffSeconds before the first retry, and double the
+	// wait before each subsequent retry, up to MaxBackoffSeconds.
+	InitialBackoffSeconds int `yaml:"initial_backoff_seconds"`
+	MaxBackoffSeconds     int `yaml:"max_backoff_seconds"`
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:           3,
+		InitialBackoffSeconds: 5,
+		MaxBackoffSeconds:     60,
+	}
+}
+
+// backoff returns how long to wait after the given (1-indexed) attempt fails,
+// before making the next attempt.
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := time.Duration(r.InitialBackoffSeconds) * time.Second
+	maxBackoff := time.Duration(r.MaxBackoffSeconds) * time.Second
+
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if maxBackoff > 0 && backoff > maxBackoff {
+		return maxBackoff
+	}
+
+	return backoff
+}
+
+// sleepContext waits for `d`, unless `ctx` is done first, in which case it
+// returns the context's error.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isRetryableError returns whether an error is likely to be transient (i.e.
+// network issues, throttling and server errors), so attempting the same
+// work again may succeed. Any error we don't recognize is permanent, as
+// retrying a permanent error just delays telling the user.
+func isRetryableError(err error) bool {
+	switch e := err.(type) {
+	case *YoutubeDlError:
+		return e.retryable()
+	case awserr.RequestFailure:
+		return e.StatusCode() >= 500 || e.StatusCode() == 429 || request.IsErrorThrottle(e)
+	case awserr.Error:
+		return request.IsErrorRetryable(e) || request.IsErrorThrottle(e)
+	case net.Error:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	retryPolicy := RetryPolicy{MaxAttempts: 10, InitialBackoffSeconds: 5, MaxBackoffSeconds: 30}
+
+	expectedBackoffs := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, expectedBackoff := range expectedBackoffs {
+		attempt := i + 1
+		if backoff := retryPolicy.backoff(attempt); backoff != expectedBackoff {
+			t.Fatalf("Expected backoff of %s after attempt %d, but got %s", expectedBackoff, attempt, backoff)
+		}
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	retryableErrors := []error{
+		&YoutubeDlError{Kind: YoutubeDlErrorThrottled},
+		&YoutubeDlError{Kind: YoutubeDlErrorNetwork},
+		awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "request-id"),
+		awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "request-id"),
+		awserr.New("RequestError", "send request failed", nil),
+	}
+	for _, err := range retryableErrors {
+		if !isRetryableError(err) {
+			t.Fatalf("Expected %v to be retryable", err)
+		}
+	}
+
+	permanentErrors := []error{
+		&YoutubeDlError{Kind: YoutubeDlErrorUnsupportedURL},
+		&YoutubeDlError{Kind: YoutubeDlErrorUnknown},
+		awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), 403, "request-id"),
+		fmt.Errorf("Cannot identify file with unique prefix: abcdefgh"),
+	}
+	for _, err := range permanentErrors {
+		if isRetryableError(err) {
+			t.Fatalf("Expected %v to be permanent", err)
+		}
+	}
+}
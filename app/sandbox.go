@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// nobodyUser is the uid:gid of the conventional unprivileged "nobody" user.
+const nobodyUser = "65534:65534"
+
+// containerTmpDirectory is where we mount a tmpfs in sandboxed containers, as
+// the rest of the root file system may be read only.
+const containerTmpDirectory = "/tmp"
+
+// ContainerSandbox controls how tightly we restrict the containers in which we
+// run youtube-dl and ffmpeg. A malicious page could otherwise make either
+// process consume all of the host's cpu, memory and disk, so every
+// restriction is enabled by default.
+type ContainerSandbox struct {
+	// User is the uid (or uid:gid) the containerized processes run as. If
+	// empty, we use the uid:gid of the vidzou process, so downloaded files
+	// are owned by vidzou on the host, or nobody if vidzou runs as root.
+	User string `yaml:"user"`
+
+	// Resource limits. Zero means unlimited.
+	MemoryMB  int64   `yaml:"memory_mb"`
+	CPUs      float64 `yaml:"cpus"`
+	PidsLimit int64   `yaml:"pids_limit"`
+	// MaxFileSizeMB causes youtube-dl to refuse to download files larger
+	// than the limit, which protects the host's disk.
+	MaxFileSizeMB int64 `yaml:"max_file_size_mb"`
+
+	ReadOnlyRootFilesystem bool `yaml:"read_only_root_filesystem"`
+	// DropCapabilities drops all linux capabilities, which neither
+	// youtube-dl nor ffmpeg need.
+	DropCapabilities bool `yaml:"drop_capabilities"`
+	NoNewPrivileges  bool `yaml:"no_new_privileges"`
+
+	// TmpfsSizeMB is the size of the tmpfs we mount at /tmp, for any
+	// scratch files. Zero disables the tmpfs.
+	TmpfsSizeMB int64 `yaml:"tmpfs_size_mb"`
+}
+
+func defaultContainerSandbox() ContainerSandbox {
+	return ContainerSandbox{
+		MemoryMB:               1024,
+		CPUs:                   1,
+		PidsLimit:              256,
+		ReadOnlyRootFilesystem: true,
+		DropCapabilities:       true,
+		NoNewPrivileges:        true,
+		TmpfsSizeMB:            256,
+	}
+}
+
+// validate catches sandbox configuration mistakes at startup.
+func (c ContainerSandbox) validate() error {
+	if c.User != "" {
+		if _, _, err := parseContainerUser(c.User); err != nil {
+			return err
+		}
+	}
+
+	if c.MemoryMB < 0 || c.CPUs < 0 || c.PidsLimit < 0 || c.MaxFileSizeMB < 0 || c.TmpfsSizeMB < 0 {
+		return fmt.Errorf("Sandbox limits must not be negative")
+	}
+
+	return nil
+}
+
+// user returns the uid:gid as which containerized processes run.
+func (c ContainerSandbox) user() string {
+	if c.User != "" {
+		return c.User
+	}
+
+	if os.Getuid() == 0 {
+		return nobodyUser
+	}
+
+	return fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+}
+
+// apply adds the sandbox's restrictions to the container options.
+func (c ContainerSandbox) apply(runContainerOpts *runContainerOptions) {
+	runContainerOpts.uid = c.user()
+
+	runContainerOpts.memoryBytes = c.MemoryMB * 1024 * 1024
+	runContainerOpts.nanoCPUs = int64(c.CPUs * 1e9)
+	runContainerOpts.pidsLimit = c.PidsLimit
+
+	runContainerOpts.readOnlyRootFilesystem = c.ReadOnlyRootFilesystem
+	runContainerOpts.dropCapabilities = c.DropCapabilities
+	runContainerOpts.noNewPrivileges = c.NoNewPrivileges
+
+	if c.TmpfsSizeMB > 0 {
+		runContainerOpts.tmpfs = map[string]string{
+			containerTmpDirectory: fmt.Sprintf("rw,noexec,nosuid,size=%dm", c.TmpfsSizeMB),
+		}
+		// Our user may not exist in the image, so may not have a home
+		// directory in which youtube-dl can keep its cache.
+		runContainerOpts.env = []string{"HOME=" + containerTmpDirectory}
+	}
+}
+
+// prepareMountDirectory ensures the sandbox's user can write downloads to the
+// mount directory. When vidzou runs as root, the sandbox's user usually
+// differs from the directory's owner, so we give the directory to them.
+func (c ContainerSandbox) prepareMountDirectory(mountDirectory string) error {
+	if os.Getuid() != 0 {
+		return nil
+	}
+
+	uid, gid, err := parseContainerUser(c.user())
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(mountDirectory, uid, gid)
+}
+
+// parseContainerUser parses a numeric "uid" or "uid:gid". We require numeric
+// ids, as the user need not exist in the image or on the host.
+func parseContainerUser(user string) (int, int, error) {
+	parts := strings.SplitN(user, ":", 2)
+
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("Sandbox user %q must be a numeric uid or uid:gid", user)
+	}
+
+	gid := uid
+	if len(parts) == 2 {
+		if gid, err = strconv.Atoi(parts[1]); err != nil || gid < 0 {
+			return 0, 0, fmt.Errorf("Sandbox user %q must be a numeric uid or uid:gid", user)
+		}
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestContainerSandboxApply(t *testing.T) {
+	runContainerOpts := &runContainerOptions{}
+	defaultContainerSandbox().apply(runContainerOpts)
+
+	if runContainerOpts.uid == "" || runContainerOpts.uid == "0" || runContainerOpts.uid == "0:0" {
+		t.Fatalf("Expected containers to run as a non-root user by default, but got %q", runContainerOpts.uid)
+	}
+
+	if runContainerOpts.memoryBytes != 1024*1024*1024 || runContainerOpts.nanoCPUs != 1e9 || runContainerOpts.pidsLimit != 256 {
+		t.Fatalf("Expected default resource limits, but got %+v", runContainerOpts)
+	}
+
+	if !runContainerOpts.readOnlyRootFilesystem || !runContainerOpts.dropCapabilities || !runContainerOpts.noNewPrivileges {
+		t.Fatalf("Expected default restrictions, but got %+v", runContainerOpts)
+	}
+
+	if runContainerOpts.tmpfs[containerTmpDirectory] != "rw,noexec,nosuid,size=256m" {
+		t.Fatalf("Expected a tmpfs at %s, but got %v", containerTmpDirectory, runContainerOpts.tmpfs)
+	}
+}
+
+func TestContainerSandboxUser(t *testing.T) {
+	sandbox := ContainerSandbox{User: "1234:5678"}
+	if user := sandbox.user(); user != "1234:5678" {
+		t.Fatalf("Expected configured user, but got %s", user)
+	}
+
+	sandbox = ContainerSandbox{}
+	expectedUser := nobodyUser
+	if os.Getuid() != 0 {
+		uid, gid, _ := parseContainerUser(sandbox.user())
+		if uid != os.Getuid() || gid != os.Getgid() {
+			t.Fatalf("Expected our own uid:gid by default, but got %s", sandbox.user())
+		}
+		return
+	}
+
+	if user := sandbox.user(); user != expectedUser {
+		t.Fatalf("Expected %s when running as root, but got %s", expectedUser, user)
+	}
+}
+
+func TestContainerSandboxValidate(t *testing.T) {
+	validSandboxes := []ContainerSandbox{
+		defaultContainerSandbox(),
+		{},
+		{User: "1000"},
+		{User: "1000:1000"},
+	}
+	for _, sandbox := range validSandboxes {
+		if err := sandbox.validate(); err != nil {
+			t.Fatalf("Expected %+v to be valid: %s", sandbox, err)
+		}
+	}
+
+	invalidSandboxes := []ContainerSandbox{
+		{User: "nobody"},
+		{User: "1000:staff"},
+		{User: "-1"},
+		{MemoryMB: -1},
+	}
+	for _, sandbox := range invalidSandboxes {
+		if err := sandbox.validate(); err == nil {
+			t.Fatalf("Expected %+v to be invalid", sandbox)
+		}
+	}
+}
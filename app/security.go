@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// csrfCookieName is the cookie holding the browser's CSRF token. Our
+	// forms submit the same token (as `csrfFormField`), which other sites
+	// can't do, as they can't read our cookies.
+	csrfCookieName = "vidzou_csrf"
+	csrfFormField  = "csrf_token"
+	// csrfHeaderName lets scripts (i.e. browser extensions) submit the token
+	// without a form.
+	csrfHeaderName = "X-CSRF-Token"
+
+	// csrfTokenLength is the length of our base64 encoded tokens, which are
+	// 24 random bytes.
+	csrfTokenLength = 32
+	// csrfCookieMaxAge is how long browsers keep their token. Forms rendered
+	// with a token stop working once it expires, so we keep it for as long
+	// as our language cookie.
+	csrfCookieMaxAge = 365 * 24 * time.Hour
+)
+
+// contentSecurityPolicy only allows our own scripts, styles and images, and
+// prevents other sites from framing our pages.
+const contentSecurityPolicy = "default-src 'self'; script-src 'self'; style-src 'self'; img-src 'self' data:; " +
+	"manifest-src 'self'; worker-src 'self'; connect-src 'self'; object-src 'none'; base-uri 'self'; " +
+	"form-action 'self'; frame-ancestors 'none'"
+
+// securityHeaders adds headers asking browsers to restrict what our pages (and
+// other sites) may do with them.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Content-Security-Policy", contentSecurityPolicy)
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("X-Content-Type-Options", "nosniff")
+		// We rely on the referer to send users back to the page on
+		// which they changed their language, but never send it to
+		// other sites (i.e. the download urls, which are secret).
+		header.Set("Referrer-Policy", "same-origin")
+		header.Set("Cross-Origin-Opener-Policy", "same-origin")
+		header.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=(), payment=()")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type csrfTokenContextKey struct{}
+
+// csrfProtect ensures every browser has a CSRF token, which pages include in
+// their forms, and refuses state changing requests which don't include it.
+//
+// The exception is requests the user themselves initiated from the browser,
+// rather than from a page (i.e. sharing a video to our web app from another
+// app), which browsers mark with `Sec-Fetch-Site: none`. These can't include
+// our token, but also can't come from another site.
+func (s *Server) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := csrfTokenFromCookie(r)
+		if token == "" {
+			var err error
+			if token, err = generateCSRFToken(); err != nil {
+				s.logger.V(0).Info("Error generating CSRF token", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Path:     "/",
+				MaxAge:   int(csrfCookieMaxAge.Seconds()),
+				HttpOnly: true,
+				// We serve over TLS whenever we have a certificate,
+				// in which case the token must never be sent in
+				// plain text.
+				Secure: r.TLS != nil,
+				// Lax, rather than Strict, so users following a
+				// link to us (i.e. our bookmarklet) keep their
+				// token.
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		if !isSafeMethod(r.Method) && !s.validCSRFRequest(r) {
+			s.logger.V(2).Info("Refusing request due to CSRF check", "method", r.Method, "path", r.URL.Path, "origin", r.Header.Get("Origin"), "fetchSite", r.Header.Get("Sec-Fetch-Site"))
+			http.Error(w, localizerFromRequest(messages, r).T("errors.csrf"), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfTokenContextKey{}, token)))
+	})
+}
+
+// validCSRFRequest returns whether the state changing request came from one of
+// our own pages (or from the user themselves).
+func (s *Server) validCSRFRequest(r *http.Request) bool {
+	// Browsers tell us the origin of cross site requests, so we can refuse
+	// them even if they somehow have a valid token.
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		originURL, err := url.Parse(origin)
+		if err != nil || originURL.Host != r.Host {
+			return false
+		}
+	}
+
+	if r.Header.Get("Sec-Fetch-Site") == "none" {
+		return true
+	}
+
+	cookieToken := csrfTokenFromCookie(r)
+	if cookieToken == "" {
+		return false
+	}
+
+	submittedToken := r.Header.Get(csrfHeaderName)
+	if submittedToken == "" {
+		submittedToken = r.PostFormValue(csrfFormField)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookieToken), []byte(submittedToken)) == 1
+}
+
+// generateCSRFToken returns a new token. Unlike `generateRandomString`, it
+// must be unpredictable, so we use crypto/rand.
+func generateCSRFToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func csrfTokenFromCookie(r *http.Request) string {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || len(cookie.Value) != csrfTokenLength {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+// csrfTokenFromRequest returns the token our forms must include.
+func csrfTokenFromRequest(r *http.Request) string {
+	token, _ := r.Context().Value(csrfTokenContextKey{}).(string)
+	return token
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	// Including requests which don't match any of our routes (404) or
+	// their methods (405).
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/", nil),
+		httptest.NewRequest("GET", "/healthz", nil),
+		httptest.NewRequest("GET", "/static/bulma.min.css", nil),
+		httptest.NewRequest("GET", "/does-not-exist", nil),
+		httptest.NewRequest("DELETE", "/history", nil),
+	} {
+		path := req.Method + " " + req.URL.Path
+		rec := httptest.NewRecorder()
+		server.router().ServeHTTP(rec, req)
+
+		for header, expected := range map[string]string{
+			"Content-Security-Policy": contentSecurityPolicy,
+			"X-Frame-Options":         "DENY",
+			"X-Content-Type-Options":  "nosniff",
+			"Referrer-Policy":         "same-origin",
+		} {
+			if value := rec.Header().Get(header); value != expected {
+				t.Errorf("Expected %s header %q for %s, but got %q", header, expected, path, value)
+			}
+		}
+	}
+}
+
+// newCSRFTestRequest returns a form submission to `path`, with the given CSRF
+// cookie and submitted token (either of which may be empty).
+func newCSRFTestRequest(path string, form url.Values, cookieToken, formToken string) *http.Request {
+	if formToken != "" {
+		form.Set(csrfFormField, formToken)
+	}
+
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookieToken != "" {
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: cookieToken})
+	}
+
+	return req
+}
+
+func TestCSRFTokenIssuedAndEmbeddedInForms(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	var csrfCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == csrfCookieName {
+			csrfCookie = cookie
+		}
+	}
+	if csrfCookie == nil || !csrfCookie.HttpOnly || csrfCookie.SameSite != http.SameSiteLaxMode || csrfCookie.MaxAge <= 0 {
+		t.Fatalf("Expected HttpOnly, SameSite, persistent CSRF cookie, but got %v", csrfCookie)
+	}
+
+	if !strings.Contains(rec.Body.String(), `name="csrf_token" value="`+csrfCookie.Value+`"`) {
+		t.Fatalf("Expected forms to include CSRF token, but got %s", rec.Body.String())
+	}
+
+	// Browsers only send the token over TLS when we serve over TLS.
+	tlsReq := httptest.NewRequest("GET", "https://example.com/", nil)
+	rec = httptest.NewRecorder()
+	server.router().ServeHTTP(rec, tlsReq)
+	if cookies := rec.Result().Cookies(); len(cookies) == 0 || !cookies[0].Secure {
+		t.Fatalf("Expected a Secure CSRF cookie over TLS, but got %v", cookies)
+	}
+
+	// Submitting the form as the browser would succeeds.
+	rec = httptest.NewRecorder()
+	server.router().ServeHTTP(rec, newCSRFTestRequest("/downloads", url.Values{"url": {youtubeURL}}, csrfCookie.Value, csrfCookie.Value))
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect to job, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitForJobComplete(t, jobStore, rec)
+}
+
+func TestCSRFRefusesForgedRequests(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	otherToken := strings.Repeat("x", csrfTokenLength)
+	testCases := []struct {
+		name        string
+		path        string
+		cookieToken string
+		formToken   string
+		headers     map[string]string
+	}{
+		{"no token", "/downloads", "", "", nil},
+		{"no cookie", "/downloads", "", testCSRFToken, nil},
+		{"no submitted token", "/downloads", testCSRFToken, "", nil},
+		{"mismatched token", "/downloads", testCSRFToken, otherToken, nil},
+		{"cross site origin", "/downloads", testCSRFToken, testCSRFToken, map[string]string{"Origin": "https://evil.test"}},
+		{"cross site fetch", "/downloads", "", "", map[string]string{"Sec-Fetch-Site": "cross-site"}},
+		{"retry", "/downloads/abc/retry", "", "", nil},
+		{"language", "/language", "", "", nil},
+	}
+
+	for _, testCase := range testCases {
+		req := newCSRFTestRequest(testCase.path, url.Values{"url": {youtubeURL}, "language": {"es"}}, testCase.cookieToken, testCase.formToken)
+		for header, value := range testCase.headers {
+			req.Header.Set(header, value)
+		}
+
+		rec := httptest.NewRecorder()
+		server.router().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d for %s, but got %d", http.StatusForbidden, testCase.name, rec.Code)
+		}
+	}
+
+	for state, count := range jobStore.Stats().JobsByState {
+		if count != 0 {
+			t.Fatalf("Should not create jobs for forged requests, but found %d %s", count, state)
+		}
+	}
+}
+
+func TestCSRFAllowsUserInitiatedRequests(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	// I.e. sharing a video to our web app from another app, which can't
+	// include our token.
+	req := newCSRFTestRequest("/downloads", url.Values{"shared_text": {youtubeURL}}, "", "")
+	req.Header.Set("Sec-Fetch-Site", "none")
+	req.Header.Set("Origin", "null")
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect to job, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitForJobComplete(t, jobStore, rec)
+
+	// Same origin requests with a valid token are fine too.
+	req = newCSRFTestRequest("/language", url.Values{"language": {"es"}}, testCSRFToken, testCSRFToken)
+	req.Header.Set("Origin", "http://example.com")
+
+	rec = httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect, but got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+var postFormRegexp = regexp.MustCompile(`<form[^>]*method="POST"[^>]*>`)
+var postFormWithTokenRegexp = regexp.MustCompile(`<form[^>]*method="POST"[^>]*>\s*<input type="hidden" name="csrf_token" value="{{ csrfToken }}" />`)
+
+func TestEveryFormIncludesCSRFToken(t *testing.T) {
+	templateFiles, _ := fs.Glob(embeddedAssets, "templates/*.html")
+
+	var forms int
+	for _, templateFile := range templateFiles {
+		contents, _ := fs.ReadFile(embeddedAssets, templateFile)
+
+		numForms := len(postFormRegexp.FindAll(contents, -1))
+		if numFormsWithToken := len(postFormWithTokenRegexp.FindAll(contents, -1)); numForms != numFormsWithToken {
+			t.Errorf("Expected every form in %s to include the CSRF token, but only %d of %d do", templateFile, numFormsWithToken, numForms)
+		}
+
+		forms += numForms
+	}
+
+	if forms < 3 {
+		t.Fatalf("Expected to find our forms, but only found %d", forms)
+	}
+}
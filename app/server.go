@@ -1,80 +1,545 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/braintree/manners"
 	"github.com/go-logr/logr"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"html/template"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
-const FailureToDownlownLoadOrUploadVideo = "FailureToDownlownLoadOrUploadVideo"
-
 // Could define Server interface, but not sure there is any benefit...
 
 // Could use Negroni and Mux, but not sure its necessary right now...
 type Server struct {
-	port              int
-	contentDownloader ContentDownloader
-	contentUploader   ContentUploader
-
-	// Should be a richer interface... that we can make either consistent
-	// storage or ephemeral.
-	publicDownloadURLCache map[string]string
+	port          int
+	jobProcessor  *JobProcessor
+	jobStore      JobStore
+	quotaEnforcer QuotaEnforcer
+	urlValidator  URLValidator
+	downloadsConf downloadsConfig
+
+	// UserHeader, if set, is the request header from which we read the
+	// identity of the user (i.e. as set by an authenticating reverse
+	// proxy). Can set after construction, should we find the need.
+	UserHeader string
+
+	// HealthChecker, if set, determines whether we're ready to serve
+	// traffic. Can set after construction, should we find the need.
+	HealthChecker *HealthChecker
+
+	// Conf controls our timeouts. Can set after construction, should we
+	// find the need.
+	Conf serverConfig
+
+	// Assets are the templates and static files we serve. Can set after
+	// construction (i.e. to reload them from disk while developing), should
+	// we find the need.
+	Assets *Assets
+
+	// Webhooks, if set, are the webhooks users may view and test. Can set
+	// after construction, should we find the need.
+	Webhooks *WebhookNotifier
+
+	// Emails, if set, lets users ask us to email them once their download
+	// finishes. Can set after construction, should we find the need.
+	Emails *EmailNotifier
+
+	// inFlightJobs are the jobs we're processing, which we wait for when
+	// shutting down. Once we start `draining`, we won't start new jobs, and
+	// we close `drained` once the last in-flight job finishes.
+	inFlightJobs map[string]bool
+	draining     bool
+	drained      chan struct{}
+	jobsMu       sync.Mutex
+	// jobsCtx is the parent of every job's context, so `cancelJobs` stops
+	// every in-flight job.
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
 
 	logger logr.Logger
 }
 
-func NewServer(port int, contentDownloader ContentDownloader, contentUploader ContentUploader, logger logr.Logger) *Server {
-	publicDownloadURLCache := make(map[string]string)
+// serverConfig controls how long we wait for clients and, when shutting down,
+// for in-flight work.
+type serverConfig struct {
+	// Port is the port on which we serve (https, if TLS is enabled).
+	Port int `yaml:"port"`
+
+	ReadHeaderTimeoutSeconds int `yaml:"read_header_timeout_seconds"`
+	ReadTimeoutSeconds       int `yaml:"read_timeout_seconds"`
+	WriteTimeoutSeconds      int `yaml:"write_timeout_seconds"`
+	IdleTimeoutSeconds       int `yaml:"idle_timeout_seconds"`
+
+	// ShutdownTimeoutSeconds is how long we wait for in-flight requests
+	// and downloads to finish when shutting down. Afterwards, we cancel
+	// the downloads which are still running (stopping their containers).
+	// We only keep jobs in memory, so users must start those downloads
+	// again once we're back.
+	ShutdownTimeoutSeconds int `yaml:"shutdown_timeout_seconds"`
+
+	TLS tlsConfig `yaml:"tls"`
+
+	// DevAssetsDirectory, if set, is the directory (i.e. the `app`
+	// directory of a checkout) from which we reload templates and static
+	// files on every request, rather than serving those built into the
+	// binary. Only useful when developing them.
+	DevAssetsDirectory string `yaml:"dev_assets_directory"`
+}
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		Port:                     8080,
+		ReadHeaderTimeoutSeconds: 10,
+		ReadTimeoutSeconds:       30,
+		WriteTimeoutSeconds:      60,
+		IdleTimeoutSeconds:       120,
+		ShutdownTimeoutSeconds:   120,
+	}
+}
+
+func NewServer(port int, jobProcessor *JobProcessor, jobStore JobStore, quotaEnforcer QuotaEnforcer, urlValidator URLValidator, downloadsConf downloadsConfig, logger logr.Logger) *Server {
+	assets, err := NewEmbeddedAssets(logger)
+	if err != nil {
+		// Only possible if we built invalid templates into the binary,
+		// which our tests catch.
+		panic(err)
+	}
+
+	jobsCtx, cancelJobs := context.WithCancel(context.Background())
 
 	return &Server{
-		port:                   port,
-		contentDownloader:      contentDownloader,
-		contentUploader:        contentUploader,
-		publicDownloadURLCache: publicDownloadURLCache,
-		logger:                 logger,
+		port:          port,
+		jobProcessor:  jobProcessor,
+		jobStore:      jobStore,
+		quotaEnforcer: quotaEnforcer,
+		urlValidator:  urlValidator,
+		downloadsConf: downloadsConf,
+		inFlightJobs:  make(map[string]bool),
+		drained:       make(chan struct{}),
+		jobsCtx:       jobsCtx,
+		cancelJobs:    cancelJobs,
+		logger:        logger,
+
+		// Can set via constructor/setting later, should we find the need.
+		Conf:   defaultServerConfig(),
+		Assets: assets,
 	}
 }
 
+// ListenAndServe serves until we receive SIGINT or SIGTERM, at which point we
+// shut down gracefully and then run `cleanUpFunc`. It returns any error
+// listening, serving, shutting down or cleaning up.
 func (s *Server) ListenAndServe(cleanUpFunc func() error) error {
-	s.logger.V(2).Info("Creating and launching web server")
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+
+	listener, redirectListener, err := s.listen()
+	if err != nil {
+		s.cleanUpAfterFailure(cleanUpFunc)
+		return err
+	}
+
+	return s.serve(listener, redirectListener, signalCh, cleanUpFunc)
+}
+
+// listen listens on our port and, if we redirect http to https, on our http
+// redirect port.
+func (s *Server) listen() (net.Listener, net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error listening on port %d: %s", s.port, err)
+	}
+
+	redirectPort := s.Conf.TLS.HTTPRedirectPort
+	if redirectPort == 0 {
+		return listener, nil, nil
+	}
+
+	redirectListener, err := net.Listen("tcp", fmt.Sprintf(":%d", redirectPort))
+	if err != nil {
+		listener.Close()
+		return nil, nil, fmt.Errorf("Error listening on port %d: %s", redirectPort, err)
+	}
+
+	return listener, redirectListener, nil
+}
+
+// cleanUpAfterFailure runs `cleanUpFunc` when we fail to start serving. We log,
+// rather than return, any error cleaning up, as why we failed to serve is more
+// useful.
+func (s *Server) cleanUpAfterFailure(cleanUpFunc func() error) {
+	if err := cleanUpFunc(); err != nil {
+		s.logger.V(1).Info("Error cleaning up", "error", err)
+	}
+}
+
+// serve serves on the listeners until it receives from `shutdownCh`, or until
+// serving fails. `redirectListener` may be nil if we don't redirect http to
+// https.
+func (s *Server) serve(listener net.Listener, redirectListener net.Listener, shutdownCh <-chan os.Signal, cleanUpFunc func() error) error {
+	tlsConf, acmeHandler, err := s.tlsServerConfig()
+	if err != nil {
+		listener.Close()
+		if redirectListener != nil {
+			redirectListener.Close()
+		}
+		s.cleanUpAfterFailure(cleanUpFunc)
+		return err
+	}
 
+	s.logger.V(2).Info("Creating and launching web server", "address", listener.Addr().String(), "tls", tlsConf != nil)
+	serveErrCh := make(chan error, 2)
+
+	httpServer := s.newHTTPServer(s.router())
+	httpServer.TLSConfig = tlsConf
+	go func() {
+		if tlsConf != nil {
+			// Our TLS config provides the certificates, and net/http
+			// enables http/2 for us.
+			serveErrCh <- httpServer.ServeTLS(listener, "", "")
+			return
+		}
+		serveErrCh <- httpServer.Serve(listener)
+	}()
+	httpServers := []*http.Server{httpServer}
+
+	if redirectListener != nil {
+		s.logger.V(2).Info("Redirecting http to https", "address", redirectListener.Addr().String())
+		redirectServer := s.newHTTPServer(acmeHandler(http.HandlerFunc(s.redirectToHTTPS)))
+		go func() {
+			serveErrCh <- redirectServer.Serve(redirectListener)
+		}()
+		httpServers = append(httpServers, redirectServer)
+	}
+
+	var serveErr error
+	select {
+	case serveErr = <-serveErrCh:
+		s.logger.V(0).Info("Web server failed", "error", serveErr)
+	case <-shutdownCh:
+		s.logger.V(2).Info("Handling shutdown signal to server")
+	}
+
+	shutdownErr := s.shutdown(httpServers)
+	cleanUpErr := cleanUpFunc()
+
+	for _, err := range []error{serveErr, shutdownErr, cleanUpErr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(s.Conf.ReadHeaderTimeoutSeconds) * time.Second,
+		ReadTimeout:       time.Duration(s.Conf.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout:      time.Duration(s.Conf.WriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(s.Conf.IdleTimeoutSeconds) * time.Second,
+	}
+}
+
+// shutdown stops accepting new jobs, waits for in-flight requests and jobs to
+// finish (up to our shutdown timeout), and then cancels any jobs which still
+// haven't finished. We wait for cancelled jobs to stop, so their containers
+// are gone before we clean up.
+func (s *Server) shutdown(httpServers []*http.Server) error {
+	shutdownTimeout := time.Duration(s.Conf.ShutdownTimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	s.startDraining()
+
+	s.logger.V(2).Info("Waiting for in-flight requests", "shutdownTimeout", shutdownTimeout)
+	var shutdownErr error
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil && shutdownErr == nil {
+			shutdownErr = fmt.Errorf("Error shutting down web server: %s", err)
+		}
+	}
+
+	s.logger.V(2).Info("Waiting for in-flight jobs", "numJobs", s.numInFlightJobs())
+	select {
+	case <-s.drained:
+		s.logger.V(2).Info("All in-flight jobs finished")
+	case <-ctx.Done():
+		s.cancelInFlightJobs()
+	}
+
+	return shutdownErr
+}
+
+// jobCancellationTimeout is how long we wait for cancelled jobs to stop. It's
+// only a safety net, as stopping a job's container is quick.
+const jobCancellationTimeout = 30 * time.Second
+
+// cancelInFlightJobs cancels every in-flight job, which fails the job's
+// unfinished items, and waits for the jobs to stop. If they somehow don't, we
+// mark them as failed ourselves, so their state is accurate while we finish
+// shutting down.
+func (s *Server) cancelInFlightJobs() {
+	s.logger.V(0).Info("Cancelling in-flight jobs due to shutdown", "numJobs", s.numInFlightJobs())
+	s.cancelJobs()
+
+	select {
+	case <-s.drained:
+		s.logger.V(2).Info("All in-flight jobs stopped")
+	case <-time.After(jobCancellationTimeout):
+		s.checkpointInFlightJobs()
+	}
+}
+
+// startDraining stops us from starting any new jobs.
+func (s *Server) startDraining() {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	if s.draining {
+		return
+	}
+
+	s.draining = true
+	if len(s.inFlightJobs) == 0 {
+		close(s.drained)
+	}
+}
+
+func (s *Server) isDraining() bool {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	return s.draining
+}
+
+func (s *Server) numInFlightJobs() int {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	return len(s.inFlightJobs)
+}
+
+// startJob records the job as in-flight, unless we're draining, in which case
+// it returns false and the job must not be started.
+func (s *Server) startJob(jobID string) bool {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	if s.draining {
+		return false
+	}
+
+	s.inFlightJobs[jobID] = true
+	return true
+}
+
+func (s *Server) finishJob(jobID string) {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	delete(s.inFlightJobs, jobID)
+	if s.draining && len(s.inFlightJobs) == 0 {
+		close(s.drained)
+	}
+}
+
+// checkpointInFlightJobs marks the unfinished items of every in-flight job as
+// failed, so the job's state is accurate even though we're giving up on it.
+func (s *Server) checkpointInFlightJobs() {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	for jobID := range s.inFlightJobs {
+		s.logger.V(0).Info("Giving up on in-flight job due to shutdown", "jobId", jobID)
+		s.jobStore.Update(jobID, interruptJob)
+		s.jobProcessor.notify(jobID)
+	}
+}
+
+// errShuttingDown explains why we're refusing new downloads.
+var errShuttingDown = newUserError("errors.shutting_down")
+
+// interruptJob marks the job's unfinished items, and thus the job, as failed
+// because we're shutting down.
+func interruptJob(job *Job) {
+	for _, item := range job.Items {
+		if item.State == JobStatePending || item.State == JobStateRunning {
+			item.State = JobStateFailed
+			item.Err = errShuttingDown
+		}
+	}
+
+	job.State = JobStateFailed
+	job.Err = errShuttingDown
+}
+
+// router registers all of our routes. It's separate from `ListenAndServe` so
+// we can test our handlers without launching a server.
+func (s *Server) router() http.Handler {
 	r := mux.NewRouter()
 	r.HandleFunc("/downloads", s.downloadsCreate).Methods("POST")
 	r.HandleFunc("/downloads/{id}", s.downloadsShow).Methods("GET")
+	r.HandleFunc("/downloads/{id}/retry", s.downloadsRetry).Methods("POST")
 	r.HandleFunc("/", s.index).Methods("GET")
+	r.HandleFunc("/language", s.languageUpdate).Methods("POST")
+	r.HandleFunc("/history", s.history).Methods("GET")
+	r.HandleFunc("/share", s.share).Methods("GET")
+	r.HandleFunc("/webhooks", s.webhooksIndex).Methods("GET")
+	r.HandleFunc("/webhooks/{name}/test", s.webhooksTest).Methods("POST")
+	r.HandleFunc("/manifest.webmanifest", s.webManifest).Methods("GET")
+	r.HandleFunc("/service-worker.js", s.serviceWorker).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", s.healthz).Methods("GET")
+	r.HandleFunc("/readyz", s.readyz).Methods("GET")
+
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", s.Assets.StaticHandler()))
+
+	r.Use(traceHTTP, instrumentHTTP, s.csrfProtect)
+
+	// mux only runs the middleware above for requests matching a route, so
+	// we wrap the whole router to add our security headers to every
+	// response (i.e. 404s and 405s too).
+	return s.hsts(securityHeaders(r))
+}
 
-	fileServer := http.FileServer(http.Dir("./templates/static"))
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", fileServer))
+// healthz reports whether the process is alive. It deliberately checks nothing
+// else, so an orchestrator won't restart us just because a dependency is down.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(3).Info("Serving request", "endpoint", "GET#healthz")
+	s.renderJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
 
-	signalCh := make(chan os.Signal)
-	signal.Notify(signalCh, os.Interrupt, os.Kill, syscall.SIGTERM)
-	terminateCh := make(chan error)
-	go s.handleShutdown(signalCh, terminateCh, cleanUpFunc)
+// readyz reports whether we're ready to serve traffic, with the details of
+// each of our readiness checks.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(3).Info("Serving request", "endpoint", "GET#readyz")
 
-	manners.ListenAndServe(fmt.Sprintf(":%d", s.port), r)
+	report := &ReadinessReport{Ready: true, Checks: []*ReadinessCheckResult{}}
+	if s.HealthChecker != nil {
+		report = s.HealthChecker.Check()
+	}
 
-	// Do not stop program until receive message on terminate channel.
-	shutdownErr := <-terminateCh
-	return shutdownErr
+	// We're never ready once we start shutting down, so we stop receiving
+	// new downloads.
+	if s.isDraining() {
+		report = &ReadinessReport{
+			Ready: false,
+			Checks: append([]*ReadinessCheckResult{
+				{Name: "shutdown", Ready: false, Error: "Shutting down"},
+			}, report.Checks...),
+		}
+	}
+
+	statusCode := http.StatusOK
+	if !report.Ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+	s.renderJSON(w, statusCode, report)
+}
+
+func (s *Server) renderJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.V(1).Info("Error encoding json response", "error", err)
+	}
 }
 
-func (s *Server) handleShutdown(signalCh <-chan os.Signal, terminateCh chan<- error, cleanUpFunc func() error) {
-	<-signalCh
-	s.logger.V(2).Info("Handling shutdown signal to server")
-	manners.Close()
-	terminateCh <- cleanUpFunc()
+type indexPage struct {
+	ErrorMessage string
+	Profiles     []*TranscodingProfile
+	Bookmarklet  template.URL
+
+	// Shared is set when the user is confirming the download of the `URL`
+	// they shared with us.
+	Shared bool
+	URL    string
+
+	// EmailNotifications is set when users may ask us to email them, in
+	// which case we fill in their `Email`, if we know it.
+	EmailNotifications bool
+	Email              string
 }
 
 func (s *Server) index(w http.ResponseWriter, r *http.Request) {
 	s.logger.V(2).Info("Serving request", "endpoint", "GET#index")
-	t := template.Must(template.ParseFiles("templates/index.html"))
-	t.Execute(w, nil)
+	s.renderIndex(w, r, http.StatusOK, nil)
+}
+
+// renderIndex renders the index page with the given status code. We use it to
+// send the user back to the form (with an explanation of `err`, in their
+// language) when we refuse to start their download.
+func (s *Server) renderIndex(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
+	s.renderIndexPage(w, r, statusCode, &indexPage{}, err)
+}
+
+func (s *Server) renderIndexPage(w http.ResponseWriter, r *http.Request, statusCode int, p *indexPage, err error) {
+	localizer := localizerFromRequest(messages, r)
+	p.ErrorMessage = localizer.Error(err)
+	p.Profiles = s.downloadsConf.Profiles
+	p.Bookmarklet = bookmarklet(r)
+	if s.Emails != nil {
+		p.EmailNotifications = true
+		p.Email = s.Emails.AccountEmail(r)
+	}
+
+	s.Assets.Render(w, r, statusCode, "index", p)
+}
+
+// languageUpdate remembers the language the user chose, which takes precedence
+// over their browser's languages, and sends them back to where they were.
+func (s *Server) languageUpdate(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(2).Info("Serving request", "endpoint", "POST#language")
+
+	locale := messages.MatchLocale(r.FormValue("language"), "")
+	http.SetCookie(w, &http.Cookie{
+		Name:     languageCookieName,
+		Value:    locale,
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// We only ever redirect to one of our own pages.
+	returnPath := "/"
+	if referer, err := url.Parse(r.Referer()); err == nil && strings.HasPrefix(referer.Path, "/") && !strings.HasPrefix(referer.Path, "//") {
+		returnPath = referer.RequestURI()
+	}
+	http.Redirect(w, r, returnPath, http.StatusSeeOther)
+}
+
+// quotaClientFromRequest identifies the client making the request, for the
+// purpose of enforcing quotas.
+func (s *Server) quotaClientFromRequest(r *http.Request) *quotaClient {
+	client := &quotaClient{}
+
+	if s.UserHeader != "" {
+		client.user = r.Header.Get(s.UserHeader)
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	client.ip = ip
+
+	return client
 }
 
 func (s *Server) downloadsCreate(w http.ResponseWriter, r *http.Request) {
@@ -83,69 +548,319 @@ func (s *Server) downloadsCreate(w http.ResponseWriter, r *http.Request) {
 	// TODO: Decide how I want to handle http errors. We should definitely
 	// be logging them.
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, fmt.Sprintf("Unable to parse form: %s", err), http.StatusInternalServerError)
+		http.Error(w, localizerFromRequest(messages, r).T("errors.parse_form", err), http.StatusInternalServerError)
+		return
+	}
+
+	if s.isDraining() {
+		s.renderIndex(w, r, http.StatusServiceUnavailable, errShuttingDown)
 		return
 	}
 
-	remotePath := r.FormValue("url")
+	client := s.quotaClientFromRequest(r)
 
-	downloadId := generateRandomString(defaultRandomStringLength)
+	downloadReq, err := s.parseDownloadRequest(r, client)
+	if err != nil {
+		s.logger.V(2).Info("Refusing download due to invalid request", "url", r.FormValue("url"), "reason", err)
+		s.renderIndex(w, r, http.StatusBadRequest, err)
+		return
+	}
 
-	// TODO: Should update the `publicDownloadURLCache` to be threadsafe by
-	// protecting w/ mutex. Will likely require creating a `downloadIDToURL`
-	// interface.
-	go func() {
-		// `FailureToDownlownLoadOrUploadVideo` is an indicator that the
-		// upload failed. Long term, I'd like to avoid overloading the
-		// downloadIDToURL mapping... but for now this is fine.
-		publicURL := FailureToDownlownLoadOrUploadVideo
-
-		s.logger.V(3).Info("Starting download", "downloadId", downloadId)
-		localFilePath, err := s.contentDownloader.DownloadContent(remotePath, &DownloadOptions{audioOnly: true})
-		s.logger.V(3).Info("Content download completed", "downloadId", downloadId)
-
-		if err == nil {
-			s.logger.V(3).Info("Starting upload", "downloadId", downloadId)
-			possPublicURL, err := s.contentUploader.UploadContentPublicly(localFilePath)
-			s.logger.V(3).Info("Content upload completed", "downloadId", downloadId)
-
-			if err != nil {
-				s.logger.V(3).Info("Upload failed", "downloadId", downloadId)
-			} else {
-				publicURL = possPublicURL
+	// We must check quotas before launching any containers, as the
+	// containers are the expensive part.
+	releaseQuota, err := s.quotaEnforcer.Reserve(client, downloadReq.numDownloads())
+	if err != nil {
+		s.logger.V(2).Info("Refusing download due to quota", "user", client.user, "ip", client.ip, "reason", err)
+		s.renderIndex(w, r, http.StatusTooManyRequests, err)
+		return
+	}
+
+	job := NewJob(downloadReq.remotePaths, downloadReq.downloadOptions)
+	job.Bundle = downloadReq.bundle
+	job.Profile = downloadReq.profile
+	job.User = client.user
+	job.Email = downloadReq.email
+	job.Locale = localizerFromRequest(messages, r).Locale
+	if err := s.jobStore.Create(job); err != nil {
+		releaseQuota(0)
+		http.Error(w, localizerFromRequest(messages, r).T("errors.create_job", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Should we start shutting down in the meantime, the job page explains
+	// the job failed.
+	s.enqueueJob(r.Context(), job.ID, 0, releaseQuota)
+
+	s.logger.V(3).Info("Redirecting based on job id", "jobId", job.ID)
+	http.Redirect(w, r, fmt.Sprintf("/downloads/%s", job.ID), http.StatusSeeOther)
+}
+
+// enqueueJob processes the job in a background go routine. Processing
+// continues the request's trace, even though it outlives the request, and is
+// cancelled if we shut down before it finishes.
+// It returns false, having marked the job as failed, if we're shutting down.
+func (s *Server) enqueueJob(ctx context.Context, jobID string, previousBytesDownloaded int64, releaseQuota func(int64)) bool {
+	ctx, span := startSpan(contextWithJobID(ctx, jobID), "job.enqueue")
+	defer span.End()
+
+	if !s.startJob(jobID) {
+		releaseQuota(0)
+		s.jobStore.Update(jobID, interruptJob)
+		s.jobProcessor.notify(jobID)
+		endSpan(span, errShuttingDown)
+		return false
+	}
+
+	go s.processJob(detachedContext(s.jobsCtx, ctx), jobID, previousBytesDownloaded, releaseQuota)
+	return true
+}
+
+// processJob processes the job and then releases the client's quota
+// reservation, charging them for whatever we downloaded beyond
+// `previousBytesDownloaded`.
+func (s *Server) processJob(ctx context.Context, jobID string, previousBytesDownloaded int64, releaseQuota func(int64)) {
+	defer s.finishJob(jobID)
+	s.jobProcessor.Process(ctx, jobID)
+
+	var bytesDownloaded int64
+	if processedJob, found := s.jobStore.Get(jobID); found {
+		bytesDownloaded = processedJob.BytesDownloaded - previousBytesDownloaded
+	}
+	releaseQuota(bytesDownloaded)
+}
+
+// downloadsRetry lets users manually retry a job which has failed items (i.e.
+// after we've exhausted our automatic retries).
+func (s *Server) downloadsRetry(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(2).Info("Serving request", "endpoint", "POST#downloads/:id/retry")
+	jobID := mux.Vars(r)["id"]
+
+	job, found := s.jobStore.Get(jobID)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	localizer := localizerFromRequest(messages, r)
+	if !job.Retryable() {
+		http.Error(w, localizer.T("errors.not_retryable"), http.StatusConflict)
+		return
+	}
+
+	if s.isDraining() {
+		http.Error(w, localizer.Error(errShuttingDown), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Retries launch containers too, so are subject to the same quotas.
+	client := s.quotaClientFromRequest(r)
+	releaseQuota, err := s.quotaEnforcer.Reserve(client, job.numDownloadsToRetry())
+	if err != nil {
+		s.logger.V(2).Info("Refusing retry due to quota", "jobId", jobID, "user", client.user, "ip", client.ip, "reason", err)
+		s.renderIndex(w, r, http.StatusTooManyRequests, err)
+		return
+	}
+
+	// The job may have been retried concurrently, so we check again while
+	// holding the job store's lock.
+	var retrying bool
+	s.jobStore.Update(jobID, func(job *Job) {
+		if retrying = job.Retryable(); retrying {
+			job.resetForRetry()
+		}
+	})
+	if !retrying {
+		releaseQuota(0)
+		http.Error(w, localizer.T("errors.not_retryable"), http.StatusConflict)
+		return
+	}
+
+	s.logger.V(2).Info("Retrying job", "jobId", jobID)
+	s.enqueueJob(r.Context(), jobID, job.BytesDownloaded, releaseQuota)
+
+	http.Redirect(w, r, fmt.Sprintf("/downloads/%s", jobID), http.StatusSeeOther)
+}
+
+// downloadRequest is everything the user asked for when submitting the
+// download form.
+type downloadRequest struct {
+	remotePaths     []string
+	downloadOptions *DownloadOptions
+	bundle          bool
+	profile         *TranscodingProfile
+	// email is where the user wants us to email them once the download
+	// finishes, if anywhere.
+	email string
+}
+
+// numDownloads returns the most videos the request could download: every url
+// may be a playlist.
+func (d *downloadRequest) numDownloads() int {
+	return len(d.remotePaths) * d.downloadOptions.maxDownloadsPerURL()
+}
+
+// parseDownloadRequest parses and validates the download form. Any error it
+// returns is intended to be shown directly to the user.
+func (s *Server) parseDownloadRequest(r *http.Request, client *quotaClient) (*downloadRequest, error) {
+	// Users may submit multiple urls, separated by whitespace (i.e. one per
+	// line).
+	rawURLs := strings.Fields(r.FormValue("url"))
+	if len(rawURLs) == 0 {
+		// Shared from another app, via our web app manifest's share
+		// target.
+		rawURLs = urlsInSharedText(r.FormValue("shared_text") + " " + r.FormValue("shared_title"))
+	}
+	if len(rawURLs) == 0 {
+		rawURLs = []string{""}
+	}
+
+	if s.downloadsConf.MaxBatchURLs > 0 && len(rawURLs) > s.downloadsConf.MaxBatchURLs {
+		return nil, newUserError("errors.too_many_urls", s.downloadsConf.MaxBatchURLs)
+	}
+
+	profile := s.downloadsConf.Profiles[0]
+	if profileName := r.FormValue("profile"); profileName != "" {
+		var found bool
+		if profile, found = findTranscodingProfile(s.downloadsConf.Profiles, profileName); !found {
+			return nil, newUserError("errors.unknown_profile", profileName)
+		}
+	}
+
+	downloadReq := &downloadRequest{
+		downloadOptions: &DownloadOptions{
+			audioOnly:   profile.AudioOnly,
+			maxDuration: s.quotaEnforcer.MaxVideoDuration(client),
+		},
+		bundle:  r.FormValue("bundle") != "",
+		profile: profile,
+	}
+
+	seenRemotePaths := make(map[string]bool)
+	for _, rawURL := range rawURLs {
+		remotePath, err := s.urlValidator.Validate(rawURL)
+		if err != nil {
+			return nil, err
+		}
+
+		if !seenRemotePaths[remotePath] {
+			seenRemotePaths[remotePath] = true
+			downloadReq.remotePaths = append(downloadReq.remotePaths, remotePath)
+		}
+	}
+
+	if r.FormValue("playlist") != "" {
+		downloadReq.downloadOptions.playlist = true
+		downloadReq.downloadOptions.maxPlaylistItems = s.downloadsConf.MaxPlaylistItems
+
+		playlistItems := strings.Join(strings.Fields(r.FormValue("playlist_items")), "")
+		if playlistItems != "" {
+			if err := validatePlaylistItems(playlistItems, s.downloadsConf.MaxPlaylistItems); err != nil {
+				return nil, err
 			}
-		} else {
-			s.logger.V(3).Info("Download failed", "downloadId", downloadId)
+			downloadReq.downloadOptions.playlistItems = playlistItems
 		}
+	}
 
-		s.publicDownloadURLCache[downloadId] = publicURL
-	}()
+	if err := parseClip(r, downloadReq.downloadOptions); err != nil {
+		return nil, err
+	}
 
-	s.logger.V(3).Info("Redirecting based on cached download id", "downloadId", downloadId)
-	http.Redirect(w, r, fmt.Sprintf("/downloads/%s", downloadId), http.StatusSeeOther)
+	if err := parseSubtitles(r, downloadReq.downloadOptions); err != nil {
+		return nil, err
+	}
+
+	// Only audio files support embedding the thumbnail (as cover art).
+	downloadReq.downloadOptions.embedThumbnail = profile.AudioOnly && r.FormValue("embed_thumbnail") != ""
+
+	if email := strings.TrimSpace(r.FormValue("email")); email != "" && s.Emails != nil {
+		var err error
+		if downloadReq.email, err = parseEmailAddress(email); err != nil {
+			return nil, err
+		}
+	}
+
+	return downloadReq, nil
+}
+
+// parseClip parses the optional start and end of the clip the user wants.
+func parseClip(r *http.Request, downloadOptions *DownloadOptions) error {
+	var err error
+
+	if clipStart := strings.TrimSpace(r.FormValue("clip_start")); clipStart != "" {
+		if downloadOptions.clipStart, err = parseTimestamp(clipStart); err != nil {
+			return err
+		}
+	}
+
+	if clipEnd := strings.TrimSpace(r.FormValue("clip_end")); clipEnd != "" {
+		if downloadOptions.clipEnd, err = parseTimestamp(clipEnd); err != nil {
+			return err
+		}
+	}
+
+	return validateClip(downloadOptions.clipStart, downloadOptions.clipEnd, downloadOptions.maxDuration)
+}
+
+// parseSubtitles parses the optional subtitles the user wants.
+func parseSubtitles(r *http.Request, downloadOptions *DownloadOptions) error {
+	subtitleLanguages, err := parseSubtitleLanguages(r.FormValue("subtitle_languages"))
+	if err != nil {
+		return err
+	}
+
+	downloadOptions.subtitleLanguages = subtitleLanguages
+	downloadOptions.autoSubtitles = r.FormValue("auto_subtitles") != ""
+
+	// Audio files can't contain subtitles, so we always upload them as
+	// separate files.
+	downloadOptions.embedSubtitles = !downloadOptions.audioOnly && r.FormValue("subtitle_mode") == "embed"
+
+	return nil
 }
 
 // TODO: Naming convention for objects containing template vars...
 type downloadShowPage struct {
+	JobID     string
+	State     JobState
+	CreatedAt time.Time
+	// RemotePathsJSON lists the job's urls, for our download history.
+	RemotePathsJSON   string
 	PublicDownloadURL string
 	DownloadComplete  bool
+	Succeeded         bool
+	Items             []*JobItem
+	Profile           *TranscodingProfile
+	Retryable         bool
 }
 
 func (s *Server) downloadsShow(w http.ResponseWriter, r *http.Request) {
 	s.logger.V(2).Info("Serving request", "endpoint", "GET#downloads/:id")
 	vars := mux.Vars(r)
 
-	p := &downloadShowPage{}
-
-	publicDownloadURL, found := s.publicDownloadURLCache[vars["id"]]
-	if found {
-		p.DownloadComplete = true
+	job, found := s.jobStore.Get(vars["id"])
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
 
-		if publicDownloadURL != FailureToDownlownLoadOrUploadVideo {
-			p.PublicDownloadURL = publicDownloadURL
-		}
+	var remotePaths []string
+	for _, item := range job.Items {
+		remotePaths = append(remotePaths, item.RemotePath)
+	}
+	remotePathsJSON, _ := json.Marshal(remotePaths)
+
+	p := &downloadShowPage{
+		JobID:             job.ID,
+		State:             job.State,
+		CreatedAt:         job.CreatedAt,
+		RemotePathsJSON:   string(remotePathsJSON),
+		PublicDownloadURL: job.PublicDownloadURL,
+		DownloadComplete:  job.Complete(),
+		Succeeded:         job.State == JobStateSucceeded,
+		Items:             job.Items,
+		Profile:           job.Profile,
+		Retryable:         job.Retryable(),
 	}
 
-	t := template.Must(template.ParseFiles("templates/download.html"))
-	t.Execute(w, p)
+	s.Assets.Render(w, r, http.StatusOK, "download", p)
 }
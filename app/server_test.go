@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*Server, JobStore, cleanUpFunc) {
+	t.Helper()
+
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+
+	conf := defaultConfig()
+
+	downloader := NewFakeContentDownloader(tmpFsClient)
+	uploader := NewRemoteStoreContentUploader(NewFakeRemoteStoreClient(), testLogger)
+	jobStore := NewInMemoryJobStore()
+	jobProcessor := NewJobProcessor(downloader, NewFakeContentTranscoder(), uploader, NewInMemoryContentCache(), jobStore, testLogger)
+	quotaEnforcer := NewInMemoryQuotaEnforcer(conf.Limits)
+
+	urlValidator := NewHostURLValidator(conf.URLs)
+	urlValidator.lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("142.250.72.14")}, nil
+	}
+
+	server := NewServer(testServerPort, jobProcessor, jobStore, quotaEnforcer, urlValidator, conf.Downloads, testLogger)
+	return server, jobStore, tmpFsClient.CleanUp
+}
+
+// testCSRFToken is a valid CSRF token, which tests submit along with the
+// matching cookie.
+const testCSRFToken = "abcdefghijklmnopqrstuvwxyz012345"
+
+// withTestCSRFToken makes the request pass our CSRF checks, as though it came
+// from one of our forms.
+func withTestCSRFToken(req *http.Request) *http.Request {
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	req.Header.Set(csrfHeaderName, testCSRFToken)
+	return req
+}
+
+func postDownloadForm(server *Server, form url.Values) *httptest.ResponseRecorder {
+	req := withTestCSRFToken(httptest.NewRequest("POST", "/downloads", strings.NewReader(form.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+	return rec
+}
+
+// waitForJobComplete waits for the background processing of the job
+// referenced by the redirect to finish.
+func waitForJobComplete(t *testing.T, jobStore JobStore, rec *httptest.ResponseRecorder) *Job {
+	t.Helper()
+
+	jobID := strings.TrimPrefix(rec.Header().Get("Location"), "/downloads/")
+
+	var job *Job
+	err := retryWithTimeout(50, 10*time.Millisecond, func() error {
+		var found bool
+		job, found = jobStore.Get(jobID)
+		if !found || !job.Complete() {
+			return fmt.Errorf("Job %s is not complete", jobID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Job %s did not complete", jobID)
+	}
+
+	return job
+}
+
+func TestServerIndex(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "downloadForm") {
+		t.Fatal("Index should contain the download form")
+	}
+}
+
+func TestServerDownloadsCreateRejectsInvalidURL(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := postDownloadForm(server, url.Values{"url": {"--exec rm -rf /"}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, but got %d", http.StatusBadRequest, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "errorMessage") {
+		t.Fatal("Should show the user why their download was refused")
+	}
+}
+
+func TestServerDownloadsCreateBatch(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	form := url.Values{
+		"url":    {youtubeURL + "\nhttps://vimeo.com/12345\n" + youtubeURL},
+		"bundle": {"true"},
+	}
+	rec := postDownloadForm(server, form)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, but got %d", http.StatusSeeOther, rec.Code)
+	}
+
+	job := waitForJobComplete(t, jobStore, rec)
+	if len(job.Items) != 2 {
+		t.Fatalf("Expected duplicate urls to be removed, leaving 2 items, but got %d", len(job.Items))
+	}
+	if !job.Bundle {
+		t.Fatal("Expected job to be bundled")
+	}
+
+	showRec := httptest.NewRecorder()
+	server.router().ServeHTTP(showRec, httptest.NewRequest("GET", rec.Header().Get("Location"), nil))
+	if !strings.Contains(showRec.Body.String(), "publicDownloadURL") {
+		t.Fatal("Completed job should link to its download")
+	}
+}
+
+func TestServerDownloadsCreateRejectsTooManyURLs(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	urls := strings.Repeat(youtubeURL+"\n", server.downloadsConf.MaxBatchURLs+1)
+	rec := postDownloadForm(server, url.Values{"url": {urls}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, but got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestServerDownloadsCreateRejectsRequestsOverQuota(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	server.quotaEnforcer = NewInMemoryQuotaEnforcer(limitsConfig{PerIP: quotaLimits{JobsPerHour: 1}})
+
+	rec := postDownloadForm(server, url.Values{"url": {youtubeURL}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect to the job, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitForJobComplete(t, jobStore, rec)
+
+	rec = postDownloadForm(server, url.Values{"url": {youtubeURL}})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, but got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	// We show the form again, explaining which limit they've reached.
+	body := rec.Body.String()
+	if !strings.Contains(body, `id="downloadForm"`) || !strings.Contains(body, "limit of 1 downloads per hour") {
+		t.Fatalf("Expected the index page explaining the limit, but got %s", body)
+	}
+
+	if jobs := jobStore.Stats().JobsByState; jobs[JobStateSucceeded] != 1 || jobs[JobStatePending] != 0 {
+		t.Fatalf("Should not create a job for requests over quota, but have %v", jobs)
+	}
+}
+
+func TestServerDownloadsCreateChargesQuotaPerVideo(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	server.quotaEnforcer = NewInMemoryQuotaEnforcer(limitsConfig{PerIP: quotaLimits{JobsPerHour: 3}})
+
+	// Each url in a batch, and each item in a playlist, counts as a
+	// download.
+	rec := postDownloadForm(server, url.Values{"url": {youtubeURL + "\n" + youtubeURL + "&2"}, "playlist": {"on"}, "playlist_items": {"1-2"}})
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "at most 3 downloads at once") {
+		t.Fatalf("Expected a batch of 4 videos to exceed the quota, but got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = postDownloadForm(server, url.Values{"url": {youtubeURL + "\n" + youtubeURL + "&2"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect to the job, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitForJobComplete(t, jobStore, rec)
+
+	rec = postDownloadForm(server, url.Values{"url": {youtubeURL + "&3\n" + youtubeURL + "&4"}})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, but got %d", http.StatusTooManyRequests, rec.Code)
+	}
+}
+
+func TestServerDownloadsShowNotFound(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/downloads/does-not-exist", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, but got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestServerDownloadsCreateRejectsInvalidClip(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	form := url.Values{
+		"url":        {youtubeURL},
+		"clip_start": {"3:00"},
+		"clip_end":   {"1:00"},
+	}
+	rec := postDownloadForm(server, form)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, but got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestServerDownloadsCreateRejectsUnknownProfile(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := postDownloadForm(server, url.Values{"url": {youtubeURL}, "profile": {"does-not-exist"}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, but got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestServerDownloadsRetry(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	postRetry := func(jobID string) *httptest.ResponseRecorder {
+		req := withTestCSRFToken(httptest.NewRequest("POST", fmt.Sprintf("/downloads/%s/retry", jobID), nil))
+		rec := httptest.NewRecorder()
+		server.router().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := postRetry("does-not-exist"); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, but got %d", http.StatusNotFound, rec.Code)
+	}
+
+	job := NewJob([]string{youtubeURL}, &DownloadOptions{audioOnly: true})
+	job.State = JobStateFailed
+	job.Items[0].State = JobStateFailed
+	job.Items[0].Err = fmt.Errorf("failed to download")
+	if err := jobStore.Create(job); err != nil {
+		t.Fatalf("Error creating job: %s", err)
+	}
+
+	rec := postRetry(job.ID)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, but got %d", http.StatusSeeOther, rec.Code)
+	}
+
+	job = waitForJobComplete(t, jobStore, rec)
+	if job.State != JobStateSucceeded {
+		t.Fatalf("Expected retried job to succeed, but got state %s", job.State)
+	}
+
+	// Jobs without failures can't be retried.
+	if rec := postRetry(job.ID); rec.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d, but got %d", http.StatusConflict, rec.Code)
+	}
+}
+
+func TestServerHealthz(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestServerReadyz(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	downloader := NewContainerYoutubeDlContentDownloader(NewFakeContainerClient(), tmpFsClient, testLogger)
+	server.HealthChecker = NewHealthChecker(testLogger)
+	server.HealthChecker.CacheDuration = 0
+	server.HealthChecker.AddCheck("youtube_dl_image", downloader.ImageAvailable)
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d before BestEffortInit finishes, but got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	var report ReadinessReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("Error decoding readiness report: %s", err)
+	}
+
+	if report.Ready || len(report.Checks) != 1 || report.Checks[0].Name != "youtube_dl_image" || report.Checks[0].Error == "" {
+		t.Fatalf("Expected report to explain the youtube-dl image check failed, but got %+v", report)
+	}
+
+	if err := downloader.BestEffortInit(); err != nil {
+		t.Fatalf("Should not have error initializing downloader: %s", err)
+	}
+
+	rec = httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d once BestEffortInit finishes, but got %d", http.StatusOK, rec.Code)
+	}
+}
+
+// blockingContentDownloader blocks each download until `release` is closed.
+type blockingContentDownloader struct {
+	ContentDownloader
+	started chan string
+	release chan struct{}
+}
+
+func (b *blockingContentDownloader) DownloadContent(ctx context.Context, remotePath string, downloadOptions *DownloadOptions) ([]string, error) {
+	b.started <- remotePath
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return b.ContentDownloader.DownloadContent(ctx, remotePath, downloadOptions)
+}
+
+// serveTestServer serves until we send to the returned channel, returning
+// serve's result on the other returned channel.
+func serveTestServer(t *testing.T, server *Server, cleanUpFunc func() error) (chan<- os.Signal, <-chan error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+
+	shutdownCh := make(chan os.Signal, 1)
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- server.serve(listener, nil, shutdownCh, cleanUpFunc)
+	}()
+
+	return shutdownCh, serveErrCh
+}
+
+func TestServerListenAndServeReturnsBindError(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+	server.port = listener.Addr().(*net.TCPAddr).Port
+
+	var cleanedUp bool
+	err = server.ListenAndServe(func() error {
+		cleanedUp = true
+		return nil
+	})
+
+	if err == nil {
+		t.Fatal("Should have error when the port is already in use")
+	}
+
+	if !cleanedUp {
+		t.Fatal("Should clean up even when we fail to listen")
+	}
+}
+
+func TestServerServeDrainsInFlightJobs(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	downloader := &blockingContentDownloader{
+		ContentDownloader: server.jobProcessor.contentDownloader,
+		started:           make(chan string, 1),
+		release:           make(chan struct{}),
+	}
+	server.jobProcessor.contentDownloader = downloader
+
+	var cleanedUp bool
+	shutdownCh, serveErrCh := serveTestServer(t, server, func() error {
+		cleanedUp = true
+		return nil
+	})
+
+	rec := postDownloadForm(server, url.Values{"url": {youtubeURL}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, but got %d", http.StatusSeeOther, rec.Code)
+	}
+	<-downloader.started
+
+	shutdownCh <- syscall.SIGTERM
+	if err := retryWithTimeout(50, 10*time.Millisecond, func() error {
+		if !server.isDraining() {
+			return fmt.Errorf("Server is not draining")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal("Server should start draining once told to shut down")
+	}
+
+	if rec := postDownloadForm(server, url.Values{"url": {youtubeURL}}); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected new downloads to be refused with status %d, but got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	readyzRec := httptest.NewRecorder()
+	server.router().ServeHTTP(readyzRec, httptest.NewRequest("GET", "/readyz", nil))
+	if readyzRec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected to not be ready while draining, but got status %d", readyzRec.Code)
+	}
+
+	select {
+	case err := <-serveErrCh:
+		t.Fatalf("Should wait for in-flight job before returning, but returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(downloader.release)
+	if err := <-serveErrCh; err != nil {
+		t.Fatalf("Should not have error shutting down: %s", err)
+	}
+
+	if !cleanedUp {
+		t.Fatal("Should clean up once shut down")
+	}
+
+	job := waitForJobComplete(t, jobStore, rec)
+	if job.State != JobStateSucceeded {
+		t.Fatalf("Expected in-flight job to finish successfully, but got %s: %v", job.State, job.Err)
+	}
+}
+
+func TestServerServeInterruptsJobsAfterShutdownTimeout(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+	server.Conf.ShutdownTimeoutSeconds = 1
+
+	downloader := &blockingContentDownloader{
+		ContentDownloader: server.jobProcessor.contentDownloader,
+		started:           make(chan string, 1),
+		release:           make(chan struct{}),
+	}
+	server.jobProcessor.contentDownloader = downloader
+	defer close(downloader.release)
+
+	// We cancel the job, and wait for it to stop, before cleaning up.
+	var jobStoppedBeforeCleanUp bool
+	shutdownCh, serveErrCh := serveTestServer(t, server, func() error {
+		jobStoppedBeforeCleanUp = server.numInFlightJobs() == 0
+		return nil
+	})
+
+	rec := postDownloadForm(server, url.Values{"url": {youtubeURL}})
+	<-downloader.started
+
+	shutdownCh <- syscall.SIGTERM
+	if err := <-serveErrCh; err != nil {
+		t.Fatalf("Should not have error shutting down: %s", err)
+	}
+
+	if !jobStoppedBeforeCleanUp {
+		t.Fatal("Should wait for cancelled jobs to stop before cleaning up")
+	}
+
+	job := waitForJobComplete(t, jobStore, rec)
+	if job.State != JobStateFailed || job.Err != errShuttingDown || job.Items[0].Err != errShuttingDown {
+		t.Fatalf("Expected unfinished job to fail due to the shutdown, but got %s: %v", job.State, job.Err)
+	}
+
+	if !job.Retryable() {
+		t.Fatal("Jobs interrupted by the shutdown should be retryable")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// share lets users send a page to vidzou from elsewhere (i.e. our bookmarklet
+// or a browser extension) via GET /share?url=.... As any site could link
+// there, we never start a download from a GET. Instead, we show the form,
+// filled in with the url, so the user confirms (and can choose options) by
+// submitting it as usual.
+func (s *Server) share(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(2).Info("Serving request", "endpoint", "GET#share")
+
+	rawURLs := strings.Fields(r.FormValue("url"))
+	if len(rawURLs) == 0 {
+		rawURLs = urlsInSharedText(r.FormValue("text") + " " + r.FormValue("title"))
+	}
+
+	// We check the urls now, so the user doesn't have to submit the form
+	// to discover we won't download them.
+	var err error
+	if len(rawURLs) == 0 {
+		_, err = s.urlValidator.Validate("")
+	}
+	for _, rawURL := range rawURLs {
+		if _, err = s.urlValidator.Validate(rawURL); err != nil {
+			break
+		}
+	}
+
+	statusCode := http.StatusOK
+	if err != nil {
+		s.logger.V(2).Info("Shared invalid url", "url", r.FormValue("url"), "reason", err)
+		statusCode = http.StatusBadRequest
+	}
+
+	s.renderIndexPage(w, r, statusCode, &indexPage{
+		Shared: true,
+		URL:    strings.Join(rawURLs, "\n"),
+	}, err)
+}
+
+// bookmarklet returns the javascript for a bookmark which sends the page the
+// user is on to our share endpoint.
+func bookmarklet(r *http.Request) template.URL {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	// Marshalling quotes (and escapes) the url as a javascript string.
+	shareURL, _ := json.Marshal(fmt.Sprintf("%s://%s/share?url=", scheme, r.Host))
+
+	// We generate the javascript ourselves, so it's safe to use as a url.
+	return template.URL(fmt.Sprintf("javascript:location.href=%s+encodeURIComponent(location.href);void(0)", shareURL))
+}
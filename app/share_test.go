@@ -0,0 +1,118 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func getShare(server *Server, query url.Values) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/share?"+query.Encode(), nil))
+	return rec
+}
+
+func TestServerShareAsksForConfirmation(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := getShare(server, url.Values{"url": []string{youtubeURL}})
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "shareTitle") {
+		t.Fatalf("Expected confirmation page, but got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	body := html.UnescapeString(rec.Body.String())
+	if !strings.Contains(body, ">"+youtubeURL+"</textarea>") {
+		t.Fatalf("Expected the form to be filled in with the url, but got %s", body)
+	}
+
+	// Any site could link to the share endpoint, so only the user
+	// submitting the form may start a download.
+	for state, count := range jobStore.Stats().JobsByState {
+		if count != 0 {
+			t.Fatalf("Should not create jobs when sharing, but found %d %s", count, state)
+		}
+	}
+}
+
+func TestServerShareFindsURLsInText(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := getShare(server, url.Values{"text": []string{"Watch this " + youtubeURL}})
+
+	if rec.Code != http.StatusOK || !strings.Contains(html.UnescapeString(rec.Body.String()), ">"+youtubeURL+"</textarea>") {
+		t.Fatalf("Expected the form to be filled in with the url, but got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerShareValidatesURLs(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	for _, query := range []url.Values{
+		{"url": []string{"ftp://example.com/video"}},
+		{},
+	} {
+		rec := getShare(server, query)
+
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "errorMessage") {
+			t.Errorf("Expected an explanation for %v, but got %d: %s", query, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestServerShareRequiresGet(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("POST", "/share?url="+url.QueryEscape(youtubeURL), nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d, but got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestBookmarklet(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "vidzou.test"
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	expected := `javascript:location.href="https://vidzou.test/share?url="+encodeURIComponent(location.href);void(0)`
+	if js := string(bookmarklet(req)); js != expected {
+		t.Fatalf("Expected %s, but got %s", expected, js)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Host = `evil.test";alert(1);"`
+	if js := string(bookmarklet(req)); !strings.Contains(js, `"http://evil.test\";alert(1);\"/share?url="`) {
+		t.Fatalf("Expected the host to be escaped, but got %s", js)
+	}
+}
+
+var bookmarkletHrefRegexp = regexp.MustCompile(`href="(javascript:[^"]*)"`)
+
+func TestServerIndexOffersBookmarklet(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	match := bookmarkletHrefRegexp.FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		t.Fatalf("Expected bookmarklet, but got %s", rec.Body.String())
+	}
+
+	// Browsers unescape javascript urls before running them.
+	js, err := url.PathUnescape(html.UnescapeString(match[1]))
+	if err != nil || js != `javascript:location.href="http://example.com/share?url="+encodeURIComponent(location.href);void(0)` {
+		t.Fatalf("Expected bookmarklet to send the page to our share endpoint, but got %s", js)
+	}
+}
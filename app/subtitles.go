@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// subtitleFileExtension is the format we convert all subtitles to, as it's the
+// format most players understand.
+const subtitleFileExtension = "srt"
+
+// maxSubtitleLanguages caps the number of subtitle languages per download,
+// which keeps the number of files we upload reasonable.
+const maxSubtitleLanguages = 5
+
+// subtitleLanguageRegexp matches the language codes youtube-dl uses for
+// subtitles (i.e. "en", "pt-BR", "zh-Hans").
+var subtitleLanguageRegexp = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// parseSubtitleLanguages parses the comma (or whitespace) separated list of
+// subtitle languages the user wants.
+func parseSubtitleLanguages(rawLanguages string) ([]string, error) {
+	fields := strings.FieldsFunc(rawLanguages, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+
+	var languages []string
+	seenLanguages := make(map[string]bool)
+	for _, language := range fields {
+		if !subtitleLanguageRegexp.MatchString(language) {
+			return nil, newUserError("errors.subtitles.unknown_language", language)
+		}
+
+		if !seenLanguages[language] {
+			seenLanguages[language] = true
+			languages = append(languages, language)
+		}
+	}
+
+	if len(languages) > maxSubtitleLanguages {
+		return nil, newUserError("errors.subtitles.too_many_languages", maxSubtitleLanguages)
+	}
+
+	return languages, nil
+}
+
+// subtitleYoutubeDlOptions translates our subtitle options into youtube-dl
+// options.
+func subtitleYoutubeDlOptions(downloadOptions *DownloadOptions) []string {
+	if len(downloadOptions.subtitleLanguages) == 0 {
+		return nil
+	}
+
+	options := []string{
+		"--write-sub",
+		"--sub-lang", strings.Join(downloadOptions.subtitleLanguages, ","),
+		"--sub-format", subtitleFileExtension + "/best",
+		"--convert-subs", subtitleFileExtension,
+	}
+	if downloadOptions.autoSubtitles {
+		// youtube-dl only uses the automatically generated subtitles for
+		// languages without regular subtitles.
+		options = append(options, "--write-auto-sub")
+	}
+	if downloadOptions.embedSubtitles {
+		// youtube-dl can only embed subtitles in mp4, mkv and webm files,
+		// and only keeps webvtt subtitles for webm, so we prefer mp4.
+		// youtube-dl deletes the subtitle files once they're embedded.
+		options = append(options,
+			"--embed-subs",
+			"-f", "bestvideo[ext=mp4]+bestaudio[ext=m4a]/best[ext=mp4]/best",
+		)
+	}
+
+	return options
+}
+
+// isSubtitleFile returns whether the file is a subtitle sidecar, rather than
+// the downloaded media. youtube-dl names subtitles after the media file, plus
+// the language (i.e. "title.en.srt").
+func isSubtitleFile(filePath string) bool {
+	return path.Ext(filePath) == "."+subtitleFileExtension
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSubtitleLanguages(t *testing.T) {
+	validLanguages := map[string][]string{
+		"":            nil,
+		"en":          {"en"},
+		"en, es":      {"en", "es"},
+		"pt-BR,en,en": {"pt-BR", "en"},
+		"zh-Hans fr":  {"zh-Hans", "fr"},
+	}
+	for rawLanguages, expectedLanguages := range validLanguages {
+		languages, err := parseSubtitleLanguages(rawLanguages)
+		if err != nil {
+			t.Fatalf("Expected %q to be valid: %s", rawLanguages, err)
+		}
+
+		if !reflect.DeepEqual(languages, expectedLanguages) {
+			t.Fatalf("Expected %q to parse to %v, but got %v", rawLanguages, expectedLanguages, languages)
+		}
+	}
+
+	invalidLanguages := []string{"e", "english!", "--exec", "en,es,fr,de,it,pt"}
+	for _, rawLanguages := range invalidLanguages {
+		if _, err := parseSubtitleLanguages(rawLanguages); err == nil {
+			t.Fatalf("Expected %q to be invalid", rawLanguages)
+		}
+	}
+}
+
+func TestSubtitleYoutubeDlOptions(t *testing.T) {
+	if options := subtitleYoutubeDlOptions(&DownloadOptions{}); options != nil {
+		t.Fatalf("Expected no subtitle options, but got %v", options)
+	}
+
+	options := subtitleYoutubeDlOptions(&DownloadOptions{subtitleLanguages: []string{"en", "es"}, autoSubtitles: true})
+	expectedOptions := []string{"--write-sub", "--sub-lang", "en,es", "--sub-format", "srt/best", "--convert-subs", "srt", "--write-auto-sub"}
+	if !reflect.DeepEqual(options, expectedOptions) {
+		t.Fatalf("Expected %v, but got %v", expectedOptions, options)
+	}
+
+	options = subtitleYoutubeDlOptions(&DownloadOptions{subtitleLanguages: []string{"en"}, embedSubtitles: true})
+	if !containsString(options, "--embed-subs") || containsString(options, "--write-auto-sub") {
+		t.Fatalf("Expected embedded subtitles without automatic subtitles, but got %v", options)
+	}
+}
+
+func TestInfoFilePathFor(t *testing.T) {
+	filePaths := []string{"/tmp/abcdefgh-My Video.mp4", "/tmp/abcdefgh-My Video.en.srt"}
+	for _, filePath := range filePaths {
+		if infoFilePath := infoFilePathFor(filePath); infoFilePath != "/tmp/abcdefgh-My Video.info.json" {
+			t.Fatalf("Unexpected info file path %s for %s", infoFilePath, filePath)
+		}
+	}
+}
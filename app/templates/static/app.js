@@ -0,0 +1,90 @@
+// Registers our service worker and keeps a history of this device's downloads,
+// which we can show even while offline.
+
+const HISTORY_KEY = "vidzou.history";
+const MAX_HISTORY_ENTRIES = 50;
+
+if ("serviceWorker" in navigator) {
+  navigator.serviceWorker.register("/service-worker.js").catch((err) => {
+    console.warn("Unable to register service worker", err);
+  });
+}
+
+function loadHistory() {
+  try {
+    return JSON.parse(localStorage.getItem(HISTORY_KEY)) || [];
+  } catch (err) {
+    return [];
+  }
+}
+
+function saveHistory(history) {
+  try {
+    localStorage.setItem(HISTORY_KEY, JSON.stringify(history.slice(0, MAX_HISTORY_ENTRIES)));
+  } catch (err) {
+    console.warn("Unable to save download history", err);
+  }
+}
+
+// recordJob adds (or updates) the job shown on a download page, which describes
+// it with data attributes.
+function recordJob(jobElement) {
+  const job = {
+    id: jobElement.dataset.id,
+    state: jobElement.dataset.state,
+    urls: JSON.parse(jobElement.dataset.remotePaths || "[]"),
+    createdAt: jobElement.dataset.createdAt,
+  };
+
+  const history = loadHistory().filter((entry) => entry.id !== job.id);
+  history.unshift(job);
+  history.sort((a, b) => (b.createdAt || "").localeCompare(a.createdAt || ""));
+  saveHistory(history);
+}
+
+// renderHistory lists the jobs in our history, labelling their states using the
+// (translated) labels the page provides.
+function renderHistory(historyElement) {
+  const history = loadHistory();
+  const stateLabels = historyElement.dataset;
+
+  if (history.length === 0) {
+    return;
+  }
+  document.getElementById("historyEmpty").hidden = true;
+
+  for (const job of history) {
+    const item = document.createElement("li");
+
+    const link = document.createElement("a");
+    link.href = "/downloads/" + encodeURIComponent(job.id);
+    link.textContent = job.urls.join(", ") || job.id;
+    item.appendChild(link);
+
+    const state = document.createElement("span");
+    state.className = "tag is-light ml-2";
+    state.textContent = stateLabels["state" + job.state.charAt(0).toUpperCase() + job.state.slice(1)] || job.state;
+    item.appendChild(state);
+
+    if (job.createdAt) {
+      const createdAt = document.createElement("p");
+      createdAt.className = "is-size-7";
+      createdAt.textContent = new Date(job.createdAt).toLocaleString(document.documentElement.lang);
+      item.appendChild(createdAt);
+    }
+
+    historyElement.appendChild(item);
+  }
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  const jobElement = document.getElementById("job");
+  if (jobElement) {
+    recordJob(jobElement);
+  }
+
+  const historyElement = document.getElementById("history");
+  if (historyElement) {
+    renderHistory(historyElement);
+  }
+});
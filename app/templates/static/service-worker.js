@@ -0,0 +1,83 @@
+// vidzou's service worker, which lets the app (and the download history)
+// open while offline. It's served from /service-worker.js, so it controls
+// every page.
+
+const CACHE_NAME = "vidzou-v1";
+
+// The pages and files we need to start the app while offline.
+const APP_SHELL = [
+  "/",
+  "/history",
+  "/manifest.webmanifest",
+  "/static/bulma.min.css",
+  "/static/app.js",
+  "/static/icon-192.png",
+  "/static/icon-512.png",
+];
+
+self.addEventListener("install", (event) => {
+  event.waitUntil(
+    caches.open(CACHE_NAME)
+      .then((cache) => cache.addAll(APP_SHELL))
+      .then(() => self.skipWaiting())
+  );
+});
+
+self.addEventListener("activate", (event) => {
+  event.waitUntil(
+    caches.keys()
+      .then((names) => Promise.all(
+        names.filter((name) => name !== CACHE_NAME).map((name) => caches.delete(name))
+      ))
+      .then(() => self.clients.claim())
+  );
+});
+
+self.addEventListener("fetch", (event) => {
+  const request = event.request;
+  const url = new URL(request.url);
+
+  // We never cache submissions (i.e. shared urls), or anything from other
+  // sites (i.e. the downloaded files).
+  if (request.method !== "GET" || url.origin !== self.location.origin) {
+    return;
+  }
+
+  if (url.pathname.startsWith("/static/")) {
+    event.respondWith(cacheFirst(request));
+  } else if (request.mode === "navigate") {
+    event.respondWith(networkFirst(request));
+  }
+});
+
+// cacheFirst serves static files from the cache, as they rarely change.
+async function cacheFirst(request) {
+  const cached = await caches.match(request);
+  if (cached) {
+    return cached;
+  }
+
+  const response = await fetch(request);
+  if (response.ok) {
+    const cache = await caches.open(CACHE_NAME);
+    cache.put(request, response.clone());
+  }
+  return response;
+}
+
+// networkFirst serves pages from the network, so they're up to date, but
+// remembers them so we can show the last version we saw while offline. If we
+// never saw the page, we show the download history instead.
+async function networkFirst(request) {
+  try {
+    const response = await fetch(request);
+    if (response.ok) {
+      const cache = await caches.open(CACHE_NAME);
+      cache.put(request, response.clone());
+    }
+    return response;
+  } catch (err) {
+    const cached = await caches.match(request);
+    return cached || caches.match("/history");
+  }
+}
@@ -69,3 +69,26 @@ func testImageAvailableOnHost(t *testing.T, imageName string) {
 		t.Fatalf("Image does not exist on host: %s", err)
 	}
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flagValues returns the value following each occurrence of the flag in the
+// args (i.e. every stream `-map` selects).
+func flagValues(args []string, flag string) []string {
+	var values []string
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag {
+			values = append(values, args[i+1])
+		}
+	}
+
+	return values
+}
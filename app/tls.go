@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsConfig controls whether we serve https ourselves, for self-hosters without
+// a reverse proxy terminating TLS for them. We serve https if either
+// certificate files or ACME are configured.
+type tlsConfig struct {
+	// CertFile and KeyFile are PEM encoded. We reload them whenever they
+	// change (i.e. when certbot renews the certificate), so there's no
+	// need to restart us.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// ACME, if set, automatically obtains (and renews) certificates (i.e.
+	// from Let's Encrypt).
+	ACME *acmeConfig `yaml:"acme"`
+
+	// HTTPRedirectPort, if non-zero, is a port on which we serve plain
+	// http, redirecting every request to https. Required for ACME's
+	// http-01 challenges, which we answer on this port.
+	HTTPRedirectPort int `yaml:"http_redirect_port"`
+	// PublicHTTPSPort is the port clients use to reach us over https, to
+	// which we redirect them. Only needed if it differs from the port on
+	// which we listen (i.e. when behind port forwarding).
+	PublicHTTPSPort int `yaml:"public_https_port"`
+
+	// HSTSMaxAgeSeconds, if non-zero, tells browsers to only ever reach us
+	// over https for this long. Only enable it once you're confident https
+	// works, as browsers will refuse plain http until it expires.
+	HSTSMaxAgeSeconds int `yaml:"hsts_max_age_seconds"`
+}
+
+// acmeConfig controls how we automatically obtain certificates.
+type acmeConfig struct {
+	// Domains are the domains for which we'll obtain certificates.
+	Domains []string `yaml:"domains"`
+	// Email is where the CA sends notices (i.e. about expiring
+	// certificates).
+	Email string `yaml:"email"`
+	// CacheDirectory stores certificates, and our ACME account key, across
+	// restarts, so we don't hit the CA's rate limits.
+	CacheDirectory string `yaml:"cache_directory"`
+	// DirectoryURL is the CA's ACME directory. If empty, we use Let's
+	// Encrypt.
+	DirectoryURL string `yaml:"directory_url"`
+	// AcceptTermsOfService must be true, as the CA won't issue
+	// certificates unless we accept its terms of service.
+	AcceptTermsOfService bool `yaml:"accept_terms_of_service"`
+}
+
+func (t *tlsConfig) enabled() bool {
+	return t.CertFile != "" || t.ACME != nil
+}
+
+func (t *tlsConfig) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("TLS requires both a cert_file and a key_file")
+	}
+
+	if t.CertFile != "" && t.ACME != nil {
+		return fmt.Errorf("TLS may use either certificate files or ACME, but not both")
+	}
+
+	if t.ACME != nil {
+		if len(t.ACME.Domains) == 0 || t.ACME.CacheDirectory == "" {
+			return fmt.Errorf("ACME requires domains and a cache_directory")
+		}
+
+		if !t.ACME.AcceptTermsOfService {
+			return fmt.Errorf("ACME requires accepting the CA's terms of service")
+		}
+	}
+
+	if !t.enabled() && (t.HTTPRedirectPort != 0 || t.HSTSMaxAgeSeconds != 0) {
+		return fmt.Errorf("Redirecting to https, and HSTS, require TLS")
+	}
+
+	return nil
+}
+
+// tlsServerConfig returns the TLS config with which we serve https, and, if
+// using ACME, a handler wrapping our http redirect handler which answers
+// http-01 challenges. It returns a nil config if TLS is disabled.
+func (s *Server) tlsServerConfig() (*tls.Config, func(http.Handler) http.Handler, error) {
+	conf := s.Conf.TLS
+	noACMEHandler := func(h http.Handler) http.Handler { return h }
+
+	if conf.ACME != nil {
+		s.logger.V(2).Info("Obtaining certificates via ACME", "domains", conf.ACME.Domains)
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(conf.ACME.Domains...),
+			Cache:      autocert.DirCache(conf.ACME.CacheDirectory),
+			Email:      conf.ACME.Email,
+			Client:     &acme.Client{DirectoryURL: conf.ACME.DirectoryURL},
+		}
+
+		// `TLSConfig` advertises http/2, and the protocol for ACME's
+		// tls-alpn-01 challenges.
+		tlsConf := manager.TLSConfig()
+		tlsConf.MinVersion = tls.VersionTLS12
+		return tlsConf, manager.HTTPHandler, nil
+	}
+
+	if conf.CertFile != "" {
+		reloader, err := newCertReloader(conf.CertFile, conf.KeyFile, s.logger)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tlsConf := &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+		return tlsConf, noACMEHandler, nil
+	}
+
+	return nil, noACMEHandler, nil
+}
+
+// redirectToHTTPS redirects every request to the same url over https.
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if hostWithoutPort, _, err := net.SplitHostPort(host); err == nil {
+		host = hostWithoutPort
+	}
+
+	httpsPort := s.port
+	if s.Conf.TLS.PublicHTTPSPort != 0 {
+		httpsPort = s.Conf.TLS.PublicHTTPSPort
+	}
+	if httpsPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// hsts is middleware telling browsers to only reach us over https. Per the
+// spec, we only send the header over https.
+func (s *Server) hsts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && s.Conf.TLS.HSTSMaxAgeSeconds > 0 {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", s.Conf.TLS.HSTSMaxAgeSeconds))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certReloader serves the certificate in the cert and key files, reloading
+// them whenever either changes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   logr.Logger
+
+	mu              sync.Mutex
+	cert            *tls.Certificate
+	certFileModTime time.Time
+	keyFileModTime  time.Time
+}
+
+// newCertReloader loads the certificate, returning an error if we can't, as
+// there's no point serving https without a certificate.
+func newCertReloader(certFile, keyFile string, logger logr.Logger) (*certReloader, error) {
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+
+	if _, err := reloader.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the
+// files have changed. If reloading fails (i.e. because we caught the files
+// mid-update), we keep serving the previous certificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	certFileInfo, certErr := os.Stat(c.certFile)
+	keyFileInfo, keyErr := os.Stat(c.keyFile)
+	if certErr == nil && keyErr == nil && certFileInfo.ModTime().Equal(c.certFileModTime) && keyFileInfo.ModTime().Equal(c.keyFileModTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			c.logger.V(1).Info("Error reloading TLS certificate, so using previous certificate", "error", err)
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("Error loading TLS certificate: %s", err)
+	}
+
+	c.logger.V(2).Info("Loaded TLS certificate", "certFile", c.certFile)
+	c.cert = &cert
+	if certErr == nil && keyErr == nil {
+		c.certFileModTime = certFileInfo.ModTime()
+		c.keyFileModTime = keyFileInfo.ModTime()
+	}
+
+	return c.cert, nil
+}
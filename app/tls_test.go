@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a PEM encoded certificate, and its key, for
+// `commonName`, signed by `parent` (or self-signed if `parent` is nil).
+func newTestCertificate(t *testing.T, commonName string, dnsNames []string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return cert, key, certPEM, keyPEM
+}
+
+// writeTestCertificateFiles writes a self-signed certificate for 127.0.0.1 to
+// the cert and key files, returning the certificate.
+func writeTestCertificateFiles(t *testing.T, certFile, keyFile, commonName string) *x509.Certificate {
+	t.Helper()
+
+	cert, _, certPEM, keyPEM := newTestCertificate(t, commonName, nil, false, nil, nil)
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatalf("Error writing cert file: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Error writing key file: %s", err)
+	}
+
+	return cert
+}
+
+func TestCertReloaderReloadsChangedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("Error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificateFiles(t, certFile, keyFile, "original")
+
+	reloader, err := newCertReloader(certFile, keyFile, testLogger)
+	if err != nil {
+		t.Fatalf("Should not have error loading certificate: %s", err)
+	}
+
+	// Ensure the modification time changes, regardless of the file system's
+	// timestamp granularity.
+	renewed := time.Now().Add(time.Minute)
+	writeTestCertificateFiles(t, certFile, keyFile, "renewed")
+	os.Chtimes(certFile, renewed, renewed)
+	os.Chtimes(keyFile, renewed, renewed)
+
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Should not have error getting certificate: %s", err)
+	}
+
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "renewed" {
+		t.Fatalf("Expected renewed certificate, but got %s", leaf.Subject.CommonName)
+	}
+
+	// We keep serving the previous certificate if the files are invalid
+	// (i.e. mid-update).
+	broken := renewed.Add(time.Minute)
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0644)
+	os.Chtimes(certFile, broken, broken)
+
+	if cert, err = reloader.GetCertificate(nil); err != nil || cert == nil {
+		t.Fatalf("Should keep serving the previous certificate, but got %v", err)
+	}
+}
+
+func TestNewCertReloaderFailsWithoutCertificate(t *testing.T) {
+	if _, err := newCertReloader("/does/not/exist.pem", "/does/not/exist.key", testLogger); err == nil {
+		t.Fatal("Should have error when the certificate doesn't exist")
+	}
+}
+
+func TestServerServesTLS(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("Error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeTestCertificateFiles(t, certFile, keyFile, "vidzou")
+
+	server.Conf.TLS.CertFile = certFile
+	server.Conf.TLS.KeyFile = keyFile
+	server.Conf.TLS.HSTSMaxAgeSeconds = 3600
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	redirectListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	server.port = listener.Addr().(*net.TCPAddr).Port
+
+	shutdownCh := make(chan os.Signal, 1)
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- server.serve(listener, redirectListener, shutdownCh, func() error { return nil })
+	}()
+	defer func() {
+		shutdownCh <- os.Interrupt
+		<-serveErrCh
+	}()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(cert)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: rootCAs},
+			ForceAttemptHTTP2: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get("https://" + listener.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatalf("Should not have error requesting over https: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected http/2, but got %s", resp.Proto)
+	}
+
+	if hsts := resp.Header.Get("Strict-Transport-Security"); hsts != "max-age=3600" {
+		t.Fatalf("Expected HSTS header, but got %q", hsts)
+	}
+
+	resp, err = client.Get("http://" + redirectListener.Addr().String() + "/downloads/abc?x=1")
+	if err != nil {
+		t.Fatalf("Should not have error requesting over http: %s", err)
+	}
+	resp.Body.Close()
+
+	expectedLocation := "https://127.0.0.1:" + strconv.Itoa(server.port) + "/downloads/abc?x=1"
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != expectedLocation {
+		t.Fatalf("Expected redirect to %s, but got %d to %s", expectedLocation, resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+// stubACMEServer is a minimal ACME (RFC 8555) certificate authority, in the
+// spirit of Pebble. It considers every order authorized, so it only exercises
+// our side of the protocol, and it doesn't verify request signatures.
+type stubACMEServer struct {
+	*httptest.Server
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	certPEM []byte
+}
+
+func newStubACMEServer(t *testing.T) *stubACMEServer {
+	t.Helper()
+
+	stub := &stubACMEServer{}
+	stub.caCert, stub.caKey, _, _ = newTestCertificate(t, "stub acme ca", nil, true, nil, nil)
+
+	mux := http.NewServeMux()
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", generateRandomString(16))
+		mux.ServeHTTP(w, r)
+	}))
+
+	url := stub.Server.URL
+	order := func(status string) map[string]interface{} {
+		return map[string]interface{}{
+			"status":         status,
+			"identifiers":    []map[string]string{{"type": "dns", "value": "vidzou.test"}},
+			"authorizations": []string{url + "/authz/1"},
+			"finalize":       url + "/finalize/1",
+			"certificate":    url + "/cert/1",
+		}
+	}
+	respond := func(w http.ResponseWriter, statusCode int, location string, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		if location != "" {
+			w.Header().Set("Location", location)
+		}
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, "", map[string]string{
+			"newNonce":   url + "/new-nonce",
+			"newAccount": url + "/new-account",
+			"newOrder":   url + "/new-order",
+			"revokeCert": url + "/revoke-cert",
+			"keyChange":  url + "/key-change",
+		})
+	})
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/new-account", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusCreated, url+"/account/1", map[string]string{"status": "valid"})
+	})
+	mux.HandleFunc("/new-order", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusCreated, url+"/order/1", order("ready"))
+	})
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, "", order("valid"))
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, "", map[string]interface{}{
+			"status":     "valid",
+			"identifier": map[string]string{"type": "dns", "value": "vidzou.test"},
+		})
+	})
+	mux.HandleFunc("/finalize/1", func(w http.ResponseWriter, r *http.Request) {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		var finalizeReq struct {
+			CSR string `json:"csr"`
+		}
+		json.NewDecoder(r.Body).Decode(&jws)
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		json.Unmarshal(payload, &finalizeReq)
+		csrDer, _ := base64.RawURLEncoding.DecodeString(finalizeReq.CSR)
+
+		csr, err := x509.ParseCertificateRequest(csrDer)
+		if err != nil {
+			respond(w, http.StatusBadRequest, "", map[string]string{"type": "urn:ietf:params:acme:error:badCSR", "detail": err.Error()})
+			return
+		}
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, stub.caCert, csr.PublicKey, stub.caKey)
+		if err != nil {
+			respond(w, http.StatusInternalServerError, "", map[string]string{"type": "urn:ietf:params:acme:error:serverInternal", "detail": err.Error()})
+			return
+		}
+		stub.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+		respond(w, http.StatusOK, url+"/order/1", order("valid"))
+	})
+	mux.HandleFunc("/cert/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(stub.certPEM)
+	})
+
+	return stub
+}
+
+func TestServerObtainsCertificateViaACME(t *testing.T) {
+	stub := newStubACMEServer(t)
+	defer stub.Close()
+
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	cacheDir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatalf("Error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	server.Conf.TLS.ACME = &acmeConfig{
+		Domains:              []string{"vidzou.test"},
+		CacheDirectory:       cacheDir,
+		DirectoryURL:         stub.URL + "/directory",
+		AcceptTermsOfService: true,
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+
+	shutdownCh := make(chan os.Signal, 1)
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- server.serve(listener, nil, shutdownCh, func() error { return nil })
+	}()
+	defer func() {
+		shutdownCh <- os.Interrupt
+		<-serveErrCh
+	}()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(stub.caCert)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: rootCAs, ServerName: "vidzou.test"})
+	if err != nil {
+		t.Fatalf("Should not have error connecting with the ACME issued certificate: %s", err)
+	}
+	defer conn.Close()
+
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if leaf.Issuer.CommonName != "stub acme ca" {
+		t.Fatalf("Expected certificate issued by the ACME server, but got issuer %s", leaf.Issuer.CommonName)
+	}
+
+	// We don't serve certificates for domains we weren't configured with.
+	if _, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: rootCAs, ServerName: "other.test"}); err == nil {
+		t.Fatal("Should not obtain a certificate for an unconfigured domain")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans vidzou creates.
+const tracerName = "mattjmcnaughton/webzou"
+
+// The exporters to which we can send spans.
+const (
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+)
+
+// tracingConfig controls whether, and where, we export traces.
+type tracingConfig struct {
+	// Exporter is one of otlp or stdout. If empty (the default), tracing is
+	// disabled.
+	Exporter string `yaml:"exporter"`
+	// OTLPEndpoint is the host:port of the collector to which we export
+	// traces via OTLP over http (i.e. a local collector on
+	// "localhost:4318").
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+	// OTLPInsecure disables TLS when talking to the collector.
+	OTLPInsecure bool `yaml:"otlp_insecure"`
+	// SampleRatio is the fraction of traces we record.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func defaultTracingConfig() tracingConfig {
+	return tracingConfig{
+		OTLPEndpoint: "localhost:4318",
+		OTLPInsecure: true,
+		SampleRatio:  1,
+	}
+}
+
+func (t *tracingConfig) validate() error {
+	switch t.Exporter {
+	case "", tracingExporterOTLP, tracingExporterStdout:
+	default:
+		return fmt.Errorf("Unknown tracing exporter %s", t.Exporter)
+	}
+
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		return fmt.Errorf("The tracing.sample_ratio setting must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// setupTracing configures the global tracer provider to export our spans, and
+// returns a function which flushes any buffered spans. If tracing is disabled,
+// the global tracer provider remains a no-op.
+func setupTracing(conf tracingConfig, logger logr.Logger) (func() error, error) {
+	// We propagate trace context even if we don't export our own spans,
+	// so we don't break traces passing through us.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case tracingExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.OTLPEndpoint)}
+		if conf.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case tracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		logger.V(3).Info("Tracing is disabled")
+		return func() error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger.V(2).Info("Exporting traces", "exporter", conf.Exporter)
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("vidzou"))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+
+	return func() error {
+		return tracerProvider.Shutdown(context.Background())
+	}, nil
+}
+
+type jobIDContextKey struct{}
+
+// contextWithJobID records the job the context's work is for, so every span we
+// start with the context is labelled with the job's id.
+func contextWithJobID(ctx context.Context, jobID string) context.Context {
+	return context.WithValue(ctx, jobIDContextKey{}, jobID)
+}
+
+// detachedContext returns a context for background work (i.e. processing a
+// job) which continues the trace in `ctx`, but is only cancelled when `parent`
+// is, rather than when `ctx` is (i.e. when the http request which started the
+// work finishes).
+func detachedContext(parent context.Context, ctx context.Context) context.Context {
+	detachedCtx := trace.ContextWithSpanContext(parent, trace.SpanContextFromContext(ctx))
+	if jobID, ok := ctx.Value(jobIDContextKey{}).(string); ok {
+		detachedCtx = contextWithJobID(detachedCtx, jobID)
+	}
+
+	return detachedCtx
+}
+
+// startSpan starts a span as a child of any span in `ctx`.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if jobID, ok := ctx.Value(jobIDContextKey{}).(string); ok {
+		attrs = append(attrs, attribute.String("vidzou.job_id", jobID))
+	}
+
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, marking it as failed if `err` is non-nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// traceHTTP is middleware starting a span for each request, continuing any
+// trace the client propagated to us.
+func traceHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(
+			ctx,
+			fmt.Sprintf("HTTP %s %s", r.Method, route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPRouteKey.String(route)),
+		)
+		defer span.End()
+
+		recorder := &statusRecordingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.statusCode))
+		if recorder.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.statusCode))
+		}
+	})
+}
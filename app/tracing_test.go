@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordTestSpans records every span we create until the returned function is
+// called.
+func recordTestSpans() (*tracetest.SpanRecorder, func()) {
+	previousTracerProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+
+	spanRecorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return spanRecorder, func() {
+		otel.SetTracerProvider(previousTracerProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	}
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) string {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value.Emit()
+		}
+	}
+
+	return ""
+}
+
+func TestServerTracesJobLifecycle(t *testing.T) {
+	spanRecorder, restore := recordTestSpans()
+	defer restore()
+
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	form := url.Values{"url": {youtubeURL}}
+	req := withTestCSRFToken(httptest.NewRequest("POST", "/downloads", strings.NewReader(form.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("traceparent", fmt.Sprintf("00-%s-00f067aa0ba902b7-01", traceID))
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, but got %d", http.StatusSeeOther, rec.Code)
+	}
+	job := waitForJobComplete(t, jobStore, rec)
+
+	expectedSpanNames := []string{"HTTP POST /downloads", "job.enqueue", "job.process", "job.item", "upload"}
+	spansByName := make(map[string]sdktrace.ReadOnlySpan)
+
+	// The job's spans end shortly after the job completes.
+	err := retryWithTimeout(50, 10*time.Millisecond, func() error {
+		for _, span := range spanRecorder.Ended() {
+			spansByName[span.Name()] = span
+		}
+
+		for _, name := range expectedSpanNames {
+			if _, found := spansByName[name]; !found {
+				return fmt.Errorf("No %s span", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected spans %v, but got %v: %s", expectedSpanNames, spansByName, err)
+	}
+
+	for _, name := range expectedSpanNames {
+		span := spansByName[name]
+
+		// Background processing continues the client's trace.
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Fatalf("Expected %s span to continue trace %s, but got %s", name, traceID, span.SpanContext().TraceID())
+		}
+
+		if name != "HTTP POST /downloads" && spanAttribute(span, "vidzou.job_id") != job.ID {
+			t.Fatalf("Expected %s span to have job id %s, but got %q", name, job.ID, spanAttribute(span, "vidzou.job_id"))
+		}
+	}
+}
+
+func TestDetachedContext(t *testing.T) {
+	spanRecorder, restore := recordTestSpans()
+	defer restore()
+
+	ctx, cancel := context.WithCancel(contextWithJobID(context.Background(), "job"))
+	ctx, span := startSpan(ctx, "parent")
+	detachedCtx := detachedContext(context.Background(), ctx)
+	cancel()
+	span.End()
+
+	if detachedCtx.Err() != nil {
+		t.Fatal("Detached context should not be cancelled with its parent")
+	}
+
+	_, childSpan := startSpan(detachedCtx, "child")
+	childSpan.End()
+
+	child := spanRecorder.Ended()[1]
+	if child.Parent().SpanID() != trace.SpanContextFromContext(ctx).SpanID() {
+		t.Fatal("Spans started with the detached context should be children of the parent's span")
+	}
+
+	if spanAttribute(child, "vidzou.job_id") != "job" {
+		t.Fatal("Detached context should keep the job id")
+	}
+}
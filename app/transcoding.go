@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ContentTranscoder converts downloaded content into a format better suited to
+// the user's device.
+type ContentTranscoder interface {
+	// TranscodeContent converts the local file according to the profile,
+	// returning the path of the converted file. The original file may no
+	// longer exist afterwards.
+	TranscodeContent(ctx context.Context, localFilePath string, profile *TranscodingProfile) (string, error)
+}
+
+// TranscodingProfile is a named set of output settings (i.e. "phone friendly
+// mp4") which users pick from when downloading. Profiles are defined by the
+// operator in the config file.
+type TranscodingProfile struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+
+	// AudioOnly indicates we should only download the audio.
+	AudioOnly bool `yaml:"audio_only"`
+
+	// Extension is the extension of the transcoded file (i.e. "mp4"). If
+	// empty, we keep the downloaded file's extension.
+	Extension string `yaml:"extension"`
+	// FfmpegArgs are the ffmpeg output options used to transcode the
+	// file. If empty, we don't transcode the downloaded file at all.
+	FfmpegArgs []string `yaml:"ffmpeg_args"`
+}
+
+// FakeContentTranscoder doesn't actually transcode anything... it just renames
+// the file to have the profile's extension.
+type FakeContentTranscoder struct{}
+
+var _ ContentTranscoder = (*ContainerYoutubeDlContentDownloader)(nil)
+var _ ContentTranscoder = (*FakeContentTranscoder)(nil)
+
+var profileExtensionRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// defaultTranscodingProfiles are the profiles we offer when the operator
+// doesn't configure any. The first profile is the default, and matches how
+// vidzou behaved before profiles existed.
+func defaultTranscodingProfiles() []*TranscodingProfile {
+	return []*TranscodingProfile{
+		{
+			Name:        "audio",
+			Description: "Audio only (mp3)",
+			AudioOnly:   true,
+		},
+		{
+			Name:        "original",
+			Description: "Original video",
+		},
+		{
+			Name:        "phone",
+			Description: "Phone friendly video (mp4, 720p)",
+			Extension:   "mp4",
+			// Map every stream, so we keep every audio track and
+			// embedded subtitle, converting the subtitles to the
+			// only text format mp4 supports.
+			FfmpegArgs: []string{
+				"-map", "0",
+				"-vf", "scale=-2:'min(720,ih)'",
+				"-c:v", "libx264", "-preset", "veryfast", "-crf", "23",
+				"-c:a", "aac", "-b:a", "128k",
+				"-c:s", "mov_text",
+				"-movflags", "+faststart",
+			},
+		},
+		{
+			Name:        "car",
+			Description: "Car stereo friendly audio (mp3, 128k)",
+			AudioOnly:   true,
+			Extension:   "mp3",
+			// Keep any embedded thumbnail (which ffmpeg treats as a
+			// video stream), so car stereos can show cover art.
+			FfmpegArgs: []string{
+				"-map", "0:a", "-map", "0:v?", "-c:v", "copy",
+				"-c:a", "libmp3lame", "-b:a", "128k", "-id3v2_version", "3",
+			},
+		},
+	}
+}
+
+// validateTranscodingProfiles ensures the operator configured at least one
+// profile, and that every profile is usable.
+func validateTranscodingProfiles(profiles []*TranscodingProfile) error {
+	if len(profiles) == 0 {
+		return fmt.Errorf("Must configure at least one transcoding profile")
+	}
+
+	seenNames := make(map[string]bool)
+	for _, profile := range profiles {
+		if profile.Name == "" {
+			return fmt.Errorf("Every transcoding profile must have a name")
+		}
+		if seenNames[profile.Name] {
+			return fmt.Errorf("Transcoding profile name %s is not unique", profile.Name)
+		}
+		seenNames[profile.Name] = true
+
+		if profile.Extension != "" && !profileExtensionRegexp.MatchString(profile.Extension) {
+			return fmt.Errorf("Transcoding profile %s has invalid extension %s", profile.Name, profile.Extension)
+		}
+	}
+
+	return nil
+}
+
+// findTranscodingProfile returns the profile with the given name.
+func findTranscodingProfile(profiles []*TranscodingProfile, name string) (*TranscodingProfile, bool) {
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+
+	return nil, false
+}
+
+func (t *TranscodingProfile) transcodes() bool {
+	return len(t.FfmpegArgs) > 0
+}
+
+// outputFilePath returns the path of the file we create when transcoding
+// `localFilePath`.
+func (t *TranscodingProfile) outputFilePath(localFilePath string) string {
+	if t.Extension == "" {
+		return localFilePath
+	}
+
+	return strings.TrimSuffix(localFilePath, path.Ext(localFilePath)) + "." + t.Extension
+}
+
+func NewFakeContentTranscoder() *FakeContentTranscoder {
+	return &FakeContentTranscoder{}
+}
+
+func (f *FakeContentTranscoder) TranscodeContent(ctx context.Context, localFilePath string, profile *TranscodingProfile) (string, error) {
+	if !profile.transcodes() {
+		return localFilePath, nil
+	}
+
+	transcodedFilePath := profile.outputFilePath(localFilePath)
+	if err := os.Rename(localFilePath, transcodedFilePath); err != nil {
+		return "", err
+	}
+
+	return transcodedFilePath, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestValidateTranscodingProfiles(t *testing.T) {
+	if err := validateTranscodingProfiles(defaultTranscodingProfiles()); err != nil {
+		t.Fatalf("Default transcoding profiles should be valid: %s", err)
+	}
+
+	invalidProfiles := [][]*TranscodingProfile{
+		{},
+		{{Name: ""}},
+		{{Name: "car"}, {Name: "car"}},
+		{{Name: "car", Extension: "../mp3"}},
+	}
+	for _, profiles := range invalidProfiles {
+		if err := validateTranscodingProfiles(profiles); err == nil {
+			t.Fatalf("Expected profiles to be invalid: %+v", profiles)
+		}
+	}
+}
+
+func TestDefaultTranscodingProfilesKeepSubtitles(t *testing.T) {
+	profile, _ := findTranscodingProfile(defaultTranscodingProfiles(), "phone")
+	if maps := flagValues(profile.FfmpegArgs, "-map"); !reflect.DeepEqual(maps, []string{"0"}) {
+		t.Fatalf("Expected the phone profile to map every stream, but got %v", profile.FfmpegArgs)
+	}
+
+	if subtitleCodecs := flagValues(profile.FfmpegArgs, "-c:s"); !reflect.DeepEqual(subtitleCodecs, []string{"mov_text"}) {
+		t.Fatalf("Expected the phone profile to convert subtitles to mov_text, but got %v", profile.FfmpegArgs)
+	}
+}
+
+func TestTranscodingProfileOutputFilePath(t *testing.T) {
+	profile := &TranscodingProfile{Name: "phone", Extension: "mp4"}
+	if outputFilePath := profile.outputFilePath("/tmp/abcdefgh-My Video.webm"); outputFilePath != "/tmp/abcdefgh-My Video.mp4" {
+		t.Fatalf("Expected extension to change to mp4, but got %s", outputFilePath)
+	}
+
+	profile = &TranscodingProfile{Name: "original"}
+	if outputFilePath := profile.outputFilePath("/tmp/abcdefgh-My Video.webm"); outputFilePath != "/tmp/abcdefgh-My Video.webm" {
+		t.Fatalf("Expected extension to be unchanged, but got %s", outputFilePath)
+	}
+}
+
+func TestContainerYoutubeDlContentDownloaderTranscodeContent(t *testing.T) {
+	fsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error generating fsClient: %s", err)
+	}
+	defer fsClient.CleanUp()
+
+	fakeContainerClient := NewFakeContainerClient()
+	fakeContainerClient.RunContainerFunc = fakeYoutubeDlRunContainerFunc(fsClient.GetMountDirectory(), `{}`)
+	contentDownloader := NewContainerYoutubeDlContentDownloader(fakeContainerClient, fsClient, testLogger)
+
+	filePaths, err := contentDownloader.DownloadContent(context.Background(), youtubeURL, &DownloadOptions{audioOnly: true})
+	if err != nil {
+		t.Fatalf("Should not have error downloading content: %s", err)
+	}
+
+	// Transcoding to the same extension must not clobber the input file
+	// while ffmpeg reads it.
+	profile, _ := findTranscodingProfile(defaultTranscodingProfiles(), "car")
+	transcodedFilePath, err := contentDownloader.TranscodeContent(context.Background(), filePaths[0], profile)
+	if err != nil {
+		t.Fatalf("Should not have error transcoding content: %s", err)
+	}
+
+	if transcodedFilePath != filePaths[0] {
+		t.Fatalf("Expected transcoded file at %s, but got %s", filePaths[0], transcodedFilePath)
+	}
+
+	ffmpegCmd := fakeContainerClient.RanCmds[len(fakeContainerClient.RanCmds)-1]
+	inputFilePath := ffmpegCmd[len(ffmpegCmd)-len(profile.FfmpegArgs)-2]
+	outputFilePath := ffmpegCmd[len(ffmpegCmd)-1]
+	if inputFilePath == outputFilePath {
+		t.Fatalf("ffmpeg should not write to the file it reads: %v", ffmpegCmd)
+	}
+
+	filesInDir, _ := ioutil.ReadDir(fsClient.GetMountDirectory())
+	if len(filesInDir) != 1 {
+		t.Fatalf("Expected only the transcoded file to remain, but found %d files", len(filesInDir))
+	}
+}
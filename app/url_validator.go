@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// URLValidator decides whether we are willing to pass a user provided url to
+// youtube-dl.
+type URLValidator interface {
+	// Validate returns the normalized url we should download, or an
+	// `*InvalidURLError` explaining why we won't download it.
+	Validate(rawURL string) (string, error)
+}
+
+// InvalidURLError is returned when we refuse to download a url. Its message is
+// intended to be shown directly to the user.
+type InvalidURLError struct {
+	*UserError
+}
+
+// HostURLValidator validates urls based on their structure and host. Hosts in
+// the allow/deny lists match the host itself and all of its subdomains (i.e.
+// "youtube.com" matches "www.youtube.com").
+type HostURLValidator struct {
+	allowedHosts         []string
+	deniedHosts          []string
+	allowPrivateNetworks bool
+
+	// lookupIP exists so tests can avoid real dns lookups.
+	lookupIP func(host string) ([]net.IP, error)
+}
+
+var _ URLValidator = (*HostURLValidator)(nil)
+
+func NewHostURLValidator(urlsConf urlsConfig) *HostURLValidator {
+	return &HostURLValidator{
+		allowedHosts:         normalizeHosts(urlsConf.AllowedHosts),
+		deniedHosts:          normalizeHosts(urlsConf.DeniedHosts),
+		allowPrivateNetworks: urlsConf.AllowPrivateNetworks,
+		lookupIP:             net.LookupIP,
+	}
+}
+
+func (h *HostURLValidator) Validate(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+
+	if rawURL == "" {
+		return "", &InvalidURLError{newUserError("errors.url.empty")}
+	}
+
+	// youtube-dl would interpret anything starting with `-` as an option
+	// (i.e. `--exec`). We also pass `--` before the url when running
+	// youtube-dl, but there's no reason to even attempt such a url.
+	if strings.HasPrefix(rawURL, "-") {
+		return "", &InvalidURLError{newUserError("errors.url.invalid")}
+	}
+
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", &InvalidURLError{newUserError("errors.url.invalid")}
+	}
+
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return "", &InvalidURLError{newUserError("errors.url.scheme")}
+	}
+
+	if parsedURL.User != nil {
+		return "", &InvalidURLError{newUserError("errors.url.credentials")}
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(parsedURL.Hostname(), "."))
+	if host == "" {
+		return "", &InvalidURLError{newUserError("errors.url.invalid")}
+	}
+
+	if matchesAnyHost(host, h.deniedHosts) {
+		return "", &InvalidURLError{newUserError("errors.url.host_not_allowed", host)}
+	}
+
+	if len(h.allowedHosts) > 0 && !matchesAnyHost(host, h.allowedHosts) {
+		return "", &InvalidURLError{newUserError("errors.url.host_not_allowed", host)}
+	}
+
+	if !h.allowPrivateNetworks {
+		if err := h.ensurePublicHost(host); err != nil {
+			return "", err
+		}
+	}
+
+	return parsedURL.String(), nil
+}
+
+// ensurePublicHost prevents users from using youtube-dl to reach services on
+// our private network (i.e. the cloud metadata service at 169.254.169.254).
+//
+// This check is best effort: the host could resolve differently by the time
+// youtube-dl requests it, or a public page could redirect to a private
+// address. Operators who need stronger guarantees should restrict the
+// network the youtube-dl container can reach.
+func (h *HostURLValidator) ensurePublicHost(host string) error {
+	var ips []net.IP
+
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		resolvedIPs, err := h.lookupIP(host)
+		if err != nil || len(resolvedIPs) == 0 {
+			return &InvalidURLError{newUserError("errors.url.host_not_found", host)}
+		}
+		ips = resolvedIPs
+	}
+
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return &InvalidURLError{newUserError("errors.url.host_not_allowed", host)}
+		}
+	}
+
+	return nil
+}
+
+// privateNetworks are the ip ranges which aren't covered by the `net.IP`
+// helper methods, but which we still don't consider public.
+var privateNetworks = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+
+	return networks
+}
+
+func normalizeHosts(hosts []string) []string {
+	normalized := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+		if host != "" {
+			normalized = append(normalized, host)
+		}
+	}
+
+	return normalized
+}
+
+func matchesAnyHost(host string, hosts []string) bool {
+	for _, candidate := range hosts {
+		if host == candidate || strings.HasSuffix(host, "."+candidate) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExtractorFilter restricts which youtube-dl extractors (i.e. "Youtube",
+// "Vimeo") we download with. Unlike hosts, a url's extractor is only known
+// once youtube-dl has looked at it, so the downloader checks it right before
+// downloading. Extractors match case insensitively.
+type ExtractorFilter struct {
+	allowedExtractors map[string]bool
+	deniedExtractors  map[string]bool
+}
+
+func NewExtractorFilter(urlsConf urlsConfig) *ExtractorFilter {
+	return &ExtractorFilter{
+		allowedExtractors: normalizeExtractors(urlsConf.AllowedExtractors),
+		deniedExtractors:  normalizeExtractors(urlsConf.DeniedExtractors),
+	}
+}
+
+// enabled returns whether the filter could refuse any extractor, so we can
+// avoid asking youtube-dl for the extractor when it can't.
+func (f *ExtractorFilter) enabled() bool {
+	return f != nil && (len(f.allowedExtractors) > 0 || len(f.deniedExtractors) > 0)
+}
+
+// Validate returns an `*InvalidURLError` if we won't download using the
+// extractor.
+func (f *ExtractorFilter) Validate(extractor string) error {
+	if !f.enabled() {
+		return nil
+	}
+
+	normalized := strings.ToLower(strings.TrimSpace(extractor))
+	if f.deniedExtractors[normalized] || (len(f.allowedExtractors) > 0 && !f.allowedExtractors[normalized]) {
+		return &InvalidURLError{newUserError("errors.url.extractor_not_allowed", extractor)}
+	}
+
+	return nil
+}
+
+func normalizeExtractors(extractors []string) map[string]bool {
+	normalized := make(map[string]bool, len(extractors))
+	for _, extractor := range extractors {
+		extractor = strings.ToLower(strings.TrimSpace(extractor))
+		if extractor != "" {
+			normalized[extractor] = true
+		}
+	}
+
+	return normalized
+}
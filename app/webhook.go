@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+)
+
+// Webhooks let other systems (i.e. home automation) know when downloads start
+// and finish. We post a JSON payload describing the job to each webhook, signed
+// with the webhook's secret so the receiver can check it came from us.
+
+// The events to which a webhook may subscribe.
+const (
+	webhookEventJobRunning   = "job.running"
+	webhookEventJobSucceeded = "job.succeeded"
+	webhookEventJobFailed    = "job.failed"
+	// webhookEventTest is only sent when a user presses a webhook's test
+	// button, so webhooks can't subscribe to it.
+	webhookEventTest = "webhook.test"
+)
+
+const (
+	webhookEventHeader    = "X-Vidzou-Event"
+	webhookDeliveryHeader = "X-Vidzou-Delivery"
+	// webhookSignatureHeader is "sha256=" followed by the hex encoded
+	// HMAC-SHA256 of the request body, keyed with the webhook's secret.
+	webhookSignatureHeader = "X-Vidzou-Signature"
+)
+
+// WebhookDeliveryState is the outcome of delivering an event to a webhook.
+type WebhookDeliveryState string
+
+const (
+	WebhookDeliveryStatePending   WebhookDeliveryState = "pending"
+	WebhookDeliveryStateSucceeded WebhookDeliveryState = "succeeded"
+	WebhookDeliveryStateFailed    WebhookDeliveryState = "failed"
+)
+
+var webhookNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// webhooksConfig configures the webhooks we notify of job state changes.
+type webhooksConfig struct {
+	// Global webhooks are notified about every user's jobs.
+	Global []*WebhookConfig `yaml:"global"`
+	// PerUser webhooks, keyed by user, are only notified about that user's
+	// jobs. Requires `limits.user_header`, as otherwise we don't know who
+	// created a job.
+	PerUser map[string][]*WebhookConfig `yaml:"per_user"`
+
+	// Retries controls how we retry deliveries which fail for transient
+	// reasons (i.e. network errors or 5xx responses).
+	Retries        RetryPolicy `yaml:"retries"`
+	TimeoutSeconds int         `yaml:"timeout_seconds"`
+	// DeliveryLogSize is how many of the most recent deliveries we
+	// remember, so users can check on their webhooks.
+	DeliveryLogSize int `yaml:"delivery_log_size"`
+}
+
+// WebhookConfig is a single url we notify of job state changes.
+type WebhookConfig struct {
+	// Name identifies the webhook to users, and must be unique.
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// SecretFile contains the secret with which we sign payloads.
+	SecretFile string `yaml:"secret_file"`
+	// Events are the events of which we notify the webhook. If empty, we
+	// notify it of every event.
+	Events []string `yaml:"events"`
+
+	secret string
+}
+
+func defaultWebhooksConfig() webhooksConfig {
+	return webhooksConfig{
+		Retries: RetryPolicy{
+			MaxAttempts:           5,
+			InitialBackoffSeconds: 10,
+			MaxBackoffSeconds:     300,
+		},
+		TimeoutSeconds:  10,
+		DeliveryLogSize: 100,
+	}
+}
+
+// all returns every webhook, global or not.
+func (c *webhooksConfig) all() []*WebhookConfig {
+	webhooks := append([]*WebhookConfig{}, c.Global...)
+	for _, userWebhooks := range c.PerUser {
+		webhooks = append(webhooks, userWebhooks...)
+	}
+
+	return webhooks
+}
+
+func (c *webhooksConfig) validate() error {
+	names := make(map[string]bool)
+	for _, webhook := range c.all() {
+		if err := webhook.validate(); err != nil {
+			return err
+		}
+
+		if names[webhook.Name] {
+			return fmt.Errorf("Webhook names must be unique, but %s is used more than once", webhook.Name)
+		}
+		names[webhook.Name] = true
+	}
+
+	if c.Retries.MaxAttempts < 1 {
+		return fmt.Errorf("The webhooks.retries.max_attempts setting must be at least 1")
+	}
+
+	if c.TimeoutSeconds < 1 {
+		return fmt.Errorf("The webhooks.timeout_seconds setting must be at least 1")
+	}
+
+	if c.DeliveryLogSize < 1 {
+		return fmt.Errorf("The webhooks.delivery_log_size setting must be at least 1")
+	}
+
+	return nil
+}
+
+func (w *WebhookConfig) validate() error {
+	if !webhookNameRegexp.MatchString(w.Name) {
+		return fmt.Errorf("Webhook name %q may only contain letters, numbers, '.', '_' and '-'", w.Name)
+	}
+
+	webhookURL, err := url.Parse(w.URL)
+	if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+		return fmt.Errorf("Webhook %s requires an http or https url", w.Name)
+	}
+
+	if w.SecretFile == "" {
+		return fmt.Errorf("Webhook %s requires a secret_file", w.Name)
+	}
+
+	for _, event := range w.Events {
+		switch event {
+		case webhookEventJobRunning, webhookEventJobSucceeded, webhookEventJobFailed:
+		default:
+			return fmt.Errorf("Webhook %s has unknown event %s", w.Name, event)
+		}
+	}
+
+	return nil
+}
+
+// loadSecrets reads every webhook's secret from its secret file.
+func (c *webhooksConfig) loadSecrets() error {
+	for _, webhook := range c.all() {
+		secret, err := ioutil.ReadFile(webhook.SecretFile)
+		if err != nil {
+			return fmt.Errorf("Error reading secret file for webhook %s: %s", webhook.Name, err)
+		}
+
+		webhook.secret = strings.TrimSpace(string(secret))
+	}
+
+	return nil
+}
+
+// wantsEvent returns whether the webhook subscribed to the event.
+func (w *WebhookConfig) wantsEvent(event string) bool {
+	if len(w.Events) == 0 || event == webhookEventTest {
+		return true
+	}
+
+	for _, wantedEvent := range w.Events {
+		if wantedEvent == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sign returns the value of our signature header for the given body.
+func (w *WebhookConfig) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPayload is the JSON body we post to webhooks.
+type webhookPayload struct {
+	// ID identifies the delivery, and is the same for every attempt, so
+	// receivers can ignore duplicates.
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Job       *webhookJob `json:"job,omitempty"`
+}
+
+type webhookJob struct {
+	ID                string         `json:"id"`
+	State             JobState       `json:"state"`
+	User              string         `json:"user,omitempty"`
+	URLs              []string       `json:"urls"`
+	PublicDownloadURL string         `json:"public_download_url,omitempty"`
+	Files             []*webhookFile `json:"files,omitempty"`
+	Error             string         `json:"error,omitempty"`
+	CreatedAt         time.Time      `json:"created_at"`
+	UpdatedAt         time.Time      `json:"updated_at"`
+}
+
+type webhookFile struct {
+	Name              string `json:"name"`
+	PublicDownloadURL string `json:"public_download_url"`
+}
+
+func newWebhookJob(job *Job) *webhookJob {
+	webhookJob := &webhookJob{
+		ID:                job.ID,
+		State:             job.State,
+		User:              job.User,
+		PublicDownloadURL: job.PublicDownloadURL,
+		CreatedAt:         job.CreatedAt,
+		UpdatedAt:         job.UpdatedAt,
+	}
+
+	for _, item := range job.Items {
+		webhookJob.URLs = append(webhookJob.URLs, item.RemotePath)
+	}
+
+	for _, file := range job.Files() {
+		webhookJob.Files = append(webhookJob.Files, &webhookFile{Name: file.Name, PublicDownloadURL: file.PublicDownloadURL})
+	}
+
+	if job.Err != nil {
+		webhookJob.Error = job.Err.Error()
+	}
+
+	return webhookJob
+}
+
+// webhookEventForJob returns the event describing the job's current state, or
+// an empty string if there's nothing to tell.
+func webhookEventForJob(job *Job) string {
+	switch job.State {
+	case JobStateRunning:
+		return webhookEventJobRunning
+	case JobStateSucceeded:
+		return webhookEventJobSucceeded
+	case JobStateFailed:
+		return webhookEventJobFailed
+	}
+
+	return ""
+}
+
+// WebhookDelivery is our attempt(s) to deliver a single event to a single
+// webhook.
+type WebhookDelivery struct {
+	ID      string
+	Webhook string
+	// User is the user whose job (or test button) caused the delivery.
+	User     string
+	Event    string
+	JobID    string
+	State    WebhookDeliveryState
+	Attempts []*WebhookDeliveryAttempt
+
+	CreatedAt time.Time
+}
+
+// WebhookDeliveryAttempt is a single request to a webhook. StatusCode is zero
+// if we didn't receive a response. Err may contain the webhook's url (and thus
+// any secret token in it), so we only ever log it, and never show it to users.
+type WebhookDeliveryAttempt struct {
+	At         time.Time
+	StatusCode int
+	Err        error
+}
+
+// TimedOut returns whether the attempt failed because the webhook didn't
+// respond in time.
+func (a *WebhookDeliveryAttempt) TimedOut() bool {
+	netErr, ok := a.Err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// LastAttempt returns the most recent attempt, or nil if we haven't made one.
+func (d *WebhookDelivery) LastAttempt() *WebhookDeliveryAttempt {
+	if len(d.Attempts) == 0 {
+		return nil
+	}
+
+	return d.Attempts[len(d.Attempts)-1]
+}
+
+func (d *WebhookDelivery) copy() *WebhookDelivery {
+	deliveryCopy := *d
+
+	deliveryCopy.Attempts = make([]*WebhookDeliveryAttempt, len(d.Attempts))
+	for i, attempt := range d.Attempts {
+		attemptCopy := *attempt
+		deliveryCopy.Attempts[i] = &attemptCopy
+	}
+
+	return &deliveryCopy
+}
+
+// webhookStatusError is returned when a webhook responds with a non 2xx
+// status code.
+type webhookStatusError struct {
+	StatusCode int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("Webhook responded with status %d", e.StatusCode)
+}
+
+// retryable returns whether the webhook may accept the delivery if we try
+// again. Other 4xx responses mean the webhook will never accept it.
+func (e *webhookStatusError) retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// WebhookNotifier delivers job state changes to the configured webhooks. We
+// deliver in the background, so slow or broken webhooks never hold up
+// downloads.
+type WebhookNotifier struct {
+	conf   webhooksConfig
+	client *http.Client
+
+	// deliveries is our delivery log, oldest first.
+	deliveries   []*WebhookDelivery
+	deliveriesMu sync.Mutex
+
+	logger logr.Logger
+
+	// sleep exists so tests can skip waiting between retries.
+	sleep func(time.Duration)
+}
+
+var _ JobNotifier = (*WebhookNotifier)(nil)
+
+func NewWebhookNotifier(conf webhooksConfig, logger logr.Logger) *WebhookNotifier {
+	return &WebhookNotifier{
+		conf:   conf,
+		client: &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second},
+		logger: logger,
+		sleep:  time.Sleep,
+	}
+}
+
+// Webhooks returns the webhooks notified of the user's jobs.
+func (n *WebhookNotifier) Webhooks(user string) []*WebhookConfig {
+	webhooks := append([]*WebhookConfig{}, n.conf.Global...)
+	if user != "" {
+		webhooks = append(webhooks, n.conf.PerUser[user]...)
+	}
+
+	return webhooks
+}
+
+// IsGlobal returns whether the webhook is notified of every user's jobs.
+func (n *WebhookNotifier) IsGlobal(webhook *WebhookConfig) bool {
+	for _, globalWebhook := range n.conf.Global {
+		if globalWebhook == webhook {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NotifyJobStateChanged sends the job to every interested webhook.
+func (n *WebhookNotifier) NotifyJobStateChanged(job *Job) {
+	event := webhookEventForJob(job)
+	if event == "" {
+		return
+	}
+
+	for _, webhook := range n.Webhooks(job.User) {
+		if webhook.wantsEvent(event) {
+			n.send(webhook, event, job.User, job)
+		}
+	}
+}
+
+// SendTest sends a test event to the user's webhook with the given name, so
+// they can check the webhook works.
+func (n *WebhookNotifier) SendTest(user string, name string) (*WebhookDelivery, error) {
+	for _, webhook := range n.Webhooks(user) {
+		if webhook.Name == name {
+			return n.send(webhook, webhookEventTest, user, nil), nil
+		}
+	}
+
+	return nil, newUserError("errors.unknown_webhook", name)
+}
+
+// Deliveries returns the user's most recent deliveries, newest first.
+func (n *WebhookNotifier) Deliveries(user string) []*WebhookDelivery {
+	n.deliveriesMu.Lock()
+	defer n.deliveriesMu.Unlock()
+
+	var deliveries []*WebhookDelivery
+	for i := len(n.deliveries) - 1; i >= 0; i-- {
+		if n.deliveries[i].User == user {
+			deliveries = append(deliveries, n.deliveries[i].copy())
+		}
+	}
+
+	return deliveries
+}
+
+// send records a new delivery, and then delivers it in the background. job
+// is nil for test events.
+func (n *WebhookNotifier) send(webhook *WebhookConfig, event string, user string, job *Job) *WebhookDelivery {
+	delivery := &WebhookDelivery{
+		ID:        generateRandomString(defaultRandomStringLength),
+		Webhook:   webhook.Name,
+		User:      user,
+		Event:     event,
+		State:     WebhookDeliveryStatePending,
+		CreatedAt: time.Now(),
+	}
+
+	payload := &webhookPayload{
+		ID:        delivery.ID,
+		Event:     event,
+		Timestamp: delivery.CreatedAt,
+	}
+	if job != nil {
+		delivery.JobID = job.ID
+		payload.Job = newWebhookJob(job)
+	}
+
+	n.deliveriesMu.Lock()
+	n.deliveries = append(n.deliveries, delivery)
+	if len(n.deliveries) > n.conf.DeliveryLogSize {
+		n.deliveries = n.deliveries[len(n.deliveries)-n.conf.DeliveryLogSize:]
+	}
+	n.deliveriesMu.Unlock()
+
+	go n.deliver(webhook, delivery, payload)
+
+	return delivery.copy()
+}
+
+// deliver posts the payload to the webhook, retrying transient failures
+// according to our retry policy.
+func (n *WebhookNotifier) deliver(webhook *WebhookConfig, delivery *WebhookDelivery, payload *webhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		// Only possible if we've broken our payload types.
+		n.logger.V(0).Info("Error encoding webhook payload", "webhook", webhook.Name, "error", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		statusCode, err := n.post(webhook, delivery, body)
+
+		n.deliveriesMu.Lock()
+		delivery.Attempts = append(delivery.Attempts, &WebhookDeliveryAttempt{
+			At:         time.Now(),
+			StatusCode: statusCode,
+			Err:        err,
+		})
+		if err == nil {
+			delivery.State = WebhookDeliveryStateSucceeded
+		} else if attempt >= n.conf.Retries.MaxAttempts || !isRetryableWebhookError(err) {
+			delivery.State = WebhookDeliveryStateFailed
+		}
+		state := delivery.State
+		n.deliveriesMu.Unlock()
+
+		if state != WebhookDeliveryStatePending {
+			n.logger.V(3).Info("Finished webhook delivery", "webhook", webhook.Name, "event", delivery.Event, "jobId", delivery.JobID, "state", state, "attempts", attempt, "error", err)
+			webhookDeliveriesTotal.WithLabelValues(metricsOutcome(err)).Inc()
+			return
+		}
+
+		backoff := n.conf.Retries.backoff(attempt)
+		n.logger.V(2).Info("Retrying webhook delivery after transient failure", "webhook", webhook.Name, "event", delivery.Event, "jobId", delivery.JobID, "attempt", attempt, "backoff", backoff, "error", err)
+		n.sleep(backoff)
+	}
+}
+
+// post makes a single request to the webhook, returning the response's status
+// code (if we received one).
+func (n *WebhookNotifier) post(webhook *WebhookConfig, delivery *WebhookDelivery, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vidzou-webhooks")
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookDeliveryHeader, delivery.ID)
+	req.Header.Set(webhookSignatureHeader, webhook.sign(body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Reading the body lets us reuse the connection, but we don't care
+	// what the webhook has to say beyond its status code.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, &webhookStatusError{StatusCode: resp.StatusCode}
+	}
+
+	return resp.StatusCode, nil
+}
+
+// isRetryableWebhookError returns whether the delivery may succeed if we try
+// again. We can't tell whether errors making the request are transient, so
+// we always retry them.
+func isRetryableWebhookError(err error) bool {
+	if statusErr, ok := err.(*webhookStatusError); ok {
+		return statusErr.retryable()
+	}
+
+	return true
+}
+
+// webhooksPage is everything the webhooks page shows.
+type webhooksPage struct {
+	Webhooks   []*WebhookConfig
+	Global     map[string]bool
+	Deliveries []*WebhookDelivery
+}
+
+// webhooksIndex lists the webhooks notified of the user's jobs, and our
+// recent attempts to deliver to them.
+func (s *Server) webhooksIndex(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(2).Info("Serving request", "endpoint", "GET#webhooks")
+
+	page := &webhooksPage{Global: make(map[string]bool)}
+	if s.Webhooks != nil {
+		user := s.quotaClientFromRequest(r).user
+		page.Webhooks = s.Webhooks.Webhooks(user)
+		page.Deliveries = s.Webhooks.Deliveries(user)
+
+		for _, webhook := range page.Webhooks {
+			page.Global[webhook.Name] = s.Webhooks.IsGlobal(webhook)
+		}
+	}
+
+	s.Assets.Render(w, r, http.StatusOK, "webhooks", page)
+}
+
+// webhooksTest sends a test event to one of the user's webhooks. The delivery
+// log on the webhooks page shows how it went.
+func (s *Server) webhooksTest(w http.ResponseWriter, r *http.Request) {
+	s.logger.V(2).Info("Serving request", "endpoint", "POST#webhooks/:name/test")
+	name := mux.Vars(r)["name"]
+
+	if s.Webhooks == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if _, err := s.Webhooks.SendTest(s.quotaClientFromRequest(r).user, name); err != nil {
+		http.Error(w, localizerFromRequest(messages, r).Error(err), http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/webhooks", http.StatusSeeOther)
+}
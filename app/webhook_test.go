@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "shh"
+
+// webhookReceiver is a webhook which records every request it receives, and
+// responds with each of `statusCodes` in turn (and then 200).
+type webhookReceiver struct {
+	*httptest.Server
+
+	statusCodes []int
+	requests    []*webhookRequest
+	mu          sync.Mutex
+}
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(statusCodes ...int) *webhookReceiver {
+	receiver := &webhookReceiver{statusCodes: statusCodes}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+
+		receiver.requests = append(receiver.requests, &webhookRequest{header: r.Header, body: body})
+
+		statusCode := http.StatusOK
+		if len(receiver.statusCodes) > 0 {
+			statusCode, receiver.statusCodes = receiver.statusCodes[0], receiver.statusCodes[1:]
+		}
+		w.WriteHeader(statusCode)
+	}))
+
+	return receiver
+}
+
+func (r *webhookReceiver) receivedRequests() []*webhookRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*webhookRequest{}, r.requests...)
+}
+
+func newTestWebhook(name string, url string, events ...string) *WebhookConfig {
+	return &WebhookConfig{Name: name, URL: url, SecretFile: "/dev/null", Events: events, secret: testWebhookSecret}
+}
+
+func newTestWebhookNotifier(global []*WebhookConfig, perUser map[string][]*WebhookConfig) *WebhookNotifier {
+	conf := defaultWebhooksConfig()
+	conf.Global = global
+	conf.PerUser = perUser
+
+	notifier := NewWebhookNotifier(conf, testLogger)
+	notifier.sleep = func(time.Duration) {}
+	return notifier
+}
+
+// waitForDeliveries waits until we've finished delivering all of the user's
+// deliveries, returning them.
+func waitForDeliveries(t *testing.T, notifier *WebhookNotifier, user string, expected int) []*WebhookDelivery {
+	t.Helper()
+
+	var deliveries []*WebhookDelivery
+	err := retryWithTimeout(50, 10*time.Millisecond, func() error {
+		deliveries = notifier.Deliveries(user)
+		if len(deliveries) != expected {
+			return fmt.Errorf("Expected %d deliveries, but found %d", expected, len(deliveries))
+		}
+
+		for _, delivery := range deliveries {
+			if delivery.State == WebhookDeliveryStatePending {
+				return fmt.Errorf("Delivery %s is still pending", delivery.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Deliveries did not finish: %s", err)
+	}
+
+	return deliveries
+}
+
+func newTestFinishedJob(user string) *Job {
+	job := NewJob([]string{youtubeURL}, &DownloadOptions{})
+	job.User = user
+	job.State = JobStateSucceeded
+	job.PublicDownloadURL = "https://example.com/video.mp4"
+	job.Items[0].State = JobStateSucceeded
+	job.Items[0].Files = []*JobFile{{Name: "video.mp4", PublicDownloadURL: job.PublicDownloadURL}}
+	return job
+}
+
+func TestWebhookNotifierSendsSignedPayload(t *testing.T) {
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	notifier := newTestWebhookNotifier([]*WebhookConfig{newTestWebhook("home", receiver.URL)}, nil)
+	job := newTestFinishedJob("alice")
+	notifier.NotifyJobStateChanged(job)
+
+	deliveries := waitForDeliveries(t, notifier, "alice", 1)
+	if deliveries[0].State != WebhookDeliveryStateSucceeded || deliveries[0].JobID != job.ID {
+		t.Fatalf("Expected successful delivery for job %s, but got %+v", job.ID, deliveries[0])
+	}
+
+	requests := receiver.receivedRequests()
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, but got %d", len(requests))
+	}
+	request := requests[0]
+
+	// Receivers verify the payload is from us by signing it themselves.
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write(request.body)
+	expectedSignature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if signature := request.header.Get(webhookSignatureHeader); !hmac.Equal([]byte(signature), []byte(expectedSignature)) {
+		t.Fatalf("Expected signature %s, but got %s", expectedSignature, signature)
+	}
+
+	if request.header.Get(webhookEventHeader) != webhookEventJobSucceeded || request.header.Get(webhookDeliveryHeader) != deliveries[0].ID {
+		t.Fatalf("Expected event and delivery headers, but got %v", request.header)
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(request.body, &payload); err != nil {
+		t.Fatalf("Should not have error parsing payload: %s", err)
+	}
+
+	if payload.Event != webhookEventJobSucceeded || payload.Job == nil || payload.Job.ID != job.ID || payload.Job.User != "alice" {
+		t.Fatalf("Expected payload describing the job, but got %s", request.body)
+	}
+
+	if payload.Job.PublicDownloadURL != job.PublicDownloadURL || len(payload.Job.Files) != 1 || payload.Job.URLs[0] != youtubeURL {
+		t.Fatalf("Expected payload to include the job's urls and files, but got %s", request.body)
+	}
+}
+
+func TestWebhookNotifierRetriesTransientFailures(t *testing.T) {
+	receiver := newWebhookReceiver(http.StatusInternalServerError, http.StatusTooManyRequests)
+	defer receiver.Close()
+
+	notifier := newTestWebhookNotifier([]*WebhookConfig{newTestWebhook("home", receiver.URL)}, nil)
+
+	var backoffs []time.Duration
+	notifier.sleep = func(backoff time.Duration) {
+		backoffs = append(backoffs, backoff)
+	}
+
+	notifier.NotifyJobStateChanged(newTestFinishedJob(""))
+
+	delivery := waitForDeliveries(t, notifier, "", 1)[0]
+	if delivery.State != WebhookDeliveryStateSucceeded || len(delivery.Attempts) != 3 {
+		t.Fatalf("Expected delivery to succeed on the third attempt, but got %s after %d", delivery.State, len(delivery.Attempts))
+	}
+
+	if delivery.Attempts[0].StatusCode != http.StatusInternalServerError || delivery.Attempts[0].Err == nil {
+		t.Fatalf("Expected the delivery log to record the failed attempt, but got %+v", delivery.Attempts[0])
+	}
+
+	if len(backoffs) != 2 || backoffs[1] <= backoffs[0] {
+		t.Fatalf("Expected increasing backoff between attempts, but got %v", backoffs)
+	}
+
+	// Every attempt is the same delivery, so receivers can ignore
+	// duplicates.
+	requests := receiver.receivedRequests()
+	if string(requests[0].body) != string(requests[2].body) {
+		t.Fatal("Expected every attempt to send the same payload")
+	}
+}
+
+func TestWebhookNotifierGivesUpOnPermanentFailures(t *testing.T) {
+	receiver := newWebhookReceiver(http.StatusNotFound)
+	defer receiver.Close()
+
+	notifier := newTestWebhookNotifier([]*WebhookConfig{newTestWebhook("home", receiver.URL)}, nil)
+	notifier.NotifyJobStateChanged(newTestFinishedJob(""))
+
+	delivery := waitForDeliveries(t, notifier, "", 1)[0]
+	if delivery.State != WebhookDeliveryStateFailed || len(delivery.Attempts) != 1 {
+		t.Fatalf("Expected delivery to fail without retrying, but got %s after %d attempts", delivery.State, len(delivery.Attempts))
+	}
+
+	// Unreachable webhooks may come back, so we retry until we run out of
+	// attempts.
+	notifier = newTestWebhookNotifier([]*WebhookConfig{newTestWebhook("home", "http://127.0.0.1:1")}, nil)
+	notifier.NotifyJobStateChanged(newTestFinishedJob(""))
+
+	delivery = waitForDeliveries(t, notifier, "", 1)[0]
+	if delivery.State != WebhookDeliveryStateFailed || len(delivery.Attempts) != defaultWebhooksConfig().Retries.MaxAttempts {
+		t.Fatalf("Expected delivery to fail after every attempt, but got %s after %d attempts", delivery.State, len(delivery.Attempts))
+	}
+}
+
+func TestWebhookNotifierOnlyNotifiesInterestedWebhooks(t *testing.T) {
+	globalReceiver := newWebhookReceiver()
+	defer globalReceiver.Close()
+	aliceReceiver := newWebhookReceiver()
+	defer aliceReceiver.Close()
+
+	notifier := newTestWebhookNotifier(
+		[]*WebhookConfig{newTestWebhook("finished", globalReceiver.URL, webhookEventJobSucceeded, webhookEventJobFailed)},
+		map[string][]*WebhookConfig{"alice": {newTestWebhook("alice", aliceReceiver.URL)}},
+	)
+
+	runningJob := newTestFinishedJob("alice")
+	runningJob.State = JobStateRunning
+	notifier.NotifyJobStateChanged(runningJob)
+	notifier.NotifyJobStateChanged(newTestFinishedJob("alice"))
+	notifier.NotifyJobStateChanged(newTestFinishedJob("bob"))
+
+	// Pending jobs haven't changed state as far as webhooks are concerned.
+	pendingJob := newTestFinishedJob("alice")
+	pendingJob.State = JobStatePending
+	notifier.NotifyJobStateChanged(pendingJob)
+
+	waitForDeliveries(t, notifier, "alice", 3)
+	waitForDeliveries(t, notifier, "bob", 1)
+
+	if requests := globalReceiver.receivedRequests(); len(requests) != 2 {
+		t.Fatalf("Expected global webhook to receive both users' finished jobs, but got %d requests", len(requests))
+	}
+
+	// We deliver concurrently, so the requests may arrive in any order.
+	events := make(map[string]bool)
+	for _, request := range aliceReceiver.receivedRequests() {
+		events[request.header.Get(webhookEventHeader)] = true
+	}
+	if len(aliceReceiver.receivedRequests()) != 2 || !events[webhookEventJobRunning] || !events[webhookEventJobSucceeded] {
+		t.Fatalf("Expected alice's webhook to receive only her jobs, but got %v", events)
+	}
+
+	if webhooks := notifier.Webhooks("bob"); len(webhooks) != 1 || !notifier.IsGlobal(webhooks[0]) {
+		t.Fatalf("Expected bob to only have the global webhook, but got %v", webhooks)
+	}
+}
+
+func TestWebhookNotifierDeliveryLogSize(t *testing.T) {
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	notifier := newTestWebhookNotifier([]*WebhookConfig{newTestWebhook("home", receiver.URL)}, nil)
+	notifier.conf.DeliveryLogSize = 2
+
+	var jobs []*Job
+	for i := 0; i < 3; i++ {
+		jobs = append(jobs, newTestFinishedJob(""))
+		notifier.NotifyJobStateChanged(jobs[i])
+	}
+
+	deliveries := waitForDeliveries(t, notifier, "", 2)
+	if deliveries[0].JobID != jobs[2].ID || deliveries[1].JobID != jobs[1].ID {
+		t.Fatalf("Expected only the newest deliveries, newest first, but got %s and %s", deliveries[0].JobID, deliveries[1].JobID)
+	}
+}
+
+func TestWebhookNotifierSendTest(t *testing.T) {
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	notifier := newTestWebhookNotifier(nil, map[string][]*WebhookConfig{"alice": {newTestWebhook("alice", receiver.URL)}})
+
+	if _, err := notifier.SendTest("bob", "alice"); err == nil {
+		t.Fatal("Should not be able to test another user's webhook")
+	}
+
+	if _, err := notifier.SendTest("alice", "alice"); err != nil {
+		t.Fatalf("Should not have error sending test: %s", err)
+	}
+
+	delivery := waitForDeliveries(t, notifier, "alice", 1)[0]
+	if delivery.Event != webhookEventTest || delivery.State != WebhookDeliveryStateSucceeded {
+		t.Fatalf("Expected successful test delivery, but got %+v", delivery)
+	}
+}
+
+func TestJobProcessorNotifiesWebhooks(t *testing.T) {
+	tmpFsClient, err := NewTmpFsClient()
+	if err != nil {
+		t.Fatalf("Error creating TmpFsClient: %s", err)
+	}
+	defer tmpFsClient.CleanUp()
+
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	notifier := newTestWebhookNotifier([]*WebhookConfig{newTestWebhook("home", receiver.URL)}, nil)
+	jobProcessor, jobStore, _ := newTestJobProcessor(t, NewFakeContentDownloader(tmpFsClient))
+	jobProcessor.Notifiers = []JobNotifier{notifier}
+
+	job := processTestJob(t, jobProcessor, jobStore, NewJob([]string{youtubeURL}, &DownloadOptions{audioOnly: true}))
+
+	deliveries := waitForDeliveries(t, notifier, "", 2)
+	if deliveries[1].Event != webhookEventJobRunning || deliveries[0].Event != webhookEventJobSucceeded || deliveries[0].JobID != job.ID {
+		t.Fatalf("Expected running and succeeded events for job %s, but got %s and %s", job.ID, deliveries[1].Event, deliveries[0].Event)
+	}
+
+	for _, request := range receiver.receivedRequests() {
+		var payload webhookPayload
+		json.Unmarshal(request.body, &payload)
+
+		if payload.Event == webhookEventJobSucceeded && payload.Job.PublicDownloadURL != job.PublicDownloadURL {
+			t.Fatalf("Expected succeeded event to include download url %s, but got %s", job.PublicDownloadURL, payload.Job.PublicDownloadURL)
+		}
+	}
+}
+
+func TestServerWebhooks(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	server.UserHeader = "X-Forwarded-User"
+	server.Webhooks = newTestWebhookNotifier(
+		[]*WebhookConfig{newTestWebhook("everyone", receiver.URL)},
+		map[string][]*WebhookConfig{"alice": {newTestWebhook("alice-phone", receiver.URL)}},
+	)
+
+	req := withTestCSRFToken(httptest.NewRequest("POST", "/webhooks/alice-phone/test", nil))
+	req.Header.Set("X-Forwarded-User", "alice")
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/webhooks" {
+		t.Fatalf("Expected redirect to webhooks, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitForDeliveries(t, server.Webhooks, "alice", 1)
+
+	req = httptest.NewRequest("GET", "/webhooks", nil)
+	req.Header.Set("X-Forwarded-User", "alice")
+	rec = httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+
+	body := rec.Body.String()
+	for _, expected := range []string{"everyone", "alice-phone", `id="deliveries"`, "Delivered"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected webhooks page to contain %s, but got %s", expected, body)
+		}
+	}
+
+	// Webhook urls often contain secrets, so we never show them.
+	if strings.Contains(body, receiver.URL) {
+		t.Fatal("Should not show webhook urls")
+	}
+
+	// Other users can't see or test alice's webhooks.
+	req = withTestCSRFToken(httptest.NewRequest("POST", "/webhooks/alice-phone/test", nil))
+	req.Header.Set("X-Forwarded-User", "bob")
+	rec = httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), `"alice-phone"`) {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusNotFound, rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/webhooks", nil)
+	req.Header.Set("X-Forwarded-User", "bob")
+	rec = httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+
+	if strings.Contains(rec.Body.String(), "alice-phone") || !strings.Contains(rec.Body.String(), "deliveriesEmpty") {
+		t.Fatalf("Expected bob to see neither alice's webhook nor its deliveries, but got %s", rec.Body.String())
+	}
+}
+
+func TestServerWebhooksHidesErrorsContainingURLs(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	// Nothing is listening once we close the receiver.
+	receiver := newWebhookReceiver()
+	receiver.Close()
+	webhookURL := receiver.URL + "/hooks?token=s3cret"
+
+	server.UserHeader = "X-Forwarded-User"
+	server.Webhooks = newTestWebhookNotifier([]*WebhookConfig{newTestWebhook("everyone", webhookURL)}, nil)
+	server.Webhooks.conf.Retries.MaxAttempts = 1
+
+	server.Webhooks.NotifyJobStateChanged(newTestFinishedJob("alice"))
+	deliveries := waitForDeliveries(t, server.Webhooks, "alice", 1)
+	if err := deliveries[0].LastAttempt().Err; err == nil || !strings.Contains(err.Error(), "s3cret") {
+		t.Fatalf("Expected the delivery to fail with an error containing the url, but got %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/webhooks", nil)
+	req.Header.Set("X-Forwarded-User", "alice")
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, req)
+
+	body := rec.Body.String()
+	if strings.Contains(body, "s3cret") || !strings.Contains(body, "connect") {
+		t.Fatalf("Expected a generic explanation of the failed delivery, without the url, but got %s", body)
+	}
+}
+
+func TestServerNotifiesWebhooksOfJobsRefusedWhileDraining(t *testing.T) {
+	server, jobStore, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	notifier := newTestWebhookNotifier([]*WebhookConfig{newTestWebhook("home", receiver.URL)}, nil)
+	server.jobProcessor.Notifiers = []JobNotifier{notifier}
+
+	job := NewJob([]string{youtubeURL}, &DownloadOptions{})
+	if err := jobStore.Create(job); err != nil {
+		t.Fatalf("Error creating job: %s", err)
+	}
+
+	server.startDraining()
+	if server.enqueueJob(context.Background(), job.ID, 0, func(int64) {}) {
+		t.Fatal("Should not start jobs while draining")
+	}
+
+	deliveries := waitForDeliveries(t, notifier, "", 1)
+	if deliveries[0].Event != webhookEventJobFailed || deliveries[0].JobID != job.ID {
+		t.Fatalf("Expected a failed event for job %s, but got %s for %s", job.ID, deliveries[0].Event, deliveries[0].JobID)
+	}
+}
+
+func TestServerWebhooksWithoutWebhooks(t *testing.T) {
+	server, _, cleanUp := newTestServer(t)
+	defer cleanUp()
+
+	rec := httptest.NewRecorder()
+	server.router().ServeHTTP(rec, httptest.NewRequest("GET", "/webhooks", nil))
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "webhooksEmpty") {
+		t.Fatalf("Expected explanation there are no webhooks, but got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWebhooksConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		webhook *WebhookConfig
+	}{
+		{"no name", newTestWebhook("", "https://example.com")},
+		{"name with slash", newTestWebhook("a/b", "https://example.com")},
+		{"no url", newTestWebhook("home", "")},
+		{"ftp url", newTestWebhook("home", "ftp://example.com")},
+		{"no secret", &WebhookConfig{Name: "home", URL: "https://example.com"}},
+		{"unknown event", newTestWebhook("home", "https://example.com", "job.exploded")},
+		{"test event", newTestWebhook("home", "https://example.com", webhookEventTest)},
+	}
+
+	for _, testCase := range testCases {
+		conf := defaultWebhooksConfig()
+		conf.Global = []*WebhookConfig{testCase.webhook}
+
+		if err := conf.validate(); err == nil {
+			t.Errorf("Expected error validating webhook with %s", testCase.name)
+		}
+	}
+
+	conf := defaultWebhooksConfig()
+	conf.Global = []*WebhookConfig{newTestWebhook("home", "https://example.com")}
+	conf.PerUser = map[string][]*WebhookConfig{"alice": {newTestWebhook("home", "https://example.com")}}
+	if err := conf.validate(); err == nil {
+		t.Error("Expected error validating webhooks with duplicate names")
+	}
+}
+
+func TestParseConfigFileLoadsWebhookSecrets(t *testing.T) {
+	secretFile, err := ioutil.TempFile("", "webhook-secret")
+	if err != nil {
+		t.Fatalf("Error creating tmp file: %s", err)
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.WriteString(testWebhookSecret + "\n")
+	secretFile.Close()
+
+	configFile, err := ioutil.TempFile("", "config.*.yaml")
+	if err != nil {
+		t.Fatalf("Error creating tmp file: %s", err)
+	}
+	defer os.Remove(configFile.Name())
+	configFile.WriteString(fmt.Sprintf(`
+limits:
+  user_header: X-Forwarded-User
+webhooks:
+  per_user:
+    alice:
+      - name: home-assistant
+        url: http://homeassistant.local:8123/api/webhook/vidzou
+        secret_file: %s
+        events: [job.succeeded]
+`, secretFile.Name()))
+	configFile.Close()
+
+	conf, err := parseConfigFile(configFile.Name())
+	if err != nil {
+		t.Fatalf("Error parsing config file: %s", err)
+	}
+
+	webhooks := conf.Webhooks.PerUser["alice"]
+	if len(webhooks) != 1 || webhooks[0].secret != testWebhookSecret || webhooks[0].Events[0] != webhookEventJobSucceeded {
+		t.Fatalf("Expected alice's webhook with its secret, but got %+v", webhooks)
+	}
+
+	if conf.Webhooks.TimeoutSeconds != defaultWebhooksConfig().TimeoutSeconds {
+		t.Fatalf("Expected default timeout, but got %d", conf.Webhooks.TimeoutSeconds)
+	}
+}
+
+func TestConfigValidateRequiresUserHeaderForPerUserWebhooks(t *testing.T) {
+	conf := defaultConfig()
+	conf.Webhooks.PerUser = map[string][]*WebhookConfig{"alice": {newTestWebhook("home", "https://example.com")}}
+
+	if err := conf.validate(); err == nil {
+		t.Fatal("Per user webhooks should require the user header")
+	}
+
+	conf.Limits.UserHeader = "X-Forwarded-User"
+	if err := conf.validate(); err != nil {
+		t.Fatalf("Per user webhooks should be valid with the user header: %s", err)
+	}
+}
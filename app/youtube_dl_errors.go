@@ -0,0 +1,93 @@
+package main
+
+import (
+	"regexp"
+)
+
+// YoutubeDlErrorKind categorizes the reasons youtube-dl fails to download a
+// video, so we can tell users something more helpful than "exit code 1".
+type YoutubeDlErrorKind string
+
+const (
+	YoutubeDlErrorUnsupportedURL YoutubeDlErrorKind = "unsupported_url"
+	YoutubeDlErrorGeoBlocked     YoutubeDlErrorKind = "geo_blocked"
+	YoutubeDlErrorPrivate        YoutubeDlErrorKind = "private"
+	YoutubeDlErrorAgeRestricted  YoutubeDlErrorKind = "age_restricted"
+	YoutubeDlErrorCopyright      YoutubeDlErrorKind = "copyright"
+	YoutubeDlErrorThrottled      YoutubeDlErrorKind = "throttled"
+	YoutubeDlErrorNetwork        YoutubeDlErrorKind = "network"
+	YoutubeDlErrorUnknown        YoutubeDlErrorKind = "unknown"
+)
+
+// youtubeDlErrorPatterns match youtube-dl's (and the sites') error messages for
+// each kind of error. We check them in order, so more specific patterns must
+// come first.
+var youtubeDlErrorPatterns = []struct {
+	kind    YoutubeDlErrorKind
+	pattern *regexp.Regexp
+}{
+	{YoutubeDlErrorUnsupportedURL, regexp.MustCompile(`(?i)unsupported url`)},
+	{YoutubeDlErrorCopyright, regexp.MustCompile(`(?i)copyright`)},
+	{YoutubeDlErrorGeoBlocked, regexp.MustCompile(`(?i)(available in your (country|location)|geo[ -]?restrict)`)},
+	{YoutubeDlErrorPrivate, regexp.MustCompile(`(?i)(private video|video is private)`)},
+	{YoutubeDlErrorAgeRestricted, regexp.MustCompile(`(?i)(confirm your age|age[ -]restricted|inappropriate for some users)`)},
+	{YoutubeDlErrorThrottled, regexp.MustCompile(`(?i)(HTTP Error 429|too many requests)`)},
+	{YoutubeDlErrorNetwork, regexp.MustCompile(`(?i)(HTTP Error 5[0-9][0-9]|timed out|connection (reset|refused|aborted)|temporary failure in name resolution|network is unreachable|urlopen error)`)},
+}
+
+// YoutubeDlError is returned when youtube-dl fails to download a video.
+type YoutubeDlError struct {
+	Kind YoutubeDlErrorKind
+	// Detail is youtube-dl's own description of the error.
+	Detail string
+}
+
+func (y *YoutubeDlError) Error() string {
+	return y.userError().Error()
+}
+
+// userError is the message we show users for the kind of error. Each kind has
+// a message in our catalog.
+func (y *YoutubeDlError) userError() *UserError {
+	return newUserError("errors.youtube_dl." + string(y.Kind))
+}
+
+// retryable returns whether the error is likely to be transient.
+func (y *YoutubeDlError) retryable() bool {
+	return y.Kind == YoutubeDlErrorThrottled || y.Kind == YoutubeDlErrorNetwork
+}
+
+// classifyYoutubeDlError determines why youtube-dl failed from its stderr.
+func classifyYoutubeDlError(stderr string) *YoutubeDlError {
+	detail := lastYoutubeDlErrorLine(stderr)
+
+	for _, errorPattern := range youtubeDlErrorPatterns {
+		if errorPattern.pattern.MatchString(detail) {
+			return &YoutubeDlError{Kind: errorPattern.kind, Detail: detail}
+		}
+	}
+
+	return &YoutubeDlError{Kind: YoutubeDlErrorUnknown, Detail: detail}
+}
+
+var youtubeDlErrorLineRegexp = regexp.MustCompile(`(?m)^ERROR: (.*)$`)
+
+// lastYoutubeDlErrorLine returns youtube-dl's last reported error, falling
+// back to the last line of output if youtube-dl didn't report one.
+func lastYoutubeDlErrorLine(stderr string) string {
+	matches := youtubeDlErrorLineRegexp.FindAllStringSubmatch(stderr, -1)
+	if len(matches) == 0 {
+		return lastNonEmptyLine(stderr)
+	}
+
+	return matches[len(matches)-1][1]
+}
+
+var youtubeDlMatchFilterSkipRegexp = regexp.MustCompile(`(?m)^\[download\] .* does not pass filter .*, skipping`)
+
+// skippedByMatchFilter returns whether youtube-dl skipped a video for not
+// passing our `--match-filter`. youtube-dl doesn't consider that an error, so
+// it only mentions it on stdout.
+func skippedByMatchFilter(stdout string) bool {
+	return youtubeDlMatchFilterSkipRegexp.MatchString(stdout)
+}
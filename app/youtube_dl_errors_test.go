@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestClassifyYoutubeDlError(t *testing.T) {
+	stderrToKind := map[string]YoutubeDlErrorKind{
+		"ERROR: Unsupported URL: https://example.com/":                                                          YoutubeDlErrorUnsupportedURL,
+		"ERROR: The uploader has not made this video available in your country.":                                YoutubeDlErrorGeoBlocked,
+		"ERROR: This video is not available in your location due to geo restriction":                            YoutubeDlErrorGeoBlocked,
+		"WARNING: Unable to extract\nERROR: Private video\nSign in if you've been granted access to this video": YoutubeDlErrorPrivate,
+		"ERROR: Sign in to confirm your age\nThis video may be inappropriate for some users.":                   YoutubeDlErrorAgeRestricted,
+		"ERROR: This video contains content from SomeLabel, who has blocked it on copyright grounds.":           YoutubeDlErrorCopyright,
+		"ERROR: This video is no longer available due to a copyright claim by Somebody":                         YoutubeDlErrorCopyright,
+		"ERROR: Unable to download webpage: HTTP Error 500: Internal Server Error":                              YoutubeDlErrorNetwork,
+		"ERROR: Unable to download webpage: HTTP Error 429: Too Many Requests":                                  YoutubeDlErrorThrottled,
+		"ERROR: Unable to extract video data":                                                                   YoutubeDlErrorUnknown,
+		"":                                                                                                      YoutubeDlErrorUnknown,
+	}
+
+	for stderr, expectedKind := range stderrToKind {
+		if youtubeDlErr := classifyYoutubeDlError(stderr); youtubeDlErr.Kind != expectedKind {
+			t.Fatalf("Expected %q to be classified as %s, but got %s", stderr, expectedKind, youtubeDlErr.Kind)
+		}
+	}
+}
+
+func TestClassifyYoutubeDlErrorDetail(t *testing.T) {
+	youtubeDlErr := classifyYoutubeDlError("[youtube] abc: Downloading webpage\nERROR: Private video\n")
+	if youtubeDlErr.Detail != "Private video" {
+		t.Fatalf("Expected youtube-dl's error as the detail, but got %q", youtubeDlErr.Detail)
+	}
+
+	if youtubeDlErr.Error() != "This video is private." {
+		t.Fatalf("Expected a user friendly error message, but got %q", youtubeDlErr.Error())
+	}
+}
+
+func TestSkippedByMatchFilter(t *testing.T) {
+	stdoutToSkipped := map[string]bool{
+		"[youtube] abc: Downloading webpage\n[download] My Video does not pass filter duration <= 300, skipping ..\n": true,
+		"[youtube] abc: Downloading webpage\n[download] Destination: /downloads/abc-My Video.mp4\n":                   false,
+		"": false,
+	}
+
+	for stdout, expected := range stdoutToSkipped {
+		if skipped := skippedByMatchFilter(stdout); skipped != expected {
+			t.Fatalf("Expected skipped to be %t for %q, but got %t", expected, stdout, skipped)
+		}
+	}
+}